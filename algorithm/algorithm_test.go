@@ -1,12 +1,25 @@
 package algorithm
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"dt/models"
 	"dt/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"math"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Setup a mock dataset for testing
@@ -29,7 +42,7 @@ func TestBuildTree(t *testing.T) {
 	utils.OutputPtr = &tempFile // Assign a valid file path
 
 	// Run BuildTree
-	tree, err := BuildTree("Target")
+	tree, err := BuildTree(context.Background(), "Target")
 	if err != nil {
 		t.Fatalf("BuildTree returned an error: %v", err)
 	}
@@ -166,7 +179,10 @@ func TestPredict(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			models.Records = tt.records
-			result := Predict(tt.tree)
+			result, err := Predict(context.Background(), tt.tree)
+			if err != nil {
+				t.Fatalf("Predict returned an error: %v", err)
+			}
 			for i, prediction := range result {
 				if prediction != tt.expected[i] {
 					t.Errorf("expected %v, got %v", tt.expected[i], prediction)
@@ -223,11 +239,50 @@ func TestPredictRecord(t *testing.T) {
 			},
 			expected: "A",
 		},
+		{
+			name: "Subset split",
+			record: map[string]interface{}{
+				"feature1": "value3",
+			},
+			node: &models.TreeNode{
+				SplitType:       "subset",
+				Feature:         "feature1",
+				LeftCategories:  []string{"value1", "value2"},
+				RightCategories: []string{"value3"},
+				Left:            &models.TreeNode{IsLeaf: true, Prediction: "A"},
+				Right:           &models.TreeNode{IsLeaf: true, Prediction: "B"},
+			},
+			expected: "B",
+		},
+		{
+			name: "Missing value follows the recorded branch",
+			record: map[string]interface{}{
+				"feature1": nil,
+			},
+			node: &models.TreeNode{
+				SplitType:     "numerical",
+				Feature:       "feature1",
+				SplitValue:    10,
+				MissingBranch: "right",
+				Left: &models.TreeNode{
+					SplitType:  "numerical",
+					Feature:    "feature2",
+					SplitValue: 1,
+					Left:       &models.TreeNode{IsLeaf: true, Prediction: "A"},
+					Right:      &models.TreeNode{IsLeaf: true, Prediction: "A"},
+				},
+				Right: &models.TreeNode{IsLeaf: true, Prediction: "B"},
+			},
+			expected: "B",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := predictRecord(tt.record, tt.node)
+			result, err := predictRecord(tt.record, tt.node, nil)
+			if err != nil {
+				t.Fatalf("predictRecord returned an error: %v", err)
+			}
 			if result != tt.expected {
 				t.Errorf("expected %v, got %v", tt.expected, result)
 			}
@@ -471,7 +526,7 @@ func Test_findNumericalSplit(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := findNumericalSplit(tt.args.indices, tt.args.feature, tt.args.targetCol, tt.args.baseEntropy)
+			got := findNumericalSplit(context.Background(), tt.args.indices, tt.args.feature, tt.args.targetCol, tt.args.baseEntropy)
 
 			// Check basic fields
 			if got.Feature != tt.want.Feature ||
@@ -569,3 +624,1579 @@ func Test_findCategoricalSplit(t *testing.T) {
 		})
 	}
 }
+
+// Imbalanced mock dataset: 6 "No" rows and 2 "Yes" rows
+func setupImbalancedData() {
+	models.Columns = []string{"income", "area", "target"}
+	models.FeatureTypes = map[string]string{
+		"income": "numeric",
+		"area":   "categorical",
+		"target": "categorical",
+	}
+	models.Records = []map[string]interface{}{
+		{"income": 100, "area": "Urban", "target": "No"},
+		{"income": 120, "area": "Rural", "target": "No"},
+		{"income": 140, "area": "Urban", "target": "No"},
+		{"income": 160, "area": "Rural", "target": "No"},
+		{"income": 180, "area": "Urban", "target": "No"},
+		{"income": 200, "area": "Rural", "target": "No"},
+		{"income": 900, "area": "Urban", "target": "Yes"},
+		{"income": 1000, "area": "Urban", "target": "Yes"},
+	}
+}
+
+func TestResample(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		wantRows int
+		wantYes  int
+		wantErr  bool
+	}{
+		{name: "None", method: "none", wantRows: 8, wantYes: 2},
+		{name: "Undersampling", method: "under", wantRows: 4, wantYes: 2},
+		{name: "Oversampling", method: "over", wantRows: 12, wantYes: 6},
+		{name: "SMOTE", method: "smote", wantRows: 12, wantYes: 6},
+		{name: "Unknown method", method: "bogus", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupImbalancedData()
+			indices := []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+			got, synthetic, err := Resample(indices, "target", tt.method, 42, 5)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resample() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(models.Records) != 8 {
+				t.Fatalf("Resample() changed models.Records to %d rows", len(models.Records))
+			}
+			models.Records = append(models.Records, synthetic...)
+
+			yes := 0
+			for _, idx := range got {
+				if models.Records[idx]["target"] == "Yes" {
+					yes++
+				}
+			}
+			if len(got) != tt.wantRows || yes != tt.wantYes {
+				t.Errorf("got %d rows with %d Yes, want %d rows with %d Yes", len(got), yes, tt.wantRows, tt.wantYes)
+			}
+		})
+	}
+}
+
+func TestResampleSMOTEIsReproducible(t *testing.T) {
+	run := func() []map[string]interface{} {
+		setupImbalancedData()
+		indices, synthetic, err := Resample([]int{0, 1, 2, 3, 4, 5, 6, 7}, "target", "smote", 7, 3)
+		if err != nil {
+			t.Fatalf("Resample() error = %v", err)
+		}
+		models.Records = append(models.Records, synthetic...)
+		rows := make([]map[string]interface{}, 0)
+		for _, idx := range indices {
+			rows = append(rows, models.Records[idx])
+		}
+		return rows
+	}
+
+	first, second := run(), run()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("same seed produced different samples:\n%v\n%v", first, second)
+	}
+
+	// Synthetic rows must stay between the two "Yes" samples
+	for _, row := range first[8:] {
+		income := row["income"].(int)
+		if income < 900 || income > 1000 {
+			t.Errorf("synthetic income %d outside [900, 1000]", income)
+		}
+	}
+}
+
+func Test_findSubsetSplit(t *testing.T) {
+	tests := []struct {
+		name      string
+		records   []map[string]interface{}
+		wantLeft  []string
+		wantRight []string
+	}{
+		{
+			name: "Binary target groups categories by class",
+			records: []map[string]interface{}{
+				{"area": "A", "target": "yes"},
+				{"area": "B", "target": "yes"},
+				{"area": "C", "target": "no"},
+				{"area": "D", "target": "no"},
+				{"area": "A", "target": "yes"},
+				{"area": "C", "target": "no"},
+			},
+			wantLeft:  []string{"A", "B"},
+			wantRight: []string{"C", "D"},
+		},
+		{
+			name: "Multiclass target separates one class",
+			records: []map[string]interface{}{
+				{"area": "A", "target": "x"},
+				{"area": "A", "target": "x"},
+				{"area": "B", "target": "y"},
+				{"area": "C", "target": "y"},
+				{"area": "D", "target": "z"},
+				{"area": "D", "target": "z"},
+			},
+			wantLeft:  []string{"B", "C"},
+			wantRight: []string{"A", "D"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			models.Records = tt.records
+			indices := make([]int, len(tt.records))
+			for i := range indices {
+				indices[i] = i
+			}
+
+			got := findSubsetSplit(indices, "area", "target", CalculateEntropy(indices, "target"))
+			if got.SplitType != "subset" || got.GainRatio <= 0 {
+				t.Fatalf("findSubsetSplit() = %v, want a positive subset split", got)
+			}
+			if !reflect.DeepEqual(got.LeftCategories, tt.wantLeft) ||
+				!reflect.DeepEqual(got.RightCategories, tt.wantRight) {
+				t.Errorf("categories = %v | %v, want %v | %v",
+					got.LeftCategories, got.RightCategories, tt.wantLeft, tt.wantRight)
+			}
+			if len(got.LeftIndices)+len(got.RightIndices) != len(indices) {
+				t.Errorf("indices not fully assigned: L=%v R=%v", got.LeftIndices, got.RightIndices)
+			}
+		})
+	}
+}
+
+func TestPredictUnseenPolicy(t *testing.T) {
+	// "Rural" goes to a large "No" branch, "Urban" to a small "Yes" branch,
+	// while the parent node itself is mostly "Yes"
+	tree := &models.TreeNode{
+		SplitType:   "categorical",
+		Feature:     "area",
+		Prediction:  "Yes",
+		Samples:     10,
+		ClassCounts: map[string]int{"Yes": 6, "No": 4},
+		OtherBranch: "Rural",
+		Children: map[string]*models.TreeNode{
+			"Rural": {IsLeaf: true, Prediction: "No", Samples: 6, ClassCounts: map[string]int{"Yes": 2, "No": 4}},
+			"Urban": {IsLeaf: true, Prediction: "Yes", Samples: 4, ClassCounts: map[string]int{"Yes": 4}},
+		},
+	}
+	record := map[string]interface{}{"area": "Semiurban"}
+
+	tests := []struct {
+		policy   string
+		expected interface{}
+		wantErr  error
+	}{
+		{policy: UnseenMissing, expected: "No"}, // Both branches hold one leaf, the first key wins
+		{policy: UnseenParent, expected: "Yes"},
+		{policy: UnseenOther, expected: "No"},
+		{policy: UnseenBlend, expected: "Yes"}, // 0.6*2/6 + 0.4*1 = 0.6 Yes
+		{policy: UnseenFail, wantErr: ErrUnseenCategory},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			policy := tt.policy
+			utils.UnseenPtr = &policy
+
+			unseen := make(map[string]int)
+			result, err := predictRecord(record, tree, unseen)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("predictRecord() error = %v, want %v", err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+			if unseen["area"] != 1 {
+				t.Errorf("expected 1 unseen value for area, got %d", unseen["area"])
+			}
+		})
+	}
+
+	defaultPolicy := UnseenMissing
+	utils.UnseenPtr = &defaultPolicy
+}
+
+func TestExplain(t *testing.T) {
+	// Income splits first, then area for the higher incomes
+	tree := &models.TreeNode{
+		SplitType:   "numerical",
+		Feature:     "income",
+		SplitValue:  5000.0,
+		Prediction:  "No",
+		Samples:     20,
+		ClassCounts: map[string]int{"Yes": 8, "No": 12},
+		Left:        &models.TreeNode{IsLeaf: true, Prediction: "No", Samples: 8, ClassCounts: map[string]int{"No": 8}},
+		Right: &models.TreeNode{
+			SplitType:   "categorical",
+			Feature:     "area",
+			Prediction:  "Yes",
+			Samples:     12,
+			ClassCounts: map[string]int{"Yes": 8, "No": 4},
+			OtherBranch: "Urban",
+			Children: map[string]*models.TreeNode{
+				"Rural": {IsLeaf: true, Prediction: "No", Samples: 4, ClassCounts: map[string]int{"Yes": 1, "No": 3}},
+				"Urban": {IsLeaf: true, Prediction: "Yes", Samples: 8, ClassCounts: map[string]int{"Yes": 7, "No": 1}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		policy string
+		record map[string]interface{}
+		path   []string
+		probs  map[string]float64
+	}{
+		{
+			name:   "low income",
+			record: map[string]interface{}{"income": 1000, "area": "Rural"},
+			path:   []string{"income < 5000"},
+			probs:  map[string]float64{"No": 1},
+		},
+		{
+			name:   "rural",
+			record: map[string]interface{}{"income": 9000, "area": "Rural"},
+			path:   []string{"income >= 5000", "area = Rural"},
+			probs:  map[string]float64{"Yes": 0.25, "No": 0.75},
+		},
+		{
+			name:   "missing income",
+			record: map[string]interface{}{"income": nil, "area": "Urban"},
+			path:   []string{"income >= 5000 (missing)", "area = Urban"},
+			probs:  map[string]float64{"Yes": 0.875, "No": 0.125},
+		},
+		{
+			name:   "unseen missing",
+			policy: UnseenMissing,
+			record: map[string]interface{}{"income": 9000, "area": "Village"},
+			path:   []string{"income >= 5000", "area = Rural (unseen)"},
+			probs:  map[string]float64{"Yes": 0.25, "No": 0.75},
+		},
+		{
+			name:   "unseen parent",
+			policy: UnseenParent,
+			record: map[string]interface{}{"income": 9000, "area": "Village"},
+			path:   []string{"income >= 5000", "area no branch, node prediction (unseen)"},
+			probs:  map[string]float64{"Yes": 8.0 / 12, "No": 4.0 / 12},
+		},
+		{
+			name:   "unseen other",
+			policy: UnseenOther,
+			record: map[string]interface{}{"income": 9000, "area": "Village"},
+			path:   []string{"income >= 5000", "area = Urban (unseen)"},
+			probs:  map[string]float64{"Yes": 0.875, "No": 0.125},
+		},
+		{
+			name:   "unseen blend",
+			policy: UnseenBlend,
+			record: map[string]interface{}{"income": 9000, "area": "Village"},
+			path:   []string{"income >= 5000", "area blend of all branches (unseen)"},
+			probs:  map[string]float64{"Yes": 8.0 / 12, "No": 4.0 / 12},
+		},
+	}
+	defaultPolicy := UnseenMissing
+	defer func() { utils.UnseenPtr = &defaultPolicy }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := cmp.Or(tt.policy, UnseenParent)
+			utils.UnseenPtr = &policy
+
+			explanation, err := Explain(tt.record, tree)
+			if err != nil {
+				t.Fatalf("Explain() error = %v", err)
+			}
+			want, _ := predictRecord(tt.record, tree, nil)
+			if explanation.Prediction != want {
+				t.Errorf("Explain() predicts %v, predictRecord() %v", explanation.Prediction, want)
+			}
+
+			path := make([]string, len(explanation.Path))
+			for i, step := range explanation.Path {
+				path[i] = step.String()
+			}
+			if !reflect.DeepEqual(path, tt.path) {
+				t.Errorf("path = %q, want %q", path, tt.path)
+			}
+			for class, prob := range tt.probs {
+				if math.Abs(explanation.Probabilities[class]-prob) > 1e-9 {
+					t.Errorf("probability of %s = %v, want %v", class, explanation.Probabilities[class], prob)
+				}
+			}
+		})
+	}
+
+	policy := UnseenFail
+	utils.UnseenPtr = &policy
+	if _, err := Explain(map[string]interface{}{"income": 9000, "area": "Village"}, tree); !errors.Is(err, ErrUnseenCategory) {
+		t.Errorf("Explain() error = %v, want %v", err, ErrUnseenCategory)
+	}
+
+	utils.UnseenPtr = &defaultPolicy
+	explanation, err := Explain(map[string]interface{}{"income": nil, "area": "Rural"}, tree)
+	if err != nil {
+		t.Fatalf("Explain() error = %v", err)
+	}
+	if got, want := explanation.String(), "income >= 5000 (missing) -> area = Rural -> leaf(No, 75%)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestPredictWithSummary(t *testing.T) {
+	tree := &models.TreeNode{
+		SplitType:  "categorical",
+		Feature:    "area",
+		Prediction: "Yes",
+		Children: map[string]*models.TreeNode{
+			"Rural": {IsLeaf: true, Prediction: "No"},
+		},
+	}
+	models.Records = []map[string]interface{}{
+		{"area": "Rural"},
+		{"area": "Urban"},
+		{"area": "Urban"},
+	}
+
+	predictions, summary, err := PredictWithSummary(context.Background(), tree)
+	if err != nil {
+		t.Fatalf("PredictWithSummary returned an error: %v", err)
+	}
+	// Unseen values follow the only branch
+	if !reflect.DeepEqual(predictions, []interface{}{"No", "No", "No"}) {
+		t.Errorf("unexpected predictions %v", predictions)
+	}
+	if summary.Records != 3 || summary.Unseen["area"] != 2 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func TestPredictStream(t *testing.T) {
+	tree := setupSyntheticData(1000, "multiway")
+	records := models.Records
+	want, _, err := PredictWithSummary(context.Background(), tree)
+	if err != nil {
+		t.Fatalf("PredictWithSummary returned an error: %v", err)
+	}
+
+	// chunks serves copies of the records in chunks of size
+	chunks := func(size int) func() ([]map[string]interface{}, error) {
+		next := 0
+		return func() ([]map[string]interface{}, error) {
+			if next >= len(records) {
+				return nil, io.EOF
+			}
+			end := min(next+size, len(records))
+			chunk := make([]map[string]interface{}, 0, end-next)
+			for _, record := range records[next:end] {
+				chunk = append(chunk, maps.Clone(record))
+			}
+			next = end
+			return chunk, nil
+		}
+	}
+
+	tests := []struct {
+		name    string
+		size    int
+		workers int
+	}{
+		{"one worker", 7, 1},
+		{"many workers", 7, 8},
+		{"single chunk", 5000, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []interface{}
+			progress := 0
+			summary, err := PredictStream(context.Background(), tree, Stream{
+				Read:     chunks(tt.size),
+				Write:    func(predictions []interface{}) error { got = append(got, predictions...); return nil },
+				Progress: func(records int) { progress = records },
+				Workers:  tt.workers,
+			})
+			if err != nil {
+				t.Fatalf("PredictStream returned an error: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("predictions are not in input order or differ from PredictWithSummary")
+			}
+			if summary.Records != len(records) || progress != len(records) {
+				t.Errorf("summary reports %d records and progress %d, want %d", summary.Records, progress, len(records))
+			}
+		})
+	}
+
+	t.Run("explanations", func(t *testing.T) {
+		var got []interface{}
+		var details []Details
+		_, err := PredictStream(context.Background(), tree, Stream{
+			Read: chunks(7),
+			WriteDetails: func(predictions []interface{}, chunk []Details) error {
+				got = append(got, predictions...)
+				details = append(details, chunk...)
+				return nil
+			},
+			Explain: true,
+			Workers: 4,
+		})
+		if err != nil {
+			t.Fatalf("PredictStream returned an error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) || len(details) != len(want) {
+			t.Fatalf("got %d predictions and %d details, want %d", len(got), len(details), len(want))
+		}
+		for i, detail := range details {
+			if detail.Explanation.Prediction != want[i] || detail.SHAP != nil {
+				t.Errorf("details %d = %+v, want an explanation predicting %v", i+1, detail, want[i])
+			}
+		}
+	})
+
+	t.Run("earliest error", func(t *testing.T) {
+		defer func() { *utils.UnseenPtr = UnseenMissing }()
+		*utils.UnseenPtr = UnseenFail
+		records[20]["area"] = "Mars"
+		records[900]["area"] = "Mars"
+		defer func() { records[20]["area"], records[900]["area"] = "Urban", "Urban" }()
+
+		byArea := &models.TreeNode{SplitType: "categorical", Feature: "area", Children: map[string]*models.TreeNode{}}
+		for _, area := range []string{"Urban", "Rural", "Semiurban", "Suburb", "Village"} {
+			byArea.Children[area] = &models.TreeNode{IsLeaf: true, Prediction: area}
+		}
+
+		written := 0
+		_, err := PredictStream(context.Background(), byArea, Stream{
+			Read:    chunks(10),
+			Write:   func(predictions []interface{}) error { written += len(predictions); return nil },
+			Workers: 4,
+		})
+		if !errors.Is(err, ErrUnseenCategory) || !strings.HasPrefix(err.Error(), "record 21:") {
+			t.Errorf("PredictStream() error = %v, want the unseen category of record 21", err)
+		}
+		if written != 20 {
+			t.Errorf("wrote %d predictions before the failing chunk, want 20", written)
+		}
+	})
+
+	t.Run("read and write errors", func(t *testing.T) {
+		failure := errors.New("disk full")
+		_, err := PredictStream(context.Background(), tree, Stream{
+			Read:  chunks(10),
+			Write: func([]interface{}) error { return failure },
+		})
+		if !errors.Is(err, failure) {
+			t.Errorf("PredictStream() error = %v, want the write error", err)
+		}
+
+		_, err = PredictStream(context.Background(), tree, Stream{
+			Read:  func() ([]map[string]interface{}, error) { return nil, failure },
+			Write: func([]interface{}) error { return nil },
+		})
+		if !errors.Is(err, failure) {
+			t.Errorf("PredictStream() error = %v, want the read error", err)
+		}
+	})
+
+	t.Run("reader done on return", func(t *testing.T) {
+		// Both workers hold a chunk and the reader waits in its fourth read
+		// when the prediction is canceled. The caller closes the input once
+		// PredictStream returns, so that read must be over by then.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		next := chunks(10)
+		reads, waiting := 0, make(chan struct{})
+		var reading atomic.Bool
+		_, err := PredictStream(ctx, tree, Stream{
+			Read: func() ([]map[string]interface{}, error) {
+				if reads++; reads <= 3 {
+					return next()
+				}
+				reading.Store(true)
+				defer reading.Store(false)
+				close(waiting)
+				time.Sleep(50 * time.Millisecond)
+				return nil, io.EOF
+			},
+			Write: func([]interface{}) error {
+				if ctx.Err() == nil {
+					<-waiting
+					cancel()
+					time.Sleep(10 * time.Millisecond) // Workers give up their chunks
+				}
+				return nil
+			},
+			Workers: 2,
+		})
+		if !errors.As(err, new(*utils.CanceledError)) {
+			t.Errorf("PredictStream() error = %v, want a cancellation", err)
+		}
+		if reading.Load() {
+			t.Error("PredictStream() returned while a read was running")
+		}
+	})
+}
+
+func TestGroupRareCategories(t *testing.T) {
+	models.Columns = []string{"area", "income", "target"}
+	models.FeatureTypes = map[string]string{
+		"area":   "categorical",
+		"income": "numeric",
+		"target": "categorical",
+	}
+	models.Records = []map[string]interface{}{
+		{"area": "Urban", "income": 1, "target": "Yes"},
+		{"area": "Urban", "income": 2, "target": "No"},
+		{"area": "Urban", "income": 3, "target": "Yes"},
+		{"area": "Rural", "income": 4, "target": "No"},
+		{"area": "Rural", "income": 5, "target": "No"},
+		{"area": "Semiurban", "income": 6, "target": "Yes"},
+		{"area": nil, "income": 7, "target": "Yes"},
+	}
+	indices := []int{0, 1, 2, 3, 4, 5, 6}
+
+	groups := GroupRareCategories(indices, "target", 2, 0)
+	want := map[string][]string{"area": {"Rural", "Urban"}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Fatalf("GroupRareCategories() = %v, want %v", groups, want)
+	}
+	if models.Records[5]["area"] != OtherCategory {
+		t.Errorf("rare category not grouped, got %v", models.Records[5]["area"])
+	}
+	if models.Records[6]["area"] != nil {
+		t.Errorf("missing value should stay missing, got %v", models.Records[6]["area"])
+	}
+
+	// Prediction applies the saved mapping, so unseen values share the bucket
+	records := []map[string]interface{}{
+		{"area": "Urban"},
+		{"area": "Semiurban"},
+		{"area": "Downtown"},
+	}
+	ApplyCategoryGroups(records, groups)
+	for i, expected := range []string{"Urban", OtherCategory, OtherCategory} {
+		if records[i]["area"] != expected {
+			t.Errorf("record %d: expected %v, got %v", i, expected, records[i]["area"])
+		}
+	}
+
+	if groups := GroupRareCategories(indices, "target", 0, 0); groups != nil {
+		t.Errorf("expected no grouping when thresholds are disabled, got %v", groups)
+	}
+}
+
+// buildTreeNode builds a tree on the calling goroutine, without the
+// resampling and rare category grouping of BuildTree
+func buildTreeNode(indices []int, features []string, targetCol string, depth int) *models.TreeNode {
+	g := newGrower(context.Background(), indices, features, targetCol)
+	g.pending[0].depth = depth
+	g.grow(nil, nil, 0)
+	return g.root
+}
+
+// setupSyntheticData fills the dataset with n random loan records whose label
+// depends on income, area and grade, and trains a tree on them
+func setupSyntheticData(n int, catSplit string) *models.TreeNode {
+	indices, features := generateSyntheticData(n)
+	previous := *utils.CatSplitPtr
+	*utils.CatSplitPtr = catSplit
+	defer func() { *utils.CatSplitPtr = previous }()
+	return buildTreeNode(indices, features, "label", 0)
+}
+
+// generateSyntheticData fills the dataset with n random loan records and
+// returns their indices and the feature columns
+func generateSyntheticData(n int) ([]int, []string) {
+	rng := rand.New(rand.NewPCG(42, 0))
+	areas := []string{"Urban", "Rural", "Semiurban", "Suburb", "Village"}
+
+	models.Columns = []string{"income", "age", "area", "grade", "label"}
+	models.FeatureTypes = map[string]string{
+		"income": "numeric", "age": "numeric", "area": "categorical", "grade": "categorical", "label": "categorical",
+	}
+	models.Records = make([]map[string]interface{}, n)
+	indices := make([]int, n)
+	for i := range models.Records {
+		income := float64(rng.IntN(400)) * 25
+		area := areas[rng.IntN(len(areas))]
+		grade := fmt.Sprintf("G%d", rng.IntN(12))
+		label := "No"
+		if (income > 4000 && area != "Village") || grade == "G3" || rng.IntN(10) == 0 {
+			label = "Yes"
+		}
+		models.Records[i] = map[string]interface{}{
+			"income": income, "age": 18 + rng.IntN(60), "area": area, "grade": grade, "label": label,
+		}
+		indices[i] = i
+	}
+	return indices, []string{"income", "age", "area", "grade"}
+}
+
+func TestBuildTreeDeterministic(t *testing.T) {
+	defer func() { *utils.CatSplitPtr, *utils.WorkersPtr = "multiway", 0 }()
+
+	for _, catSplit := range []string{"multiway", "binary"} {
+		*utils.CatSplitPtr = catSplit
+		var want []byte
+		for _, workers := range []int{1, 2, 8} {
+			*utils.WorkersPtr = workers
+			generateSyntheticData(parallelSplitMin + 100)
+			tree, err := BuildTree(context.Background(), "label")
+			if err != nil {
+				t.Fatalf("BuildTree() error = %v", err)
+			}
+			got, err := json.Marshal(tree)
+			if err != nil {
+				t.Fatalf("failed to encode tree: %v", err)
+			}
+			if want == nil {
+				want = got
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("%s tree built with %d workers differs from the one built with 1", catSplit, workers)
+			}
+		}
+	}
+}
+
+func TestBuildTreeCanceled(t *testing.T) {
+	generateSyntheticData(parallelSplitMin + 1000)
+	defer func() { *utils.WorkersPtr = 0 }()
+	*utils.WorkersPtr = 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tree, err := BuildTree(ctx, "label")
+	var canceled *utils.CanceledError
+	if !errors.As(err, &canceled) || !errors.Is(err, context.Canceled) || tree != nil {
+		t.Errorf("BuildTree() = %v, %v, want a canceled error before training", tree, err)
+	}
+
+	// A deadline during training stops it promptly and leaves a usable tree
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	tree, err = BuildTree(ctx, "label")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("training took %v after the deadline", elapsed)
+	}
+	if !errors.As(err, &canceled) || !errors.Is(err, context.DeadlineExceeded) || tree == nil {
+		t.Fatalf("BuildTree() = %v, %v, want a partial tree and a deadline error", tree, err)
+	}
+	model := &models.ModelData{TargetColumn: "label", Columns: models.Columns, FeatureTypes: models.FeatureTypes, Tree: tree}
+	if err := model.Validate(); err != nil {
+		t.Errorf("partial tree is not valid: %v", err)
+	}
+}
+
+func TestBuildTreeResume(t *testing.T) {
+	_, features := generateSyntheticData(1000)
+	models.DatasetHash = "synthetic"
+	*utils.ColumnPtr = "label"
+	defer func() {
+		*utils.CheckpointPtr, *utils.ResumePtr, *utils.ColumnPtr = "", false, ""
+		models.DatasetHash = ""
+	}()
+
+	full, err := BuildTree(context.Background(), "label")
+	if err != nil {
+		t.Fatalf("BuildTree() error = %v", err)
+	}
+	want, err := json.Marshal(full)
+	if err != nil {
+		t.Fatalf("failed to encode tree: %v", err)
+	}
+
+	// Grow a tree until the third checkpoint, as if the process was stopped
+	*utils.CheckpointPtr = filepath.Join(t.TempDir(), "checkpoint.dt")
+	indices, _ := generateSyntheticData(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g := newGrower(ctx, indices, features, "label")
+	saved := 0
+	g.grow(nil, func() error {
+		if saved++; saved == 3 {
+			cancel()
+		}
+		return utils.SaveCheckpoint(g.root, g.state(len(indices), nil))
+	}, 0)
+	if len(g.pending) == 0 {
+		t.Fatal("training finished before it was stopped")
+	}
+
+	*utils.ResumePtr = true
+	resumed, err := BuildTree(context.Background(), "label")
+	if err != nil {
+		t.Fatalf("BuildTree() resuming error = %v", err)
+	}
+	got, err := json.Marshal(resumed)
+	if err != nil {
+		t.Fatalf("failed to encode tree: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("resumed tree differs from the one built without stopping")
+	}
+
+	// A checkpoint of other data is refused
+	models.DatasetHash = "other"
+	if _, err := BuildTree(context.Background(), "label"); err == nil {
+		t.Error("BuildTree() resumed from a checkpoint of a different training file")
+	}
+}
+
+func TestGrowthProgress(t *testing.T) {
+	var p growthProgress
+	p.pendingRows.Store(100)
+	if _, ok := p.eta(50); ok {
+		t.Error("eta() is known before any node was finished")
+	}
+
+	// The root passes 80 of its 100 rows on, so each level keeps 80%
+	p.finish(100, []pendingNode{{indices: make([]int, 50)}, {indices: make([]int, 30)}})
+	p.depth.Store(1)
+	if got := p.pendingRows.Load(); got != 80 {
+		t.Errorf("pending rows = %d, want 80", got)
+	}
+	if eta, ok := p.eta(100); !ok || eta != 4*time.Second {
+		t.Errorf("eta() = %v, %v, want 4s", eta, ok)
+	}
+
+	// Rows that all reach children are bounded by the remaining depth
+	p.finish(80, []pendingNode{{indices: make([]int, 80)}})
+	p.childRows.Store(p.rows.Load())
+	p.depth.Store(MaxDepth)
+	if eta, ok := p.eta(80); !ok || eta != time.Second {
+		t.Errorf("eta() = %v, %v, want 1s", eta, ok)
+	}
+}
+
+func TestPredictCanceled(t *testing.T) {
+	tree := setupSyntheticData(500, "multiway")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := PredictWithSummary(ctx, tree); !errors.Is(err, context.Canceled) {
+		t.Errorf("PredictWithSummary() error = %v, want context.Canceled", err)
+	}
+
+	// Cancelling after the first chunk stops the stream
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	next, written := 0, 0
+	_, err := PredictStream(ctx, tree, Stream{
+		Read: func() ([]map[string]interface{}, error) {
+			if next >= len(models.Records) {
+				return nil, io.EOF
+			}
+			next += 10
+			return models.Records[next-10 : next], nil
+		},
+		Write:    func(predictions []interface{}) error { written += len(predictions); return nil },
+		Progress: func(int) { cancel() },
+		Workers:  2,
+	})
+	var canceled *utils.CanceledError
+	if !errors.As(err, &canceled) || canceled.Op != "prediction" {
+		t.Errorf("PredictStream() error = %v, want a canceled prediction", err)
+	}
+	if written == len(models.Records) {
+		t.Errorf("every chunk was written after cancellation")
+	}
+}
+
+func TestTaskPool(t *testing.T) {
+	// Nested fork-join deeper than the number of workers must not deadlock
+	var sum func(w *poolWorker, lo, hi int) int
+	sum = func(w *poolWorker, lo, hi int) int {
+		if hi-lo == 1 {
+			return lo
+		}
+		mid := (lo + hi) / 2
+		halves := make([]int, 2)
+		forEach(w, 2, func(w *poolWorker, i int) {
+			if i == 0 {
+				halves[i] = sum(w, lo, mid)
+			} else {
+				halves[i] = sum(w, mid, hi)
+			}
+		})
+		return halves[0] + halves[1]
+	}
+
+	for _, workers := range []int{1, 2, 7} {
+		pool := newTaskPool(workers)
+		var got int
+		pool.run(func(w *poolWorker) { got = sum(w, 0, 10000) })
+		pool.close()
+		if got != 10000*9999/2 {
+			t.Errorf("sum with %d workers = %d, want %d", workers, got, 10000*9999/2)
+		}
+	}
+}
+
+func TestCompiledTreeMatchesPredictRecord(t *testing.T) {
+	records := []map[string]interface{}{
+		{"income": 1500.0, "age": 30, "area": "Urban", "grade": "G1"},
+		{"income": 9000, "age": 70, "area": "Village", "grade": "G3"},
+		{"income": nil, "age": nil, "area": nil, "grade": nil},
+		{"income": 5000.0, "age": 40, "area": "Mars", "grade": "G99"},
+		{"income": "unknown", "age": 40, "area": "Rural", "grade": "G5"},
+		{"income": 4000.5, "age": 1 << 60, "area": "Suburb", "grade": 7},
+		{"income": math.NaN(), "age": 25, "area": "Semiurban", "grade": "G11"},
+	}
+	defer func() { *utils.UnseenPtr = UnseenMissing }()
+
+	for _, catSplit := range []string{"multiway", "binary"} {
+		tree := setupSyntheticData(400, catSplit)
+		for _, policy := range []string{UnseenMissing, UnseenParent, UnseenOther, UnseenBlend, UnseenFail} {
+			t.Run(catSplit+"/"+policy, func(t *testing.T) {
+				*utils.UnseenPtr = policy
+				wantUnseen := make(map[string]int)
+				want := make([]interface{}, len(records))
+				var wantErr error
+				for i, record := range records {
+					prediction, err := predictRecord(record, tree, wantUnseen)
+					if err != nil {
+						wantErr = fmt.Errorf("record %d: %w", i+1, err)
+						break
+					}
+					want[i] = prediction
+				}
+
+				gotUnseen := make(map[string]int)
+				compiled := Compile(tree, policy)
+				got, err := compiled.Predict(records, gotUnseen)
+				if wantErr != nil {
+					if err == nil || err.Error() != wantErr.Error() {
+						t.Fatalf("Predict() error = %v, want %v", err, wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Predict returned an error: %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Predict() = %v, want %v", got, want)
+				}
+				if !reflect.DeepEqual(gotUnseen, wantUnseen) {
+					t.Errorf("unseen counts = %v, want %v", gotUnseen, wantUnseen)
+				}
+
+				for i, record := range records {
+					explanation, err := Explain(record, tree)
+					if err != nil {
+						t.Fatalf("Explain returned an error: %v", err)
+					}
+					prediction, scores, err := compiled.Score(record)
+					if err != nil || prediction != explanation.Prediction || !reflect.DeepEqual(scores, explanation.Probabilities) {
+						t.Errorf("record %d: Score() = %v, %v, %v, want %v, %v", i+1, prediction, scores, err,
+							explanation.Prediction, explanation.Probabilities)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPredictStreamRows(t *testing.T) {
+	leaf := func(label string) *models.TreeNode { return &models.TreeNode{IsLeaf: true, Prediction: label} }
+	tree := &models.TreeNode{
+		Feature: "area", SplitType: "categorical", Prediction: "root",
+		Children: map[string]*models.TreeNode{
+			"Urban": {
+				Feature: "grade", SplitType: "categorical", Prediction: "urban",
+				Children: map[string]*models.TreeNode{"G1": leaf("G1"), "G8": leaf("G8"), OtherCategory: leaf("other")},
+			},
+			"Rural":   {Feature: "income", SplitType: "numerical", SplitValue: 2000.0, Prediction: "rural", Left: leaf("poor"), Right: leaf("rich")},
+			"Village": {Feature: "age", SplitType: "numerical", SplitValue: 40, Prediction: "village", Left: leaf("young"), Right: leaf("old")},
+		},
+	}
+	groups := map[string][]string{"grade": {"G1", "G2"}}
+	// area is named twice: the last cell a row has wins, as in a record
+	columns := []string{"income", "age", "area", "grade", "area"}
+	base := [][]string{
+		{"1500", "30", "Urban", "G1", "Rural"},
+		{"1500", "30", "Urban", "G1"},
+		{"9000", "70", "Village", "G3"},
+		{"", "", "", "", ""},
+		{"5000", "40", "Mars", "G99", "Mars"},
+		{"unknown", "40", "Rural", "G5", "Rural"},
+		{"4000.5", "1152921504606846976", "Village", "7", "Village"},
+		{"NaN", "25", "Rural", "G11", "Rural"},
+		{"2500"},
+		{"3000", "50", "Urban", "G2", "Urban", "extra"},
+		{"3000", "50", "Urban", "G8", "Urban"},
+		{"2024-01-02", "30", "Rural", "G8", "Rural"},
+	}
+	var rows [][]string
+	for i := 0; i < 5; i++ {
+		rows = append(rows, base...)
+	}
+	defer func() { *utils.UnseenPtr = UnseenMissing }()
+
+	for _, policy := range []string{UnseenMissing, UnseenParent, UnseenOther, UnseenBlend} {
+		t.Run(policy, func(t *testing.T) {
+			*utils.UnseenPtr = policy
+			wantUnseen := make(map[string]int)
+			want := make([]interface{}, len(rows))
+			for i, row := range rows {
+				records := []map[string]interface{}{utils.RowRecord(columns, row)}
+				ApplyCategoryGroups(records, groups)
+				prediction, err := predictRecord(records[0], tree, wantUnseen)
+				if err != nil {
+					t.Fatalf("predictRecord returned an error: %v", err)
+				}
+				want[i] = prediction
+			}
+
+			for _, explain := range []bool{false, true} {
+				next := 0
+				var got []interface{}
+				stream := Stream{
+					ReadRows: func() ([][]string, error) {
+						if next >= len(rows) {
+							return nil, io.EOF
+						}
+						chunk := rows[next:min(next+3, len(rows))]
+						next += len(chunk)
+						return chunk, nil
+					},
+					Columns: columns,
+					Groups:  groups,
+					Write:   func(predictions []interface{}) error { got = append(got, predictions...); return nil },
+					Workers: 3,
+				}
+				if explain {
+					stream.Explain = true
+					stream.WriteDetails = func(predictions []interface{}, _ []Details) error {
+						got = append(got, predictions...)
+						return nil
+					}
+				}
+				summary, err := PredictStream(context.Background(), tree, stream)
+				if err != nil {
+					t.Fatalf("PredictStream returned an error: %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("explain %v: predictions = %v, want %v", explain, got, want)
+				}
+				if summary.Records != len(rows) || !reflect.DeepEqual(summary.Unseen, wantUnseen) {
+					t.Errorf("explain %v: summary = %+v, want %d records and unseen %v", explain, summary, len(rows), wantUnseen)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPredict compares walking the linked tree with the compiled form on
+// a single goroutine. "compiled" includes compiling the tree and encoding the
+// records; "columnar" evaluates records that are already encoded.
+func BenchmarkPredict(b *testing.B) {
+	tree := setupSyntheticData(5000, "multiway")
+	records := models.Records
+
+	b.Run("recursive", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, record := range records {
+				if _, err := predictRecord(record, tree, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Compile(tree, UnseenParent).Predict(records, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("columnar", func(b *testing.B) {
+		compiled := Compile(tree, UnseenParent)
+		cols := compiled.Encode(records)
+		out := make([]interface{}, len(records))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := compiled.predictRows(func(row int) map[string]interface{} { return records[row] }, cols, out, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPredictCSV measures prediction from a CSV file to the predictions
+// on a single goroutine. "tree walk" reads records and walks the linked tree,
+// "records" scores records with the compiled form and "rows" encodes the
+// rows of the file for the compiled form without making records. "read"
+// only reads the rows, the floor for the others.
+func BenchmarkPredictCSV(b *testing.B) {
+	tree := setupSyntheticData(5000, "multiway")
+	var csv strings.Builder
+	csv.WriteString(strings.Join(models.Columns, ",") + "\n")
+	for _, record := range models.Records {
+		cells := make([]string, len(models.Columns))
+		for i, column := range models.Columns {
+			cells[i] = models.GetValueKey(record[column])
+		}
+		csv.WriteString(strings.Join(cells, ",") + "\n")
+	}
+	input := filepath.Join(b.TempDir(), "input.csv")
+	if err := os.WriteFile(input, []byte(csv.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	previous := *utils.InputPtr
+	*utils.InputPtr = input
+	defer func() { *utils.InputPtr = previous }()
+
+	open := func(b *testing.B) *utils.PredictionReader {
+		reader, err := utils.OpenPredictionData()
+		if err != nil {
+			b.Fatal(err)
+		}
+		return reader
+	}
+	discard := func([]interface{}) error { return nil }
+
+	b.Run("read", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := open(b)
+			for {
+				if _, err := reader.ReadRows(1000); err == io.EOF {
+					break
+				}
+			}
+			reader.Close()
+		}
+	})
+	b.Run("tree walk", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := open(b)
+			for {
+				records, err := reader.ReadChunk(1000)
+				if err == io.EOF {
+					break
+				}
+				for _, record := range records {
+					if _, err := predictRecord(record, tree, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			reader.Close()
+		}
+	})
+	b.Run("records", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := open(b)
+			_, err := PredictStream(context.Background(), tree, Stream{
+				Read:    func() ([]map[string]interface{}, error) { return reader.ReadChunk(1000) },
+				Write:   discard,
+				Workers: 1,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			reader.Close()
+		}
+	})
+	b.Run("rows", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := open(b)
+			_, err := PredictStream(context.Background(), tree, Stream{
+				ReadRows: func() ([][]string, error) { return reader.ReadRows(1000) },
+				Columns:  reader.Columns(),
+				Write:    discard,
+				Workers:  1,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			reader.Close()
+		}
+	})
+}
+
+func TestGainImportance(t *testing.T) {
+	leaf := func(samples int) *models.TreeNode {
+		return &models.TreeNode{IsLeaf: true, Prediction: "No", Samples: samples}
+	}
+	model := &models.ModelData{
+		TargetColumn: "label",
+		Columns:      []string{"income", "area", "age", "label"},
+		Tree: &models.TreeNode{
+			Feature: "income", SplitType: "numerical", SplitValue: 5000.0, Samples: 10, InfoGain: 0.4, GainRatio: 0.5,
+			Left: leaf(6),
+			Right: &models.TreeNode{
+				Feature: "area", SplitType: "categorical", Samples: 4, InfoGain: 0.6, GainRatio: 0.8,
+				Children: map[string]*models.TreeNode{
+					"Rural": leaf(2),
+					"Urban": {
+						Feature: "income", SplitType: "numerical", SplitValue: 9000.0, Samples: 2, InfoGain: 1, GainRatio: 1,
+						Left: leaf(1), Right: leaf(1),
+					},
+				},
+			},
+		},
+	}
+	depth := func(d int) *int { return &d }
+
+	got, err := GainImportance(model)
+	if err != nil {
+		t.Fatalf("GainImportance() error = %v", err)
+	}
+	want := []FeatureImportance{
+		{Feature: "income", GainRatio: 0.7, InfoGain: 0.6, Splits: 2, FirstDepth: depth(0)},
+		{Feature: "area", GainRatio: 0.32, InfoGain: 0.24, Splits: 1, FirstDepth: depth(1)},
+		{Feature: "age"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("GainImportance() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Feature != w.Feature || math.Abs(g.GainRatio-w.GainRatio) > 1e-9 || math.Abs(g.InfoGain-w.InfoGain) > 1e-9 ||
+			g.Splits != w.Splits || !reflect.DeepEqual(g.FirstDepth, w.FirstDepth) {
+			t.Errorf("rank %d = %+v, want %+v", i+1, g, w)
+		}
+	}
+
+	// Imported models carry no gains
+	model.Tree.Right.GainRatio, model.Tree.Right.InfoGain = 0, 0
+	if _, err := GainImportance(model); !errors.Is(err, ErrNoGains) {
+		t.Errorf("GainImportance() without gains error = %v, want ErrNoGains", err)
+	}
+
+	// Every split the builder makes records its gains
+	indices, features := generateSyntheticData(2000)
+	trained := &models.ModelData{TargetColumn: "label", Columns: models.Columns, Tree: buildTreeNode(indices, features, "label", 0)}
+	ranked, err := GainImportance(trained)
+	if err != nil {
+		t.Fatalf("GainImportance() of a trained tree error = %v", err)
+	}
+	if ranked[0].Splits == 0 || *ranked[0].FirstDepth != 0 || ranked[0].Feature != trained.Tree.Feature {
+		t.Errorf("top feature = %+v, want the root feature %s", ranked[0], trained.Tree.Feature)
+	}
+}
+
+func TestPermutationImportance(t *testing.T) {
+	defer func(workers int) { *utils.WorkersPtr = workers }(*utils.WorkersPtr)
+
+	// The label follows income; area is never read
+	model := &models.ModelData{
+		TargetColumn: "label",
+		TargetType:   "categorical",
+		Columns:      []string{"income", "area", "label"},
+		FeatureTypes: map[string]string{"income": "numeric", "area": "categorical", "label": "categorical"},
+		Tree: &models.TreeNode{
+			Feature: "income", SplitType: "numerical", SplitValue: 100.0,
+			Left:  &models.TreeNode{IsLeaf: true, Prediction: "No"},
+			Right: &models.TreeNode{IsLeaf: true, Prediction: "Yes"},
+		},
+	}
+	records := func() []map[string]interface{} {
+		var records []map[string]interface{}
+		for i := 0; i < 200; i++ {
+			label := "No"
+			if i >= 100 {
+				label = "Yes"
+			}
+			records = append(records, map[string]interface{}{"income": float64(i), "area": "Urban", "label": label})
+		}
+		// Records without a label are not scored
+		return append(records, map[string]interface{}{"income": 1.0, "area": "Rural", "label": nil})
+	}
+
+	var reports []*PermutationReport
+	for _, workers := range []int{1, 4} {
+		*utils.WorkersPtr = workers
+		report, err := PermutationImportance(context.Background(), model, records(), 5, 3)
+		if err != nil {
+			t.Fatalf("PermutationImportance() error = %v", err)
+		}
+		reports = append(reports, report)
+	}
+	report := reports[0]
+	if !reflect.DeepEqual(reports[0], reports[1]) {
+		t.Errorf("reports differ with 1 and 4 workers:\n%+v\n%+v", reports[0], reports[1])
+	}
+	if report.Metric != MetricAccuracy || report.Baseline != 1 || report.Rows != 200 {
+		t.Errorf("report = %s %v on %d rows, want accuracy 1 on 200 rows", report.Metric, report.Baseline, report.Rows)
+	}
+	if len(report.Features) != 2 || report.Features[0].Feature != "income" || report.Features[1].Feature != "area" {
+		t.Fatalf("features = %+v, want income then area", report.Features)
+	}
+	// Shuffling income makes the model about as good as a coin toss
+	if income := report.Features[0]; math.Abs(income.MeanDrop-0.5) > 0.15 || income.StdDrop <= 0 || len(income.Drops) != 5 {
+		t.Errorf("income = %+v, want a mean drop near 0.5", income)
+	}
+	if area := report.Features[1]; area.MeanDrop != 0 || area.StdDrop != 0 {
+		t.Errorf("area = %+v, want no drop", area)
+	}
+
+	// Numeric targets are scored with R²
+	regression := *model
+	regression.TargetType = "numeric"
+	regression.Tree = &models.TreeNode{
+		Feature: "income", SplitType: "numerical", SplitValue: 100.0,
+		Left:  &models.TreeNode{IsLeaf: true, Prediction: 0.0},
+		Right: &models.TreeNode{IsLeaf: true, Prediction: 1.0},
+	}
+	numeric := records()
+	for _, record := range numeric {
+		if record["label"] != nil {
+			record["label"] = map[string]float64{"No": 0, "Yes": 1}[record["label"].(string)]
+		}
+	}
+	report, err := PermutationImportance(context.Background(), &regression, numeric, 2, 1)
+	if err != nil {
+		t.Fatalf("PermutationImportance() of a regression error = %v", err)
+	}
+	if report.Metric != MetricR2 || report.Baseline != 1 || report.Features[0].MeanDrop <= 1 {
+		t.Errorf("regression report = %+v, want r2 1 dropping by more than 1", report)
+	}
+
+	if _, err := PermutationImportance(context.Background(), model, records(), 0, 1); err == nil {
+		t.Error("PermutationImportance() accepted 0 repeats")
+	}
+	if _, err := PermutationImportance(context.Background(), model, records()[200:], 1, 1); err == nil {
+		t.Error("PermutationImportance() scored records without labels")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := PermutationImportance(ctx, model, records(), 1, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("PermutationImportance() with a canceled context error = %v", err)
+	}
+}
+
+func TestSHAPValues(t *testing.T) {
+	// Income splits twice on the path through Urban
+	tree := &models.TreeNode{
+		SplitType:   "numerical",
+		Feature:     "income",
+		SplitValue:  5000.0,
+		Prediction:  "No",
+		Samples:     20,
+		ClassCounts: map[string]int{"Yes": 9, "No": 11},
+		Left:        &models.TreeNode{IsLeaf: true, Prediction: "No", Samples: 8, ClassCounts: map[string]int{"Yes": 1, "No": 7}},
+		Right: &models.TreeNode{
+			SplitType:   "categorical",
+			Feature:     "area",
+			Prediction:  "Yes",
+			Samples:     12,
+			ClassCounts: map[string]int{"Yes": 8, "No": 4},
+			OtherBranch: "Urban",
+			Children: map[string]*models.TreeNode{
+				"Rural": {IsLeaf: true, Prediction: "No", Samples: 4, ClassCounts: map[string]int{"Yes": 1, "No": 3}},
+				"Urban": {
+					SplitType:   "numerical",
+					Feature:     "income",
+					SplitValue:  8000.0,
+					Prediction:  "Yes",
+					Samples:     8,
+					ClassCounts: map[string]int{"Yes": 7, "No": 1},
+					Left:        &models.TreeNode{IsLeaf: true, Prediction: "Yes", Samples: 3, ClassCounts: map[string]int{"Yes": 2, "No": 1}},
+					Right:       &models.TreeNode{IsLeaf: true, Prediction: "Yes", Samples: 5, ClassCounts: map[string]int{"Yes": 5}},
+				},
+			},
+		},
+	}
+	model := &models.ModelData{TargetColumn: "label", Columns: []string{"income", "area", "age", "label"}, Tree: tree}
+
+	tests := []struct {
+		name   string
+		policy string
+		record map[string]interface{}
+	}{
+		{"low income", "", map[string]interface{}{"income": 1000.0, "area": "Urban"}},
+		{"rural", "", map[string]interface{}{"income": 9000.0, "area": "Rural"}},
+		{"urban twice on income", "", map[string]interface{}{"income": 9000.0, "area": "Urban"}},
+		{"urban middle income", "", map[string]interface{}{"income": 6000.0, "area": "Urban"}},
+		{"missing income", "", map[string]interface{}{"income": nil, "area": "Urban"}},
+		{"unseen parent", UnseenParent, map[string]interface{}{"income": 9000.0, "area": "Village"}},
+		{"unseen other", UnseenOther, map[string]interface{}{"income": 6000.0, "area": "Village"}},
+		{"unseen blend", UnseenBlend, map[string]interface{}{"income": 9000.0, "area": "Village"}},
+	}
+	defaultPolicy := UnseenMissing
+	defer func() { utils.UnseenPtr = &defaultPolicy }()
+
+	explainer, err := NewSHAPExplainer(model)
+	if err != nil {
+		t.Fatalf("NewSHAPExplainer() error = %v", err)
+	}
+	if features := explainer.Features(); !reflect.DeepEqual(features, []string{"income", "area", "age"}) {
+		t.Errorf("Features() = %q, want the model columns", features)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := cmp.Or(tt.policy, UnseenParent)
+			utils.UnseenPtr = &policy
+
+			shap, err := explainer.Explain(tt.record)
+			if err != nil {
+				t.Fatalf("Explain() error = %v", err)
+			}
+			checkSHAPAdditive(t, shap)
+			if base := float64(tree.ClassCounts[shap.Class]) / 20; math.Abs(shap.Base-base) > 1e-9 {
+				t.Errorf("base = %v, want the share of %s at the root, %v", shap.Base, shap.Class, base)
+			}
+			want := bruteForceSHAP(tt.record, tree, explainer.Features(), shap.Class)
+			for feature, value := range want {
+				if math.Abs(shap.Values[feature]-value) > 1e-9 {
+					t.Errorf("SHAP value of %s = %v, want %v", feature, shap.Values[feature], value)
+				}
+			}
+			if shap.Values["age"] != 0 {
+				t.Errorf("SHAP value of unused age = %v, want 0", shap.Values["age"])
+			}
+		})
+	}
+
+	// Trees grown from data, with multiway and subset splits
+	for _, catSplit := range []string{"multiway", "subset"} {
+		t.Run("grown "+catSplit, func(t *testing.T) {
+			utils.UnseenPtr = &defaultPolicy
+			grown := &models.ModelData{TargetColumn: "label", Tree: setupSyntheticData(400, catSplit)}
+			grown.Columns = models.Columns
+			explainer, err := NewSHAPExplainer(grown)
+			if err != nil {
+				t.Fatalf("NewSHAPExplainer() error = %v", err)
+			}
+			for _, record := range models.Records[:40] {
+				shap, err := explainer.Explain(record)
+				if err != nil {
+					t.Fatalf("Explain() error = %v", err)
+				}
+				checkSHAPAdditive(t, shap)
+				want := bruteForceSHAP(record, grown.Tree, explainer.Features(), shap.Class)
+				for feature, value := range want {
+					if math.Abs(shap.Values[feature]-value) > 1e-9 {
+						t.Fatalf("SHAP value of %s = %v, want %v", feature, shap.Values[feature], value)
+					}
+				}
+			}
+		})
+	}
+
+	// Imported models have no covers
+	imported := &models.ModelData{TargetColumn: "label", Tree: &models.TreeNode{
+		Feature: "income", SplitType: "numerical", SplitValue: 1.0,
+		Left:  &models.TreeNode{IsLeaf: true, Prediction: "No"},
+		Right: &models.TreeNode{IsLeaf: true, Prediction: "Yes"},
+	}}
+	if _, err := NewSHAPExplainer(imported); !errors.Is(err, ErrNoCovers) {
+		t.Errorf("NewSHAPExplainer() error = %v, want %v", err, ErrNoCovers)
+	}
+}
+
+// checkSHAPAdditive checks that the base value and the SHAP values add up to
+// the model output
+func checkSHAPAdditive(t *testing.T, shap *SHAPValues) {
+	t.Helper()
+	sum := shap.Base
+	for _, value := range shap.Values {
+		sum += value
+	}
+	if math.Abs(sum-shap.Output) > 1e-9 {
+		t.Errorf("base %v plus SHAP values %v = %v, want the output %v", shap.Base, shap.Values, sum, shap.Output)
+	}
+}
+
+// bruteForceSHAP computes SHAP values from their definition: the weighted
+// change of the cover-weighted expected output over every subset of features
+func bruteForceSHAP(record map[string]interface{}, tree *models.TreeNode, features []string, class string) map[string]float64 {
+	value := func(node *models.TreeNode) float64 { return nodeDistribution(node)[class] }
+	var expect func(node *models.TreeNode, known map[string]bool) float64
+	expect = func(node *models.TreeNode, known map[string]bool) float64 {
+		if node.IsLeaf {
+			return value(node)
+		}
+		var total float64
+		for _, branch := range shapBranches(record, node) {
+			weight := branch.zero
+			if known[node.Feature] {
+				weight = branch.one
+			}
+			switch {
+			case weight == 0:
+			case branch.node == nil:
+				total += weight * value(node)
+			default:
+				total += weight * expect(branch.node, known)
+			}
+		}
+		return total
+	}
+
+	factorial := func(n int) float64 { return math.Gamma(float64(n) + 1) }
+	n := len(features)
+	phi := make(map[string]float64, n)
+	for j, feature := range features {
+		for mask := 0; mask < 1<<n; mask++ {
+			if mask&(1<<j) != 0 {
+				continue
+			}
+			known := make(map[string]bool)
+			for i := range features {
+				if mask&(1<<i) != 0 {
+					known[features[i]] = true
+				}
+			}
+			size := len(known)
+			without := expect(tree, known)
+			known[feature] = true
+			phi[feature] += factorial(size) * factorial(n-size-1) / factorial(n) * (expect(tree, known) - without)
+		}
+	}
+	return phi
+}
+
+func TestCounterfactualSearch(t *testing.T) {
+	// Yes needs an income of at least 5000 and an Urban area
+	tree := &models.TreeNode{
+		SplitType:   "numerical",
+		Feature:     "income",
+		SplitValue:  5000.0,
+		Prediction:  "No",
+		Samples:     20,
+		ClassCounts: map[string]int{"Yes": 8, "No": 12},
+		Left:        &models.TreeNode{IsLeaf: true, Prediction: "No", Samples: 8, ClassCounts: map[string]int{"No": 8}},
+		Right: &models.TreeNode{
+			SplitType:   "categorical",
+			Feature:     "area",
+			Prediction:  "Yes",
+			Samples:     12,
+			ClassCounts: map[string]int{"Yes": 8, "No": 4},
+			Children: map[string]*models.TreeNode{
+				"Rural":       {IsLeaf: true, Prediction: "No", Samples: 4, ClassCounts: map[string]int{"No": 4}},
+				"Urban":       {IsLeaf: true, Prediction: "Yes", Samples: 6, ClassCounts: map[string]int{"Yes": 6}},
+				OtherCategory: {IsLeaf: true, Prediction: "Yes", Samples: 2, ClassCounts: map[string]int{"Yes": 2}},
+			},
+		},
+	}
+	model := &models.ModelData{TargetColumn: "label", Columns: []string{"income", "area", "label"}, Tree: tree}
+
+	tests := []struct {
+		name      string
+		record    map[string]interface{}
+		immutable []string
+		costs     map[string]float64
+		want      []string // Changes of each counterfactual, cheapest first
+		wantCost  float64  // Cost of the cheapest
+	}{
+		{
+			name:     "raise income",
+			record:   map[string]interface{}{"income": 1000.0, "area": "Urban"},
+			want:     []string{"income=5000"},
+			wantCost: 4000,
+		},
+		{
+			name:     "cost per unit of income",
+			record:   map[string]interface{}{"income": 1000.0, "area": "Urban"},
+			costs:    map[string]float64{"income": 0.001},
+			want:     []string{"income=5000"},
+			wantCost: 4,
+		},
+		{
+			name:     "change area",
+			record:   map[string]interface{}{"income": 9000.0, "area": "Rural"},
+			want:     []string{"area=Urban"},
+			wantCost: 1,
+		},
+		{
+			name:     "change both",
+			record:   map[string]interface{}{"income": 1000.5, "area": "Rural"},
+			costs:    map[string]float64{"income": 0.01, "area": 2},
+			want:     []string{"area=Urban,income=5000"},
+			wantCost: 41.995,
+		},
+		{
+			name:     "missing income follows the larger branch",
+			record:   map[string]interface{}{"income": nil, "area": "Rural"},
+			want:     []string{"area=Urban"},
+			wantCost: 1,
+		},
+		{
+			name:      "immutable area",
+			record:    map[string]interface{}{"income": 9000.0, "area": "Rural"},
+			immutable: []string{"area"},
+		},
+		{
+			name:     "already predicted",
+			record:   map[string]interface{}{"income": 9000.0, "area": "Urban"},
+			want:     []string{""},
+			wantCost: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			search, err := NewCounterfactualSearch(model, CounterfactualOptions{Class: "Yes", Immutable: tt.immutable, Costs: tt.costs})
+			if err != nil {
+				t.Fatalf("NewCounterfactualSearch() error = %v", err)
+			}
+			found := search.Search(tt.record)
+			got := make([]string, len(found))
+			for i, counterfactual := range found {
+				got[i] = changesKey(counterfactual.Changes)
+
+				changed := maps.Clone(tt.record)
+				for _, change := range counterfactual.Changes {
+					changed[change.Feature] = change.To
+				}
+				if prediction, _ := predictRecord(changed, tree, nil); prediction != "Yes" {
+					t.Errorf("counterfactual %s predicts %v", got[i], prediction)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) && len(got)+len(tt.want) > 0 {
+				t.Fatalf("counterfactuals = %q, want %q", got, tt.want)
+			}
+			if len(found) > 0 && math.Abs(found[0].Cost-tt.wantCost) > 1e-9 {
+				t.Errorf("cost = %v, want %v", found[0].Cost, tt.wantCost)
+			}
+		})
+	}
+
+	for _, options := range []CounterfactualOptions{
+		{Class: "Maybe"},
+		{Class: "Yes", Immutable: []string{"age"}},
+		{Class: "Yes", Costs: map[string]float64{"income": -1}},
+	} {
+		if _, err := NewCounterfactualSearch(model, options); err == nil {
+			t.Errorf("NewCounterfactualSearch(%+v) accepted invalid options", options)
+		}
+	}
+
+	// Values are rounded to the fewest decimals staying in the region
+	rounding := []struct {
+		got, want float64
+	}{
+		{roundAbove(28918.5, math.Inf(1)), 28919},
+		{roundAbove(1.25, 1.3), 1.25},
+		{roundBelow(560, math.Inf(-1)), 559},
+		{roundBelow(0.5, math.Inf(-1)), 0},
+		{roundBelow(2.05, 2), 2},
+		{roundBelow(2.05, 2.01), 2.04},
+	}
+	for i, r := range rounding {
+		if math.Abs(r.got-r.want) > 1e-9 {
+			t.Errorf("rounding %d = %v, want %v", i, r.got, r.want)
+		}
+	}
+}
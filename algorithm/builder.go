@@ -1,8 +1,17 @@
 package algorithm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"io/fs"
+	"log/slog"
+	"math"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"dt/models"
 	"dt/utils"
@@ -14,9 +23,15 @@ const (
 	MinInfoGain    = 0.001 // Minimum information gain required to split
 )
 
-// BuildTree builds a decision tree from the given dataset
-func BuildTree(targetCol string) (*models.TreeNode, error) {
-	fmt.Println("Building decision tree for target:", targetCol)
+// BuildTree builds a decision tree from the given dataset. When ctx is
+// cancelled or its deadline passes, every worker stops and BuildTree returns
+// the partially built tree with a *utils.CanceledError. Nodes that were not
+// finished are leaves in that tree, so it can still be saved and used.
+//
+// With -checkpoint the growing tree and its pending nodes are saved every
+// -checkpoint-every and when training stops; -resume continues from there.
+func BuildTree(ctx context.Context, targetCol string) (*models.TreeNode, error) {
+	slog.Info("building decision tree", "target", targetCol)
 
 	// Get available features (exclude target column)
 	features := make([]string, 0)
@@ -32,113 +47,476 @@ func BuildTree(targetCol string) (*models.TreeNode, error) {
 		indices[i] = i
 	}
 
-	// Train in batches
-	batchSize := 1000
-	var tree *models.TreeNode
-	for i := 0; i < len(indices); i += batchSize {
-		end := i + batchSize
-		if end > len(indices) {
-			end = len(indices)
+	models.Hyperparameters = &models.TrainingParams{
+		MaxDepth:         MaxDepth,
+		MinSamplesLeaf:   MinSamplesLeaf,
+		MinInfoGain:      MinInfoGain,
+		CategoricalSplit: *utils.CatSplitPtr,
+		Sampling:         *utils.SamplePtr,
+		Seed:             *utils.SeedPtr,
+		SmoteK:           *utils.SmoteKPtr,
+		RareMinCount:     *utils.RareCountPtr,
+		RareMinFreq:      *utils.RareFreqPtr,
+	}
+
+	// Merge rare categories before any split sees them
+	models.CategoryGroups = GroupRareCategories(indices, targetCol, *utils.RareCountPtr, *utils.RareFreqPtr)
+	for _, feature := range features {
+		if kept, ok := models.CategoryGroups[feature]; ok {
+			slog.Info("grouped rare categories", "feature", feature, "into", OtherCategory, "kept", len(kept))
+		}
+	}
+
+	if err := utils.Canceled(ctx, "training"); err != nil {
+		return nil, err
+	}
+
+	// Rebalance the target distribution if requested. SMOTE rows are added
+	// to the training data, so models.Records grows. A resumed run samples
+	// again, which recreates any synthetic rows the checkpoint refers to.
+	indices, synthetic, rngState, err := resample(indices, targetCol, *utils.SamplePtr, *utils.SeedPtr, *utils.SmoteKPtr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resample training data: %w", err)
+	}
+	models.Records = append(models.Records, synthetic...)
+	if method := *utils.SamplePtr; method != "" && method != "none" {
+		slog.Info("resampled training data", "method", method, "rows", len(indices))
+	}
+
+	g := newGrower(ctx, indices, features, targetCol)
+	if *utils.ResumePtr {
+		file, model, err := utils.LoadCheckpoint()
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			slog.Info("no checkpoint to resume, training from the start", "checkpoint", *utils.CheckpointPtr)
+		case err != nil:
+			return nil, err
+		default:
+			if err := g.resume(file, model, len(indices), rngState); err != nil {
+				return nil, fmt.Errorf("cannot resume from %s: %w", *utils.CheckpointPtr, err)
+			}
+			slog.Info("resumed training", "checkpoint", *utils.CheckpointPtr,
+				"nodes", g.progress.nodes.Load(), "pending", len(g.pending))
+		}
+	}
+
+	var checkpoint func() error
+	if *utils.CheckpointPtr != "" {
+		checkpoint = func() error {
+			if err := utils.SaveCheckpoint(g.root, g.state(len(indices), rngState)); err != nil {
+				return err
+			}
+			slog.Debug("checkpoint saved", "checkpoint", *utils.CheckpointPtr, "pending", len(g.pending))
+			return nil
 		}
-		batchIndices := indices[i:end]
+	}
 
-		if tree == nil {
-			tree = buildTreeNode(batchIndices, features, targetCol, 0)
+	start := time.Now()
+	stopReports := g.progress.reportEvery(progressInterval)
+	pool := newTaskPool(workerCount())
+	defer pool.close()
+	pool.run(func(w *poolWorker) {
+		err = g.grow(w, checkpoint, *utils.CheckpointEveryPtr)
+	})
+	stopReports()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	if canceled := utils.Canceled(ctx, "training"); canceled != nil {
+		if checkpoint != nil {
+			if err := checkpoint(); err != nil {
+				return g.root, fmt.Errorf("failed to save checkpoint: %w", err)
+			}
+			slog.Info("partially built tree saved", "checkpoint", *utils.CheckpointPtr, "pending", len(g.pending))
 		}
+		return g.root, canceled
+	}
+
+	slog.Info("tree building complete", "nodes", g.progress.nodes.Load(), "elapsed", time.Since(start).Round(time.Millisecond))
+	return g.root, nil
+}
+
+// grower grows a tree one frontier of pending nodes at a time. Between rounds
+// the tree is complete, with every pending node a leaf, so it can be saved
+// as a checkpoint together with the queue.
+type grower struct {
+	ctx       context.Context
+	features  []string
+	targetCol string
+	root      *models.TreeNode
+	pending   []pendingNode
+	progress  growthProgress
+}
+
+// progressInterval is how often training progress is logged
+const progressInterval = 5 * time.Second
+
+// growthProgress counts the work done by a grower. Workers update it while
+// the progress reporter reads it.
+type growthProgress struct {
+	nodes       atomic.Int64 // Nodes split or finished as leaves
+	rows        atomic.Int64 // Rows of the nodes finished in this run
+	childRows   atomic.Int64 // Rows those nodes passed on to their children
+	pendingRows atomic.Int64 // Rows of the nodes still to split
+	depth       atomic.Int64 // Depth of the deepest node being split
+}
+
+// finish records a node of rows rows that has been split into children
+func (p *growthProgress) finish(rows int, children []pendingNode) {
+	childRows := 0
+	for _, child := range children {
+		childRows += len(child.indices)
+	}
+	p.nodes.Add(1)
+	p.rows.Add(int64(rows))
+	p.childRows.Add(int64(childRows))
+	p.pendingRows.Add(int64(childRows - rows))
+}
 
-		// Save the model incrementally
-		if err := utils.SaveModel(tree); err != nil {
-			return nil, fmt.Errorf("failed to save model: %w", err)
+// eta estimates the time left at rate rows per second. Pending rows are
+// split once more, then again at each level below in the proportion passed
+// on to children so far, down to MaxDepth.
+func (p *growthProgress) eta(rate float64) (time.Duration, bool) {
+	rows := p.rows.Load()
+	if rows == 0 || rate <= 0 {
+		return 0, false
+	}
+	levels := float64(MaxDepth - p.depth.Load() + 1)
+	if ratio := float64(p.childRows.Load()) / float64(rows); ratio < 1 {
+		levels = min(levels, 1/(1-ratio))
+	}
+	seconds := float64(p.pendingRows.Load()) * levels / rate
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// reportEvery logs progress at every interval until the returned function
+// is called
+func (p *growthProgress) reportEvery(interval time.Duration) func() {
+	start := time.Now()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				rate := float64(p.rows.Load()) / time.Since(start).Seconds()
+				attrs := []any{
+					"nodes", p.nodes.Load(),
+					"depth", p.depth.Load(),
+					"rows_per_sec", math.Round(rate),
+				}
+				if eta, ok := p.eta(rate); ok {
+					attrs = append(attrs, "eta", eta.Round(time.Second))
+				}
+				slog.Info("training progress", attrs...)
+			}
 		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// pendingNode is a node waiting to be split. node is a leaf placeholder in the
+// tree that is turned into a decision node in place.
+type pendingNode struct {
+	node    *models.TreeNode
+	path    []string
+	depth   int
+	indices []int
+}
+
+func newGrower(ctx context.Context, indices []int, features []string, targetCol string) *grower {
+	root := leafNode(indices, targetCol)
+	g := &grower{
+		ctx:       ctx,
+		features:  features,
+		targetCol: targetCol,
+		root:      root,
+		pending:   []pendingNode{{node: root, indices: indices}},
 	}
+	g.progress.pendingRows.Store(int64(len(indices)))
+	return g
+}
 
-	fmt.Println("Tree building complete")
-	return tree, nil
+// leafNode creates a leaf holding the training statistics of indices, which
+// prediction falls back on
+func leafNode(indices []int, targetCol string) *models.TreeNode {
+	return &models.TreeNode{
+		IsLeaf:      true,
+		Prediction:  MostCommonTarget(indices, targetCol),
+		Samples:     len(indices),
+		ClassCounts: ClassDistribution(indices, targetCol),
+	}
 }
 
-func buildTreeNode(indices []int, features []string, targetCol string, depth int) *models.TreeNode {
-	// Create a leaf node if:
+// grow splits pending nodes until there are none left or ctx is done. When
+// checkpoint is not nil it is called between rounds once every interval.
+// Leaves that agree are merged once the tree is finished.
+func (g *grower) grow(w *poolWorker, checkpoint func() error, every time.Duration) error {
+	last := time.Now()
+	for len(g.pending) > 0 && g.ctx.Err() == nil {
+		g.round(w)
+		if checkpoint != nil && len(g.pending) > 0 && time.Since(last) >= every {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+			last = time.Now()
+		}
+	}
+	if len(g.pending) == 0 {
+		mergeLeaves(g.root)
+	}
+	return nil
+}
+
+// round splits every pending node in parallel and queues their children in
+// order. Nodes whose split was cut short by ctx stay pending.
+func (g *grower) round(w *poolWorker) {
+	frontier := g.pending
+	depth := 0
+	for _, p := range frontier {
+		depth = max(depth, p.depth)
+	}
+	g.progress.depth.Store(int64(depth))
+
+	children := make([][]pendingNode, len(frontier))
+	done := make([]bool, len(frontier))
+	forEach(w, len(frontier), func(w *poolWorker, i int) {
+		children[i], done[i] = g.split(w, frontier[i])
+		if done[i] {
+			g.progress.finish(len(frontier[i].indices), children[i])
+		}
+	})
+
+	g.pending = nil
+	for i, p := range frontier {
+		if !done[i] {
+			g.pending = append(g.pending, p)
+			continue
+		}
+		g.pending = append(g.pending, children[i]...)
+	}
+}
+
+// split turns a pending node into a decision node and returns its children,
+// or leaves it a leaf when it should not be split. It reports false when ctx
+// stopped it before it could decide.
+func (g *grower) split(w *poolWorker, p pendingNode) ([]pendingNode, bool) {
+	if g.ctx.Err() != nil {
+		return nil, false
+	}
+
+	// Keep the node a leaf if:
 	// 1. Maximum depth reached
 	// 2. Not enough samples to split
 	// 3. All samples have the same target value
-	if depth >= MaxDepth || len(indices) <= MinSamplesLeaf || CalculateEntropy(indices, targetCol) == 0 {
-		prediction := MostCommonTarget(indices, targetCol)
-		return &models.TreeNode{
-			IsLeaf:     true,
-			Prediction: prediction,
-		}
+	indices := p.indices
+	if p.depth >= MaxDepth || len(indices) <= MinSamplesLeaf || CalculateEntropy(indices, g.targetCol) == 0 {
+		return nil, true
 	}
 
-	bestSplit := FindBestSplit(indices, features, targetCol)
+	bestSplit := findBestSplit(g.ctx, w, indices, g.features, g.targetCol)
+	if g.ctx.Err() != nil {
+		return nil, false
+	}
 
-	// If no good split is found, create a leaf node
+	// If no good split is found, keep the leaf
 	if bestSplit.GainRatio < MinInfoGain {
-		prediction := MostCommonTarget(indices, targetCol)
-		return &models.TreeNode{
-			IsLeaf:     true,
-			Prediction: prediction,
-		}
+		return nil, true
 	}
 
-	// Create a decision node
-	node := &models.TreeNode{
-		IsLeaf:     false,
-		Feature:    bestSplit.Feature,
-		SplitType:  bestSplit.SplitType,
-		SplitValue: bestSplit.SplitValue,
+	var children []pendingNode
+	child := func(branch string, indices []int) *models.TreeNode {
+		leaf := leafNode(indices, g.targetCol)
+		children = append(children, pendingNode{
+			node:    leaf,
+			path:    append(slices.Clip(p.path), branch),
+			depth:   p.depth + 1,
+			indices: indices,
+		})
+		return leaf
 	}
 
 	// Split based on feature type
+	node := p.node
 	if bestSplit.SplitType == "categorical" {
-		// For categorical features, create a child for each value
-		node.Children = make(map[string]*models.TreeNode)
-
-		var wg sync.WaitGroup
-		var mutex sync.Mutex
-
+		// For categorical features, create a child for each value, in sorted order
+		values := make([]string, 0, len(bestSplit.SplitIndices))
 		for value, subIndices := range bestSplit.SplitIndices {
-			if len(subIndices) == 0 {
-				continue
+			if len(subIndices) > 0 {
+				values = append(values, value)
 			}
-
-			wg.Add(1)
-			go func(value string, subIndices []int) {
-				defer wg.Done()
-				childNode := buildTreeNode(subIndices, features, targetCol, depth+1)
-
-				mutex.Lock()
-				node.Children[value] = childNode
-				mutex.Unlock()
-			}(value, subIndices)
 		}
+		// If no children would be created, keep the leaf
+		if len(values) == 0 {
+			return nil, true
+		}
+		sort.Strings(values)
 
-		wg.Wait()
-
-		// If no children were created, make it a leaf node
-		if len(node.Children) == 0 {
-			node.IsLeaf = true
-			node.Prediction = MostCommonTarget(indices, targetCol)
-			node.Children = nil
+		node.Children = make(map[string]*models.TreeNode, len(values))
+		for _, value := range values {
+			node.Children[value] = child(value, bestSplit.SplitIndices[value])
+		}
+		if _, ok := node.Children[OtherCategory]; ok {
+			node.OtherBranch = OtherCategory
+		} else {
+			node.OtherBranch = largestChildKey(node.Children)
 		}
 	} else {
+		// Subset splits send each group of values to one side
+		if bestSplit.SplitType == "subset" {
+			node.LeftCategories = bestSplit.LeftCategories
+			node.RightCategories = bestSplit.RightCategories
+			node.OtherBranch = "left"
+			if slices.Contains(node.RightCategories, OtherCategory) ||
+				(!slices.Contains(node.LeftCategories, OtherCategory) &&
+					len(bestSplit.RightIndices) > len(bestSplit.LeftIndices)) {
+				node.OtherBranch = "right"
+			}
+		}
+
 		// For numerical features, create left and right children
 		if len(bestSplit.LeftIndices) > 0 {
-			node.Left = buildTreeNode(bestSplit.LeftIndices, features, targetCol, depth+1)
+			node.Left = child("left", bestSplit.LeftIndices)
 		}
-
 		if len(bestSplit.RightIndices) > 0 {
-			node.Right = buildTreeNode(bestSplit.RightIndices, features, targetCol, depth+1)
+			node.Right = child("right", bestSplit.RightIndices)
 		}
+	}
+
+	node.IsLeaf = false
+	node.Feature = bestSplit.Feature
+	node.SplitType = bestSplit.SplitType
+	node.SplitValue = bestSplit.SplitValue
+	node.InfoGain = bestSplit.InfoGain
+	node.GainRatio = bestSplit.GainRatio
+	return children, true
+}
+
+// mergeLeaves turns binary nodes whose two children are leaves with the same
+// prediction into leaves, from the bottom of the tree up
+func mergeLeaves(node *models.TreeNode) {
+	if node == nil || node.IsLeaf {
+		return
+	}
+	for _, child := range node.Children {
+		mergeLeaves(child)
+	}
+	mergeLeaves(node.Left)
+	mergeLeaves(node.Right)
 
-		// If both children are the same leaf, merge them
-		if node.Left != nil && node.Right != nil &&
-			node.Left.IsLeaf && node.Right.IsLeaf &&
-			fmt.Sprintf("%v", node.Left.Prediction) == fmt.Sprintf("%v", node.Right.Prediction) {
-			node.IsLeaf = true
-			node.Prediction = node.Left.Prediction
-			node.Left = nil
-			node.Right = nil
+	if node.Left != nil && node.Right != nil &&
+		node.Left.IsLeaf && node.Right.IsLeaf &&
+		fmt.Sprintf("%v", node.Left.Prediction) == fmt.Sprintf("%v", node.Right.Prediction) {
+		node.IsLeaf = true
+		node.Prediction = node.Left.Prediction
+		node.Left = nil
+		node.Right = nil
+		node.LeftCategories = nil
+		node.RightCategories = nil
+		node.OtherBranch = ""
+		node.InfoGain = 0
+		node.GainRatio = 0
+	}
+}
+
+// state describes the pending nodes for a checkpoint
+func (g *grower) state(rows int, rngState []byte) *models.TrainingState {
+	state := &models.TrainingState{
+		RNGState:   rngState,
+		Rows:       rows,
+		NodesBuilt: int(g.progress.nodes.Load()),
+		Pending:    make([]models.PendingNode, len(g.pending)),
+	}
+	for i, p := range g.pending {
+		state.Pending[i] = models.PendingNode{Path: p.path, Depth: p.depth, Indices: p.indices}
+	}
+	return state
+}
+
+// resume replaces the tree and queue with those of a checkpoint, after
+// checking that it was made from the same data and settings
+func (g *grower) resume(file *models.ModelFile, model *models.ModelData, rows int, rngState []byte) error {
+	state := file.Training
+	switch {
+	case file.DatasetHash != models.DatasetHash:
+		return errors.New("checkpoint was made from a different training file")
+	case model.TargetColumn != g.targetCol:
+		return fmt.Errorf("checkpoint trains target %s, not %s", model.TargetColumn, g.targetCol)
+	case file.Hyperparameters == nil || *file.Hyperparameters != *models.Hyperparameters:
+		return errors.New("checkpoint was made with different training options")
+	case state.Rows != rows || !bytes.Equal(state.RNGState, rngState):
+		return errors.New("sampling does not match the checkpoint")
+	}
+
+	pending := make([]pendingNode, len(state.Pending))
+	pendingRows := 0
+	for i, p := range state.Pending {
+		node := descend(model.Tree, p.Path)
+		if node == nil || !node.IsLeaf {
+			return fmt.Errorf("pending node %v is not a leaf of the checkpoint tree", p.Path)
+		}
+		for _, idx := range p.Indices {
+			if idx < 0 || idx >= len(models.Records) {
+				return fmt.Errorf("pending node %v refers to row %d of %d", p.Path, idx, len(models.Records))
+			}
 		}
+		pending[i] = pendingNode{node: node, path: p.Path, depth: p.Depth, indices: p.Indices}
+		pendingRows += len(p.Indices)
+	}
+
+	g.root = model.Tree
+	g.pending = pending
+	g.progress.nodes.Store(int64(state.NodesBuilt))
+	g.progress.pendingRows.Store(int64(pendingRows))
+	return nil
+}
+
+// descend follows a path of branch names from node
+func descend(node *models.TreeNode, path []string) *models.TreeNode {
+	for _, branch := range path {
+		if node == nil {
+			return nil
+		}
+		node = namedBranch(node, branch)
 	}
 	return node
 }
+
+// forEach calls fn for 0 to n-1, spawning the calls on the pool when w is not
+// nil and running them in order otherwise
+func forEach(w *poolWorker, n int, fn func(w *poolWorker, i int)) {
+	if w == nil || n == 1 {
+		for i := 0; i < n; i++ {
+			fn(w, i)
+		}
+		return
+	}
+	group := newTaskGroup()
+	for i := 0; i < n; i++ {
+		w.spawn(group, func(runner *poolWorker) { fn(runner, i) })
+	}
+	w.wait(group)
+}
+
+// largestChildKey returns the key of the child with the most training rows,
+// preferring the smallest key on ties so the choice is deterministic
+func largestChildKey(children map[string]*models.TreeNode) string {
+	bestKey := ""
+	bestSamples := -1
+	for key, child := range children {
+		if child.Samples > bestSamples || (child.Samples == bestSamples && key < bestKey) {
+			bestKey = key
+			bestSamples = child.Samples
+		}
+	}
+	return bestKey
+}
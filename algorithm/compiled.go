@@ -0,0 +1,525 @@
+package algorithm
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"dt/models"
+	"dt/utils"
+)
+
+// Node kinds of a compiled tree
+const (
+	flatLeaf    = iota
+	flatNumeric // Numerical split on a float threshold
+	flatCodes   // Categorical or subset split through a code table
+	flatGeneric // Split the compiled form cannot evaluate, such as a date threshold
+)
+
+// Value states of a numeric column
+const (
+	valuePresent = iota
+	valueMissing
+	valueIrregular // Not a number, or an int too large for a float64
+)
+
+// Codes of a categorical column besides the category codes
+const (
+	codeMissing = -1
+	codeUnseen  = -2
+)
+
+// slowPath marks an unseen target that must be resolved by predictRecord
+const slowPath = -1
+
+// CompiledTree is a flat, array-based form of a tree built for fast
+// inference. Nodes refer to children by index and to features by column
+// number; categorical splits look up integer codes in per-node tables.
+//
+// A compiled tree predicts exactly like predictRecord. Whenever a record
+// needs handling the flat form does not cover, such as a non-numeric value
+// in a numerical split or the blend unseen policy, evaluation continues from
+// the original node with predictRecord.
+type CompiledTree struct {
+	nodes    []flatNode
+	tables   []int32            // Code tables of all categorical nodes, back to back
+	values   []interface{}      // Prediction of every node
+	sources  []*models.TreeNode // Original node of every node
+	features []string           // Column number to feature name
+	codes    []map[string]int   // Per column, category to code; nil for numeric columns
+	numeric  []bool             // Columns used by numerical splits
+}
+
+// flatNode is kept small so a walk touches few cache lines; predictions and
+// original nodes live in parallel slices of the tree
+type flatNode struct {
+	kind      uint8
+	feature   int32
+	threshold float64
+	left      int32 // Numerical split: child for values below the threshold
+	right     int32 // Numerical split: child for other values
+	missing   int32 // Child for missing values
+	unseen    int32 // Child for unseen categories, or slowPath
+	table     int32 // Offset of the code table mapping category codes to children, -1 when unseen
+}
+
+// Columns holds records in columnar form for a compiled tree. Every column
+// of a kind is stored back to back in one slice, column f starting at f*rows.
+type Columns struct {
+	rows   int
+	values []float64 // Numeric columns, NaN unless the value is present
+	states []uint8   // State of every numeric value, read only for NaN
+	codes  []int32   // Categorical columns
+}
+
+// Compile flattens a tree for the given unseen category policy
+func Compile(tree *models.TreeNode, policy string) *CompiledTree {
+	c := &CompiledTree{}
+	columns := make(map[string]int32)
+	column := func(feature string) int32 {
+		if i, ok := columns[feature]; ok {
+			return i
+		}
+		i := int32(len(c.features))
+		columns[feature] = i
+		c.features = append(c.features, feature)
+		c.codes = append(c.codes, nil)
+		c.numeric = append(c.numeric, false)
+		return i
+	}
+	code := func(feature int32, category string) int {
+		if c.codes[feature] == nil {
+			c.codes[feature] = make(map[string]int)
+		}
+		if i, ok := c.codes[feature][category]; ok {
+			return i
+		}
+		i := len(c.codes[feature])
+		c.codes[feature][category] = i
+		return i
+	}
+
+	// First pass: number the columns and categories
+	var visit func(node *models.TreeNode)
+	visit = func(node *models.TreeNode) {
+		if node == nil || node.IsLeaf {
+			return
+		}
+		feature := column(node.Feature)
+		switch node.SplitType {
+		case "categorical":
+			for _, key := range sortedKeys(node.Children) {
+				code(feature, key)
+				visit(node.Children[key])
+			}
+		case "subset":
+			for _, category := range node.LeftCategories {
+				code(feature, category)
+			}
+			for _, category := range node.RightCategories {
+				code(feature, category)
+			}
+		default:
+			if _, ok := numericThreshold(node.SplitValue); ok {
+				c.numeric[feature] = true
+			}
+		}
+		visit(node.Left)
+		visit(node.Right)
+	}
+	if tree != nil {
+		visit(tree)
+	}
+
+	// Second pass: lay out the nodes
+	if tree == nil {
+		tree = &models.TreeNode{IsLeaf: true}
+	}
+	c.add(tree, columns, policy)
+	return c
+}
+
+// add appends a node and its subtree and returns the node's index
+func (c *CompiledTree) add(node *models.TreeNode, columns map[string]int32, policy string) int32 {
+	index := c.leaf(node)
+	if node.IsLeaf {
+		return index
+	}
+
+	flat := flatNode{feature: columns[node.Feature]}
+	missing := MissingValueChild(node)
+	targets := make(map[*models.TreeNode]int32)
+	// target compiles a branch once; a missing child predicts the node's value
+	target := func(next *models.TreeNode) int32 {
+		if next == nil {
+			return c.leaf(node)
+		}
+		if i, ok := targets[next]; ok {
+			return i
+		}
+		i := c.add(next, columns, policy)
+		targets[next] = i
+		return i
+	}
+
+	switch node.SplitType {
+	case "categorical", "subset":
+		flat.kind = flatCodes
+		table := make([]int32, len(c.codes[flat.feature]))
+		for i := range table {
+			table[i] = -1
+		}
+		if node.SplitType == "categorical" {
+			for _, key := range sortedKeys(node.Children) {
+				table[c.codes[flat.feature][key]] = target(node.Children[key])
+			}
+		} else {
+			// Right first so a category listed on both sides goes left, as in nextNode
+			if node.Right != nil {
+				for _, category := range node.RightCategories {
+					table[c.codes[flat.feature][category]] = target(node.Right)
+				}
+			}
+			if node.Left != nil {
+				for _, category := range node.LeftCategories {
+					table[c.codes[flat.feature][category]] = target(node.Left)
+				}
+			}
+		}
+		flat.table = int32(len(c.tables))
+		c.tables = append(c.tables, table...)
+		flat.missing = target(missing)
+		flat.unseen = c.unseenTarget(node, policy, target)
+	default:
+		threshold, ok := numericThreshold(node.SplitValue)
+		if !ok {
+			flat.kind = flatGeneric
+			break
+		}
+		flat.kind = flatNumeric
+		flat.threshold = threshold
+		flat.left = target(node.Left)
+		flat.right = target(node.Right)
+		flat.missing = target(missing)
+	}
+	c.nodes[index] = flat
+	return index
+}
+
+// leaf appends a leaf predicting the value of node
+func (c *CompiledTree) leaf(node *models.TreeNode) int32 {
+	c.nodes = append(c.nodes, flatNode{kind: flatLeaf})
+	c.values = append(c.values, node.Prediction)
+	c.sources = append(c.sources, node)
+	return int32(len(c.nodes) - 1)
+}
+
+// unseenTarget resolves where an unseen category goes under the policy,
+// mirroring predictRecord
+func (c *CompiledTree) unseenTarget(node *models.TreeNode, policy string, target func(*models.TreeNode) int32) int32 {
+	switch policy {
+	case UnseenMissing:
+	case UnseenParent:
+		if node.Prediction != nil {
+			return c.leaf(node)
+		}
+	case UnseenOther:
+		if other := otherBranch(node); other != nil {
+			return target(other)
+		}
+	default:
+		return slowPath
+	}
+	return target(MissingValueChild(node))
+}
+
+// Encode converts records to columns, reading each feature the tree uses once
+func (c *CompiledTree) Encode(records []map[string]interface{}) *Columns {
+	size := len(c.features) * len(records)
+	cols := &Columns{rows: len(records)}
+	for f, feature := range c.features {
+		offset := f * len(records)
+		if c.numeric[f] {
+			if cols.values == nil {
+				cols.values, cols.states = make([]float64, size), make([]uint8, size)
+			}
+			for i, record := range records {
+				value, state := numericValue(record[feature])
+				if state != valuePresent {
+					value = math.NaN()
+				}
+				cols.values[offset+i], cols.states[offset+i] = value, state
+			}
+		}
+		if table := c.codes[f]; table != nil {
+			if cols.codes == nil {
+				cols.codes = make([]int32, size)
+			}
+			for i, record := range records {
+				cols.codes[offset+i] = categoryCode(table, record[feature])
+			}
+		}
+	}
+	return cols
+}
+
+// Predict makes a prediction for every record. Unseen categorical values
+// are counted per feature in unseen when it is not nil.
+func (c *CompiledTree) Predict(records []map[string]interface{}, unseen map[string]int) ([]interface{}, error) {
+	predictions := make([]interface{}, len(records))
+	record := func(row int) map[string]interface{} { return records[row] }
+	if row, err := c.predictRows(record, c.Encode(records), predictions, unseen); err != nil {
+		return nil, fmt.Errorf("record %d: %w", row+1, err)
+	}
+	return predictions, nil
+}
+
+// Score predicts one record and returns the class probabilities of the node
+// it ends in, as Explain does without the path
+func (c *CompiledTree) Score(record map[string]interface{}) (interface{}, map[string]float64, error) {
+	end := c.walk(c.Encode([]map[string]interface{}{record}), 0, nil)
+	node := c.sources[end]
+	if c.nodes[end].kind != flatLeaf {
+		var blended map[string]float64
+		var err error
+		if node, blended, err = route(record, node, nil, nil); err != nil {
+			return nil, nil, err
+		}
+		if blended != nil {
+			return labelForKey(node, mostLikely(blended)), blended, nil
+		}
+	}
+	return node.Prediction, nodeDistribution(node), nil
+}
+
+// predictRows evaluates every row with an iterative loop. Rows the flat form
+// cannot finish are finished on the original tree with the record returned by
+// record. On error it returns the failing row.
+func (c *CompiledTree) predictRows(record func(row int) map[string]interface{}, cols *Columns, out []interface{}, unseen map[string]int) (int, error) {
+	for row := 0; row < cols.rows; row++ {
+		end := c.walk(cols, row, unseen)
+		if c.nodes[end].kind == flatLeaf {
+			out[row] = c.values[end]
+			continue
+		}
+
+		// Finish the record from the node the walk stopped at, the slow way
+		prediction, err := predictRecord(record(row), c.sources[end], unseen)
+		if err != nil {
+			return row, err
+		}
+		out[row] = prediction
+	}
+	return 0, nil
+}
+
+// walk follows a row from the root and returns the leaf it reaches, or the
+// node whose split the flat form cannot evaluate for this row
+func (c *CompiledTree) walk(cols *Columns, row int, unseen map[string]int) int32 {
+	nodes, tables := c.nodes, c.tables
+	values, states, codes, rows := cols.values, cols.states, cols.codes, cols.rows
+	i := int32(0)
+	for {
+		current := i
+		node := &nodes[current]
+		switch node.kind {
+		case flatNumeric:
+			cell := int(node.feature)*rows + row
+			value := values[cell]
+			switch {
+			case value < node.threshold:
+				i = node.left
+			case value == value:
+				i = node.right
+			case states[cell] == valuePresent:
+				// A NaN in the record is never below the threshold, as in predictRecord
+				i = node.right
+			case states[cell] == valueMissing:
+				i = node.missing
+			default:
+				i = slowPath
+			}
+		case flatCodes:
+			code := codes[int(node.feature)*rows+row]
+			if code >= 0 {
+				if i = tables[node.table+code]; i >= 0 {
+					continue
+				}
+			}
+			switch {
+			case code == codeMissing:
+				i = node.missing
+			case node.unseen != slowPath && unseen != nil:
+				unseen[c.sources[current].Feature]++
+				i = node.unseen
+			default:
+				i = node.unseen
+			}
+		default:
+			// A leaf, or a split only the original tree can evaluate
+			return current
+		}
+		if i == slowPath {
+			return current
+		}
+	}
+}
+
+// rowEncoder encodes the rows of a CSV file for a compiled tree without
+// making a record of every row. Cells are read like utils.RowRecord reads
+// them, and grouped like ApplyCategoryGroups groups records.
+type rowEncoder struct {
+	tree  *CompiledTree
+	cells [][]int           // Per feature of the tree, the columns holding it, last one first
+	keep  []map[string]bool // Per feature, the categories its rare category group keeps; nil when ungrouped
+}
+
+// newRowEncoder prepares the encoding of rows laid out as columns
+func (c *CompiledTree) newRowEncoder(columns []string, groups map[string][]string) *rowEncoder {
+	e := &rowEncoder{tree: c, cells: make([][]int, len(c.features)), keep: make([]map[string]bool, len(c.features))}
+	for f, feature := range c.features {
+		// A column named twice holds the value of its last cell in the row
+		for i := len(columns) - 1; i >= 0; i-- {
+			if columns[i] == feature {
+				e.cells[f] = append(e.cells[f], i)
+			}
+		}
+		if kept, ok := groups[feature]; ok {
+			e.keep[f] = make(map[string]bool, len(kept))
+			for _, category := range kept {
+				e.keep[f][category] = true
+			}
+		}
+	}
+	return e
+}
+
+// cell returns the text of feature f in a row, false when the row has none
+func (e *rowEncoder) cell(f int, row []string) (string, bool) {
+	for _, i := range e.cells[f] {
+		if i < len(row) {
+			return row[i], true
+		}
+	}
+	return "", false
+}
+
+// value parses the text of feature f and applies its rare category group
+func (e *rowEncoder) value(f int, text string) interface{} {
+	value := utils.ParseValue(text)
+	if keep := e.keep[f]; keep != nil && value != nil && !keep[models.GetValueKey(value)] {
+		return OtherCategory
+	}
+	return value
+}
+
+// encode converts rows to columns. Categorical cells are looked up once per
+// distinct text.
+func (e *rowEncoder) encode(rows [][]string) *Columns {
+	c := e.tree
+	size := len(c.features) * len(rows)
+	cols := &Columns{rows: len(rows)}
+	for f := range c.features {
+		offset := f * len(rows)
+		if c.numeric[f] {
+			if cols.values == nil {
+				cols.values, cols.states = make([]float64, size), make([]uint8, size)
+			}
+			for i, row := range rows {
+				var value interface{}
+				if text, ok := e.cell(f, row); ok {
+					value = e.value(f, text)
+				}
+				number, state := numericValue(value)
+				if state != valuePresent {
+					number = math.NaN()
+				}
+				cols.values[offset+i], cols.states[offset+i] = number, state
+			}
+		}
+		if table := c.codes[f]; table != nil {
+			if cols.codes == nil {
+				cols.codes = make([]int32, size)
+			}
+			known := make(map[string]int32)
+			for i, row := range rows {
+				text, ok := e.cell(f, row)
+				if !ok {
+					cols.codes[offset+i] = codeMissing
+					continue
+				}
+				code, found := known[text]
+				if !found {
+					code = categoryCode(table, e.value(f, text))
+					known[text] = code
+				}
+				cols.codes[offset+i] = code
+			}
+		}
+	}
+	return cols
+}
+
+// maxExactInt is the largest integer every float64 up to it can hold exactly
+const maxExactInt = 1 << 53
+
+// numericValue converts a record value for a numerical split
+func numericValue(value interface{}) (float64, uint8) {
+	switch v := value.(type) {
+	case nil:
+		return 0, valueMissing
+	case float64:
+		return v, valuePresent
+	case int:
+		if v > maxExactInt || v < -maxExactInt {
+			return 0, valueIrregular
+		}
+		return float64(v), valuePresent
+	}
+	return 0, valueIrregular
+}
+
+// numericThreshold converts a split value the flat form can compare against
+func numericThreshold(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, !math.IsNaN(v)
+	case int:
+		if v > maxExactInt || v < -maxExactInt {
+			return 0, false
+		}
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// categoryCode looks up the code of a value, formatting it like GetValueKey
+func categoryCode(table map[string]int, value interface{}) int32 {
+	var key string
+	switch v := value.(type) {
+	case nil:
+		return codeMissing
+	case string:
+		key = v
+	case int:
+		key = strconv.Itoa(v)
+	default:
+		key = models.GetValueKey(value)
+	}
+	if code, ok := table[key]; ok {
+		return int32(code)
+	}
+	return codeUnseen
+}
+
+// sortedKeys returns the keys of a node's children in order
+func sortedKeys(children map[string]*models.TreeNode) []string {
+	keys := make([]string, 0, len(children))
+	for key := range children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
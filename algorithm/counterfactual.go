@@ -0,0 +1,310 @@
+package algorithm
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"dt/models"
+)
+
+// CounterfactualOptions configures a counterfactual search
+type CounterfactualOptions struct {
+	Class     string   // Class the changed record must be predicted as
+	Immutable []string // Features that cannot be changed
+	// Costs is the cost of changing each feature, 1 when not set: per unit of
+	// change for numeric features, per change for categorical ones
+	Costs map[string]float64
+	Limit int // Most counterfactuals returned per record, all of them when zero
+}
+
+// Counterfactual is a set of changes to a record that makes the tree predict
+// the class searched for
+type Counterfactual struct {
+	Changes []Change `json:"changes"` // Sorted by feature
+	Cost    float64  `json:"cost"`    // Total cost of the changes
+}
+
+// Change is a new value for one feature of a record
+type Change struct {
+	Feature string      `json:"feature"`
+	From    interface{} `json:"from"`
+	To      interface{} `json:"to"`
+	Cost    float64     `json:"cost"`
+}
+
+// CounterfactualSearch finds the cheapest changes that give records a class.
+// Every leaf predicting the class is a region of the feature space, bounded
+// by the splits on the path to it; moving a record into a region means
+// changing each feature whose value falls outside the region to the nearest
+// value inside it. It is safe for concurrent use.
+type CounterfactualSearch struct {
+	tree      *models.TreeNode
+	options   CounterfactualOptions
+	immutable map[string]bool
+	regions   []leafRegion
+}
+
+// leafRegion is the part of the feature space leading to a leaf
+type leafRegion struct {
+	constraints []featureConstraint // One per feature split on, in path order
+}
+
+// featureConstraint bounds the values of a feature in a region: an interval
+// [lo, hi) for numeric features, a set of categories for categorical ones
+type featureConstraint struct {
+	feature    string
+	numeric    bool
+	lo, hi     float64
+	categories []string       // Allowed categories, sorted; nil when numeric
+	steps      []regionBranch // Branches on the path taken on the feature
+}
+
+// regionBranch is the child a region's path takes at a node
+type regionBranch struct {
+	node, child *models.TreeNode
+}
+
+// NewCounterfactualSearch collects the regions of model's tree predicting
+// options.Class
+func NewCounterfactualSearch(model *models.ModelData, options CounterfactualOptions) (*CounterfactualSearch, error) {
+	features := make(map[string]bool)
+	for _, column := range model.Columns {
+		if column != model.TargetColumn {
+			features[column] = true
+		}
+	}
+	for feature := range treeFeatures(model.Tree) {
+		features[feature] = true
+	}
+	s := &CounterfactualSearch{tree: model.Tree, options: options, immutable: make(map[string]bool)}
+	for _, feature := range options.Immutable {
+		if !features[feature] {
+			return nil, fmt.Errorf("unknown immutable feature %q", feature)
+		}
+		s.immutable[feature] = true
+	}
+	for feature, cost := range options.Costs {
+		if !features[feature] {
+			return nil, fmt.Errorf("unknown feature %q in costs", feature)
+		}
+		if cost < 0 || math.IsNaN(cost) {
+			return nil, fmt.Errorf("cost of %s must not be negative, got %v", feature, cost)
+		}
+	}
+
+	var visit func(node *models.TreeNode, constraints []featureConstraint)
+	visit = func(node *models.TreeNode, constraints []featureConstraint) {
+		if node == nil {
+			return
+		}
+		if node.IsLeaf {
+			if models.GetValueKey(node.Prediction) == options.Class {
+				s.regions = append(s.regions, leafRegion{constraints: constraints})
+			}
+			return
+		}
+		for _, child := range treeChildren(node) {
+			if narrowed, ok := narrow(constraints, node, child); ok {
+				visit(child, narrowed)
+			}
+		}
+	}
+	visit(model.Tree, nil)
+	if len(s.regions) == 0 {
+		return nil, fmt.Errorf("no leaf of the tree predicts class %q", options.Class)
+	}
+	return s, nil
+}
+
+// narrow adds the test sending a record from node to child to constraints.
+// It returns false when no value passes every test.
+func narrow(constraints []featureConstraint, node, child *models.TreeNode) ([]featureConstraint, bool) {
+	narrowed := slices.Clone(constraints)
+	i := slices.IndexFunc(narrowed, func(c featureConstraint) bool { return c.feature == node.Feature })
+	if i < 0 {
+		narrowed = append(narrowed, featureConstraint{
+			feature: node.Feature,
+			numeric: node.SplitType != "categorical" && node.SplitType != "subset",
+			lo:      math.Inf(-1),
+			hi:      math.Inf(1),
+		})
+		i = len(narrowed) - 1
+	}
+	c := &narrowed[i]
+	c.steps = append(slices.Clip(c.steps), regionBranch{node: node, child: child})
+
+	if c.numeric {
+		threshold, ok := numericThreshold(node.SplitValue)
+		if !ok {
+			return nil, false
+		}
+		if child == node.Left {
+			c.hi = math.Min(c.hi, threshold)
+		} else {
+			c.lo = math.Max(c.lo, threshold)
+		}
+		return narrowed, c.lo < c.hi
+	}
+
+	var allowed []string
+	switch {
+	case node.SplitType == "subset" && child == node.Left:
+		allowed = node.LeftCategories
+	case node.SplitType == "subset":
+		allowed = node.RightCategories
+	default:
+		for key, branch := range node.Children {
+			if branch == child {
+				allowed = []string{key}
+			}
+		}
+	}
+	if c.categories != nil {
+		allowed = slices.DeleteFunc(slices.Clone(allowed), func(v string) bool { return !slices.Contains(c.categories, v) })
+	}
+	c.categories = slices.Sorted(slices.Values(allowed))
+	return narrowed, len(c.categories) > 0
+}
+
+// Search returns the cheapest counterfactuals of record, cheapest first. A
+// record the tree already predicts as the class gets one without changes.
+// Every counterfactual is checked by predicting the changed record, so
+// missing values and unseen categories are handled as Predict handles them.
+func (s *CounterfactualSearch) Search(record map[string]interface{}) []Counterfactual {
+	seen := make(map[string]bool)
+	var found []Counterfactual
+	for _, region := range s.regions {
+		counterfactual, ok := s.move(record, region)
+		if !ok {
+			continue
+		}
+		key := changesKey(counterfactual.Changes)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		changed := maps.Clone(record)
+		for _, change := range counterfactual.Changes {
+			changed[change.Feature] = change.To
+		}
+		prediction, err := predictRecord(changed, s.tree, nil)
+		if err != nil || models.GetValueKey(prediction) != s.options.Class {
+			continue
+		}
+		found = append(found, counterfactual)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.Cost != b.Cost {
+			return a.Cost < b.Cost
+		}
+		if len(a.Changes) != len(b.Changes) {
+			return len(a.Changes) < len(b.Changes)
+		}
+		return changesKey(a.Changes) < changesKey(b.Changes)
+	})
+	if s.options.Limit > 0 && len(found) > s.options.Limit {
+		found = found[:s.options.Limit]
+	}
+	return found
+}
+
+// move returns the cheapest changes bringing record into region, or false
+// when an immutable feature or a value that cannot be chosen stands in the way
+func (s *CounterfactualSearch) move(record map[string]interface{}, region leafRegion) (Counterfactual, bool) {
+	var counterfactual Counterfactual
+	for _, c := range region.constraints {
+		if c.satisfied(record) {
+			continue
+		}
+		if s.immutable[c.feature] {
+			return Counterfactual{}, false
+		}
+		weight, ok := s.options.Costs[c.feature]
+		if !ok {
+			weight = 1
+		}
+
+		change := Change{Feature: c.feature, From: record[c.feature]}
+		if c.numeric {
+			value, state := numericValue(record[c.feature])
+			switch {
+			case state != valuePresent:
+				// There is no distance from a missing value, setting one costs one unit
+				if math.IsInf(c.lo, -1) {
+					change.To = roundBelow(c.hi, c.lo)
+				} else {
+					change.To = roundAbove(c.lo, c.hi)
+				}
+				change.Cost = weight
+			case value < c.lo:
+				to := roundAbove(c.lo, c.hi)
+				change.To, change.Cost = to, weight*math.Abs(to-value)
+			default:
+				to := roundBelow(c.hi, c.lo)
+				change.To, change.Cost = to, weight*math.Abs(value-to)
+			}
+		} else {
+			// Grouped rare categories are not a value a record can be given
+			i := slices.IndexFunc(c.categories, func(v string) bool { return v != OtherCategory && v != models.GetValueKey(nil) })
+			if i < 0 {
+				return Counterfactual{}, false
+			}
+			change.To, change.Cost = c.categories[i], weight
+		}
+		counterfactual.Changes = append(counterfactual.Changes, change)
+		counterfactual.Cost += change.Cost
+	}
+	sort.Slice(counterfactual.Changes, func(i, j int) bool {
+		return counterfactual.Changes[i].Feature < counterfactual.Changes[j].Feature
+	})
+	return counterfactual, true
+}
+
+// satisfied reports whether record takes every branch of the constraint's
+// path, counting missing values that follow it
+func (c featureConstraint) satisfied(record map[string]interface{}) bool {
+	for _, step := range c.steps {
+		if child, isUnseen := nextNode(record, step.node); isUnseen || child != step.child {
+			return false
+		}
+	}
+	return true
+}
+
+// roundAbove returns the value in [lo, hi) with the fewest decimals, from
+// the smallest ones
+func roundAbove(lo, hi float64) float64 {
+	for scale := 1.0; scale <= 1e6; scale *= 10 {
+		if v := math.Ceil(lo*scale) / scale; v < hi {
+			return v
+		}
+	}
+	return lo
+}
+
+// roundBelow returns the value in [lo, hi) with the fewest decimals, from
+// the largest ones
+func roundBelow(hi, lo float64) float64 {
+	for scale := 1.0; scale <= 1e6; scale *= 10 {
+		if v := (math.Ceil(hi*scale) - 1) / scale; v >= lo {
+			return v
+		}
+	}
+	return math.Nextafter(hi, math.Inf(-1))
+}
+
+// changesKey identifies a set of changes sorted by feature
+func changesKey(changes []Change) string {
+	parts := make([]string, len(changes))
+	for i, change := range changes {
+		parts[i] = change.Feature + "=" + models.GetValueKey(change.To)
+	}
+	return strings.Join(parts, ",")
+}
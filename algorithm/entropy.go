@@ -1,10 +1,12 @@
 package algorithm
 
 import (
+	"context"
 	"math"
 	"sort"
 
 	"dt/models"
+	"dt/utils"
 )
 
 // Calculate entropy of a set of indices
@@ -13,22 +15,7 @@ func CalculateEntropy(indices []int, targetCol string) float64 {
 		return 0
 	}
 
-	// Count occurrences of each target value
-	valueCount := make(map[string]int)
-	for _, idx := range indices {
-		value := models.Records[idx][targetCol]
-		key := models.GetValueKey(value)
-		valueCount[key]++
-	}
-
-	// Calculate entropy
-	entropy := 0.0
-	for _, count := range valueCount {
-		prob := float64(count) / float64(len(indices))
-		entropy -= prob * math.Log2(prob)
-	}
-
-	return entropy
+	return entropyFromCounts(ClassDistribution(indices, targetCol), len(indices))
 }
 
 // Calculate the most common target value for a set of indices
@@ -48,11 +35,11 @@ func MostCommonTarget(indices []int, targetCol string) interface{} {
 		valueMap[key] = value
 	}
 
-	// Find the most common value
+	// Find the most common value, the smallest key on ties
 	maxCount := 0
 	var maxKey string
 	for key, count := range valueCount {
-		if count > maxCount {
+		if count > maxCount || (count == maxCount && key < maxKey) {
 			maxCount = count
 			maxKey = key
 		}
@@ -61,7 +48,27 @@ func MostCommonTarget(indices []int, targetCol string) interface{} {
 	return valueMap[maxKey]
 }
 
+// Count the occurrences of each target value for a set of indices
+func ClassDistribution(indices []int, targetCol string) map[string]int {
+	counts := make(map[string]int)
+	for _, idx := range indices {
+		counts[models.GetValueKey(models.Records[idx][targetCol])]++
+	}
+	return counts
+}
+
+// parallelSplitMin is the number of rows from which the features of a node
+// are evaluated in parallel
+const parallelSplitMin = 2000
+
 func FindBestSplit(indices []int, features []string, targetCol string) models.SplitCriteria {
+	return findBestSplit(context.Background(), nil, indices, features, targetCol)
+}
+
+// findBestSplit evaluates the features of a large node in parallel when w is
+// not nil. Ties go to the earliest feature either way. The search stops
+// early once ctx is done.
+func findBestSplit(ctx context.Context, w *poolWorker, indices []int, features []string, targetCol string) models.SplitCriteria {
 	baseEntropy := CalculateEntropy(indices, targetCol)
 	bestSplit := models.SplitCriteria{
 		InfoGain:  -1,
@@ -73,28 +80,35 @@ func FindBestSplit(indices []int, features []string, targetCol string) models.Sp
 		return bestSplit
 	}
 
-	for _, feature := range features {
-		if feature == targetCol {
-			continue
-		}
+	if len(indices) < parallelSplitMin {
+		w = nil
+	}
+	splits := make([]models.SplitCriteria, len(features))
+	forEach(w, len(features), func(_ *poolWorker, i int) {
+		splits[i] = bestFeatureSplit(ctx, indices, features[i], targetCol, baseEntropy)
+	})
 
-		featureType := models.FeatureTypes[feature]
-		if featureType == "categorical" {
-			split := findCategoricalSplit(indices, feature, targetCol, baseEntropy)
-			if split.GainRatio > bestSplit.GainRatio {
-				bestSplit = split
-			}
-		} else {
-			split := findNumericalSplit(indices, feature, targetCol, baseEntropy)
-			if split.GainRatio > bestSplit.GainRatio {
-				bestSplit = split
-			}
+	for i, feature := range features {
+		if feature != targetCol && splits[i].GainRatio > bestSplit.GainRatio {
+			bestSplit = splits[i]
 		}
 	}
-
 	return bestSplit
 }
 
+// bestFeatureSplit finds the best split on one feature
+func bestFeatureSplit(ctx context.Context, indices []int, feature string, targetCol string, baseEntropy float64) models.SplitCriteria {
+	featureType := models.FeatureTypes[feature]
+	if feature == targetCol {
+		return models.SplitCriteria{InfoGain: -1, GainRatio: -1}
+	} else if featureType == "categorical" && *utils.CatSplitPtr == "binary" {
+		return findSubsetSplit(indices, feature, targetCol, baseEntropy)
+	} else if featureType == "categorical" {
+		return findCategoricalSplit(indices, feature, targetCol, baseEntropy)
+	}
+	return findNumericalSplit(ctx, indices, feature, targetCol, baseEntropy)
+}
+
 // Find the best split for a categorical feature
 func findCategoricalSplit(indices []int, feature string, targetCol string, baseEntropy float64) models.SplitCriteria {
 	// Group indices by feature value
@@ -105,11 +119,12 @@ func findCategoricalSplit(indices []int, feature string, targetCol string, baseE
 		valueIndices[key] = append(valueIndices[key], idx)
 	}
 
-	// Calculate weighted entropy
+	// Calculate weighted entropy, summing in a fixed order
 	weightedEntropy := 0.0
 	splitInfo := 0.0
 
-	for _, subIndices := range valueIndices {
+	for _, key := range sortedMapKeys(valueIndices) {
+		subIndices := valueIndices[key]
 		prob := float64(len(subIndices)) / float64(len(indices))
 		weightedEntropy += prob * CalculateEntropy(subIndices, targetCol)
 		splitInfo -= prob * math.Log2(prob)
@@ -131,8 +146,149 @@ func findCategoricalSplit(indices []int, feature string, targetCol string, baseE
 	}
 }
 
+// Find the best split of a categorical feature into two groups of values.
+// Categories are ordered by the proportion of one class and only the cut
+// points along that ordering are tried, keeping the one with the best gain
+// ratio. This is a heuristic: for a binary target the ordering holds the
+// partition with the best information gain (Breiman et al.), but gain ratio
+// may prefer another cut, and for multiclass targets every class is tried
+// as the ordering key.
+func findSubsetSplit(indices []int, feature string, targetCol string, baseEntropy float64) models.SplitCriteria {
+	bestSplit := models.SplitCriteria{
+		Feature:   feature,
+		SplitType: "subset",
+		InfoGain:  -1,
+		GainRatio: -1,
+	}
+
+	// Count target values for each category
+	categoryCounts := make(map[string]map[string]int)
+	categorySizes := make(map[string]int)
+	totalCounts := make(map[string]int)
+	for _, idx := range indices {
+		category := models.GetValueKey(models.Records[idx][feature])
+		class := models.GetValueKey(models.Records[idx][targetCol])
+		if categoryCounts[category] == nil {
+			categoryCounts[category] = make(map[string]int)
+		}
+		categoryCounts[category][class]++
+		categorySizes[category]++
+		totalCounts[class]++
+	}
+
+	if len(categoryCounts) < 2 {
+		return bestSplit
+	}
+
+	categories := make([]string, 0, len(categoryCounts))
+	for category := range categoryCounts {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	classes := make([]string, 0, len(totalCounts))
+	for class := range totalCounts {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	// With two classes one ordering is enough
+	orderings := classes
+	if len(classes) == 2 {
+		orderings = classes[:1]
+	}
+
+	total := float64(len(indices))
+	var bestLeft []string
+
+	for _, key := range orderings {
+		ordered := append([]string(nil), categories...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			pi := float64(categoryCounts[ordered[i]][key]) / float64(categorySizes[ordered[i]])
+			pj := float64(categoryCounts[ordered[j]][key]) / float64(categorySizes[ordered[j]])
+			return pi < pj
+		})
+
+		leftCounts := make(map[string]int)
+		leftSize := 0
+		for cut := 0; cut < len(ordered)-1; cut++ {
+			for class, count := range categoryCounts[ordered[cut]] {
+				leftCounts[class] += count
+			}
+			leftSize += categorySizes[ordered[cut]]
+
+			rightCounts := make(map[string]int)
+			for class, count := range totalCounts {
+				rightCounts[class] = count - leftCounts[class]
+			}
+			rightSize := len(indices) - leftSize
+
+			leftProb := float64(leftSize) / total
+			rightProb := float64(rightSize) / total
+			weightedEntropy := leftProb*entropyFromCounts(leftCounts, leftSize) +
+				rightProb*entropyFromCounts(rightCounts, rightSize)
+			infoGain := baseEntropy - weightedEntropy
+
+			splitInfo := -leftProb*math.Log2(leftProb) - rightProb*math.Log2(rightProb)
+			gainRatio := 0.0
+			if splitInfo > 0 {
+				gainRatio = infoGain / splitInfo
+			}
+
+			if gainRatio > bestSplit.GainRatio {
+				bestSplit.InfoGain = infoGain
+				bestSplit.GainRatio = gainRatio
+				bestLeft = append([]string(nil), ordered[:cut+1]...)
+			}
+		}
+	}
+
+	if bestLeft == nil {
+		return bestSplit
+	}
+
+	// Assign the indices and record both sides of the partition
+	inLeft := make(map[string]bool)
+	for _, category := range bestLeft {
+		inLeft[category] = true
+	}
+	for _, idx := range indices {
+		if inLeft[models.GetValueKey(models.Records[idx][feature])] {
+			bestSplit.LeftIndices = append(bestSplit.LeftIndices, idx)
+		} else {
+			bestSplit.RightIndices = append(bestSplit.RightIndices, idx)
+		}
+	}
+	for _, category := range categories {
+		if inLeft[category] {
+			bestSplit.LeftCategories = append(bestSplit.LeftCategories, category)
+		} else {
+			bestSplit.RightCategories = append(bestSplit.RightCategories, category)
+		}
+	}
+
+	return bestSplit
+}
+
+// entropyFromCounts calculates entropy from target value counts. Classes are
+// summed in sorted order so the result does not depend on map order.
+func entropyFromCounts(counts map[string]int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	entropy := 0.0
+	for _, class := range sortedMapKeys(counts) {
+		count := counts[class]
+		if count == 0 {
+			continue
+		}
+		prob := float64(count) / float64(total)
+		entropy -= prob * math.Log2(prob)
+	}
+	return entropy
+}
+
 // Find the best split for a numerical feature
-func findNumericalSplit(indices []int, feature string, targetCol string, baseEntropy float64) models.SplitCriteria {
+func findNumericalSplit(ctx context.Context, indices []int, feature string, targetCol string, baseEntropy float64) models.SplitCriteria {
 	// Collect unique values
 	values := make([]interface{}, 0)
 	valuesMap := make(map[string]bool)
@@ -171,7 +327,7 @@ func findNumericalSplit(indices []int, feature string, targetCol string, baseEnt
 		GainRatio: -1,
 	}
 
-	for i := 0; i < len(values)-1; i++ {
+	for i := 0; i < len(values)-1 && ctx.Err() == nil; i++ {
 		a := values[i]
 		b := values[i+1]
 
@@ -247,3 +403,13 @@ func findNumericalSplit(indices []int, feature string, targetCol string, baseEnt
 
 	return bestSplit
 }
+
+// sortedMapKeys returns the keys of a map in order
+func sortedMapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+package algorithm
+
+import (
+	"fmt"
+	"strings"
+
+	"dt/models"
+)
+
+// Explanation is the prediction for one record with the class probabilities
+// behind it and the decisions that led to it
+type Explanation struct {
+	Prediction    interface{}        `json:"prediction"`
+	Probabilities map[string]float64 `json:"probabilities"`
+	Path          []PathStep         `json:"path"`
+}
+
+// PathStep is one decision taken by a record on its way through the tree
+type PathStep struct {
+	Feature   string      `json:"feature"`
+	Value     interface{} `json:"value"`             // Value of the record, nil when missing
+	Condition string      `json:"condition"`         // Test of the branch taken, such as "< 5000" or "= Urban"
+	Missing   bool        `json:"missing,omitempty"` // The value was missing and the fallback branch was taken
+	Unseen    bool        `json:"unseen,omitempty"`  // The category was not seen in training and the unseen policy routed it
+}
+
+// String formats the step as a readable test, such as "Credit_History < 0.5"
+func (s PathStep) String() string {
+	text := s.Feature + " " + s.Condition
+	switch {
+	case s.Missing:
+		text += " (missing)"
+	case s.Unseen:
+		text += " (unseen)"
+	}
+	return text
+}
+
+// String formats the path on one line, ending with the prediction and its
+// probability, such as
+// "Credit_History < 0.5 -> Property_Area = Rural -> leaf(No, 87%)"
+func (e *Explanation) String() string {
+	parts := make([]string, 0, len(e.Path)+1)
+	for _, step := range e.Path {
+		parts = append(parts, step.String())
+	}
+	leaf := models.GetValueKey(e.Prediction)
+	if probability, ok := e.Probabilities[leaf]; ok {
+		leaf += fmt.Sprintf(", %.0f%%", 100*probability)
+	}
+	return strings.Join(append(parts, "leaf("+leaf+")"), " -> ")
+}
+
+// Explain predicts one record like Predict does and reports the path it took.
+// The probabilities are the class distribution of the training rows at the
+// node that made the prediction, or the blend of its children under the
+// blend policy.
+func Explain(record map[string]interface{}, tree *models.TreeNode) (*Explanation, error) {
+	var path []PathStep
+	end, blended, err := route(record, tree, nil, func(node, child *models.TreeNode, isUnseen bool) {
+		path = append(path, PathStep{
+			Feature:   node.Feature,
+			Value:     record[node.Feature],
+			Condition: branchCondition(node, child),
+			Missing:   record[node.Feature] == nil,
+			Unseen:    isUnseen,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if blended != nil {
+		path[len(path)-1].Condition = "blend of all branches"
+		return &Explanation{Prediction: labelForKey(end, mostLikely(blended)), Probabilities: blended, Path: path}, nil
+	}
+	return &Explanation{Prediction: end.Prediction, Probabilities: nodeDistribution(end), Path: path}, nil
+}
+
+// branchCondition describes the test that sends a record from node to child.
+// A nil child means the record stopped at node.
+func branchCondition(node, child *models.TreeNode) string {
+	switch {
+	case child == nil:
+		return "no branch, node prediction"
+	case node.SplitType == "categorical":
+		for _, key := range sortedKeys(node.Children) {
+			if node.Children[key] == child {
+				return "= " + key
+			}
+		}
+		return "= " + models.GetValueKey(nil)
+	case node.SplitType == "subset":
+		if child == node.Left {
+			return "in [" + strings.Join(node.LeftCategories, ", ") + "]"
+		}
+		return "in [" + strings.Join(node.RightCategories, ", ") + "]"
+	case child == node.Left:
+		return fmt.Sprintf("< %v", node.SplitValue)
+	}
+	return fmt.Sprintf(">= %v", node.SplitValue)
+}
@@ -0,0 +1,74 @@
+package algorithm
+
+import (
+	"sort"
+
+	"dt/models"
+)
+
+// OtherCategory is the bucket that rare and unseen categorical values share
+const OtherCategory = "__other__"
+
+// GroupRareCategories merges categorical values that occur fewer than
+// minCount times, or in less than minFreq of the rows, into OtherCategory.
+// A zero threshold disables that check. Records are updated in place and the
+// categories kept for each grouped feature are returned so prediction can
+// apply the same mapping.
+func GroupRareCategories(indices []int, targetCol string, minCount int, minFreq float64) map[string][]string {
+	if (minCount <= 0 && minFreq <= 0) || len(indices) == 0 {
+		return nil
+	}
+
+	groups := make(map[string][]string)
+	for _, feature := range models.Columns {
+		if feature == targetCol || models.FeatureTypes[feature] != "categorical" {
+			continue
+		}
+
+		// Count values, leaving missing values alone
+		counts := make(map[string]int)
+		for _, idx := range indices {
+			if value := models.Records[idx][feature]; value != nil {
+				counts[models.GetValueKey(value)]++
+			}
+		}
+
+		kept := make([]string, 0, len(counts))
+		merged := false
+		for category, count := range counts {
+			freq := float64(count) / float64(len(indices))
+			if count < minCount || freq < minFreq {
+				merged = true
+				continue
+			}
+			kept = append(kept, category)
+		}
+		if !merged {
+			continue
+		}
+
+		sort.Strings(kept)
+		groups[feature] = kept
+	}
+
+	ApplyCategoryGroups(models.Records, groups)
+	return groups
+}
+
+// ApplyCategoryGroups replaces every value of a grouped feature that is not
+// in its kept list with OtherCategory, including values never seen in training
+func ApplyCategoryGroups(records []map[string]interface{}, groups map[string][]string) {
+	for feature, kept := range groups {
+		keep := make(map[string]bool, len(kept))
+		for _, category := range kept {
+			keep[category] = true
+		}
+
+		for _, record := range records {
+			value := record[feature]
+			if value != nil && !keep[models.GetValueKey(value)] {
+				record[feature] = OtherCategory
+			}
+		}
+	}
+}
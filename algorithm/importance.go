@@ -0,0 +1,96 @@
+package algorithm
+
+import (
+	"errors"
+	"sort"
+
+	"dt/models"
+)
+
+// FeatureImportance sums up the splits a tree makes on one feature
+type FeatureImportance struct {
+	Feature    string  `json:"feature"`
+	GainRatio  float64 `json:"gain_ratio"`  // Gain ratio of its splits, each weighted by the share of training rows reaching it
+	InfoGain   float64 `json:"info_gain"`   // Information gain of its splits, weighted the same way
+	Splits     int     `json:"splits"`      // Number of nodes splitting on it
+	FirstDepth *int    `json:"first_depth"` // Depth of its shallowest split, 0 for the root; nil when it is never used
+}
+
+// ErrNoGains is returned for models whose splits carry no gains, such as
+// imported models or models trained before gains were recorded
+var ErrNoGains = errors.New("model has no recorded split gains, retrain it to compute gain importance")
+
+// GainImportance ranks the features of a model by the weighted gain ratio of
+// their splits, then by weighted information gain. Features the tree never
+// splits on come last, with no gain.
+func GainImportance(model *models.ModelData) ([]FeatureImportance, error) {
+	importance := make(map[string]*FeatureImportance)
+	for _, column := range model.Columns {
+		if column != model.TargetColumn {
+			importance[column] = &FeatureImportance{Feature: column}
+		}
+	}
+
+	root := model.Tree
+	if root != nil && !root.IsLeaf && root.Samples == 0 {
+		return nil, ErrNoGains
+	}
+
+	var visit func(node *models.TreeNode, depth int) error
+	visit = func(node *models.TreeNode, depth int) error {
+		if node == nil || node.IsLeaf {
+			return nil
+		}
+		if node.GainRatio == 0 && node.InfoGain == 0 {
+			return ErrNoGains
+		}
+		feature, ok := importance[node.Feature]
+		if !ok {
+			feature = &FeatureImportance{Feature: node.Feature}
+			importance[node.Feature] = feature
+		}
+		weight := float64(node.Samples) / float64(root.Samples)
+		feature.GainRatio += weight * node.GainRatio
+		feature.InfoGain += weight * node.InfoGain
+		feature.Splits++
+		if feature.FirstDepth == nil || depth < *feature.FirstDepth {
+			first := depth
+			feature.FirstDepth = &first
+		}
+
+		// Children are visited in a fixed order so sums do not vary
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := visit(node.Children[key], depth+1); err != nil {
+				return err
+			}
+		}
+		if err := visit(node.Left, depth+1); err != nil {
+			return err
+		}
+		return visit(node.Right, depth+1)
+	}
+	if err := visit(root, 0); err != nil {
+		return nil, err
+	}
+
+	ranked := make([]FeatureImportance, 0, len(importance))
+	for _, feature := range importance {
+		ranked = append(ranked, *feature)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.GainRatio != b.GainRatio {
+			return a.GainRatio > b.GainRatio
+		}
+		if a.InfoGain != b.InfoGain {
+			return a.InfoGain > b.InfoGain
+		}
+		return a.Feature < b.Feature
+	})
+	return ranked, nil
+}
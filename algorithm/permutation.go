@@ -0,0 +1,241 @@
+package algorithm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"dt/models"
+	"dt/utils"
+)
+
+// Metrics scored by permutation importance, higher is better for both
+const (
+	MetricAccuracy = "accuracy" // Share of correct predictions, for categorical targets
+	MetricR2       = "r2"       // Coefficient of determination, for numeric targets
+)
+
+// PermutationReport is the drop of a metric when the values of each feature
+// are shuffled between records, breaking their link with the target
+type PermutationReport struct {
+	Metric   string        `json:"metric"`
+	Baseline float64       `json:"baseline"` // Metric on the records as given
+	Rows     int           `json:"rows"`     // Records with a target value, the ones scored
+	Repeats  int           `json:"repeats"`
+	Seed     int64         `json:"seed"`
+	Features []FeatureDrop `json:"features"` // Largest mean drop first
+}
+
+// FeatureDrop is the metric drop measured for one feature
+type FeatureDrop struct {
+	Feature  string    `json:"feature"`
+	MeanDrop float64   `json:"mean_drop"`
+	StdDrop  float64   `json:"std_drop"` // Standard deviation of the drops over the repeats
+	Drops    []float64 `json:"drops"`    // Drop of each repeat
+}
+
+// PermutationImportance shuffles each feature of records repeats times and
+// measures how much the model's metric drops: accuracy for categorical
+// targets, R² for numeric ones. Records without a target value are not
+// scored. Features are scored in parallel on -workers goroutines; each one
+// shuffles with its own generator derived from seed, so results do not depend
+// on scheduling. Features the tree never reads have no drop. The category
+// groups of the model are applied to records in place, as predict does.
+func PermutationImportance(ctx context.Context, model *models.ModelData, records []map[string]interface{},
+	repeats int, seed int64) (*PermutationReport, error) {
+	if err := CheckUnseenPolicy(); err != nil {
+		return nil, err
+	}
+	if repeats <= 0 {
+		return nil, fmt.Errorf("repeats must be positive, got %d", repeats)
+	}
+
+	metric := MetricAccuracy
+	if model.TargetType == "numeric" {
+		metric = MetricR2
+	}
+	// Only records with a target value are scored
+	var labeled []map[string]interface{}
+	var labels []interface{}
+	for _, record := range records {
+		if label := record[model.TargetColumn]; label != nil {
+			labeled = append(labeled, record)
+			labels = append(labels, label)
+		}
+	}
+	if len(labeled) == 0 {
+		return nil, fmt.Errorf("no record has a value for the target %s", model.TargetColumn)
+	}
+	ApplyCategoryGroups(labeled, model.CategoryGroups)
+
+	compiled := Compile(model.Tree, *utils.UnseenPtr)
+	score := func(records []map[string]interface{}) (float64, error) {
+		predictions, err := compiled.Predict(records, nil)
+		if err != nil {
+			return 0, err
+		}
+		return scoreMetric(metric, predictions, labels)
+	}
+	baseline, err := score(labeled)
+	if err != nil {
+		return nil, err
+	}
+	report := &PermutationReport{Metric: metric, Baseline: baseline, Rows: len(labeled), Repeats: repeats, Seed: seed}
+
+	used := treeFeatures(model.Tree)
+	var features []string
+	for _, column := range model.Columns {
+		if column == model.TargetColumn {
+			continue
+		}
+		if used[column] {
+			features = append(features, column)
+		} else {
+			report.Features = append(report.Features, FeatureDrop{Feature: column, Drops: make([]float64, repeats)})
+		}
+	}
+
+	// Workers take features one at a time. Each shuffles a private copy of the
+	// columns the tree reads, so the records are never modified.
+	drops := make([]FeatureDrop, len(features))
+	errs := make([]error, len(features))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < min(workerCount(), len(features)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shadow := make([]map[string]interface{}, len(labeled))
+			for i, record := range labeled {
+				shadow[i] = make(map[string]interface{}, len(used))
+				for feature := range used {
+					shadow[i][feature] = record[feature]
+				}
+			}
+			perm := make([]int, len(labeled))
+
+			for {
+				k := int(next.Add(1) - 1)
+				if k >= len(features) || ctx.Err() != nil {
+					return
+				}
+				feature := features[k]
+				rng := rand.New(rand.NewPCG(uint64(seed), uint64(k)))
+				drop := FeatureDrop{Feature: feature, Drops: make([]float64, repeats)}
+				for r := 0; r < repeats && ctx.Err() == nil; r++ {
+					for i := range perm {
+						perm[i] = i
+					}
+					rng.Shuffle(len(perm), func(i, j int) { perm[i], perm[j] = perm[j], perm[i] })
+					for i, source := range perm {
+						shadow[i][feature] = labeled[source][feature]
+					}
+					permuted, err := score(shadow)
+					if err != nil {
+						errs[k] = fmt.Errorf("feature %s: %w", feature, err)
+						break
+					}
+					drop.Drops[r] = baseline - permuted
+				}
+				for i, record := range labeled {
+					shadow[i][feature] = record[feature]
+				}
+				drop.MeanDrop, drop.StdDrop = meanStd(drop.Drops)
+				drops[k] = drop
+			}
+		}()
+	}
+	wg.Wait()
+	if err := utils.Canceled(ctx, "permutation importance"); err != nil {
+		return nil, err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	report.Features = append(drops, report.Features...)
+	sort.SliceStable(report.Features, func(i, j int) bool {
+		a, b := report.Features[i], report.Features[j]
+		if a.MeanDrop != b.MeanDrop {
+			return a.MeanDrop > b.MeanDrop
+		}
+		return a.Feature < b.Feature
+	})
+	return report, nil
+}
+
+// scoreMetric compares predictions with the target values
+func scoreMetric(metric string, predictions, labels []interface{}) (float64, error) {
+	if metric == MetricAccuracy {
+		correct := 0
+		for i, label := range labels {
+			if models.GetValueKey(predictions[i]) == models.GetValueKey(label) {
+				correct++
+			}
+		}
+		return float64(correct) / float64(len(labels)), nil
+	}
+
+	var sum, residual float64
+	values := make([]float64, len(labels))
+	for i, label := range labels {
+		value, state := numericValue(label)
+		if state != valuePresent {
+			return 0, fmt.Errorf("target value %v of record %d is not a number", label, i+1)
+		}
+		values[i] = value
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	var total float64
+	for i, value := range values {
+		predicted, state := numericValue(predictions[i])
+		if state != valuePresent {
+			return 0, fmt.Errorf("prediction %v of record %d is not a number", predictions[i], i+1)
+		}
+		residual += (value - predicted) * (value - predicted)
+		total += (value - mean) * (value - mean)
+	}
+	if total == 0 {
+		return 0, errors.New("r2 is undefined when every target value is the same")
+	}
+	return 1 - residual/total, nil
+}
+
+// treeFeatures returns the features split on anywhere in the tree
+func treeFeatures(node *models.TreeNode) map[string]bool {
+	features := make(map[string]bool)
+	var visit func(node *models.TreeNode)
+	visit = func(node *models.TreeNode) {
+		if node == nil || node.IsLeaf {
+			return
+		}
+		features[node.Feature] = true
+		for _, child := range node.Children {
+			visit(child)
+		}
+		visit(node.Left)
+		visit(node.Right)
+	}
+	visit(node)
+	return features
+}
+
+// meanStd returns the mean and population standard deviation of values
+func meanStd(values []float64) (float64, float64) {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
@@ -0,0 +1,156 @@
+package algorithm
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"dt/utils"
+)
+
+// workerCount returns the -workers setting, or one worker per CPU when unset
+func workerCount() int {
+	if *utils.WorkersPtr > 0 {
+		return *utils.WorkersPtr
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// taskPool runs fork-join tasks on a fixed number of workers with work
+// stealing. A task spawned by a worker goes to the back of that worker's
+// deque. Workers run tasks from the back of their own deque and steal from
+// the front of the others when it is empty. A worker waiting for the tasks it
+// spawned runs other tasks meanwhile, so nested work never blocks the pool.
+type taskPool struct {
+	workers []*poolWorker
+	wake    chan struct{} // Signalled when a task is queued
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// poolWorker is one worker of a taskPool and its deque of tasks
+type poolWorker struct {
+	pool  *taskPool
+	id    int
+	mu    sync.Mutex
+	tasks []func(*poolWorker)
+}
+
+// taskGroup tracks spawned tasks until they have all finished
+type taskGroup struct {
+	pending atomic.Int64
+	done    chan struct{} // Signalled whenever a task of the group finishes
+}
+
+func newTaskGroup() *taskGroup {
+	return &taskGroup{done: make(chan struct{}, 1)}
+}
+
+// newTaskPool starts a pool with n workers
+func newTaskPool(n int) *taskPool {
+	p := &taskPool{wake: make(chan struct{}, n), quit: make(chan struct{})}
+	for i := 0; i < n; i++ {
+		p.workers = append(p.workers, &poolWorker{pool: p, id: i})
+	}
+	for _, w := range p.workers {
+		p.wg.Add(1)
+		go func(w *poolWorker) {
+			defer p.wg.Done()
+			w.loop()
+		}(w)
+	}
+	return p
+}
+
+// run executes task on the pool and waits for it to finish
+func (p *taskPool) run(task func(*poolWorker)) {
+	group := newTaskGroup()
+	p.workers[0].spawn(group, task)
+	for group.pending.Load() > 0 {
+		<-group.done
+	}
+}
+
+// close stops the workers once they are idle
+func (p *taskPool) close() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// loop runs queued tasks until the pool is closed
+func (w *poolWorker) loop() {
+	for {
+		if task := w.next(); task != nil {
+			task(w)
+			continue
+		}
+		select {
+		case <-w.pool.wake:
+		case <-w.pool.quit:
+			return
+		}
+	}
+}
+
+// spawn queues task as part of group
+func (w *poolWorker) spawn(group *taskGroup, task func(*poolWorker)) {
+	group.pending.Add(1)
+	w.mu.Lock()
+	w.tasks = append(w.tasks, func(runner *poolWorker) {
+		task(runner)
+		group.pending.Add(-1)
+		select {
+		case group.done <- struct{}{}:
+		default:
+		}
+	})
+	w.mu.Unlock()
+
+	select {
+	case w.pool.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait runs queued tasks until every task of group has finished
+func (w *poolWorker) wait(group *taskGroup) {
+	for group.pending.Load() > 0 {
+		if task := w.next(); task != nil {
+			task(w)
+			continue
+		}
+		select {
+		case <-group.done:
+		case <-w.pool.wake:
+		}
+	}
+}
+
+// next takes the newest task of the worker's own deque, or steals the
+// oldest task of another worker
+func (w *poolWorker) next() func(*poolWorker) {
+	w.mu.Lock()
+	if n := len(w.tasks); n > 0 {
+		task := w.tasks[n-1]
+		w.tasks[n-1] = nil
+		w.tasks = w.tasks[:n-1]
+		w.mu.Unlock()
+		return task
+	}
+	w.mu.Unlock()
+
+	workers := w.pool.workers
+	for i := 1; i < len(workers); i++ {
+		victim := workers[(w.id+i)%len(workers)]
+		victim.mu.Lock()
+		if len(victim.tasks) > 0 {
+			task := victim.tasks[0]
+			victim.tasks[0] = nil
+			victim.tasks = victim.tasks[1:]
+			victim.mu.Unlock()
+			return task
+		}
+		victim.mu.Unlock()
+	}
+	return nil
+}
@@ -1,19 +1,63 @@
 package algorithm
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
 	"sync"
 
 	"dt/models"
+	"dt/utils"
 )
 
+// Policies for categorical values that were not seen during training
+const (
+	UnseenMissing = "missing" // Follow the branch missing values take, the one with the most leaves
+	UnseenParent  = "parent"  // Predict the majority class of the splitting node
+	UnseenBlend   = "blend"   // Blend all children weighted by their training frequency
+	UnseenOther   = "other"   // Follow the branch designated at training time
+	UnseenFail    = "fail"    // Stop with an error
+)
+
+// ErrUnseenCategory is returned when the "fail" policy meets an unseen value
+var ErrUnseenCategory = errors.New("unseen categorical value")
+
+// PredictSummary collects statistics gathered while predicting
+type PredictSummary struct {
+	Records int
+	Unseen  map[string]int // Number of unseen categorical values per feature
+}
+
+// predictBlock is the number of rows a worker scores between checks for
+// cancellation
+const predictBlock = 4096
+
 // Predict makes predictions for all records in the dataset
-func Predict(tree *models.TreeNode) []interface{} {
+func Predict(ctx context.Context, tree *models.TreeNode) ([]interface{}, error) {
+	predictions, _, err := PredictWithSummary(ctx, tree)
+	return predictions, err
+}
+
+// PredictWithSummary makes predictions for all records in the dataset and
+// reports how many unseen categorical values were met per feature. The tree is
+// compiled to its flat form first. When ctx is done the workers stop and a
+// *utils.CanceledError is returned.
+func PredictWithSummary(ctx context.Context, tree *models.TreeNode) ([]interface{}, *PredictSummary, error) {
+	if err := CheckUnseenPolicy(); err != nil {
+		return nil, nil, err
+	}
+
 	predictions := make([]interface{}, len(models.Records))
+	compiled := Compile(tree, *utils.UnseenPtr)
 
 	// Use goroutines for parallel prediction
 	var wg sync.WaitGroup
-	workers := 4 // Number of worker goroutines
+	workers := workerCount()
 	batchSize := (len(models.Records) + workers - 1) / workers
+	unseen := make([]map[string]int, workers)
+	errs := make([]error, workers)
 
 	for w := 0; w < workers; w++ {
 		wg.Add(1)
@@ -26,92 +70,312 @@ func Predict(tree *models.TreeNode) []interface{} {
 				end = len(models.Records)
 			}
 
-			for i := start; i < end; i++ {
-				predictions[i] = predictRecord(models.Records[i], tree)
+			unseen[workerID] = make(map[string]int)
+			for ; start < end && ctx.Err() == nil; start += predictBlock {
+				records := models.Records[start:min(start+predictBlock, end)]
+				record := func(row int) map[string]interface{} { return records[row] }
+				row, err := compiled.predictRows(record, compiled.Encode(records), predictions[start:], unseen[workerID])
+				if err != nil {
+					errs[workerID] = fmt.Errorf("record %d: %w", start+row+1, err)
+					return
+				}
 			}
 		}(w)
 	}
 
 	wg.Wait()
-	return predictions
+	if err := utils.Canceled(ctx, "prediction"); err != nil {
+		return nil, nil, err
+	}
+
+	// Report the error of the earliest failing record
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	summary := &PredictSummary{
+		Records: len(models.Records),
+		Unseen:  make(map[string]int),
+	}
+	for _, counts := range unseen {
+		for feature, count := range counts {
+			summary.Unseen[feature] += count
+		}
+	}
+	return predictions, summary, nil
 }
 
-// predictRecord makes a prediction for a single record
-func predictRecord(record map[string]interface{}, node *models.TreeNode) interface{} {
-	// If it's a leaf node, return the prediction
-	if node.IsLeaf {
-		return node.Prediction
+// CheckUnseenPolicy rejects an unknown -unseen value
+func CheckUnseenPolicy() error {
+	switch *utils.UnseenPtr {
+	case UnseenMissing, UnseenParent, UnseenBlend, UnseenOther, UnseenFail:
+		return nil
 	}
-	// Get the feature value
-	featureValue := record[node.Feature]
+	return fmt.Errorf("unknown unseen category policy %q", *utils.UnseenPtr)
+}
 
-	// Handle missing values (null) by going to the majority branch
-	if featureValue == nil {
-		if node.SplitType == "categorical" {
-			// Find the child with the most examples (first key as fallback)
-			var bestChild *models.TreeNode
-			maxSamples := -1
-
-			for _, child := range node.Children {
-				if bestChild == nil || estimateNodeSize(child) > maxSamples {
-					bestChild = child
-					maxSamples = estimateNodeSize(child)
-				}
-			}
+// predictRecord makes a prediction for a single record. Unseen categorical
+// values are counted per feature in unseen when it is not nil.
+func predictRecord(record map[string]interface{}, node *models.TreeNode, unseen map[string]int) (interface{}, error) {
+	end, blended, err := route(record, node, unseen, nil)
+	if err != nil {
+		return nil, err
+	}
+	if blended != nil {
+		return labelForKey(end, mostLikely(blended)), nil
+	}
+	return end.Prediction, nil
+}
 
-			if bestChild != nil {
-				return predictRecord(record, bestChild)
+// route follows a record from node down to the node whose prediction it
+// gets, applying the unseen category policy. step, when not nil, is called
+// for every node passed with the child taken; the child is nil at an inner
+// node where the record stops. When the blend policy resolves an unseen
+// value, the blended class distribution is returned with the blending node.
+func route(record map[string]interface{}, node *models.TreeNode, unseen map[string]int,
+	step func(node, child *models.TreeNode, isUnseen bool)) (*models.TreeNode, map[string]float64, error) {
+	for !node.IsLeaf {
+		child, isUnseen := nextNode(record, node)
+		if isUnseen {
+			if unseen != nil {
+				unseen[node.Feature]++
 			}
-			return node.Prediction // Fallback to current node's prediction
-		} else {
-			// For numerical splits, go to the side with more samples
-			leftSize := estimateNodeSize(node.Left)
-			rightSize := estimateNodeSize(node.Right)
-
-			if leftSize >= rightSize && node.Left != nil {
-				return predictRecord(record, node.Left)
-			} else if node.Right != nil {
-				return predictRecord(record, node.Right)
+
+			switch *utils.UnseenPtr {
+			case UnseenFail:
+				return nil, nil, fmt.Errorf("%w %q for feature %s", ErrUnseenCategory,
+					models.GetValueKey(record[node.Feature]), node.Feature)
+			case UnseenBlend:
+				if distribution := blendChildren(record, node); len(distribution) > 0 {
+					if step != nil {
+						step(node, nil, true)
+					}
+					return node, distribution, nil
+				}
+			case UnseenOther:
+				if other := otherBranch(node); other != nil {
+					child = other
+				}
+			case UnseenParent:
+				// Models saved before node statistics existed keep the missing value branch
+				if node.Prediction != nil {
+					child = nil
+				}
 			}
-			return node.Prediction
 		}
+
+		if step != nil {
+			step(node, child, isUnseen)
+		}
+		if child == nil {
+			return node, nil, nil
+		}
+		node = child
+	}
+	return node, nil, nil
+}
+
+// nextNode picks the child a record follows. When the value of a categorical
+// feature was not seen in training, the missing value child is returned and the
+// second result is true so the caller can apply its policy.
+func nextNode(record map[string]interface{}, node *models.TreeNode) (*models.TreeNode, bool) {
+	// Get the feature value
+	featureValue := record[node.Feature]
+
+	// Handle missing values (null) by going to the majority branch
+	if featureValue == nil {
+		return MissingValueChild(node), false
 	}
+
 	// Split based on feature type
-	if node.SplitType == "categorical" {
+	switch node.SplitType {
+	case "categorical":
 		// For categorical features, find the matching child
+		if child, ok := node.Children[models.GetValueKey(featureValue)]; ok {
+			return child, false
+		}
+		return MissingValueChild(node), true
+	case "subset":
+		// For subset splits, check which group the value belongs to
 		valueKey := models.GetValueKey(featureValue)
-		if child, ok := node.Children[valueKey]; ok {
-			return predictRecord(record, child)
+		if slices.Contains(node.LeftCategories, valueKey) && node.Left != nil {
+			return node.Left, false
 		}
+		if slices.Contains(node.RightCategories, valueKey) && node.Right != nil {
+			return node.Right, false
+		}
+		return MissingValueChild(node), true
+	default:
+		// For numerical features, compare with the threshold
+		if models.CompareValues(featureValue, node.SplitValue) < 0 {
+			return node.Left, false
+		}
+		return node.Right, false
+	}
+}
+
+// MissingValueChild returns the child a record with a missing value follows:
+// the branch recorded in the model, or else the one holding the most leaves
+func MissingValueChild(node *models.TreeNode) *models.TreeNode {
+	if child := namedBranch(node, node.MissingBranch); child != nil {
+		return child
+	}
+
+	if node.SplitType == "categorical" {
+		// Find the child with the most examples, visiting keys in order so
+		// ties always resolve the same way
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
 
-		// If no matching child, use the most common child
 		var bestChild *models.TreeNode
 		maxSamples := -1
-
-		for _, child := range node.Children {
-			if bestChild == nil || estimateNodeSize(child) > maxSamples {
-				bestChild = child
-				maxSamples = estimateNodeSize(child)
+		for _, key := range keys {
+			if size := estimateNodeSize(node.Children[key]); size > maxSamples {
+				bestChild = node.Children[key]
+				maxSamples = size
 			}
 		}
+		return bestChild
+	}
+
+	// For binary splits, go to the side with more samples
+	if estimateNodeSize(node.Left) >= estimateNodeSize(node.Right) && node.Left != nil {
+		return node.Left
+	}
+	return node.Right
+}
+
+// otherBranch returns the child designated for unseen values at training time
+func otherBranch(node *models.TreeNode) *models.TreeNode {
+	return namedBranch(node, node.OtherBranch)
+}
+
+// namedBranch resolves a Children key, or "left"/"right", to the child
+func namedBranch(node *models.TreeNode, name string) *models.TreeNode {
+	switch name {
+	case "":
+		return nil
+	case "left":
+		return node.Left
+	case "right":
+		return node.Right
+	default:
+		return node.Children[name]
+	}
+}
+
+// blendChildren mixes the class distributions predicted by every child,
+// weighting each child by the number of training rows that reached it
+func blendChildren(record map[string]interface{}, node *models.TreeNode) map[string]float64 {
+	keys := make([]string, 0, len(node.Children))
+	for key := range node.Children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-		if bestChild != nil {
-			return predictRecord(record, bestChild)
+	children := make([]*models.TreeNode, 0, len(node.Children)+2)
+	for _, key := range keys {
+		children = append(children, node.Children[key])
+	}
+	for _, child := range []*models.TreeNode{node.Left, node.Right} {
+		if child != nil {
+			children = append(children, child)
 		}
-		return node.Prediction
-	} else {
-		// For numerical features, compare with the threshold
-		if models.CompareValues(featureValue, node.SplitValue) < 0 {
-			if node.Left != nil {
-				return predictRecord(record, node.Left)
-			}
-		} else {
-			if node.Right != nil {
-				return predictRecord(record, node.Right)
-			}
+	}
+
+	total := 0
+	for _, child := range children {
+		total += child.Samples
+	}
+
+	blended := make(map[string]float64)
+	for _, child := range children {
+		weight := 1 / float64(len(children))
+		if total > 0 {
+			weight = float64(child.Samples) / float64(total)
 		}
+		for class, prob := range predictDistribution(record, child) {
+			blended[class] += weight * prob
+		}
+	}
+	return blended
+}
+
+// predictDistribution returns the class probabilities for a record,
+// blending children whenever an unseen value is met
+func predictDistribution(record map[string]interface{}, node *models.TreeNode) map[string]float64 {
+	if !node.IsLeaf {
+		child, isUnseen := nextNode(record, node)
+		if isUnseen {
+			return blendChildren(record, node)
+		}
+		if child != nil {
+			return predictDistribution(record, child)
+		}
+	}
+
+	return nodeDistribution(node)
+}
+
+// nodeDistribution returns the class probabilities of the training rows that
+// reached node
+func nodeDistribution(node *models.TreeNode) map[string]float64 {
+	distribution := make(map[string]float64)
+	if node.Samples > 0 {
+		for class, count := range node.ClassCounts {
+			distribution[class] = float64(count) / float64(node.Samples)
+		}
+	} else if node.Prediction != nil {
+		distribution[models.GetValueKey(node.Prediction)] = 1
+	}
+	return distribution
+}
+
+// mostLikely returns the most probable class, preferring the smallest key on ties
+func mostLikely(distribution map[string]float64) string {
+	bestKey := ""
+	bestProb := -1.0
+	for key, prob := range distribution {
+		if prob > bestProb || (prob == bestProb && key < bestKey) {
+			bestKey = key
+			bestProb = prob
+		}
+	}
+	return bestKey
+}
+
+// labelForKey finds the typed prediction matching a class key in the subtree,
+// falling back to the key itself
+func labelForKey(node *models.TreeNode, key string) interface{} {
+	if label := findLabel(node, key); label != nil {
+		return label
+	}
+	return key
+}
+
+func findLabel(node *models.TreeNode, key string) interface{} {
+	if node == nil {
+		return nil
+	}
+	if node.Prediction != nil && models.GetValueKey(node.Prediction) == key {
 		return node.Prediction
 	}
+	for _, child := range []*models.TreeNode{node.Left, node.Right} {
+		if label := findLabel(child, key); label != nil {
+			return label
+		}
+	}
+	for _, child := range node.Children {
+		if label := findLabel(child, key); label != nil {
+			return label
+		}
+	}
+	return nil
 }
 
 // estimateNodeSize estimates the number of samples in a node
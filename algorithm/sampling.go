@@ -0,0 +1,214 @@
+package algorithm
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+
+	"dt/models"
+)
+
+// Resample rebalances the target distribution of the given indices of
+// models.Records. Rows outside indices are not looked at.
+//
+// Supported methods:
+//   - "none": indices are returned unchanged
+//   - "under": every class is randomly reduced to the size of the smallest one
+//   - "over": every class is randomly duplicated up to the size of the largest one
+//   - "smote": smaller classes are grown with synthetic rows interpolated
+//     between a sample and one of its k nearest neighbours
+//
+// SMOTE also returns the synthetic rows, which the returned indices number
+// from len(models.Records) on: the caller appends them to models.Records
+// before using the indices. The same seed always yields the same result.
+func Resample(indices []int, targetCol string, method string, seed int64, k int) ([]int, []map[string]interface{}, error) {
+	resampled, synthetic, _, err := resample(indices, targetCol, method, seed, k)
+	return resampled, synthetic, err
+}
+
+// resample is Resample that also returns the state of the random generator
+// once sampling is done, which training checkpoints record
+func resample(indices []int, targetCol string, method string, seed int64, k int) ([]int, []map[string]interface{}, []byte, error) {
+	switch method {
+	case "", "none":
+		return indices, nil, nil, nil
+	case "under", "over", "smote":
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown sampling method %q", method)
+	}
+
+	classes, groups := groupByClass(indices, targetCol)
+	if len(classes) < 2 {
+		return indices, nil, nil, nil
+	}
+
+	minCount, maxCount := len(indices), 0
+	for _, class := range classes {
+		n := len(groups[class])
+		if n < minCount {
+			minCount = n
+		}
+		if n > maxCount {
+			maxCount = n
+		}
+	}
+
+	source := rand.NewPCG(uint64(seed), 0)
+	rng := rand.New(source)
+	resampled := make([]int, 0, len(indices))
+	var synthetic []map[string]interface{}
+
+	for _, class := range classes {
+		group := groups[class]
+		switch method {
+		case "under":
+			shuffled := append([]int(nil), group...)
+			rng.Shuffle(len(shuffled), func(i, j int) {
+				shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+			})
+			resampled = append(resampled, shuffled[:minCount]...)
+		case "over":
+			resampled = append(resampled, group...)
+			for i := len(group); i < maxCount; i++ {
+				resampled = append(resampled, group[rng.IntN(len(group))])
+			}
+		case "smote":
+			resampled = append(resampled, group...)
+			for _, record := range synthesize(group, maxCount-len(group), targetCol, k, rng) {
+				resampled = append(resampled, len(models.Records)+len(synthetic))
+				synthetic = append(synthetic, record)
+			}
+		}
+	}
+
+	sort.Ints(resampled)
+	state, err := source.MarshalBinary()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return resampled, synthetic, state, nil
+}
+
+// groupByClass splits indices by target value. Classes are returned sorted so
+// that sampling consumes random numbers in the same order on every run.
+func groupByClass(indices []int, targetCol string) ([]string, map[string][]int) {
+	groups := make(map[string][]int)
+	for _, idx := range indices {
+		key := models.GetValueKey(models.Records[idx][targetCol])
+		groups[key] = append(groups[key], idx)
+	}
+
+	classes := make([]string, 0, len(groups))
+	for class := range groups {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes, groups
+}
+
+// synthesize creates n SMOTE rows for one class
+func synthesize(group []int, n int, targetCol string, k int, rng *rand.Rand) []map[string]interface{} {
+	if n <= 0 {
+		return nil
+	}
+
+	// Numeric features are scaled to [0, 1] so no column dominates the distance
+	numeric := make([]string, 0)
+	for _, col := range models.Columns {
+		if col != targetCol && models.FeatureTypes[col] == "numeric" {
+			numeric = append(numeric, col)
+		}
+	}
+	lows := make([]float64, len(numeric))
+	spans := make([]float64, len(numeric))
+	for f, col := range numeric {
+		low, high := math.Inf(1), math.Inf(-1)
+		for _, idx := range group {
+			if v, ok := models.ToFloat(models.Records[idx][col]); ok {
+				low = math.Min(low, v)
+				high = math.Max(high, v)
+			}
+		}
+		lows[f] = low
+		spans[f] = high - low
+	}
+
+	distance := func(a, b int) float64 {
+		sum := 0.0
+		for f, col := range numeric {
+			va, okA := models.ToFloat(models.Records[a][col])
+			vb, okB := models.ToFloat(models.Records[b][col])
+			if !okA || !okB || spans[f] == 0 {
+				continue
+			}
+			d := (va - vb) / spans[f]
+			sum += d * d
+		}
+		return sum
+	}
+
+	neighbours := make(map[int][]int)
+	nearest := func(base int) []int {
+		if found, ok := neighbours[base]; ok {
+			return found
+		}
+		candidates := make([]int, 0, len(group)-1)
+		for _, idx := range group {
+			if idx != base {
+				candidates = append(candidates, idx)
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return distance(base, candidates[i]) < distance(base, candidates[j])
+		})
+		if len(candidates) > k {
+			candidates = candidates[:k]
+		}
+		neighbours[base] = candidates
+		return candidates
+	}
+
+	created := make([]map[string]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		base := group[rng.IntN(len(group))]
+		record := make(map[string]interface{}, len(models.Records[base]))
+		for col, val := range models.Records[base] {
+			record[col] = val
+		}
+
+		// A lone sample has no neighbours and is simply duplicated
+		if candidates := nearest(base); len(candidates) > 0 {
+			neighbour := models.Records[candidates[rng.IntN(len(candidates))]]
+			gap := rng.Float64()
+			for _, col := range models.Columns {
+				if col == targetCol {
+					continue
+				}
+				record[col] = interpolate(record[col], neighbour[col], gap)
+			}
+		}
+
+		created = append(created, record)
+	}
+
+	return created
+}
+
+// interpolate returns the value a fraction gap of the way from a to b.
+// Numbers keep the type of a; other values take whichever end is closer.
+func interpolate(a, b interface{}, gap float64) interface{} {
+	fa, okA := models.ToFloat(a)
+	fb, okB := models.ToFloat(b)
+	if okA && okB {
+		v := fa + gap*(fb-fa)
+		if _, isInt := a.(int); isInt {
+			return int(math.Round(v))
+		}
+		return v
+	}
+	if gap < 0.5 || b == nil {
+		return a
+	}
+	return b
+}
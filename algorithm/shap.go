@@ -0,0 +1,299 @@
+package algorithm
+
+import (
+	"errors"
+	"slices"
+
+	"dt/models"
+	"dt/utils"
+)
+
+// SHAPValues attributes the probability of the predicted class of a record to
+// its features. Base plus the sum of Values is Output.
+type SHAPValues struct {
+	Class  string             `json:"class"`  // Class whose probability is explained, the predicted one
+	Output float64            `json:"output"` // Probability of Class for the record
+	Base   float64            `json:"base"`   // Expected probability of Class over the training rows
+	Values map[string]float64 `json:"values"` // Contribution of each feature
+}
+
+// ErrNoCovers is returned for models whose nodes carry no training row
+// counts, such as imported models
+var ErrNoCovers = errors.New("model has no node sample counts, retrain it to compute SHAP values")
+
+// SHAPExplainer computes exact SHAP values of a tree with the TreeSHAP
+// algorithm (Lundberg et al., 2018), using the training rows that reached
+// each node as its cover. Features of the record that are not known are
+// marginalized over the children of a split in proportion to their cover.
+// It is safe for concurrent use.
+type SHAPExplainer struct {
+	tree     *models.TreeNode
+	features []string
+	index    map[string]int
+}
+
+// NewSHAPExplainer prepares the tree of model for SHAP values
+func NewSHAPExplainer(model *models.ModelData) (*SHAPExplainer, error) {
+	e := &SHAPExplainer{tree: model.Tree, index: make(map[string]int)}
+	addFeature := func(feature string) {
+		if _, ok := e.index[feature]; !ok {
+			e.index[feature] = len(e.features)
+			e.features = append(e.features, feature)
+		}
+	}
+	for _, column := range model.Columns {
+		if column != model.TargetColumn {
+			addFeature(column)
+		}
+	}
+
+	var visit func(node *models.TreeNode) error
+	visit = func(node *models.TreeNode) error {
+		if node == nil || node.IsLeaf {
+			return nil
+		}
+		addFeature(node.Feature)
+		total := 0
+		for _, child := range treeChildren(node) {
+			total += child.Samples
+		}
+		if total == 0 {
+			return ErrNoCovers
+		}
+		for _, child := range treeChildren(node) {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(model.Tree); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Features returns the features SHAP values are given for: the columns of
+// the model, then any other feature the tree splits on
+func (e *SHAPExplainer) Features() []string {
+	return slices.Clone(e.features)
+}
+
+// Explain returns the SHAP values of the predicted class of record. Missing
+// values and unseen categories are routed as Predict routes them.
+func (e *SHAPExplainer) Explain(record map[string]interface{}) (*SHAPValues, error) {
+	explanation, err := Explain(record, e.tree)
+	if err != nil {
+		return nil, err
+	}
+	class := models.GetValueKey(explanation.Prediction)
+	value := func(node *models.TreeNode) float64 { return nodeDistribution(node)[class] }
+
+	phi := make([]float64, len(e.features))
+	e.recurse(record, e.tree, nil, 1, 1, -1, value, phi)
+	values := make(map[string]float64, len(e.features))
+	for i, feature := range e.features {
+		values[feature] = phi[i]
+	}
+	return &SHAPValues{
+		Class:  class,
+		Output: explanation.Probabilities[class],
+		Base:   expectedValue(e.tree, value),
+		Values: values,
+	}, nil
+}
+
+// shapPath is the unique feature path of TreeSHAP, from a dummy root element
+type shapPath []pathElement
+
+// pathElement is a feature split on above a node, with the share of cover
+// (zero) and of the record (one) flowing down the path, and the weight of the
+// subsets of the path's features of its size
+type pathElement struct {
+	feature   int
+	zero, one float64
+	weight    float64
+}
+
+// shapBranch is a way down from a node. A nil node is the node itself, for
+// records that stop there.
+type shapBranch struct {
+	node      *models.TreeNode
+	zero, one float64
+}
+
+// recurse walks the tree below node, extending path with the split that led
+// to it, and adds the contribution of every leaf to phi
+func (e *SHAPExplainer) recurse(record map[string]interface{}, node *models.TreeNode, path shapPath,
+	zero, one float64, feature int, value func(*models.TreeNode) float64, phi []float64) {
+	path = extendPath(slices.Clone(path), zero, one, feature)
+	if node.IsLeaf {
+		e.addContributions(path, value(node), phi)
+		return
+	}
+
+	// A feature met again is removed from the path, carrying its fractions
+	feature = e.index[node.Feature]
+	zero, one = 1, 1
+	for i := 1; i < len(path); i++ {
+		if path[i].feature == feature {
+			zero, one = path[i].zero, path[i].one
+			path = unwindPath(path, i)
+			break
+		}
+	}
+
+	for _, branch := range shapBranches(record, node) {
+		if zero*branch.zero == 0 && one*branch.one == 0 {
+			continue // No cover and not taken by the record
+		}
+		if branch.node == nil {
+			// The record stops at node: a leaf holding its prediction that no
+			// training row reached
+			stop := extendPath(slices.Clone(path), 0, one*branch.one, feature)
+			e.addContributions(stop, value(node), phi)
+			continue
+		}
+		e.recurse(record, branch.node, path, zero*branch.zero, one*branch.one, feature, value, phi)
+	}
+}
+
+// addContributions adds the contribution of a leaf of the given value to the
+// features of path
+func (e *SHAPExplainer) addContributions(path shapPath, value float64, phi []float64) {
+	for i := 1; i < len(path); i++ {
+		weight := unwoundPathSum(path, i)
+		phi[path[i].feature] += weight * (path[i].one - path[i].zero) * value
+	}
+}
+
+// shapBranches lists the children of node with the share of its cover each
+// one holds and the share of record sent to it. The record takes one branch,
+// or is blended over all of them when the blend policy resolves an unseen
+// category.
+func shapBranches(record map[string]interface{}, node *models.TreeNode) []shapBranch {
+	children := treeChildren(node)
+	total := 0
+	for _, child := range children {
+		total += child.Samples
+	}
+
+	taken, isUnseen := nextNode(record, node)
+	blend := false
+	if isUnseen {
+		switch *utils.UnseenPtr {
+		case UnseenBlend:
+			blend = len(children) > 0
+		case UnseenOther:
+			if other := otherBranch(node); other != nil {
+				taken = other
+			}
+		case UnseenParent:
+			if node.Prediction != nil {
+				taken = nil
+			}
+		}
+	}
+
+	branches := make([]shapBranch, 0, len(children)+1)
+	for _, child := range children {
+		zero := float64(child.Samples) / float64(total)
+		one := 0.0
+		switch {
+		case blend:
+			one = zero
+		case child == taken:
+			one = 1
+		}
+		branches = append(branches, shapBranch{node: child, zero: zero, one: one})
+	}
+	if taken == nil && !blend {
+		branches = append(branches, shapBranch{one: 1})
+	}
+	return branches
+}
+
+// treeChildren returns the children of node in a fixed order
+func treeChildren(node *models.TreeNode) []*models.TreeNode {
+	children := make([]*models.TreeNode, 0, len(node.Children)+2)
+	for _, key := range sortedKeys(node.Children) {
+		children = append(children, node.Children[key])
+	}
+	for _, child := range []*models.TreeNode{node.Left, node.Right} {
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// expectedValue is the mean value of the leaves below node, weighted by
+// cover: the output when no feature is known
+func expectedValue(node *models.TreeNode, value func(*models.TreeNode) float64) float64 {
+	if node.IsLeaf {
+		return value(node)
+	}
+	children := treeChildren(node)
+	total := 0
+	for _, child := range children {
+		total += child.Samples
+	}
+	var expected float64
+	for _, child := range children {
+		expected += float64(child.Samples) / float64(total) * expectedValue(child, value)
+	}
+	return expected
+}
+
+// extendPath adds a split to path, updating the subset weights
+func extendPath(path shapPath, zero, one float64, feature int) shapPath {
+	depth := len(path)
+	weight := 0.0
+	if depth == 0 {
+		weight = 1
+	}
+	path = append(path, pathElement{feature: feature, zero: zero, one: one, weight: weight})
+	for i := depth - 1; i >= 0; i-- {
+		path[i+1].weight += one * path[i].weight * float64(i+1) / float64(depth+1)
+		path[i].weight = zero * path[i].weight * float64(depth-i) / float64(depth+1)
+	}
+	return path
+}
+
+// unwindPath removes element i from path, undoing its extension
+func unwindPath(path shapPath, i int) shapPath {
+	depth := len(path) - 1
+	zero, one := path[i].zero, path[i].one
+	next := path[depth].weight
+	for j := depth - 1; j >= 0; j-- {
+		if one != 0 {
+			weight := path[j].weight
+			path[j].weight = next * float64(depth+1) / (float64(j+1) * one)
+			next = weight - path[j].weight*zero*float64(depth-j)/float64(depth+1)
+		} else {
+			path[j].weight = path[j].weight * float64(depth+1) / (zero * float64(depth-j))
+		}
+	}
+	for j := i; j < depth; j++ {
+		path[j].feature, path[j].zero, path[j].one = path[j+1].feature, path[j+1].zero, path[j+1].one
+	}
+	return path[:depth]
+}
+
+// unwoundPathSum is the total subset weight of path without element i
+func unwoundPathSum(path shapPath, i int) float64 {
+	depth := len(path) - 1
+	zero, one := path[i].zero, path[i].one
+	next := path[depth].weight
+	var total float64
+	for j := depth - 1; j >= 0; j-- {
+		if one != 0 {
+			weight := next * float64(depth+1) / (float64(j+1) * one)
+			total += weight
+			next = path[j].weight - weight*zero*float64(depth-j)/float64(depth+1)
+		} else {
+			total += path[j].weight / zero * float64(depth+1) / float64(depth-j)
+		}
+	}
+	return total
+}
@@ -0,0 +1,235 @@
+package algorithm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"dt/models"
+	"dt/utils"
+)
+
+// Stream describes a prediction pipeline over chunks of records
+type Stream struct {
+	Read  func() ([]map[string]interface{}, error) // Next chunk of records, io.EOF after the last one
+	Write func(predictions []interface{}) error    // Predictions of one chunk, called in input order
+	// ReadRows, when set, is called in place of Read for the next chunk as
+	// rows of text laid out as Columns, io.EOF after the last one. The cells
+	// are encoded for the compiled tree directly; records are only made for
+	// rows that finish on the original tree, or for every row when details
+	// are asked for.
+	ReadRows func() ([][]string, error)
+	Columns  []string // Header of the rows returned by ReadRows
+	// WriteDetails, when set, is called in place of Write with the details
+	// of every prediction of the chunk asked for by Explain and SHAP
+	WriteDetails func(predictions []interface{}, details []Details) error
+	Explain      bool                // Explain every prediction
+	SHAP         *SHAPExplainer      // Compute the SHAP values of every prediction with this explainer
+	Progress     func(records int)   // Called with the number of records written so far; optional
+	Groups       map[string][]string // Rare category groups applied to every chunk
+	Workers      int                 // Number of scoring goroutines, the -workers setting when zero
+}
+
+// Details are what a stream reports about a prediction besides its value
+type Details struct {
+	Explanation *Explanation // Set when the stream explains predictions
+	SHAP        *SHAPValues  // Set when the stream computes SHAP values
+}
+
+// streamChunk is one chunk of records on its way through the pipeline
+type streamChunk struct {
+	seq         int
+	first       int // Index of the chunk's first record in the input
+	records     []map[string]interface{}
+	rows        [][]string // Set instead of records when the stream reads rows
+	predictions []interface{}
+	details     []Details // Set when the stream has WriteDetails
+	unseen      map[string]int
+	err         error
+}
+
+// PredictStream scores records chunk by chunk with a pool of workers and
+// writes the predictions in input order. At most two chunks per worker are in
+// flight, so memory use does not depend on the size of the input. When ctx
+// is done the pipeline stops and a *utils.CanceledError is returned.
+func PredictStream(parent context.Context, tree *models.TreeNode, stream Stream) (*PredictSummary, error) {
+	if err := CheckUnseenPolicy(); err != nil {
+		return nil, err
+	}
+	compiled := Compile(tree, *utils.UnseenPtr)
+	var encoder *rowEncoder
+	if stream.ReadRows != nil {
+		encoder = compiled.newRowEncoder(stream.Columns, stream.Groups)
+	}
+
+	workers := stream.Workers
+	if workers <= 0 {
+		workers = workerCount()
+	}
+	jobs := make(chan *streamChunk)
+	results := make(chan *streamChunk)
+	slots := make(chan struct{}, 2*workers)
+
+	// Stopping the pipeline, after an error or when parent is done, ends every goroutine
+	ctx, stop := context.WithCancel(parent)
+	defer stop()
+	done := ctx.Done()
+
+	// Read chunks while there is a free slot. The reader is waited for before
+	// returning, so the caller may close the input as soon as this returns.
+	var readErr error
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		defer close(jobs)
+		first := 0
+		for seq := 0; ; seq++ {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			chunk := &streamChunk{seq: seq, first: first}
+			var err error
+			if stream.ReadRows != nil {
+				chunk.rows, err = stream.ReadRows()
+			} else {
+				chunk.records, err = stream.Read()
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+			select {
+			case jobs <- chunk:
+			case <-done:
+				return
+			}
+			first += len(chunk.records) + len(chunk.rows)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				var cols *Columns
+				record := func(row int) map[string]interface{} { return chunk.records[row] }
+				if chunk.rows != nil && stream.WriteDetails == nil {
+					cols = encoder.encode(chunk.rows)
+					record = func(row int) map[string]interface{} {
+						records := []map[string]interface{}{utils.RowRecord(stream.Columns, chunk.rows[row])}
+						ApplyCategoryGroups(records, stream.Groups)
+						return records[0]
+					}
+				} else {
+					if chunk.rows != nil {
+						// Explanations and SHAP values are computed on records
+						chunk.records = make([]map[string]interface{}, len(chunk.rows))
+						for i, row := range chunk.rows {
+							chunk.records[i] = utils.RowRecord(stream.Columns, row)
+						}
+					}
+					ApplyCategoryGroups(chunk.records, stream.Groups)
+					cols = compiled.Encode(chunk.records)
+				}
+				chunk.predictions = make([]interface{}, cols.rows)
+				chunk.unseen = make(map[string]int)
+				row, err := compiled.predictRows(record, cols, chunk.predictions, chunk.unseen)
+				if err != nil {
+					chunk.err = fmt.Errorf("record %d: %w", chunk.first+row+1, err)
+				}
+				if chunk.err == nil && stream.WriteDetails != nil {
+					chunk.details, chunk.err = detailChunk(chunk, tree, stream)
+				}
+				select {
+				case results <- chunk:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Write chunks in input order, holding back those that finish early
+	summary := &PredictSummary{Unseen: make(map[string]int)}
+	pending := make(map[int]*streamChunk)
+	next := 0
+	var err error
+	for chunk := range results {
+		if err != nil {
+			continue
+		}
+		pending[chunk.seq] = chunk
+		for chunk, ok := pending[next]; ok; chunk, ok = pending[next] {
+			delete(pending, next)
+			next++
+			switch {
+			case chunk.err != nil:
+				err = chunk.err
+			case stream.WriteDetails != nil:
+				err = stream.WriteDetails(chunk.predictions, chunk.details)
+			default:
+				err = stream.Write(chunk.predictions)
+			}
+			if err != nil {
+				stop()
+				break
+			}
+
+			summary.Records += len(chunk.predictions)
+			for feature, count := range chunk.unseen {
+				summary.Unseen[feature] += count
+			}
+			<-slots
+			if stream.Progress != nil {
+				stream.Progress(summary.Records)
+			}
+		}
+	}
+
+	stop()
+	<-readDone
+	if err == nil {
+		err = utils.Canceled(parent, "prediction")
+	}
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// detailChunk gathers the details the stream asks for about every record of
+// a scored chunk
+func detailChunk(chunk *streamChunk, tree *models.TreeNode, stream Stream) ([]Details, error) {
+	details := make([]Details, len(chunk.records))
+	for i, record := range chunk.records {
+		var err error
+		if stream.Explain {
+			details[i].Explanation, err = Explain(record, tree)
+		}
+		if err == nil && stream.SHAP != nil {
+			details[i].SHAP, err = stream.SHAP.Explain(record)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", chunk.first+i+1, err)
+		}
+	}
+	return details, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"dt/algorithm"
+	"dt/export"
+	"dt/models"
+	"dt/utils"
+)
+
+// runCodegen compiles a trained model into standalone source code. When an
+// input CSV is given, a test checking the generated code against the model's
+// own predictions on those records is written next to it.
+func runCodegen(ctx context.Context) error {
+	if *utils.LangPtr != "go" {
+		return fmt.Errorf("unsupported codegen language %q, expected go", *utils.LangPtr)
+	}
+	if *utils.UnseenPtr != algorithm.UnseenMissing && *utils.UnseenPtr != algorithm.UnseenParent {
+		return fmt.Errorf("generated code only supports the %q and %q unseen category policies",
+			algorithm.UnseenMissing, algorithm.UnseenParent)
+	}
+
+	modelData, err := utils.LoadModels()
+	if err != nil {
+		return fmt.Errorf("failed to load model: %w", err)
+	}
+
+	if err := writeFile(*utils.OutputPtr, func(file *os.File) error {
+		return export.WriteGo(file, modelData, *utils.PackagePtr, *utils.UnseenPtr)
+	}); err != nil {
+		return fmt.Errorf("failed to generate code: %w", err)
+	}
+	slog.Info("go code written", "output", *utils.OutputPtr)
+
+	if *utils.InputPtr == "" {
+		return nil
+	}
+
+	// Keep the raw records for the test; prediction sees them grouped
+	if err := utils.LoadPredictionData(ctx); err != nil {
+		return fmt.Errorf("failed to load sample data: %w", err)
+	}
+	records := make([]map[string]interface{}, len(models.Records))
+	for i, record := range models.Records {
+		records[i] = make(map[string]interface{}, len(record))
+		for column, value := range record {
+			records[i][column] = value
+		}
+	}
+	algorithm.ApplyCategoryGroups(models.Records, modelData.CategoryGroups)
+	predictions, err := algorithm.Predict(ctx, modelData.Tree)
+	if err != nil {
+		return fmt.Errorf("failed to make predictions: %w", err)
+	}
+
+	testPath := strings.TrimSuffix(*utils.OutputPtr, ".go") + "_test.go"
+	if err := writeFile(testPath, func(file *os.File) error {
+		return export.WriteGoTest(file, *utils.PackagePtr, records, predictions)
+	}); err != nil {
+		return fmt.Errorf("failed to generate test: %w", err)
+	}
+	slog.Info("go test written", "output", testPath)
+	return nil
+}
+
+// writeFile creates a file and hands it to write
+func writeFile(path string, write func(*os.File) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"dt/algorithm"
+	"dt/models"
+	"dt/utils"
+)
+
+// counterfactualRow is what the search found for one input row
+type counterfactualRow struct {
+	Row             int                        `json:"row"` // Index of the record in the input, from 1
+	Prediction      interface{}                `json:"prediction"`
+	Counterfactuals []algorithm.Counterfactual `json:"counterfactuals"` // Cheapest first, empty when none was found
+}
+
+// runCounterfactual searches the cheapest changes that would make the model
+// predict -class for every -i row it predicts otherwise, and writes them to
+// -o, or to stdout when no output is given, as a table or as JSON Lines
+func runCounterfactual(ctx context.Context) error {
+	format := *utils.FormatPtr
+	if format == "" {
+		format = "text"
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown counterfactual format %q, expected text or json", format)
+	}
+	if *utils.ClassPtr == "" {
+		return errors.New("please provide the class to reach with -class")
+	}
+	if *utils.TopPtr < 0 {
+		return fmt.Errorf("-top must not be negative, got %d", *utils.TopPtr)
+	}
+	if *utils.ChunkSizePtr <= 0 {
+		return fmt.Errorf("chunk size must be positive, got %d", *utils.ChunkSizePtr)
+	}
+	if err := algorithm.CheckUnseenPolicy(); err != nil {
+		return err
+	}
+	costs, err := parseNamedNumbers(*utils.CostsPtr, "cost")
+	if err != nil {
+		return err
+	}
+	var immutable []string
+	for _, feature := range strings.Split(*utils.ImmutablePtr, ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			immutable = append(immutable, feature)
+		}
+	}
+
+	modelData, err := utils.LoadModels()
+	if err != nil {
+		return fmt.Errorf("failed to load model: %w", err)
+	}
+	search, err := algorithm.NewCounterfactualSearch(modelData, algorithm.CounterfactualOptions{
+		Class:     *utils.ClassPtr,
+		Immutable: immutable,
+		Costs:     costs,
+		Limit:     *utils.TopPtr,
+	})
+	if err != nil {
+		return err
+	}
+	reader, err := utils.OpenPredictionData()
+	if err != nil {
+		return fmt.Errorf("failed to load input data: %w", err)
+	}
+	defer reader.Close()
+
+	output := io.Writer(os.Stdout)
+	if *utils.OutputPtr != "" {
+		file, err := os.Create(*utils.OutputPtr)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer file.Close()
+		output = file
+	}
+	buffer := bufio.NewWriter(output)
+	var write func(rows []counterfactualRow) error
+	if format == "json" {
+		encoder := json.NewEncoder(buffer)
+		encoder.SetEscapeHTML(false)
+		write = func(rows []counterfactualRow) error {
+			for _, row := range rows {
+				if err := encoder.Encode(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	} else {
+		// Columns are aligned within each chunk
+		tw := tabwriter.NewWriter(buffer, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ROW\tPREDICTION\tCOST\tCHANGES")
+		write = func(rows []counterfactualRow) error {
+			writeCounterfactualTable(tw, rows)
+			return tw.Flush()
+		}
+	}
+
+	// Rows are searched chunk by chunk, with the grouping of rare categories
+	// learned during training
+	compiled := algorithm.Compile(modelData.Tree, *utils.UnseenPtr)
+	searched, unreachable, first := 0, 0, 0
+	for {
+		if err := utils.Canceled(ctx, "counterfactual search"); err != nil {
+			return err
+		}
+		records, err := reader.ReadChunk(*utils.ChunkSizePtr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load input data: %w", err)
+		}
+		algorithm.ApplyCategoryGroups(records, modelData.CategoryGroups)
+		predictions, err := compiled.Predict(records, nil)
+		if err != nil {
+			return fmt.Errorf("failed to make predictions: %w", err)
+		}
+
+		var rows []counterfactualRow
+		for i, record := range records {
+			if models.GetValueKey(predictions[i]) == *utils.ClassPtr {
+				continue
+			}
+			row := counterfactualRow{Row: first + i + 1, Prediction: predictions[i], Counterfactuals: search.Search(record)}
+			if row.Counterfactuals == nil {
+				row.Counterfactuals = []algorithm.Counterfactual{}
+				unreachable++
+			}
+			rows = append(rows, row)
+		}
+		first += len(records)
+		searched += len(rows)
+		if err := write(rows); err != nil {
+			return fmt.Errorf("failed to write counterfactuals: %w", err)
+		}
+	}
+
+	if err := buffer.Flush(); err != nil {
+		return fmt.Errorf("failed to write counterfactuals: %w", err)
+	}
+	if file, ok := output.(*os.File); ok && file != os.Stdout {
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to write counterfactuals: %w", err)
+		}
+	}
+	slog.Info("counterfactual search completed", "rows", first, "searched", searched,
+		"without_counterfactual", unreachable, "class", *utils.ClassPtr)
+	return nil
+}
+
+// writeCounterfactualTable writes one tab-separated line per counterfactual,
+// such as "2	N	1	Credit_History: 0 -> 1"
+func writeCounterfactualTable(tw io.Writer, rows []counterfactualRow) {
+	for _, row := range rows {
+		prediction := models.GetValueKey(row.Prediction)
+		if len(row.Counterfactuals) == 0 {
+			fmt.Fprintf(tw, "%d\t%s\t-\tnone found\n", row.Row, prediction)
+		}
+		for _, counterfactual := range row.Counterfactuals {
+			changes := make([]string, len(counterfactual.Changes))
+			for i, change := range counterfactual.Changes {
+				changes[i] = fmt.Sprintf("%s: %s -> %s", change.Feature, formatValue(change.From), formatValue(change.To))
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", row.Row, prediction,
+				strconv.FormatFloat(counterfactual.Cost, 'g', 6, 64), strings.Join(changes, ", "))
+		}
+	}
+}
+
+// formatValue prints a feature value, "missing" for none
+func formatValue(value interface{}) string {
+	if value == nil {
+		return "missing"
+	}
+	return models.GetValueKey(value)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"dt/algorithm"
+	"dt/utils"
+)
+
+// detailsFunc writes the predictions of a chunk with their details
+type detailsFunc func(predictions []interface{}, details []algorithm.Details) error
+
+// explanationLine is one line of the -explain-file sidecar
+type explanationLine struct {
+	Row int `json:"row"` // Index of the record in the input, from 1
+	*algorithm.Explanation
+	Text string `json:"explanation"` // The path on one line, as in the explanation column
+}
+
+// detailColumns names the columns predict adds after the prediction: the
+// explanation with -explain, then the SHAP base value and the SHAP value of
+// each of shapFeatures with -shap
+func detailColumns(shapFeatures []string) []string {
+	var columns []string
+	if *utils.ExplainPtr && *utils.ExplainFilePtr == "" {
+		columns = append(columns, "explanation")
+	}
+	if *utils.SHAPPtr {
+		columns = append(columns, "shap_base")
+		for _, feature := range shapFeatures {
+			columns = append(columns, "shap_"+feature)
+		}
+	}
+	return columns
+}
+
+// detailsWriter returns the writer of predict -explain and -shap and a
+// function closing what it opened. Details go to the columns named by
+// detailColumns, except explanations, which go to the -explain-file JSONL
+// sidecar when one is given.
+func detailsWriter(predictions *utils.PredictionWriter, shapFeatures []string) (detailsFunc, func() error, error) {
+	explainColumn := *utils.ExplainPtr && *utils.ExplainFilePtr == ""
+	cells := func(details []algorithm.Details) [][]string {
+		rows := make([][]string, len(details))
+		for i, detail := range details {
+			if explainColumn {
+				rows[i] = append(rows[i], detail.Explanation.String())
+			}
+			if shap := detail.SHAP; shap != nil {
+				rows[i] = append(rows[i], strconv.FormatFloat(shap.Base, 'g', -1, 64))
+				for _, feature := range shapFeatures {
+					rows[i] = append(rows[i], strconv.FormatFloat(shap.Values[feature], 'g', -1, 64))
+				}
+			}
+		}
+		return rows
+	}
+	if *utils.ExplainFilePtr == "" {
+		write := func(preds []interface{}, details []algorithm.Details) error {
+			return predictions.WriteWith(preds, cells(details))
+		}
+		return write, func() error { return nil }, nil
+	}
+
+	file, err := os.Create(*utils.ExplainFilePtr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create explanation file: %w", err)
+	}
+	buffer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false) // Keep conditions such as "< 0.5" readable
+	row := 0
+	write := func(preds []interface{}, details []algorithm.Details) error {
+		if err := predictions.WriteWith(preds, cells(details)); err != nil {
+			return err
+		}
+		for _, detail := range details {
+			row++
+			line := explanationLine{Row: row, Explanation: detail.Explanation, Text: detail.Explanation.String()}
+			if err := encoder.Encode(line); err != nil {
+				return fmt.Errorf("failed to write explanation: %w", err)
+			}
+		}
+		return nil
+	}
+	closeFile := func() error {
+		if err := buffer.Flush(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write explanations: %w", err)
+		}
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to close explanation file: %w", err)
+		}
+		return nil
+	}
+	return write, closeFile, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"dt/export"
+	"dt/models"
+	"dt/onnx"
+	"dt/pmml"
+	"dt/utils"
+)
+
+// modelWriter renders a loaded model to a writer
+type modelWriter func(io.Writer, *models.ModelData) error
+
+// exporters maps each -format value of the export command to its renderer
+var exporters = map[string]modelWriter{
+	"dot":     export.WriteDOT,
+	"mermaid": export.WriteMermaid,
+	"svg":     export.WriteSVG,
+	"pmml":    withUnseenPolicy(pmml.Write),
+	"onnx":    withUnseenPolicy(onnx.Write),
+}
+
+// withUnseenPolicy adapts a writer that routes unseen categories by policy to
+// the -unseen setting
+func withUnseenPolicy(write func(io.Writer, *models.ModelData, string) error) modelWriter {
+	return func(w io.Writer, model *models.ModelData) error {
+		return write(w, model, *utils.UnseenPtr)
+	}
+}
+
+// ruleWriters maps each -format value of the rules command to its writer
+var ruleWriters = map[string]modelWriter{
+	"text": export.WriteRulesText,
+	"json": export.WriteRulesJSON,
+	"sql":  withUnseenPolicy(export.WriteRulesSQL),
+}
+
+// runExport renders a trained model as a diagram or an interchange format
+func runExport(context.Context) error {
+	format := *utils.FormatPtr
+	if format == "" {
+		format = "dot"
+	}
+	write, ok := exporters[format]
+	if !ok {
+		return fmt.Errorf("unknown export format %q, expected dot, mermaid, svg, pmml or onnx", format)
+	}
+
+	if err := writeModel(write); err != nil {
+		return fmt.Errorf("failed to export model: %w", err)
+	}
+	slog.Info("tree exported", "format", format, "output", *utils.OutputPtr)
+	return nil
+}
+
+// runRules writes a trained model as an ordered list of if/else rules
+func runRules(context.Context) error {
+	format := *utils.FormatPtr
+	if format == "" {
+		format = "text"
+	}
+	write, ok := ruleWriters[format]
+	if !ok {
+		return fmt.Errorf("unknown rules format %q, expected text, json or sql", format)
+	}
+
+	if err := writeModel(write); err != nil {
+		return fmt.Errorf("failed to write rules: %w", err)
+	}
+	slog.Info("rules written", "format", format, "output", *utils.OutputPtr)
+	return nil
+}
+
+// writeModel loads the model given with -m and renders it to the -o file
+func writeModel(write modelWriter) error {
+	modelData, err := utils.LoadModels()
+	if err != nil {
+		return fmt.Errorf("failed to load model: %w", err)
+	}
+
+	file, err := os.Create(*utils.OutputPtr)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	if err := write(file, modelData); err != nil {
+		return err
+	}
+	return file.Close()
+}
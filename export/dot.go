@@ -0,0 +1,42 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"dt/models"
+)
+
+// WriteDOT renders the tree as a Graphviz digraph
+func WriteDOT(w io.Writer, model *models.ModelData) error {
+	nodes, edges := buildGraph(model.Tree)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "digraph %s {\n", dotQuote("Tree for "+model.TargetColumn))
+	fmt.Fprintln(out, `  node [shape=box, style="rounded,filled", fontname="Helvetica"];`)
+	fmt.Fprintln(out, `  edge [fontname="Helvetica"];`)
+
+	for _, node := range nodes {
+		fill := "#dae8fc"
+		if node.Leaf {
+			fill = "#d5e8d4"
+		}
+		fmt.Fprintf(out, "  n%d [label=%s, fillcolor=%q];\n", node.ID, dotQuote(strings.Join(node.Lines, "\n")), fill)
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(out, "  n%d -> n%d [label=%s];\n", edge.From, edge.To, dotQuote(edge.Label))
+	}
+
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+// dotQuote quotes a string for use as a DOT identifier
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,279 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"dt/algorithm"
+	"dt/internal/testmodel"
+	"dt/models"
+	"dt/utils"
+)
+
+func TestWriters(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(io.Writer, *models.ModelData) error
+		want  []string
+	}{
+		{
+			name:  "DOT",
+			write: WriteDOT,
+			want: []string{
+				`digraph "Tree for Approved" {`,
+				`n0 [label="Credit_History < 0.5\nsamples = 12\nvalue = [No: 5, Yes: 7]\nclass = Yes"`,
+				`n0 -> n1 [label="< 0.5"];`,
+				`n2 -> n3 [label="= Rural"];`,
+				`label="in {Not \"Graduate\"}"`,
+			},
+		},
+		{
+			name:  "Mermaid",
+			write: WriteMermaid,
+			want: []string{
+				"flowchart TD",
+				`n0["Credit_History #lt; 0.5<br/>samples = 12<br/>value = [No: 5, Yes: 7]<br/>class = Yes"]`,
+				`n1(["samples = 3<br/>value = [No: 3]<br/>class = No"])`,
+				`n0 -->|"#gt;= 0.5"| n2`,
+			},
+		},
+		{
+			name:  "SVG",
+			write: WriteSVG,
+			want: []string{
+				`<svg xmlns="http://www.w3.org/2000/svg"`,
+				"Credit_History &lt; 0.5",
+				"class = No",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.write(&buf, testmodel.Loan()); err != nil {
+				t.Fatalf("write returned an error: %v", err)
+			}
+			out := buf.String()
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output missing %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSVGIsWellFormed(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSVG(&buf, testmodel.Loan()); err != nil {
+		t.Fatalf("WriteSVG returned an error: %v", err)
+	}
+
+	decoder := xml.NewDecoder(&buf)
+	rects := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid SVG: %v", err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "rect" {
+			rects++
+		}
+	}
+	if rects != 8 {
+		t.Errorf("expected 8 node boxes, got %d", rects)
+	}
+}
+
+func TestExtractRules(t *testing.T) {
+	ruleSet := ExtractRules(testmodel.Loan())
+
+	if ruleSet.Default != "Yes" || len(ruleSet.Rules) != 5 {
+		t.Fatalf("expected 5 rules with default Yes, got %+v", ruleSet)
+	}
+
+	// The most supported of the fully confident rules comes first
+	first := ruleSet.Rules[0]
+	if first.Prediction != "Yes" || first.Samples != 4 ||
+		first.Support != 4.0/12 || first.Confidence != 1 {
+		t.Errorf("unexpected first rule %+v", first)
+	}
+	want := "Credit_History >= 0.5 AND Property_Area = Urban"
+	got := make([]string, len(first.Conditions))
+	for i, condition := range first.Conditions {
+		got[i] = condition.String()
+	}
+	if strings.Join(got, " AND ") != want {
+		t.Errorf("expected conditions %q, got %q", want, strings.Join(got, " AND "))
+	}
+}
+
+func TestSimplifyConditions(t *testing.T) {
+	conditions := []Condition{
+		{Feature: "income", Operator: "<", Value: 5000},
+		{Feature: "area", Operator: "in", Values: []string{"Rural", "Urban", "Semiurban"}},
+		{Feature: "income", Operator: ">=", Value: 1000},
+		{Feature: "income", Operator: "<", Value: 3000},
+		{Feature: "area", Operator: "in", Values: []string{"Rural", "Urban"}},
+		{Feature: "income", Operator: ">=", Value: 2000},
+		{Feature: "area", Operator: "=", Value: "Urban"},
+	}
+
+	got := SimplifyConditions(conditions)
+	want := []string{"income < 3000", "area = Urban", "income >= 2000"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d conditions, got %v", len(want), got)
+	}
+	for i, condition := range got {
+		if condition.String() != want[i] {
+			t.Errorf("condition %d: expected %q, got %q", i, want[i], condition.String())
+		}
+	}
+}
+
+func TestWriteRulesSQL(t *testing.T) {
+	// NULLs take the Credit_History >= 0.5, Rural and Graduate branches, and
+	// the rare category bucket matches every area not kept
+	const (
+		history = `("Credit_History" >= 0.5 OR "Credit_History" IS NULL)`
+		rural   = `("Property_Area" = 'Rural' OR "Property_Area" IS NULL)`
+	)
+	shared := []string{
+		`  WHEN ` + history + ` AND "Property_Area" = 'Urban' THEN 'Yes'`,
+		`  WHEN "Credit_History" < 0.5 THEN 'No'`,
+		`  WHEN ` + history + ` AND ` + rural + ` AND "Education" = 'Not "Graduate"' THEN 'No'`,
+		`  WHEN ` + history + ` AND "Property_Area" NOT IN ('Rural', 'Urban') THEN 'No'`,
+	}
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		// Unseen educations follow NULLs
+		{algorithm.UnseenMissing, []string{
+			`  WHEN ` + history + ` AND ` + rural + ` AND ("Education" <> 'Not "Graduate"' OR "Education" IS NULL) THEN 'Yes'`,
+		}},
+		// Unseen educations get the majority class of the Education split
+		{algorithm.UnseenParent, []string{
+			`  WHEN ` + history + ` AND ` + rural + ` AND ("Education" IN ('Graduate', 'Post Graduate') OR "Education" IS NULL) THEN 'Yes'`,
+			`  WHEN ` + history + ` AND ` + rural + ` AND "Education" NOT IN ('Graduate', 'Post Graduate', 'Not "Graduate"') THEN 'Yes'`,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteRulesSQL(&buf, testmodel.Loan(), tt.policy); err != nil {
+				t.Fatalf("WriteRulesSQL returned an error: %v", err)
+			}
+			out := buf.String()
+
+			want := append(slices.Clone(shared), tt.want...)
+			if whens := strings.Count(out, "  WHEN "); whens != len(want) {
+				t.Errorf("expected %d WHEN clauses, got %d:\n%s", len(want), whens, out)
+			}
+			for _, line := range append(want, "CASE\n", "  ELSE 'Yes'\nEND AS \"Approved\"\n") {
+				if !strings.Contains(out, line) {
+					t.Errorf("output missing %q:\n%s", line, out)
+				}
+			}
+		})
+	}
+
+	if err := WriteRulesSQL(io.Discard, testmodel.Loan(), algorithm.UnseenFail); err == nil {
+		t.Error("WriteRulesSQL accepted the fail policy")
+	}
+}
+
+func TestWriteGo(t *testing.T) {
+	for _, policy := range []string{algorithm.UnseenMissing, algorithm.UnseenParent} {
+		t.Run(policy, func(t *testing.T) {
+			testWriteGo(t, policy)
+		})
+	}
+	if err := WriteGo(io.Discard, testmodel.Loan(), "loanmodel", algorithm.UnseenBlend); err == nil {
+		t.Error("WriteGo accepted the blend policy")
+	}
+
+	dated := testmodel.Loan()
+	dated.Tree.Feature, dated.Tree.SplitValue = "Applied", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := WriteGo(io.Discard, dated, "loanmodel", algorithm.UnseenMissing); err == nil {
+		t.Error("WriteGo accepted a date threshold")
+	}
+}
+
+// testWriteGo checks the generated code against Predict under an unseen policy
+func testWriteGo(t *testing.T, policy string) {
+	defer func() { *utils.UnseenPtr = algorithm.UnseenMissing }()
+	*utils.UnseenPtr = policy
+	model := testmodel.Loan()
+	// Unseen educations then predict No under the parent policy and Yes
+	// under the missing one
+	model.Tree.Right.Children["Rural"].Prediction = "No"
+	records := testmodel.LoanRecords()
+
+	// Expected labels come from the interpreter on grouped copies
+	models.Records = make([]map[string]interface{}, len(records))
+	for i, record := range records {
+		models.Records[i] = make(map[string]interface{})
+		for column, value := range record {
+			models.Records[i][column] = value
+		}
+	}
+	algorithm.ApplyCategoryGroups(models.Records, model.CategoryGroups)
+	expected, err := algorithm.Predict(context.Background(), model.Tree)
+	if err != nil {
+		t.Fatalf("Predict returned an error: %v", err)
+	}
+
+	var code, test bytes.Buffer
+	if err := WriteGo(&code, model, "loanmodel", policy); err != nil {
+		t.Fatalf("WriteGo returned an error: %v", err)
+	}
+	if err := WriteGoTest(&test, "loanmodel", records, expected); err != nil {
+		t.Fatalf("WriteGoTest returned an error: %v", err)
+	}
+	for _, want := range []string{"package loanmodel", "func Predict(features Features) string {", `case "Urban":`} {
+		if !strings.Contains(code.String(), want) {
+			t.Errorf("generated code missing %q", want)
+		}
+	}
+
+	// Compile and run the generated test when a Go toolchain is available
+	goBin, err := exec.LookPath("go")
+	if err != nil || testing.Short() {
+		t.Skip("skipping compilation of generated code")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":            "module loanmodel\n\ngo 1.21\n",
+		"loanmodel.go":      code.String(),
+		"loanmodel_test.go": test.String(),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	// vet reports unreachable code, such as a return after a switch with a default
+	for _, command := range []string{"vet", "test"} {
+		cmd := exec.Command(goBin, command, "./...")
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go %s failed on the generated code: %v\n%s", command, err, out)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package export
+
+import (
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// WriteGo compiles the tree into a standalone Go source file with a
+// Predict(Features) string function built from nested if/switch statements.
+// The generated code follows the predictor: missing values take the branch
+// with the most leaves, and unseen categories follow them under the
+// algorithm.UnseenMissing policy or get the majority class of the splitting
+// node under algorithm.UnseenParent. Other policies are not supported, nor
+// are splits on dates or text, whose thresholds are not numbers.
+func WriteGo(w io.Writer, model *models.ModelData, pkg, unseen string) error {
+	if unseen != algorithm.UnseenMissing && unseen != algorithm.UnseenParent {
+		return fmt.Errorf("generated code does not support the %q unseen category policy", unseen)
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// Code generated by dt codegen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "// Package %s predicts %s with a compiled decision tree.\n", pkg, model.TargetColumn)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	b.WriteString("import (\n\t\"fmt\"\n\t\"strconv\"\n)\n\n")
+	b.WriteString("// Features holds the values of one record keyed by column name.\n")
+	b.WriteString("// Missing values are absent keys or nil.\n")
+	b.WriteString("type Features map[string]interface{}\n\n")
+
+	if len(model.CategoryGroups) > 0 {
+		writeGoCategoryGroups(&b, model.CategoryGroups)
+	}
+
+	fmt.Fprintf(&b, "// Predict returns the predicted %s for a record.\n", model.TargetColumn)
+	b.WriteString("func Predict(features Features) string {\n")
+	if len(model.CategoryGroups) > 0 {
+		b.WriteString("features = groupCategories(features)\n")
+	}
+	if model.Tree != nil {
+		if err := writeGoNode(&b, model.Tree, unseen); err != nil {
+			return err
+		}
+	} else {
+		b.WriteString("return \"unknown\"\n")
+	}
+	b.WriteString("}\n\n")
+	b.WriteString(goHelpers)
+
+	source, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return fmt.Errorf("failed to format generated code: %w", err)
+	}
+	_, err = w.Write(source)
+	return err
+}
+
+// writeGoNode emits the statements that predict from one node. Thresholds
+// must be numbers: the generated code has no comparison for dates or text.
+func writeGoNode(b *strings.Builder, node *models.TreeNode, unseen string) error {
+	if node.IsLeaf {
+		fmt.Fprintf(b, "return %s\n", goLabel(node.Prediction))
+		return nil
+	}
+
+	feature := strconv.Quote(node.Feature)
+	missing := algorithm.MissingValueChild(node)
+
+	switch node.SplitType {
+	case "categorical":
+		keys := make([]string, 0, len(node.Children))
+		missingKey := ""
+		for key, child := range node.Children {
+			keys = append(keys, key)
+			if child == missing {
+				missingKey = key
+			}
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(b, "// %s\n", node.Feature)
+		fmt.Fprintf(b, "switch categoryKey(features[%s], %s) {\n", feature, strconv.Quote(missingKey))
+		for _, key := range keys {
+			if key == missingKey {
+				writeGoUnseen(b, node, unseen)
+			}
+			fmt.Fprintf(b, "case %s:\n", strconv.Quote(key))
+			if err := writeGoNode(b, node.Children[key], unseen); err != nil {
+				return err
+			}
+		}
+		b.WriteString("}\n")
+		if missingKey == "" {
+			writeGoUnseenReturn(b, node)
+		}
+	case "subset":
+		missingKey := ""
+		if missing == node.Left && len(node.LeftCategories) > 0 {
+			missingKey = node.LeftCategories[0]
+		} else if missing == node.Right && len(node.RightCategories) > 0 {
+			missingKey = node.RightCategories[0]
+		}
+
+		fmt.Fprintf(b, "// %s in %s\n", node.Feature, formatSet(node.LeftCategories))
+		fmt.Fprintf(b, "switch categoryKey(features[%s], %s) {\n", feature, strconv.Quote(missingKey))
+		sides := []struct {
+			categories []string
+			child      *models.TreeNode
+		}{
+			{node.LeftCategories, node.Left},
+			{node.RightCategories, node.Right},
+		}
+		for _, side := range sides {
+			if side.child == nil || len(side.categories) == 0 {
+				continue
+			}
+			if side.child == missing {
+				writeGoUnseen(b, node, unseen)
+			}
+			quoted := make([]string, len(side.categories))
+			for i, category := range side.categories {
+				quoted[i] = strconv.Quote(category)
+			}
+			fmt.Fprintf(b, "case %s:\n", strings.Join(quoted, ", "))
+			if err := writeGoNode(b, side.child, unseen); err != nil {
+				return err
+			}
+		}
+		b.WriteString("}\n")
+		if missingKey == "" {
+			writeGoUnseenReturn(b, node)
+		}
+	default:
+		threshold, ok := models.ToFloat(node.SplitValue)
+		if !ok {
+			return fmt.Errorf("generated code does not support the non-numeric threshold %v of feature %s",
+				node.SplitValue, node.Feature)
+		}
+		fmt.Fprintf(b, "// %s < %v\n", node.Feature, node.SplitValue)
+		fmt.Fprintf(b, "if less(features[%s], %s, %t) {\n", feature, goFloat(threshold), missing == node.Left)
+		if err := writeGoChild(b, node, node.Left, unseen); err != nil {
+			return err
+		}
+		b.WriteString("} else {\n")
+		if err := writeGoChild(b, node, node.Right, unseen); err != nil {
+			return err
+		}
+		b.WriteString("}\n")
+	}
+	return nil
+}
+
+// writeGoChild emits a child branch, falling back to the node's prediction
+// when the child does not exist
+func writeGoChild(b *strings.Builder, node, child *models.TreeNode, unseen string) error {
+	if child == nil {
+		fmt.Fprintf(b, "return %s\n", goLabel(node.Prediction))
+		return nil
+	}
+	return writeGoNode(b, child, unseen)
+}
+
+// writeGoUnseen emits the default case for unseen categories. They fall
+// through to the missing value branch that follows, unless the parent policy
+// returns the node's prediction.
+func writeGoUnseen(b *strings.Builder, node *models.TreeNode, unseen string) {
+	b.WriteString("default:\n")
+	if unseen == algorithm.UnseenParent && node.Prediction != nil {
+		fmt.Fprintf(b, "return %s\n", goLabel(node.Prediction))
+		return
+	}
+	b.WriteString("fallthrough\n")
+}
+
+// writeGoUnseenReturn emits the return after a switch with no missing branch,
+// and so no default case
+func writeGoUnseenReturn(b *strings.Builder, node *models.TreeNode) {
+	b.WriteString("// Unseen category\n")
+	fmt.Fprintf(b, "return %s\n", goLabel(node.Prediction))
+}
+
+// writeGoCategoryGroups emits the rare category mapping learned in training
+func writeGoCategoryGroups(b *strings.Builder, groups map[string][]string) {
+	features := make([]string, 0, len(groups))
+	for feature := range groups {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	b.WriteString("// keptCategories lists, per grouped feature, the categories kept as-is.\n")
+	b.WriteString("var keptCategories = map[string]map[string]bool{\n")
+	for _, feature := range features {
+		fmt.Fprintf(b, "%s: {", strconv.Quote(feature))
+		for _, category := range groups[feature] {
+			fmt.Fprintf(b, "%s: true, ", strconv.Quote(category))
+		}
+		b.WriteString("},\n")
+	}
+	b.WriteString("}\n\n")
+
+	fmt.Fprintf(b, `// groupCategories maps values of grouped features that were rare or unseen
+// in training to %q.
+func groupCategories(features Features) Features {
+	grouped := make(Features, len(features))
+	for name, value := range features {
+		if kept, ok := keptCategories[name]; ok && value != nil && !kept[fmt.Sprint(value)] {
+			value = %q
+		}
+		grouped[name] = value
+	}
+	return grouped
+}
+
+`, algorithm.OtherCategory, algorithm.OtherCategory)
+}
+
+// goHelpers are the support functions every generated file needs
+const goHelpers = `// categoryKey returns the category of a value, or missing when it is nil.
+func categoryKey(value interface{}, missing string) string {
+	if value == nil {
+		return missing
+	}
+	return fmt.Sprint(value)
+}
+
+// less reports whether a value is below a threshold, or missingLeft when it is nil.
+func less(value interface{}, threshold float64, missingLeft bool) bool {
+	switch v := value.(type) {
+	case nil:
+		return missingLeft
+	case int:
+		return float64(v) < threshold
+	case int64:
+		return float64(v) < threshold
+	case float32:
+		return float64(v) < threshold
+	case float64:
+		return v < threshold
+	}
+	return fmt.Sprint(value) < strconv.FormatFloat(threshold, 'g', -1, 64)
+}
+`
+
+// WriteGoTest writes a test for the generated package that checks Predict
+// against the predictions the tree made for the same records
+func WriteGoTest(w io.Writer, pkg string, records []map[string]interface{}, expected []interface{}) error {
+	var b strings.Builder
+	usesTime := false
+	for _, record := range records {
+		for _, value := range record {
+			if _, ok := value.(time.Time); ok {
+				usesTime = true
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "// Code generated by dt codegen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	if usesTime {
+		b.WriteString("import (\n\t\"testing\"\n\t\"time\"\n)\n\n")
+	} else {
+		b.WriteString("import \"testing\"\n\n")
+	}
+
+	b.WriteString("// TestPredict checks the compiled tree against the predictions of the\n")
+	b.WriteString("// original model on the sample records.\n")
+	b.WriteString("func TestPredict(t *testing.T) {\n")
+	b.WriteString("tests := []struct {\nfeatures Features\nwant string\n}{\n")
+	for i, record := range records {
+		columns := make([]string, 0, len(record))
+		for column := range record {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		b.WriteString("{Features{")
+		for _, column := range columns {
+			fmt.Fprintf(&b, "%s: %s, ", strconv.Quote(column), goValue(record[column]))
+		}
+		fmt.Fprintf(&b, "}, %s},\n", goLabel(expected[i]))
+	}
+	b.WriteString("}\n\n")
+	b.WriteString(`for i, tt := range tests {
+if got := Predict(tt.features); got != tt.want {
+t.Errorf("record %d: Predict() = %q, want %q", i+1, got, tt.want)
+}
+}
+}
+`)
+
+	source, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return fmt.Errorf("failed to format generated test: %w", err)
+	}
+	_, err = w.Write(source)
+	return err
+}
+
+// goLabel writes a prediction as a Go string literal
+func goLabel(prediction interface{}) string {
+	if prediction == nil {
+		return strconv.Quote("unknown")
+	}
+	return strconv.Quote(fmt.Sprintf("%v", prediction))
+}
+
+// goValue writes a record value as a Go literal of the same type
+func goValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return "float64(" + goFloat(v) + ")"
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return strconv.Quote(v)
+	case time.Time:
+		return fmt.Sprintf("time.Date(%d, %d, %d, %d, %d, %d, %d, time.UTC)",
+			v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond())
+	}
+	return strconv.Quote(fmt.Sprintf("%v", value))
+}
+
+// goFloat writes a float64 literal that round-trips exactly
+func goFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEn") {
+		s += ".0"
+	}
+	return s
+}
@@ -0,0 +1,153 @@
+// Package export renders trained decision trees in formats meant for people
+// and other tools.
+package export
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"dt/models"
+)
+
+// graphNode is a tree node flattened for rendering
+type graphNode struct {
+	ID       int
+	Depth    int
+	Leaf     bool
+	Lines    []string
+	Children []int
+}
+
+// graphEdge connects a node to one of its children
+type graphEdge struct {
+	From  int
+	To    int
+	Label string
+}
+
+// buildGraph numbers the nodes of a tree depth-first, visiting categorical
+// children in key order and Left before Right, so output is stable
+func buildGraph(tree *models.TreeNode) ([]graphNode, []graphEdge) {
+	nodes := make([]graphNode, 0)
+	edges := make([]graphEdge, 0)
+
+	var visit func(node *models.TreeNode, depth int) int
+	visit = func(node *models.TreeNode, depth int) int {
+		id := len(nodes)
+		nodes = append(nodes, graphNode{
+			ID:    id,
+			Depth: depth,
+			Leaf:  node.IsLeaf,
+			Lines: nodeLines(node),
+		})
+
+		for _, branch := range Branches(node) {
+			childID := visit(branch.Node, depth+1)
+			nodes[id].Children = append(nodes[id].Children, childID)
+			edges = append(edges, graphEdge{From: id, To: childID, Label: branch.Label})
+		}
+		return id
+	}
+
+	if tree != nil {
+		visit(tree, 0)
+	}
+	return nodes, edges
+}
+
+// Branch is one outgoing edge of a decision node
+type Branch struct {
+	Label string
+	Key   string // Children key for categorical splits
+	Node  *models.TreeNode
+}
+
+// Branches lists the children of a node with the condition leading to each,
+// in a stable order
+func Branches(node *models.TreeNode) []Branch {
+	if node.IsLeaf {
+		return nil
+	}
+
+	branches := make([]Branch, 0)
+	switch node.SplitType {
+	case "categorical":
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			branches = append(branches, Branch{Label: "= " + key, Key: key, Node: node.Children[key]})
+		}
+	case "subset":
+		if node.Left != nil {
+			branches = append(branches, Branch{Label: "in " + formatSet(node.LeftCategories), Node: node.Left})
+		}
+		if node.Right != nil {
+			branches = append(branches, Branch{Label: "in " + formatSet(node.RightCategories), Node: node.Right})
+		}
+	default:
+		if node.Left != nil {
+			branches = append(branches, Branch{Label: fmt.Sprintf("< %v", node.SplitValue), Node: node.Left})
+		}
+		if node.Right != nil {
+			branches = append(branches, Branch{Label: fmt.Sprintf(">= %v", node.SplitValue), Node: node.Right})
+		}
+	}
+	return branches
+}
+
+// nodeLines describes a node: its split, sample count, class distribution
+// and majority prediction
+func nodeLines(node *models.TreeNode) []string {
+	lines := make([]string, 0, 4)
+	if !node.IsLeaf {
+		switch node.SplitType {
+		case "categorical":
+			lines = append(lines, node.Feature)
+		case "subset":
+			lines = append(lines, fmt.Sprintf("%s in %s", node.Feature, formatSet(node.LeftCategories)))
+		default:
+			lines = append(lines, fmt.Sprintf("%s < %v", node.Feature, node.SplitValue))
+		}
+	}
+	if node.Samples > 0 {
+		lines = append(lines, fmt.Sprintf("samples = %d", node.Samples))
+	}
+	if len(node.ClassCounts) > 0 {
+		lines = append(lines, "value = "+FormatDistribution(node.ClassCounts))
+	}
+	if node.Prediction != nil {
+		lines = append(lines, fmt.Sprintf("class = %v", node.Prediction))
+	}
+	return lines
+}
+
+// FormatDistribution writes class counts in class order, e.g. "[No: 3, Yes: 7]"
+func FormatDistribution(counts map[string]int) string {
+	classes := make([]string, 0, len(counts))
+	for class := range counts {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	parts := make([]string, len(classes))
+	for i, class := range classes {
+		parts[i] = fmt.Sprintf("%s: %d", class, counts[class])
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// maxSetItems caps how many categories a label lists before summarising
+const maxSetItems = 8
+
+// formatSet writes a category list as "{A, B}", shortening long lists
+func formatSet(categories []string) string {
+	if len(categories) > maxSetItems {
+		shown := strings.Join(categories[:maxSetItems], ", ")
+		return fmt.Sprintf("{%s, ... +%d more}", shown, len(categories)-maxSetItems)
+	}
+	return "{" + strings.Join(categories, ", ") + "}"
+}
@@ -0,0 +1,44 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"dt/models"
+)
+
+// WriteMermaid renders the tree as a Mermaid flowchart
+func WriteMermaid(w io.Writer, model *models.ModelData) error {
+	nodes, edges := buildGraph(model.Tree)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "flowchart TD")
+	for _, node := range nodes {
+		lines := make([]string, len(node.Lines))
+		for i, line := range node.Lines {
+			lines[i] = mermaidEscape(line)
+		}
+		label := strings.Join(lines, "<br/>")
+		if node.Leaf {
+			fmt.Fprintf(out, "  n%d([\"%s\"])\n", node.ID, label)
+		} else {
+			fmt.Fprintf(out, "  n%d[\"%s\"]\n", node.ID, label)
+		}
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(out, "  n%d -->|\"%s\"| n%d\n", edge.From, mermaidEscape(edge.Label), edge.To)
+	}
+	return out.Flush()
+}
+
+// mermaidEscape replaces characters that break quoted Mermaid labels
+func mermaidEscape(s string) string {
+	replacer := strings.NewReplacer(
+		`"`, "#quot;",
+		"<", "#lt;",
+		">", "#gt;",
+	)
+	return replacer.Replace(s)
+}
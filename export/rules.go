@@ -0,0 +1,504 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// Condition is a single test on a feature along the path to a leaf
+type Condition struct {
+	Feature  string      `json:"feature"`
+	Operator string      `json:"operator"`         // "<", ">=", "=" or "in"
+	Value    interface{} `json:"value,omitempty"`  // Threshold or category
+	Values   []string    `json:"values,omitempty"` // Categories for "in"
+}
+
+// Rule is the path to one leaf written as a conjunction of conditions
+type Rule struct {
+	Conditions []Condition `json:"conditions"`
+	Prediction interface{} `json:"prediction"`
+	Samples    int         `json:"samples"`
+	Support    float64     `json:"support"`    // Share of training rows covered by the rule
+	Confidence float64     `json:"confidence"` // Share of covered rows with the predicted class
+}
+
+// RuleSet is an ordered rule list with a default for rows no rule matches
+type RuleSet struct {
+	Target  string      `json:"target"`
+	Default interface{} `json:"default"`
+	Rules   []Rule      `json:"rules"`
+}
+
+// ExtractRules turns every leaf of the tree into a simplified rule. Rules are
+// ordered by confidence and then support, strongest first. They describe the
+// feature tests only: missing and unseen values follow the predictor's
+// fallbacks instead.
+func ExtractRules(model *models.ModelData) *RuleSet {
+	ruleSet := &RuleSet{Target: model.TargetColumn, Rules: make([]Rule, 0)}
+	if model.Tree == nil {
+		return ruleSet
+	}
+	ruleSet.Default = model.Tree.Prediction
+	total := model.Tree.Samples
+
+	var visit func(node *models.TreeNode, path []Condition)
+	visit = func(node *models.TreeNode, path []Condition) {
+		branches := Branches(node)
+		if len(branches) == 0 {
+			ruleSet.Rules = append(ruleSet.Rules, newRule(node, SimplifyConditions(path), total))
+			return
+		}
+
+		for _, branch := range branches {
+			condition := branchCondition(node, branch)
+			visit(branch.Node, append(path[:len(path):len(path)], condition))
+		}
+	}
+	visit(model.Tree, nil)
+
+	sort.SliceStable(ruleSet.Rules, func(i, j int) bool {
+		return stronger(ruleSet.Rules[i], ruleSet.Rules[j])
+	})
+	return ruleSet
+}
+
+// newRule returns the rule for the rows reaching node, out of total rows
+func newRule(node *models.TreeNode, conditions []Condition, total int) Rule {
+	rule := Rule{
+		Conditions: conditions,
+		Prediction: node.Prediction,
+		Samples:    node.Samples,
+	}
+	if total > 0 {
+		rule.Support = float64(node.Samples) / float64(total)
+	}
+	if node.Samples > 0 {
+		rule.Confidence = float64(node.ClassCounts[models.GetValueKey(node.Prediction)]) / float64(node.Samples)
+	}
+	return rule
+}
+
+// stronger orders rules by confidence and then support
+func stronger(a, b Rule) bool {
+	if a.Confidence != b.Confidence {
+		return a.Confidence > b.Confidence
+	}
+	return a.Support > b.Support
+}
+
+// branchCondition describes the test leading from a node to one of its children
+func branchCondition(node *models.TreeNode, branch Branch) Condition {
+	switch node.SplitType {
+	case "categorical":
+		return Condition{Feature: node.Feature, Operator: "=", Value: branch.Key}
+	case "subset":
+		values := node.RightCategories
+		if branch.Node == node.Left {
+			values = node.LeftCategories
+		}
+		return Condition{Feature: node.Feature, Operator: "in", Values: values}
+	}
+
+	if branch.Node == node.Left {
+		return Condition{Feature: node.Feature, Operator: "<", Value: node.SplitValue}
+	}
+	return Condition{Feature: node.Feature, Operator: ">=", Value: node.SplitValue}
+}
+
+// SimplifyConditions drops conditions implied by others on the same feature:
+// only the tightest upper and lower bound are kept, and category tests are
+// intersected into a single equality or set membership
+func SimplifyConditions(conditions []Condition) []Condition {
+	simplified := make([]Condition, 0, len(conditions))
+	position := make(map[string]int) // feature and operator kind -> index in simplified
+
+	for _, condition := range conditions {
+		kind := condition.Operator
+		if kind == "=" {
+			kind = "in"
+		}
+		key := condition.Feature + "\x00" + kind
+
+		i, seen := position[key]
+		if !seen {
+			position[key] = len(simplified)
+			simplified = append(simplified, condition)
+			continue
+		}
+
+		previous := &simplified[i]
+		switch kind {
+		case "<":
+			if models.CompareValues(condition.Value, previous.Value) < 0 {
+				previous.Value = condition.Value
+			}
+		case ">=":
+			if models.CompareValues(condition.Value, previous.Value) > 0 {
+				previous.Value = condition.Value
+			}
+		case "in":
+			*previous = intersectCategories(*previous, condition)
+		}
+	}
+	return simplified
+}
+
+// intersectCategories combines two category tests on the same feature
+func intersectCategories(a, b Condition) Condition {
+	categories := func(c Condition) []string {
+		if c.Operator == "=" {
+			return []string{models.GetValueKey(c.Value)}
+		}
+		return c.Values
+	}
+
+	allowed := make(map[string]bool)
+	for _, category := range categories(b) {
+		allowed[category] = true
+	}
+	common := make([]string, 0)
+	for _, category := range categories(a) {
+		if allowed[category] {
+			common = append(common, category)
+		}
+	}
+
+	if len(common) == 1 {
+		return Condition{Feature: a.Feature, Operator: "=", Value: common[0]}
+	}
+	return Condition{Feature: a.Feature, Operator: "in", Values: common}
+}
+
+// String writes a condition as e.g. "Property_Area in {Rural, Urban}"
+func (c Condition) String() string {
+	if c.Operator == "in" {
+		return fmt.Sprintf("%s in {%s}", c.Feature, strings.Join(c.Values, ", "))
+	}
+	return fmt.Sprintf("%s %s %v", c.Feature, c.Operator, c.Value)
+}
+
+// WriteRulesText writes the rule list as numbered IF ... THEN lines
+func WriteRulesText(w io.Writer, model *models.ModelData) error {
+	ruleSet := ExtractRules(model)
+
+	out := bufio.NewWriter(w)
+	for i, rule := range ruleSet.Rules {
+		conditions := make([]string, len(rule.Conditions))
+		for j, condition := range rule.Conditions {
+			conditions[j] = condition.String()
+		}
+		test := "TRUE"
+		if len(conditions) > 0 {
+			test = strings.Join(conditions, " AND ")
+		}
+		fmt.Fprintf(out, "Rule %d: IF %s THEN %s = %v (support %.1f%%, confidence %.1f%%, %d samples)\n",
+			i+1, test, ruleSet.Target, rule.Prediction, rule.Support*100, rule.Confidence*100, rule.Samples)
+	}
+	fmt.Fprintf(out, "Default: %s = %v\n", ruleSet.Target, ruleSet.Default)
+	return out.Flush()
+}
+
+// WriteRulesJSON writes the rule list as an indented JSON document
+func WriteRulesJSON(w io.Writer, model *models.ModelData) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(ExtractRules(model))
+}
+
+// WriteRulesSQL writes the rule list as a SQL CASE WHEN expression. The
+// conditions follow the predictor: NULLs take the branch with the most leaves,
+// and the rare category bucket of a grouped feature matches every value not
+// kept in training. Unseen categories follow NULLs under the
+// algorithm.UnseenMissing policy or get the majority class of the splitting
+// node under algorithm.UnseenParent. Other policies are not supported.
+func WriteRulesSQL(w io.Writer, model *models.ModelData, unseen string) error {
+	if unseen != algorithm.UnseenMissing && unseen != algorithm.UnseenParent {
+		return fmt.Errorf("SQL rules do not support the %q unseen category policy", unseen)
+	}
+
+	var rules []sqlRule
+	var fallback interface{}
+	if model.Tree != nil {
+		fallback = model.Tree.Prediction
+		total := model.Tree.Samples
+
+		add := func(node *models.TreeNode, path []sqlStep) {
+			if test, ok := sqlPathTest(path, unseen, model.CategoryGroups); ok {
+				rules = append(rules, sqlRule{Rule: newRule(node, nil, total), test: test})
+			}
+		}
+		var visit func(node *models.TreeNode, path []sqlStep)
+		visit = func(node *models.TreeNode, path []sqlStep) {
+			branches := Branches(node)
+			if len(branches) == 0 {
+				if len(path) > 0 {
+					add(node, path)
+				}
+				return
+			}
+			for _, branch := range branches {
+				visit(branch.Node, append(path[:len(path):len(path)], sqlStep{node, branch.Node}))
+			}
+			if unseen == algorithm.UnseenParent && node.Prediction != nil &&
+				(node.SplitType == "categorical" || node.SplitType == "subset") {
+				// Unseen categories stop here
+				add(node, append(path[:len(path):len(path)], sqlStep{node, nil}))
+			}
+		}
+		visit(model.Tree, nil)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return stronger(rules[i].Rule, rules[j].Rule)
+	})
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "CASE")
+	for _, rule := range rules {
+		fmt.Fprintf(out, "  WHEN %s THEN %s\n", rule.test, sqlLiteral(rule.Prediction))
+	}
+	fmt.Fprintf(out, "  ELSE %s\n", sqlLiteral(fallback))
+	fmt.Fprintf(out, "END AS %s\n", sqlIdentifier(model.TargetColumn))
+	return out.Flush()
+}
+
+// sqlRule is a rule with its conditions written as a SQL predicate
+type sqlRule struct {
+	Rule
+	test string
+}
+
+// sqlStep is one split on the path to a rule with the child taken, or nil
+// for unseen categories stopping at the split
+type sqlStep struct {
+	node, child *models.TreeNode
+}
+
+// sqlFeature gathers what the steps of a path require of one feature
+type sqlFeature struct {
+	name         string
+	lower, upper interface{} // Tightest bounds of numerical splits, nil when open
+	in           []string    // Categories allowed, nil when not restricted
+	notIn        []string    // Categories excluded
+	missing      bool        // Whether NULL passes every step
+}
+
+// sqlPathTest writes the conditions of a path as a SQL predicate. It returns
+// false when no row can take the path.
+func sqlPathTest(path []sqlStep, unseen string, groups map[string][]string) (string, bool) {
+	features := make([]*sqlFeature, 0)
+	position := make(map[string]int)
+	for _, step := range path {
+		node := step.node
+		i, seen := position[node.Feature]
+		if !seen {
+			i = len(features)
+			position[node.Feature] = i
+			features = append(features, &sqlFeature{name: node.Feature, missing: true})
+		}
+		feature := features[i]
+
+		missing := algorithm.MissingValueChild(node)
+		feature.missing = feature.missing && step.child != nil && step.child == missing
+		switch node.SplitType {
+		case "categorical", "subset":
+			taken, others := branchCategories(node, step.child)
+			takesUnseen := step.child == nil ||
+				(step.child == missing && (unseen == algorithm.UnseenMissing || node.Prediction == nil))
+			if takesUnseen {
+				feature.notIn = append(feature.notIn, others...)
+			} else if feature.in == nil {
+				feature.in = slices.Clone(taken)
+			} else {
+				feature.in = slices.DeleteFunc(feature.in, func(category string) bool {
+					return !slices.Contains(taken, category)
+				})
+			}
+		default:
+			if step.child == node.Left {
+				if feature.upper == nil || models.CompareValues(node.SplitValue, feature.upper) < 0 {
+					feature.upper = node.SplitValue
+				}
+			} else if feature.lower == nil || models.CompareValues(node.SplitValue, feature.lower) > 0 {
+				feature.lower = node.SplitValue
+			}
+		}
+	}
+
+	tests := make([]string, 0, len(features))
+	for _, feature := range features {
+		test, ok := feature.sql(groups[feature.name])
+		if !ok {
+			return "", false
+		}
+		if test != "" {
+			tests = append(tests, test)
+		}
+	}
+	if len(tests) == 0 {
+		return "TRUE", true
+	}
+	return strings.Join(tests, " AND "), true
+}
+
+// branchCategories returns the categories leading from node to child and
+// those leading to its other children. A nil child takes no category.
+func branchCategories(node *models.TreeNode, child *models.TreeNode) (taken, others []string) {
+	if node.SplitType == "categorical" {
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if node.Children[key] == child {
+				taken = append(taken, key)
+			} else {
+				others = append(others, key)
+			}
+		}
+		return taken, others
+	}
+
+	// A category listed on both sides goes left
+	left := node.LeftCategories
+	right := slices.DeleteFunc(slices.Clone(node.RightCategories), func(category string) bool {
+		return slices.Contains(left, category)
+	})
+	switch child {
+	case nil:
+		return nil, append(slices.Clone(left), right...)
+	case node.Left:
+		return left, right
+	}
+	return right, left
+}
+
+// sql writes the feature's conditions as a SQL predicate, or "" when every
+// row passes. kept lists the categories a grouped feature kept in training.
+// It returns false when no row passes.
+func (f *sqlFeature) sql(kept []string) (string, bool) {
+	column := sqlIdentifier(f.name)
+	tests := make([]string, 0, 2)
+	if f.lower != nil {
+		tests = append(tests, fmt.Sprintf("%s >= %s", column, sqlLiteral(f.lower)))
+	}
+	if f.upper != nil {
+		tests = append(tests, fmt.Sprintf("%s < %s", column, sqlLiteral(f.upper)))
+	}
+	if f.in != nil || len(f.notIn) > 0 {
+		test, ok := f.categories(column, kept)
+		if !ok {
+			if f.missing {
+				return column + " IS NULL", true
+			}
+			return "", false
+		}
+		if test != "" {
+			tests = append(tests, test)
+		}
+	}
+
+	switch {
+	case len(tests) == 0 && f.missing:
+		return "", true
+	case len(tests) == 0:
+		return column + " IS NOT NULL", true
+	case f.missing:
+		return fmt.Sprintf("(%s OR %s IS NULL)", strings.Join(tests, " AND "), column), true
+	}
+	return strings.Join(tests, " AND "), true
+}
+
+// categories writes the category conditions on raw values, expanding the rare
+// category bucket of a grouped feature into the values it was not kept for.
+// It returns "" when every value passes and false when none does.
+func (f *sqlFeature) categories(column string, kept []string) (string, bool) {
+	allowed := func(categories []string) []string {
+		return slices.DeleteFunc(slices.Clone(categories), func(category string) bool {
+			return slices.Contains(f.notIn, category)
+		})
+	}
+
+	if f.in != nil {
+		in := allowed(f.in)
+		if kept != nil && slices.Contains(in, algorithm.OtherCategory) {
+			// Every value but the kept ones left out of in
+			excluded := slices.DeleteFunc(slices.Clone(kept), func(category string) bool {
+				return slices.Contains(in, category)
+			})
+			return sqlNotIn(column, excluded), true
+		}
+		if len(in) == 0 {
+			return "", false
+		}
+		return sqlIn(column, in), true
+	}
+
+	if kept != nil && slices.Contains(f.notIn, algorithm.OtherCategory) {
+		// Values not kept in training fall in the excluded bucket
+		in := allowed(kept)
+		if len(in) == 0 {
+			return "", false
+		}
+		return sqlIn(column, in), true
+	}
+	return sqlNotIn(column, f.notIn), true
+}
+
+// sqlIn matches a column against one or more categories
+func sqlIn(column string, categories []string) string {
+	if len(categories) == 1 {
+		return fmt.Sprintf("%s = %s", column, sqlLiteral(categories[0]))
+	}
+	return fmt.Sprintf("%s IN (%s)", column, sqlList(categories))
+}
+
+// sqlNotIn excludes categories from a column, or returns "" for none
+func sqlNotIn(column string, categories []string) string {
+	switch len(categories) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("%s <> %s", column, sqlLiteral(categories[0]))
+	}
+	return fmt.Sprintf("%s NOT IN (%s)", column, sqlList(categories))
+}
+
+// sqlList writes categories as a comma separated list of literals
+func sqlList(categories []string) string {
+	values := make([]string, len(categories))
+	for i, category := range categories {
+		values[i] = sqlLiteral(category)
+	}
+	return strings.Join(values, ", ")
+}
+
+// sqlIdentifier quotes a column name
+func sqlIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlLiteral writes numbers as-is and everything else as a quoted string
+func sqlLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case int, float64:
+		return fmt.Sprintf("%v", v)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return "'" + strings.ReplaceAll(fmt.Sprintf("%v", value), "'", "''") + "'"
+}
@@ -0,0 +1,108 @@
+package export
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"dt/models"
+)
+
+// Layout constants for SVG rendering, in pixels
+const (
+	svgCharWidth  = 7
+	svgLineHeight = 16
+	svgPadding    = 8
+	svgGapX       = 20
+	svgGapY       = 50
+)
+
+// WriteSVG renders the tree as a standalone SVG image. Leaves are laid out
+// left to right and each decision node is centred above its children.
+func WriteSVG(w io.Writer, model *models.ModelData) error {
+	nodes, edges := buildGraph(model.Tree)
+
+	// Every box has the same size so rows line up
+	boxWidth, boxHeight := 0, 0
+	for _, node := range nodes {
+		for _, line := range node.Lines {
+			boxWidth = max(boxWidth, len(line)*svgCharWidth)
+		}
+		boxHeight = max(boxHeight, len(node.Lines)*svgLineHeight)
+	}
+	boxWidth += 2 * svgPadding
+	boxHeight += 2 * svgPadding
+
+	centers := make([]float64, len(nodes))
+	nextLeaf := 0
+	var place func(id int)
+	place = func(id int) {
+		node := nodes[id]
+		if len(node.Children) == 0 {
+			centers[id] = float64(nextLeaf*(boxWidth+svgGapX) + boxWidth/2 + svgGapX)
+			nextLeaf++
+			return
+		}
+		for _, child := range node.Children {
+			place(child)
+		}
+		first, last := node.Children[0], node.Children[len(node.Children)-1]
+		centers[id] = (centers[first] + centers[last]) / 2
+	}
+
+	maxDepth := 0
+	if len(nodes) > 0 {
+		place(0)
+	}
+	for _, node := range nodes {
+		maxDepth = max(maxDepth, node.Depth)
+	}
+
+	width := nextLeaf*(boxWidth+svgGapX) + svgGapX
+	height := (maxDepth+1)*(boxHeight+svgGapY) + svgGapY
+	top := func(depth int) float64 {
+		return float64(depth*(boxHeight+svgGapY) + svgGapY/2)
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Helvetica, Arial, sans-serif" font-size="12">`+"\n",
+		width, height, width, height)
+	fmt.Fprintf(out, "  <title>%s</title>\n", svgEscape("Tree for "+model.TargetColumn))
+
+	// Edges first so boxes are drawn over them
+	for _, edge := range edges {
+		from, to := nodes[edge.From], nodes[edge.To]
+		x1, y1 := centers[edge.From], top(from.Depth)+float64(boxHeight)
+		x2, y2 := centers[edge.To], top(to.Depth)
+		fmt.Fprintf(out, `  <line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#666"/>`+"\n", x1, y1, x2, y2)
+		fmt.Fprintf(out, `  <text x="%.1f" y="%.1f" text-anchor="middle" fill="#333">%s</text>`+"\n",
+			(x1+x2)/2, (y1+y2)/2, svgEscape(edge.Label))
+	}
+
+	for _, node := range nodes {
+		fill := "#dae8fc"
+		if node.Leaf {
+			fill = "#d5e8d4"
+		}
+		x := centers[node.ID] - float64(boxWidth)/2
+		y := top(node.Depth)
+		fmt.Fprintf(out, `  <rect x="%.1f" y="%.1f" width="%d" height="%d" rx="6" fill="%s" stroke="#333"/>`+"\n",
+			x, y, boxWidth, boxHeight, fill)
+		for i, line := range node.Lines {
+			fmt.Fprintf(out, `  <text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n",
+				centers[node.ID], y+float64(svgPadding+(i+1)*svgLineHeight-4), svgEscape(line))
+		}
+	}
+
+	fmt.Fprintln(out, "</svg>")
+	return out.Flush()
+}
+
+// svgEscape escapes text for XML content
+func svgEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
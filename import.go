@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"dt/models"
+	"dt/pmml"
+	"dt/sklearn"
+	"dt/utils"
+)
+
+// importers maps each -format value of the import command to its reader
+var importers = map[string]func(io.Reader) (*models.ModelData, error){
+	"sklearn": sklearn.Read,
+	"pmml":    readPMML,
+}
+
+// runImport converts a model trained elsewhere to this tool's model format
+func runImport(context.Context) error {
+	format := *utils.FormatPtr
+	if format == "" {
+		switch filepath.Ext(*utils.InputPtr) {
+		case ".pmml", ".xml":
+			format = "pmml"
+		default:
+			format = "sklearn"
+		}
+	}
+	read, ok := importers[format]
+	if !ok {
+		return fmt.Errorf("unknown import format %q, expected sklearn or pmml", format)
+	}
+
+	file, err := os.Open(*utils.InputPtr)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer file.Close()
+
+	modelData, err := read(file)
+	if err != nil {
+		return fmt.Errorf("failed to import model: %w", err)
+	}
+	if *utils.ColumnPtr != "" {
+		renameTarget(modelData, *utils.ColumnPtr)
+	}
+
+	if err := utils.SaveModelData(modelData); err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	slog.Info("imported model", "format", format, "target", modelData.TargetColumn, "output", *utils.OutputPtr)
+	return nil
+}
+
+// readPMML reads a PMML TreeModel document as a model
+func readPMML(r io.Reader) (*models.ModelData, error) {
+	doc, err := pmml.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return doc.ToModel()
+}
+
+// renameTarget gives the target column the name passed with -t
+func renameTarget(modelData *models.ModelData, name string) {
+	old := modelData.TargetColumn
+	for i, column := range modelData.Columns {
+		if column == old {
+			modelData.Columns[i] = name
+		}
+	}
+	modelData.FeatureTypes[name] = modelData.FeatureTypes[old]
+	if name != old {
+		delete(modelData.FeatureTypes, old)
+	}
+	modelData.TargetColumn = name
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"dt/algorithm"
+	"dt/models"
+	"dt/utils"
+)
+
+// importanceReport is a ranking of the features of a model, written as a
+// table or as JSON
+type importanceReport interface {
+	writeTable(io.Writer) error
+}
+
+// runImportance ranks the features of a model and writes the report to -o,
+// or to stdout when no output is given. Features are ranked by the gain of
+// their splits, or by permutation importance on the labeled -i dataset.
+func runImportance(ctx context.Context) error {
+	format := *utils.FormatPtr
+	if format == "" {
+		format = "text"
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown importance format %q, expected text or json", format)
+	}
+
+	modelData, err := utils.LoadModels()
+	if err != nil {
+		return fmt.Errorf("failed to load model: %w", err)
+	}
+	var report importanceReport
+	if *utils.InputPtr == "" {
+		ranked, err := algorithm.GainImportance(modelData)
+		if err != nil {
+			return err
+		}
+		report = gainReport(ranked)
+	} else {
+		if report, err = permutationImportance(ctx, modelData); err != nil {
+			return err
+		}
+	}
+
+	write := func(w io.Writer) error {
+		if format == "text" {
+			return report.writeTable(w)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	if *utils.OutputPtr == "" {
+		return write(os.Stdout)
+	}
+	file, err := os.Create(*utils.OutputPtr)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+	if err := write(file); err != nil {
+		return fmt.Errorf("failed to write importance: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write importance: %w", err)
+	}
+	slog.Info("importance written", "format", format, "output", *utils.OutputPtr)
+	return nil
+}
+
+// permutationImportance scores the model on the -i dataset with each feature
+// shuffled in turn
+func permutationImportance(ctx context.Context, modelData *models.ModelData) (importanceReport, error) {
+	if err := utils.LoadPredictionData(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load labeled data: %w", err)
+	}
+	if !containsColumn(models.Columns, modelData.TargetColumn) {
+		return nil, fmt.Errorf("input has no %s column to score predictions against", modelData.TargetColumn)
+	}
+	report, err := algorithm.PermutationImportance(ctx, modelData, models.Records, *utils.RepeatsPtr, *utils.SeedPtr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute permutation importance: %w", err)
+	}
+	slog.Info("baseline score", "metric", report.Metric, "score", report.Baseline, "rows", report.Rows)
+	return permutationReport{report}, nil
+}
+
+func containsColumn(columns []string, name string) bool {
+	for _, column := range columns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+// gainReport ranks features by the gain of their splits
+type gainReport []algorithm.FeatureImportance
+
+func (r gainReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "RANK\tFEATURE\tGAIN_RATIO\tINFO_GAIN\tSPLITS\tFIRST_DEPTH\t")
+	for i, feature := range r {
+		depth := "-"
+		if feature.FirstDepth != nil {
+			depth = strconv.Itoa(*feature.FirstDepth)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%.4f\t%.4f\t%d\t%s\t\n",
+			i+1, feature.Feature, feature.GainRatio, feature.InfoGain, feature.Splits, depth)
+	}
+	return tw.Flush()
+}
+
+// permutationReport ranks features by the metric drop their shuffling causes
+type permutationReport struct {
+	*algorithm.PermutationReport
+}
+
+func (r permutationReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "RANK\tFEATURE\tMEAN_DROP\tSTD_DROP\t")
+	for i, feature := range r.Features {
+		fmt.Fprintf(tw, "%d\t%s\t%.4f\t%.4f\t\n", i+1, feature.Feature, feature.MeanDrop, feature.StdDrop)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,75 @@
+// Package testmodel holds the model the exporter and importer tests share
+package testmodel
+
+import (
+	"dt/algorithm"
+	"dt/models"
+)
+
+// Loan returns a small model mixing numerical, categorical and subset splits,
+// with a rare category bucket on Property_Area
+func Loan() *models.ModelData {
+	return &models.ModelData{
+		TargetColumn: "Approved",
+		TargetType:   "categorical",
+		Columns:      []string{"Credit_History", "Property_Area", "Education", "Approved"},
+		FeatureTypes: map[string]string{
+			"Credit_History": "numeric",
+			"Property_Area":  "categorical",
+			"Education":      "categorical",
+			"Approved":       "categorical",
+		},
+		CategoryGroups: map[string][]string{"Property_Area": {"Rural", "Urban"}},
+		Tree: &models.TreeNode{
+			Feature:     "Credit_History",
+			SplitType:   "numerical",
+			SplitValue:  0.5,
+			Prediction:  "Yes",
+			Samples:     12,
+			ClassCounts: map[string]int{"No": 5, "Yes": 7},
+			Left: &models.TreeNode{
+				IsLeaf: true, Prediction: "No", Samples: 3,
+				ClassCounts: map[string]int{"No": 3},
+			},
+			Right: &models.TreeNode{
+				Feature:     "Property_Area",
+				SplitType:   "categorical",
+				Prediction:  "Yes",
+				Samples:     9,
+				ClassCounts: map[string]int{"No": 2, "Yes": 7},
+				Children: map[string]*models.TreeNode{
+					"Urban":                 {IsLeaf: true, Prediction: "Yes", Samples: 4, ClassCounts: map[string]int{"Yes": 4}},
+					algorithm.OtherCategory: {IsLeaf: true, Prediction: "No", Samples: 2, ClassCounts: map[string]int{"No": 1, "Yes": 1}},
+					"Rural": {
+						Feature:         "Education",
+						SplitType:       "subset",
+						LeftCategories:  []string{"Graduate", "Post Graduate"},
+						RightCategories: []string{"Not \"Graduate\""},
+						Prediction:      "Yes",
+						Samples:         3,
+						ClassCounts:     map[string]int{"No": 1, "Yes": 2},
+						Left:            &models.TreeNode{IsLeaf: true, Prediction: "Yes", Samples: 2, ClassCounts: map[string]int{"Yes": 2}},
+						Right:           &models.TreeNode{IsLeaf: true, Prediction: "No", Samples: 1, ClassCounts: map[string]int{"No": 1}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// LoanRecords returns records reaching every branch of Loan, with missing
+// values, unseen and rare categories
+func LoanRecords() []map[string]interface{} {
+	return []map[string]interface{}{
+		{"Credit_History": 0.0, "Property_Area": "Urban"},
+		{"Credit_History": 1, "Property_Area": "Urban"},
+		{"Credit_History": 0.5, "Property_Area": "Rural", "Education": "Graduate"},
+		{"Credit_History": 1.0, "Property_Area": "Rural", "Education": "Post Graduate"},
+		{"Credit_History": 1.0, "Property_Area": "Rural", "Education": "Not \"Graduate\""},
+		{"Credit_History": 1.0, "Property_Area": "Rural", "Education": "Doctorate"},
+		{"Credit_History": 1.0, "Property_Area": "Rural", "Education": nil},
+		{"Credit_History": 1.0, "Property_Area": "Semiurban"},
+		{"Credit_History": 1.0, "Property_Area": nil},
+		{"Credit_History": nil, "Property_Area": "Urban"},
+	}
+}
@@ -1,65 +1,110 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
 
 	"dt/algorithm"
 	"dt/utils"
 )
 
+// command describes a -c workflow and the flags it requires
+type command struct {
+	run         func(ctx context.Context) error
+	needsInput  bool
+	needsTarget bool
+	needsModel  bool
+	needsOutput bool
+}
+
+var commands = map[string]command{
+	"train":          {run: runTraining, needsInput: true, needsTarget: true, needsOutput: true},
+	"predict":        {run: runPrediction, needsInput: true, needsModel: true, needsOutput: true},
+	"export":         {run: runExport, needsModel: true, needsOutput: true},
+	"rules":          {run: runRules, needsModel: true, needsOutput: true},
+	"codegen":        {run: runCodegen, needsModel: true, needsOutput: true},
+	"import":         {run: runImport, needsInput: true, needsOutput: true},
+	"migrate":        {run: runMigrate, needsModel: true, needsOutput: true},
+	"serve":          {run: runServe, needsModel: true},
+	"registry":       {run: runRegistry},
+	"importance":     {run: runImportance, needsModel: true},
+	"counterfactual": {run: runCounterfactual, needsInput: true, needsModel: true},
+}
+
 func main() {
 	utils.ParseFlag()
-	if *utils.CommandPtr != "train" && *utils.CommandPtr != "predict" {
-		fmt.Println("Please provide a valid command")
-		fmt.Println("Ex: -c train or -c predict")
+	if err := utils.SetupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[*utils.CommandPtr]
+	if !ok {
+		slog.Error("please provide a valid command",
+			"example", "-c train, -c predict, -c export, -c rules, -c codegen, -c import, -c migrate, -c serve, -c registry, -c importance or -c counterfactual")
 		return
 	}
-	if *utils.InputPtr == "" {
-		fmt.Println("Please provide an input file")
-		fmt.Println("Ex: -i <filepath.csv>")
+	if *utils.InputPtr == "" && cmd.needsInput {
+		slog.Error("please provide an input file", "example", "-i <filepath.csv>")
 		return
 	}
-	if *utils.ColumnPtr == "" && *utils.CommandPtr == "train" {
-		fmt.Println("Please provide a column to train")
-		fmt.Println("Ex: -t <column_name>")
+	if *utils.ColumnPtr == "" && cmd.needsTarget {
+		slog.Error("please provide a column to train", "example", "-t <column_name>")
 		return
 	}
-	if *utils.ModelFilePtr == "" && *utils.CommandPtr == "predict" {
-		fmt.Println("Please provide a trained decision tree to predict")
-		fmt.Println("Ex: -m <filepath.dt>")
+	if *utils.ModelFilePtr == "" && cmd.needsModel {
+		slog.Error("please provide a trained decision tree", "example", "-m <filepath.dt> or -m <name>@production")
 		return
 	}
-	if *utils.OutputPtr == "" {
-		fmt.Println("Please provide an output file")
-		fmt.Println("Ex: -o <filepath.dt> for training or -o <filepath.csv> for prediction")
+	if *utils.OutputPtr == "" && cmd.needsOutput {
+		slog.Error("please provide an output file",
+			"example", "-o <filepath.dt> for training or -o <filepath.csv> for prediction")
 		return
 	}
 	err := utils.FileExtValidation()
 	if err != nil {
-		fmt.Println(err.Error())
+		slog.Error(err.Error())
 		return
 	}
-	if *utils.CommandPtr == "train" {
-		err = runTraining()
-	} else if *utils.CommandPtr == "predict" {
-		err = runPrediction()
+	// serve resolves its registry models at every reload
+	if cmd.needsModel && *utils.CommandPtr != "serve" && utils.IsModelRef(*utils.ModelFilePtr) {
+		if err := resolveModelRef(); err != nil {
+			slog.Error("failed to resolve model", "err", err)
+			os.Exit(1)
+		}
 	}
 
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+	// Stop cleanly on Ctrl-C, SIGTERM or when -timeout passes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *utils.TimeoutPtr > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *utils.TimeoutPtr)
+		defer cancel()
+	}
+
+	if err := cmd.run(ctx); err != nil {
+		slog.Error("command failed", "command", *utils.CommandPtr, "err", err)
+		stop()
 		os.Exit(1)
 	}
 }
 
 // runTraining handles the training workflow
-func runTraining() error {
-	fmt.Println("Starting training process...")
-	if err := utils.LoadTrainingData(); err != nil {
+func runTraining(ctx context.Context) error {
+	slog.Info("starting training", "input", *utils.InputPtr, "target", *utils.ColumnPtr)
+	if err := utils.LoadTrainingData(ctx); err != nil {
 		return fmt.Errorf("failed to load training data: %w", err)
 	}
 	// Build the decision tree
-	tree, err := algorithm.BuildTree(*utils.ColumnPtr)
+	tree, err := algorithm.BuildTree(ctx, *utils.ColumnPtr)
 	if err != nil {
 		return fmt.Errorf("failed to build decision tree: %w", err)
 	}
@@ -68,31 +113,119 @@ func runTraining() error {
 	if err := utils.SaveModel(tree); err != nil {
 		return fmt.Errorf("failed to save model: %w", err)
 	}
+	if *utils.CheckpointPtr != "" {
+		if err := utils.RemoveCheckpoint(); err != nil {
+			return err
+		}
+	}
 
-	fmt.Println("Training completed successfully!")
+	slog.Info("training completed", "model", *utils.OutputPtr)
 	return nil
 }
 
-// runPrediction handles the prediction workflow
-func runPrediction() error {
-	fmt.Println("Starting prediction process...")
+// runPrediction handles the prediction workflow. Rows are streamed from the
+// input in chunks, so files larger than memory can be scored.
+func runPrediction(ctx context.Context) error {
+	slog.Info("starting prediction", "input", *utils.InputPtr, "model", *utils.ModelFilePtr)
 
 	// Load the model
 	modelData, err := utils.LoadModels()
 	if err != nil {
 		return fmt.Errorf("failed to load model: %w", err)
 	}
-	if err := utils.LoadPredictionData(); err != nil {
+	if *utils.ChunkSizePtr <= 0 {
+		return fmt.Errorf("chunk size must be positive, got %d", *utils.ChunkSizePtr)
+	}
+
+	reader, err := utils.OpenPredictionData()
+	if err != nil {
 		return fmt.Errorf("failed to load prediction data: %w", err)
 	}
+	defer reader.Close()
+	var shap *algorithm.SHAPExplainer
+	var shapFeatures []string
+	if *utils.SHAPPtr {
+		if shap, err = algorithm.NewSHAPExplainer(modelData); err != nil {
+			return err
+		}
+		shapFeatures = shap.Features()
+	}
+	writer, err := utils.CreatePredictions(detailColumns(shapFeatures)...)
+	if err != nil {
+		return fmt.Errorf("failed to save predictions: %w", err)
+	}
 
-	// Make predictions
-	predictions := algorithm.Predict(modelData.Tree)
-	// Save predictions
-	if err := utils.SavePredictions(predictions); err != nil {
+	// Make predictions, applying the rare category grouping learned during training
+	start := time.Now()
+	lastReport := start
+	stream := algorithm.Stream{
+		ReadRows: func() ([][]string, error) { return reader.ReadRows(*utils.ChunkSizePtr) },
+		Columns:  reader.Columns(),
+		Write:    writer.Write,
+		Groups:   modelData.CategoryGroups,
+		Explain:  *utils.ExplainPtr || *utils.ExplainFilePtr != "",
+		SHAP:     shap,
+		Progress: func(records int) {
+			if time.Since(lastReport) >= time.Second {
+				lastReport = time.Now()
+				slog.Info("prediction progress", "records", records,
+					"records_per_sec", math.Round(float64(records)/time.Since(start).Seconds()))
+			}
+		},
+	}
+	closeExplanations := func() error { return nil }
+	if stream.Explain || stream.SHAP != nil {
+		if stream.WriteDetails, closeExplanations, err = detailsWriter(writer, shapFeatures); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	summary, err := algorithm.PredictStream(ctx, modelData.Tree, stream)
+	if err != nil {
+		writer.Close()
+		closeExplanations()
+		return fmt.Errorf("failed to make predictions: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		closeExplanations()
 		return fmt.Errorf("failed to save predictions: %w", err)
 	}
+	if err := closeExplanations(); err != nil {
+		return err
+	}
+	logPredictSummary(summary)
+	slog.Info("prediction completed", "output", *utils.OutputPtr)
+	return nil
+}
 
-	fmt.Println("Prediction completed successfully!")
+// runMigrate rewrites a model file in the current format, converting it to
+// the binary encoding with -format binary
+func runMigrate(context.Context) error {
+	modelFile, modelData, err := utils.LoadModelFile()
+	if err != nil {
+		return fmt.Errorf("failed to load model: %w", err)
+	}
+	if err := utils.SaveModelFile(modelFile, modelData); err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	slog.Info("model saved", "format_version", modelFile.FormatVersion, "output", *utils.OutputPtr)
 	return nil
 }
+
+// logPredictSummary reports statistics collected during prediction
+func logPredictSummary(summary *algorithm.PredictSummary) {
+	slog.Info("predicted records", "records", summary.Records)
+	if len(summary.Unseen) == 0 {
+		return
+	}
+
+	features := make([]string, 0, len(summary.Unseen))
+	for feature := range summary.Unseen {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	for _, feature := range features {
+		slog.Warn("unseen categorical values", "feature", feature, "count", summary.Unseen[feature])
+	}
+}
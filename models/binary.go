@@ -0,0 +1,479 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// BinaryMagic starts every binary model file
+var BinaryMagic = []byte("DTB\x00")
+
+// Version of the binary tree layout following the header
+const binaryLayoutVersion = 1
+
+// Value tags of the binary layout
+const (
+	tagNil = iota
+	tagString
+	tagInt
+	tagFloat
+	tagBool
+	tagTime
+)
+
+// EncodeBinary writes a model in the binary format:
+//
+//	magic | header length (uvarint) | header (JSON envelope) | body
+//
+// The envelope carries the metadata and the checksum of the body. The body
+// is a layout version, a string table and the nodes in preorder. Each node
+// refers to strings and to its children by index, so a file can be decoded
+// in one pass from a memory-mapped slice.
+func EncodeBinary(file *ModelFile, model *ModelData) ([]byte, error) {
+	body, err := encodeBody(model)
+	if err != nil {
+		return nil, err
+	}
+
+	header := *file
+	header.Model = nil
+	header.Encoding = "binary"
+	header.Checksum = checksum(body)
+	headerJSON, err := json.Marshal(&header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode model header: %w", err)
+	}
+
+	out := make([]byte, 0, len(BinaryMagic)+binary.MaxVarintLen64+len(headerJSON)+len(body))
+	out = append(out, BinaryMagic...)
+	out = binary.AppendUvarint(out, uint64(len(headerJSON)))
+	out = append(out, headerJSON...)
+	return append(out, body...), nil
+}
+
+// binaryWriter collects strings and nodes of the body
+type binaryWriter struct {
+	strings map[string]uint64
+	table   []string
+	nodes   []*TreeNode
+	index   map[*TreeNode]uint64
+}
+
+func encodeBody(model *ModelData) ([]byte, error) {
+	w := &binaryWriter{strings: make(map[string]uint64), index: make(map[*TreeNode]uint64)}
+
+	if model.Tree != nil {
+		w.collect(model.Tree)
+	}
+
+	var fields, nodes []byte
+	fields = binary.AppendUvarint(fields, w.str(model.TargetColumn))
+	fields = binary.AppendUvarint(fields, w.str(model.TargetType))
+	fields = binary.AppendUvarint(fields, uint64(len(model.Columns)))
+	for _, column := range model.Columns {
+		fields = binary.AppendUvarint(fields, w.str(column))
+		fields = binary.AppendUvarint(fields, w.str(model.FeatureTypes[column]))
+	}
+	groups := sortedKeys(model.CategoryGroups)
+	fields = binary.AppendUvarint(fields, uint64(len(groups)))
+	for _, feature := range groups {
+		fields = binary.AppendUvarint(fields, w.str(feature))
+		fields = w.strs(fields, model.CategoryGroups[feature])
+	}
+
+	nodes = binary.AppendUvarint(nodes, uint64(len(w.nodes)))
+	for _, node := range w.nodes {
+		var err error
+		if nodes, err = w.node(nodes, node); err != nil {
+			return nil, err
+		}
+	}
+
+	// The string table is complete only once every node was written
+	body := []byte{binaryLayoutVersion}
+	body = binary.AppendUvarint(body, uint64(len(w.table)))
+	for _, s := range w.table {
+		body = binary.AppendUvarint(body, uint64(len(s)))
+		body = append(body, s...)
+	}
+	body = append(body, fields...)
+	return append(body, nodes...), nil
+}
+
+// collect numbers the nodes in preorder
+func (w *binaryWriter) collect(node *TreeNode) {
+	w.index[node] = uint64(len(w.nodes))
+	w.nodes = append(w.nodes, node)
+	for _, key := range sortedKeys(node.Children) {
+		if child := node.Children[key]; child != nil {
+			w.collect(child)
+		}
+	}
+	if node.Left != nil {
+		w.collect(node.Left)
+	}
+	if node.Right != nil {
+		w.collect(node.Right)
+	}
+}
+
+// str returns the table index of a string, adding it when new
+func (w *binaryWriter) str(s string) uint64 {
+	if i, ok := w.strings[s]; ok {
+		return i
+	}
+	i := uint64(len(w.table))
+	w.strings[s] = i
+	w.table = append(w.table, s)
+	return i
+}
+
+func (w *binaryWriter) strs(out []byte, values []string) []byte {
+	out = binary.AppendUvarint(out, uint64(len(values)))
+	for _, v := range values {
+		out = binary.AppendUvarint(out, w.str(v))
+	}
+	return out
+}
+
+// ref writes a child as its index plus one, zero for no child
+func (w *binaryWriter) ref(out []byte, child *TreeNode) []byte {
+	if child == nil {
+		return binary.AppendUvarint(out, 0)
+	}
+	return binary.AppendUvarint(out, w.index[child]+1)
+}
+
+func (w *binaryWriter) node(out []byte, node *TreeNode) ([]byte, error) {
+	var flags byte
+	if node.IsLeaf {
+		flags = 1
+	}
+	out = append(out, flags)
+	out = binary.AppendUvarint(out, w.str(node.Feature))
+	out = binary.AppendUvarint(out, w.str(node.SplitType))
+
+	var err error
+	if out, err = w.value(out, node.SplitValue); err != nil {
+		return nil, err
+	}
+	if out, err = w.value(out, node.Prediction); err != nil {
+		return nil, err
+	}
+	out = binary.AppendUvarint(out, uint64(node.Samples))
+
+	classes := sortedKeys(node.ClassCounts)
+	out = binary.AppendUvarint(out, uint64(len(classes)))
+	for _, class := range classes {
+		out = binary.AppendUvarint(out, w.str(class))
+		out = binary.AppendUvarint(out, uint64(node.ClassCounts[class]))
+	}
+	out = binary.AppendUvarint(out, w.str(node.OtherBranch))
+	out = binary.AppendUvarint(out, w.str(node.MissingBranch))
+	out = binary.LittleEndian.AppendUint64(out, math.Float64bits(node.InfoGain))
+	out = binary.LittleEndian.AppendUint64(out, math.Float64bits(node.GainRatio))
+
+	keys := sortedKeys(node.Children)
+	out = binary.AppendUvarint(out, uint64(len(keys)))
+	for _, key := range keys {
+		out = binary.AppendUvarint(out, w.str(key))
+		out = w.ref(out, node.Children[key])
+	}
+	out = w.ref(out, node.Left)
+	out = w.ref(out, node.Right)
+	out = w.strs(out, node.LeftCategories)
+	return w.strs(out, node.RightCategories), nil
+}
+
+// value writes a prediction or split value with its type
+func (w *binaryWriter) value(out []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(out, tagNil), nil
+	case string:
+		out = append(out, tagString)
+		return binary.AppendUvarint(out, w.str(v)), nil
+	case int:
+		out = append(out, tagInt)
+		return binary.AppendVarint(out, int64(v)), nil
+	case float64:
+		out = append(out, tagFloat)
+		return binary.LittleEndian.AppendUint64(out, math.Float64bits(v)), nil
+	case bool:
+		out = append(out, tagBool)
+		if v {
+			return append(out, 1), nil
+		}
+		return append(out, 0), nil
+	case time.Time:
+		out = append(out, tagTime)
+		return binary.AppendVarint(out, v.UnixNano()), nil
+	}
+	return nil, fmt.Errorf("cannot encode value %v of type %T", value, value)
+}
+
+// decodeBinary reads a file written by EncodeBinary
+func decodeBinary(data []byte) (*ModelFile, *ModelData, error) {
+	r := &binaryReader{data: data, pos: len(BinaryMagic)}
+	headerJSON := r.bytes(r.uvarint())
+	if r.err != nil {
+		return nil, nil, fmt.Errorf("failed to read model header: %w", r.err)
+	}
+
+	var file ModelFile
+	if err := json.Unmarshal(headerJSON, &file); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse model header: %w", err)
+	}
+	if file.FormatVersion > FormatVersion {
+		return nil, nil, fmt.Errorf("model format version %d is newer than the supported version %d",
+			file.FormatVersion, FormatVersion)
+	}
+	body := data[r.pos:]
+	if sum := checksum(body); sum != file.Checksum {
+		return nil, nil, fmt.Errorf("model checksum mismatch: file says %s, content is %s", file.Checksum, sum)
+	}
+
+	model, err := decodeBody(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode binary model: %w", err)
+	}
+	if err := model.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &file, model, nil
+}
+
+// binaryReader reads the body, remembering the first error
+type binaryReader struct {
+	data  []byte
+	pos   int
+	err   error
+	table []string
+}
+
+var errTruncated = errors.New("unexpected end of data")
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *binaryReader) byte() byte {
+	b := r.bytes(1)
+	if len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *binaryReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail(errTruncated)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// count reads a length, rejecting values larger than the remaining data
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail(fmt.Errorf("invalid count %d", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) str() string {
+	i := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if i >= uint64(len(r.table)) {
+		r.fail(fmt.Errorf("string index %d out of range", i))
+		return ""
+	}
+	return r.table[i]
+}
+
+func (r *binaryReader) float() float64 {
+	b := r.bytes(8)
+	if len(b) < 8 {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+func (r *binaryReader) strs() []string {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+	values := make([]string, n)
+	for i := range values {
+		values[i] = r.str()
+	}
+	return values
+}
+
+func (r *binaryReader) value() interface{} {
+	switch tag := r.byte(); tag {
+	case tagNil:
+		return nil
+	case tagString:
+		return r.str()
+	case tagInt:
+		return int(r.varint())
+	case tagFloat:
+		return r.float()
+	case tagBool:
+		return r.byte() == 1
+	case tagTime:
+		return time.Unix(0, r.varint()).UTC()
+	default:
+		r.fail(fmt.Errorf("unknown value tag %d", tag))
+		return nil
+	}
+}
+
+func decodeBody(body []byte) (*ModelData, error) {
+	r := &binaryReader{data: body}
+	version := r.byte()
+	if r.err == nil && version != binaryLayoutVersion {
+		return nil, fmt.Errorf("unsupported binary layout version %d", version)
+	}
+
+	// Strings are copied so the model does not keep the mapped file alive
+	r.table = make([]string, r.count())
+	for i := range r.table {
+		r.table[i] = string(r.bytes(r.uvarint()))
+	}
+
+	model := &ModelData{
+		TargetColumn: r.str(),
+		TargetType:   r.str(),
+		FeatureTypes: make(map[string]string),
+	}
+	model.Columns = make([]string, r.count())
+	for i := range model.Columns {
+		model.Columns[i] = r.str()
+		model.FeatureTypes[model.Columns[i]] = r.str()
+	}
+	if n := r.count(); n > 0 {
+		model.CategoryGroups = make(map[string][]string, n)
+		for i := 0; i < n; i++ {
+			feature := r.str()
+			model.CategoryGroups[feature] = r.strs()
+		}
+	}
+
+	nodes := make([]TreeNode, r.count())
+	child := func(parent int) *TreeNode {
+		ref := r.uvarint()
+		if ref == 0 || r.err != nil {
+			return nil
+		}
+		// Children follow their parent in preorder, which also rules out cycles
+		if i := ref - 1; i > uint64(parent) && i < uint64(len(nodes)) {
+			return &nodes[i]
+		}
+		r.fail(fmt.Errorf("node %d refers to invalid child %d", parent, ref-1))
+		return nil
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		node.IsLeaf = r.byte()&1 == 1
+		node.Feature = r.str()
+		node.SplitType = r.str()
+		node.SplitValue = r.value()
+		node.Prediction = r.value()
+		node.Samples = int(r.uvarint())
+		if n := r.count(); n > 0 {
+			node.ClassCounts = make(map[string]int, n)
+			for j := 0; j < n; j++ {
+				class := r.str()
+				node.ClassCounts[class] = int(r.uvarint())
+			}
+		}
+		node.OtherBranch = r.str()
+		node.MissingBranch = r.str()
+		node.InfoGain = r.float()
+		node.GainRatio = r.float()
+		if n := r.count(); n > 0 {
+			node.Children = make(map[string]*TreeNode, n)
+			for j := 0; j < n; j++ {
+				key := r.str()
+				node.Children[key] = child(i)
+			}
+		}
+		node.Left = child(i)
+		node.Right = child(i)
+		node.LeftCategories = r.strs()
+		node.RightCategories = r.strs()
+		if r.err != nil {
+			return nil, fmt.Errorf("node %d: %w", i, r.err)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.pos != len(body) {
+		return nil, fmt.Errorf("%d trailing bytes", len(body)-r.pos)
+	}
+	if len(nodes) > 0 {
+		model.Tree = &nodes[0]
+	}
+	return model, nil
+}
+
+// IsBinaryModel reports whether data starts with the binary model magic
+func IsBinaryModel(data []byte) bool {
+	return bytes.HasPrefix(data, BinaryMagic)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -12,6 +12,10 @@ var (
 	TargetValues map[interface{}]int
 	TargetType   string
 	TargetColumn string
+
+	// CategoryGroups lists, per feature, the categories kept as-is; every
+	// other value of that feature is merged into a shared "other" bucket
+	CategoryGroups map[string][]string
 )
 
 type TreeNode struct {
@@ -19,10 +23,22 @@ type TreeNode struct {
 	Prediction interface{}          `json:"prediction,omitempty"`
 	Feature    string               `json:"feature,omitempty"`
 	SplitValue interface{}          `json:"split_value,omitempty"`
-	SplitType  string               `json:"split_type,omitempty"` // "categorical" or "numerical"
+	SplitType  string               `json:"split_type,omitempty"` // "categorical", "subset" or "numerical"
 	Children   map[string]*TreeNode `json:"children,omitempty"`   // For categorical features
-	Left       *TreeNode            `json:"left,omitempty"`       // For numerical features (< threshold)
-	Right      *TreeNode            `json:"right,omitempty"`      // For numerical features (>= threshold)
+	Left       *TreeNode            `json:"left,omitempty"`       // For numerical features (< threshold) and subset splits (in LeftCategories)
+	Right      *TreeNode            `json:"right,omitempty"`      // For numerical features (>= threshold) and subset splits (in RightCategories)
+
+	LeftCategories  []string `json:"left_categories,omitempty"`  // For subset splits: values sent to Left
+	RightCategories []string `json:"right_categories,omitempty"` // For subset splits: values sent to Right
+
+	Samples     int            `json:"samples,omitempty"`      // Number of training rows that reached the node
+	ClassCounts map[string]int `json:"class_counts,omitempty"` // Training target distribution at the node
+	OtherBranch string         `json:"other_branch,omitempty"` // Child used for unseen values: a Children key, or "left"/"right"
+
+	MissingBranch string `json:"missing_branch,omitempty"` // Child used for missing values when set: a Children key, or "left"/"right"
+
+	InfoGain  float64 `json:"info_gain,omitempty"`  // Information gain of the split, recorded by the builder
+	GainRatio float64 `json:"gain_ratio,omitempty"` // Gain ratio of the split, recorded by the builder
 }
 
 func GetValueKey(val interface{}) string {
@@ -32,6 +48,18 @@ func GetValueKey(val interface{}) string {
 	return fmt.Sprintf("%v", val)
 }
 
+// ToFloat converts an int or float64 value, as records and split values hold
+// numbers, to float64
+func ToFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
 type SplitCriteria struct {
 	Feature      string
 	SplitValue   interface{}
@@ -39,8 +67,11 @@ type SplitCriteria struct {
 	InfoGain     float64
 	GainRatio    float64
 	SplitIndices map[string][]int // For categorical splits
-	LeftIndices  []int            // For numerical splits (<)
-	RightIndices []int            // For numerical splits (>=)
+	LeftIndices  []int            // For numerical splits (<) and subset splits
+	RightIndices []int            // For numerical splits (>=) and subset splits
+
+	LeftCategories  []string // For subset splits
+	RightCategories []string // For subset splits
 }
 
 // ModelData represents the serializable model structure
@@ -50,6 +81,8 @@ type ModelData struct {
 	TargetColumn string            `json:"target_column"`
 	TargetType   string            `json:"target_type"`
 	Columns      []string          `json:"columns"`
+
+	CategoryGroups map[string][]string `json:"category_groups,omitempty"`
 }
 
 // CompareValues compares two values based on their types
@@ -0,0 +1,349 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	FormatVersion  = 2       // Version of the .dt envelope written by SaveModel
+	LibraryVersion = "1.0.0" // Version of this module recorded in saved models
+)
+
+var (
+	// Hyperparameters holds the settings of the last training run
+	Hyperparameters *TrainingParams
+
+	// DatasetHash is the SHA-256 of the training file, hex encoded
+	DatasetHash string
+)
+
+// TrainingParams records the settings a tree was trained with
+type TrainingParams struct {
+	MaxDepth         int     `json:"max_depth"`
+	MinSamplesLeaf   int     `json:"min_samples_leaf"`
+	MinInfoGain      float64 `json:"min_info_gain"`
+	CategoricalSplit string  `json:"categorical_split"`
+	Sampling         string  `json:"sampling"`
+	Seed             int64   `json:"seed"`
+	SmoteK           int     `json:"smote_k,omitempty"`
+	RareMinCount     int     `json:"rare_min_count,omitempty"`
+	RareMinFreq      float64 `json:"rare_min_freq,omitempty"`
+}
+
+// TrainingState is the progress of an unfinished training run, saved in
+// checkpoint files so that training can be resumed
+type TrainingState struct {
+	RNGState   []byte        `json:"rng_state,omitempty"` // Sampling generator state after resampling
+	Rows       int           `json:"rows"`                // Training rows after resampling
+	NodesBuilt int           `json:"nodes_built"`
+	Pending    []PendingNode `json:"pending"`
+}
+
+// PendingNode is a node of a checkpoint tree that has not been split yet. It
+// is a leaf in the saved tree, predicting the majority class of its rows.
+type PendingNode struct {
+	Path    []string `json:"path"` // Branches from the root: "left", "right" or a category
+	Depth   int      `json:"depth"`
+	Indices []int    `json:"indices"`
+}
+
+// Feature describes one input column of a model
+type Feature struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ModelFile is the versioned envelope of a .dt file. The model itself is kept
+// as raw JSON so its checksum can be verified before it is decoded.
+type ModelFile struct {
+	FormatVersion   int             `json:"format_version"`
+	LibraryVersion  string          `json:"library_version"`
+	CreatedAt       time.Time       `json:"created_at"`
+	MigratedFrom    int             `json:"migrated_from,omitempty"` // Format version the file was converted from
+	DatasetHash     string          `json:"dataset_hash,omitempty"`
+	Hyperparameters *TrainingParams `json:"hyperparameters,omitempty"`
+	Features        []Feature       `json:"features"`
+	Target          Feature         `json:"target"`
+	TargetClasses   []string        `json:"target_classes,omitempty"`
+	Encoding        string          `json:"encoding,omitempty"`       // "binary" when a binary body follows the header
+	Checksum        string          `json:"checksum"`                 // SHA-256 of the compact model JSON or the binary body
+	Training        *TrainingState  `json:"training_state,omitempty"` // Set in checkpoints of unfinished training
+	Model           json.RawMessage `json:"model,omitempty"`
+
+	migrated bool // Converted from an older format while decoding
+}
+
+// Migrated reports whether the file was converted from an older format when
+// it was decoded, so it should be saved again
+func (f *ModelFile) Migrated() bool {
+	return f.migrated
+}
+
+// NewModelFile wraps a model in an envelope describing it
+func NewModelFile(model *ModelData) (*ModelFile, error) {
+	raw, err := json.Marshal(model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode model: %w", err)
+	}
+
+	file := &ModelFile{
+		FormatVersion:  FormatVersion,
+		LibraryVersion: LibraryVersion,
+		CreatedAt:      creationTime(),
+		Target:         Feature{Name: model.TargetColumn, Type: model.TargetType},
+		TargetClasses:  model.TargetClasses(),
+		Checksum:       checksum(raw),
+		Model:          raw,
+	}
+	for _, column := range model.Columns {
+		if column != model.TargetColumn {
+			file.Features = append(file.Features, Feature{Name: column, Type: model.FeatureTypes[column]})
+		}
+	}
+	return file, nil
+}
+
+// creationTime returns the current time, or the time given in seconds by
+// SOURCE_DATE_EPOCH so that training the same data twice gives identical files
+func creationTime() time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return time.Now().UTC()
+}
+
+// EncodeJSON writes a model as a JSON envelope with the metadata of file
+func EncodeJSON(file *ModelFile, model *ModelData) ([]byte, error) {
+	raw, err := json.Marshal(model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode model: %w", err)
+	}
+
+	envelope := *file
+	envelope.Encoding = ""
+	envelope.Model = raw
+	envelope.Checksum = checksum(raw)
+	data, err := json.Marshal(&envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode model file: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// DecodeModelFile reads a .dt file in the JSON or binary encoding, detected
+// from the first bytes. Files written before the envelope
+// existed hold a bare model and are migrated; the returned envelope then
+// reports Migrated and has MigratedFrom set to 1. The model is checked against its checksum and
+// validated.
+func DecodeModelFile(data []byte) (*ModelFile, *ModelData, error) {
+	if IsBinaryModel(data) {
+		return decodeBinary(data)
+	}
+
+	var header struct {
+		FormatVersion int             `json:"format_version"`
+		Tree          json.RawMessage `json:"tree"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse model file: %w", err)
+	}
+
+	switch {
+	case header.FormatVersion == 0 && header.Tree != nil:
+		return migrateUnversioned(data)
+	case header.FormatVersion == 0:
+		return nil, nil, errors.New("model file has no format version")
+	case header.FormatVersion > FormatVersion:
+		return nil, nil, fmt.Errorf("model format version %d is newer than the supported version %d",
+			header.FormatVersion, FormatVersion)
+	}
+
+	var file ModelFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse model file: %w", err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, file.Model); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse model: %w", err)
+	}
+	if sum := checksum(compact.Bytes()); sum != file.Checksum {
+		return nil, nil, fmt.Errorf("model checksum mismatch: file says %s, content is %s", file.Checksum, sum)
+	}
+
+	var model ModelData
+	if err := json.Unmarshal(file.Model, &model); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse model: %w", err)
+	}
+	if err := model.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &file, &model, nil
+}
+
+// migrateUnversioned converts a bare model written by format version 1
+func migrateUnversioned(data []byte) (*ModelFile, *ModelData, error) {
+	var model ModelData
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse model data: %w", err)
+	}
+	if err := model.Validate(); err != nil {
+		return nil, nil, err
+	}
+	file, err := NewModelFile(&model)
+	if err != nil {
+		return nil, nil, err
+	}
+	file.CreatedAt = time.Time{}
+	file.MigratedFrom = 1
+	file.migrated = true
+	return file, &model, nil
+}
+
+// Validate checks that the model describes a tree the predictor can walk
+func (m *ModelData) Validate() error {
+	if m.TargetColumn == "" {
+		return errors.New("invalid model: no target column")
+	}
+	if len(m.Columns) > 0 && !slices.Contains(m.Columns, m.TargetColumn) {
+		return fmt.Errorf("invalid model: target column %s is not a model column", m.TargetColumn)
+	}
+	if m.Tree == nil {
+		return errors.New("invalid model: no tree")
+	}
+	if err := m.validateNode(m.Tree, "root"); err != nil {
+		return fmt.Errorf("invalid model: %w", err)
+	}
+	return nil
+}
+
+// validateNode checks one node and its subtree; path names the node in errors
+func (m *ModelData) validateNode(node *TreeNode, path string) error {
+	if node.IsLeaf {
+		if node.Prediction == nil {
+			return fmt.Errorf("leaf %s has no prediction", path)
+		}
+		return nil
+	}
+
+	if node.Feature == "" {
+		return fmt.Errorf("node %s has no split feature", path)
+	}
+	if len(m.Columns) > 0 && !slices.Contains(m.Columns, node.Feature) {
+		return fmt.Errorf("node %s splits on unknown feature %s", path, node.Feature)
+	}
+	if node.Feature == m.TargetColumn {
+		return fmt.Errorf("node %s splits on the target column", path)
+	}
+	path += "/" + node.Feature
+
+	var children []*TreeNode
+	var names []string
+	switch node.SplitType {
+	case "categorical":
+		if len(node.Children) == 0 {
+			return fmt.Errorf("categorical node %s has no children", path)
+		}
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			children = append(children, node.Children[key])
+			names = append(names, path+"="+key)
+		}
+	case "subset":
+		if len(node.LeftCategories) == 0 || len(node.RightCategories) == 0 {
+			return fmt.Errorf("subset node %s is missing the categories of a side", path)
+		}
+		children = []*TreeNode{node.Left, node.Right}
+		names = []string{path + "/left", path + "/right"}
+	case "numerical":
+		if node.SplitValue == nil {
+			return fmt.Errorf("numerical node %s has no split value", path)
+		}
+		children = []*TreeNode{node.Left, node.Right}
+		names = []string{path + "/left", path + "/right"}
+	default:
+		return fmt.Errorf("node %s has unknown split type %q", path, node.SplitType)
+	}
+
+	for _, branch := range []string{node.OtherBranch, node.MissingBranch} {
+		if !hasBranch(node, branch) {
+			return fmt.Errorf("node %s refers to unknown branch %q", path, branch)
+		}
+	}
+	for i, child := range children {
+		if child == nil {
+			return fmt.Errorf("node %s is missing a child", names[i])
+		}
+		if err := m.validateNode(child, names[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasBranch reports whether an OtherBranch or MissingBranch value names a
+// child of the node; the empty name is always valid
+func hasBranch(node *TreeNode, name string) bool {
+	switch name {
+	case "":
+		return true
+	case "left":
+		return node.SplitType != "categorical"
+	case "right":
+		return node.SplitType != "categorical"
+	}
+	_, ok := node.Children[name]
+	return ok
+}
+
+// TargetClasses lists every class the tree predicts or saw in training,
+// sorted; it is empty for numeric targets
+func (m *ModelData) TargetClasses() []string {
+	if m.TargetType == "numeric" {
+		return nil
+	}
+	classSet := make(map[string]bool)
+	var visit func(node *TreeNode)
+	visit = func(node *TreeNode) {
+		if node == nil {
+			return
+		}
+		for class := range node.ClassCounts {
+			classSet[class] = true
+		}
+		if node.Prediction != nil {
+			classSet[GetValueKey(node.Prediction)] = true
+		}
+		visit(node.Left)
+		visit(node.Right)
+		for _, child := range node.Children {
+			visit(child)
+		}
+	}
+	visit(m.Tree)
+
+	classes := make([]string, 0, len(classSet))
+	for class := range classSet {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -1,6 +1,11 @@
 package models
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -38,3 +43,378 @@ func TestCompareValues(t *testing.T) {
 		}
 	}
 }
+
+func mockModel() *ModelData {
+	return &ModelData{
+		TargetColumn: "Target",
+		TargetType:   "categorical",
+		Columns:      []string{"Feature1", "Feature2", "Target"},
+		FeatureTypes: map[string]string{"Feature1": "categorical", "Feature2": "numeric", "Target": "categorical"},
+		Tree: &TreeNode{
+			Feature:    "Feature2",
+			SplitType:  "numerical",
+			SplitValue: 1.5,
+			Prediction: "Yes",
+			Left:       &TreeNode{IsLeaf: true, Prediction: "Yes"},
+			Right: &TreeNode{
+				Feature:    "Feature1",
+				SplitType:  "categorical",
+				Prediction: "No",
+				Children: map[string]*TreeNode{
+					"A": {IsLeaf: true, Prediction: "Yes"},
+					"B": {IsLeaf: true, Prediction: "No"},
+				},
+			},
+		},
+	}
+}
+
+func TestModelFileRoundTrip(t *testing.T) {
+	file, err := NewModelFile(mockModel())
+	if err != nil {
+		t.Fatalf("NewModelFile returned an error: %v", err)
+	}
+	file.DatasetHash = "abc"
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatalf("failed to encode envelope: %v", err)
+	}
+
+	decoded, model, err := DecodeModelFile(data)
+	if err != nil {
+		t.Fatalf("DecodeModelFile returned an error: %v", err)
+	}
+	if decoded.Migrated() || decoded.FormatVersion != FormatVersion || decoded.MigratedFrom != 0 || decoded.DatasetHash != "abc" {
+		t.Errorf("envelope = version %d migrated from %d hash %q", decoded.FormatVersion, decoded.MigratedFrom, decoded.DatasetHash)
+	}
+	if len(decoded.Features) != 2 || decoded.Features[1] != (Feature{Name: "Feature2", Type: "numeric"}) {
+		t.Errorf("Features = %v", decoded.Features)
+	}
+	if strings.Join(decoded.TargetClasses, ",") != "No,Yes" {
+		t.Errorf("TargetClasses = %v, want [No Yes]", decoded.TargetClasses)
+	}
+	if model.Tree.Right.Children["A"].Prediction != "Yes" {
+		t.Errorf("decoded tree differs from the saved tree")
+	}
+
+	// Reformatting the file keeps the checksum valid
+	var indented strings.Builder
+	encoder := json.NewEncoder(&indented)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(decoded); err != nil {
+		t.Fatalf("failed to encode envelope: %v", err)
+	}
+	if _, _, err := DecodeModelFile([]byte(indented.String())); err != nil {
+		t.Errorf("DecodeModelFile rejected an indented file: %v", err)
+	}
+}
+
+func TestNewModelFileSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	var files []string
+	for i := 0; i < 2; i++ {
+		file, err := NewModelFile(mockModel())
+		if err != nil {
+			t.Fatalf("NewModelFile returned an error: %v", err)
+		}
+		data, err := EncodeJSON(file, mockModel())
+		if err != nil {
+			t.Fatalf("EncodeJSON returned an error: %v", err)
+		}
+		files = append(files, string(data))
+	}
+
+	if files[0] != files[1] {
+		t.Errorf("files of the same model differ")
+	}
+	if !strings.Contains(files[0], `"created_at":"2023-11-14T22:13:20Z"`) {
+		t.Errorf("creation time does not follow SOURCE_DATE_EPOCH")
+	}
+}
+
+func TestDecodeModelFileMigratesUnversioned(t *testing.T) {
+	data, err := json.Marshal(mockModel())
+	if err != nil {
+		t.Fatalf("failed to encode model: %v", err)
+	}
+
+	file, model, err := DecodeModelFile(data)
+	if err != nil {
+		t.Fatalf("DecodeModelFile returned an error: %v", err)
+	}
+	if !file.Migrated() || file.MigratedFrom != 1 || file.FormatVersion != FormatVersion {
+		t.Errorf("envelope = version %d migrated from %d, want %d from 1", file.FormatVersion, file.MigratedFrom, FormatVersion)
+	}
+	if model.TargetColumn != "Target" || model.Tree == nil {
+		t.Errorf("migrated model lost its content")
+	}
+}
+
+func TestDecodeModelFileErrors(t *testing.T) {
+	valid, err := NewModelFile(mockModel())
+	if err != nil {
+		t.Fatalf("NewModelFile returned an error: %v", err)
+	}
+	encode := func(change func(file *ModelFile)) string {
+		file := *valid
+		change(&file)
+		data, err := json.Marshal(&file)
+		if err != nil {
+			t.Fatalf("failed to encode envelope: %v", err)
+		}
+		return string(data)
+	}
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"Not JSON", "tree", "failed to parse model file"},
+		{"No version", `{"model": {}}`, "no format version"},
+		{"Newer version", `{"format_version": 99}`, "newer than the supported version"},
+		{
+			name: "Tampered model",
+			data: encode(func(file *ModelFile) {
+				file.Model = json.RawMessage(strings.Replace(string(file.Model), `"Yes"`, `"No"`, 1))
+			}),
+			want: "checksum mismatch",
+		},
+		{
+			name: "Invalid tree",
+			data: `{"tree": {"is_leaf": false, "feature": "Feature1", "split_type": "oblique"}, "target_column": "Target"}`,
+			want: `unknown split type "oblique"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeModelFile([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("DecodeModelFile() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(model *ModelData)
+		want   string
+	}{
+		{"Valid model", func(model *ModelData) {}, ""},
+		{"No tree", func(model *ModelData) { model.Tree = nil }, "no tree"},
+		{"No target", func(model *ModelData) { model.TargetColumn = "" }, "no target column"},
+		{"Missing child", func(model *ModelData) { model.Tree.Left = nil }, "root/Feature2/left is missing a child"},
+		{"Nil categorical child", func(model *ModelData) { model.Tree.Right.Children["B"] = nil }, "Feature1=B is missing a child"},
+		{"Unknown split type", func(model *ModelData) { model.Tree.SplitType = "oblique" }, "unknown split type"},
+		{"Unknown feature", func(model *ModelData) { model.Tree.Feature = "Feature3" }, "unknown feature Feature3"},
+		{"Leaf without prediction", func(model *ModelData) { model.Tree.Left.Prediction = nil }, "has no prediction"},
+		{"Missing split value", func(model *ModelData) { model.Tree.SplitValue = nil }, "no split value"},
+		{"Bad missing branch", func(model *ModelData) { model.Tree.Right.MissingBranch = "C" }, `refers to unknown branch "C"`},
+		{"Subset without categories", func(model *ModelData) {
+			model.Tree.SplitType = "subset"
+			model.Tree.LeftCategories = []string{"A"}
+		}, "missing the categories of a side"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := mockModel()
+			tt.change(model)
+			err := model.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() returned an error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// richModel uses every node field and value type the binary layout stores
+func richModel() *ModelData {
+	model := mockModel()
+	model.Columns = []string{"Feature1", "Feature2", "Date", "Target"}
+	model.FeatureTypes["Date"] = "date"
+	model.CategoryGroups = map[string][]string{"Feature1": {"A", "B"}}
+	model.Tree.Samples = 10
+	model.Tree.ClassCounts = map[string]int{"No": 4, "Yes": 6}
+	model.Tree.MissingBranch = "right"
+	model.Tree.InfoGain = 0.42
+	model.Tree.GainRatio = 0.3
+	model.Tree.Left = &TreeNode{
+		Feature:         "Feature1",
+		SplitType:       "subset",
+		Prediction:      1,
+		LeftCategories:  []string{"A"},
+		RightCategories: []string{"B", "__other__"},
+		OtherBranch:     "right",
+		Left: &TreeNode{
+			Feature:    "Date",
+			SplitType:  "numerical",
+			SplitValue: time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
+			Prediction: true,
+			Left:       &TreeNode{IsLeaf: true, Prediction: -2.5},
+			Right:      &TreeNode{IsLeaf: true, Prediction: false},
+		},
+		Right: &TreeNode{IsLeaf: true, Feature: "Feature2", SplitType: "numerical", Prediction: 3},
+	}
+	model.Tree.Right.OtherBranch = "A"
+	return model
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	model := richModel()
+	file, err := NewModelFile(model)
+	if err != nil {
+		t.Fatalf("NewModelFile returned an error: %v", err)
+	}
+	file.DatasetHash = "abc"
+	data, err := EncodeBinary(file, model)
+	if err != nil {
+		t.Fatalf("EncodeBinary returned an error: %v", err)
+	}
+	if !IsBinaryModel(data) {
+		t.Fatalf("encoded model does not start with the binary magic")
+	}
+
+	decoded, got, err := DecodeModelFile(data)
+	if err != nil {
+		t.Fatalf("DecodeModelFile returned an error: %v", err)
+	}
+	if decoded.Encoding != "binary" || decoded.DatasetHash != "abc" || decoded.Model != nil {
+		t.Errorf("header = encoding %q hash %q model %s", decoded.Encoding, decoded.DatasetHash, decoded.Model)
+	}
+	// Unlike JSON, the binary layout keeps the type of every value
+	if !reflect.DeepEqual(got, model) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(model)
+		t.Errorf("decoded model differs:\ngot  %s\nwant %s", gotJSON, wantJSON)
+	}
+
+	// Converting back to JSON restores the embedded model
+	jsonData, err := EncodeJSON(decoded, got)
+	if err != nil {
+		t.Fatalf("EncodeJSON returned an error: %v", err)
+	}
+	if _, _, err := DecodeModelFile(jsonData); err != nil {
+		t.Errorf("DecodeModelFile rejected the converted file: %v", err)
+	}
+}
+
+func TestDecodeBinaryErrors(t *testing.T) {
+	model := richModel()
+	file, err := NewModelFile(model)
+	if err != nil {
+		t.Fatalf("NewModelFile returned an error: %v", err)
+	}
+	valid, err := EncodeBinary(file, model)
+	if err != nil {
+		t.Fatalf("EncodeBinary returned an error: %v", err)
+	}
+
+	// withBody rebuilds a file around a body so only the body is invalid
+	withBody := func(body []byte) []byte {
+		header := *file
+		header.Model = nil
+		header.Checksum = checksum(body)
+		headerJSON, _ := json.Marshal(&header)
+		out := binary.AppendUvarint(append([]byte{}, BinaryMagic...), uint64(len(headerJSON)))
+		return append(append(out, headerJSON...), body...)
+	}
+	body, err := encodeBody(model)
+	if err != nil {
+		t.Fatalf("encodeBody returned an error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"Truncated header", valid[:6], "failed to read model header"},
+		{"Corrupted body", append(valid[:len(valid)-1:len(valid)-1], valid[len(valid)-1]^1), "checksum mismatch"},
+		{"Truncated body", withBody(body[:len(body)-3]), "unexpected end of data"},
+		{"Trailing bytes", withBody(append(body[:len(body):len(body)], 0)), "trailing bytes"},
+		{"Unknown layout", withBody(append([]byte{9}, body[1:]...)), "unsupported binary layout version 9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeModelFile(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("DecodeModelFile() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// deepModel builds a complete binary tree of the given depth
+func deepModel(depth int) *ModelData {
+	var build func(level, id int) *TreeNode
+	build = func(level, id int) *TreeNode {
+		counts := map[string]int{"No": id % 7, "Yes": id%5 + 1}
+		if level == depth {
+			return &TreeNode{IsLeaf: true, Prediction: "Yes", Samples: 6, ClassCounts: counts}
+		}
+		return &TreeNode{
+			Feature:     fmt.Sprintf("Feature%d", level%20),
+			SplitType:   "numerical",
+			SplitValue:  float64(id) + 0.5,
+			Prediction:  "No",
+			Samples:     100,
+			ClassCounts: counts,
+			Left:        build(level+1, 2*id),
+			Right:       build(level+1, 2*id+1),
+		}
+	}
+
+	model := &ModelData{TargetColumn: "Target", TargetType: "categorical", FeatureTypes: map[string]string{}}
+	for i := 0; i < 20; i++ {
+		column := fmt.Sprintf("Feature%d", i)
+		model.Columns = append(model.Columns, column)
+		model.FeatureTypes[column] = "numeric"
+	}
+	model.Columns = append(model.Columns, "Target")
+	model.Tree = build(0, 1)
+	return model
+}
+
+// BenchmarkDecodeModelFile compares loading the same deep tree from the JSON
+// and binary encodings
+func BenchmarkDecodeModelFile(b *testing.B) {
+	model := deepModel(14)
+	file, err := NewModelFile(model)
+	if err != nil {
+		b.Fatalf("NewModelFile returned an error: %v", err)
+	}
+	jsonData, err := EncodeJSON(file, model)
+	if err != nil {
+		b.Fatalf("EncodeJSON returned an error: %v", err)
+	}
+	binaryData, err := EncodeBinary(file, model)
+	if err != nil {
+		b.Fatalf("EncodeBinary returned an error: %v", err)
+	}
+
+	for _, bm := range []struct {
+		name string
+		data []byte
+	}{
+		{"json", jsonData},
+		{"binary", binaryData},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(bm.data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := DecodeModelFile(bm.data); err != nil {
+					b.Fatalf("DecodeModelFile returned an error: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package onnx
+
+import (
+	"sort"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// Node modes of the TreeEnsemble operators
+const (
+	modeLeaf = "LEAF"
+	modeLT   = "BRANCH_LT"
+	modeEQ   = "BRANCH_EQ"
+)
+
+// ensemble holds the attributes of a single-tree TreeEnsemble operator
+type ensemble struct {
+	classification bool
+	classes        []string
+	classIndex     map[string]int
+
+	modes       []string
+	features    []int64
+	values      []float32
+	trueIDs     []int64
+	falseIDs    []int64
+	missingTrue []int64
+
+	// Leaf outputs: for classifiers one entry per leaf and class, for
+	// regressors one entry per leaf
+	leafIDs    []int64
+	leafTarget []int64
+	leafWeight []float32
+
+	encoding     *Encoding
+	featureIndex map[string]int
+	unseen       string // Unseen category policy, missing or parent
+}
+
+// convert flattens the tree into TreeEnsemble node arrays.
+//
+// ONNX trees only compare single values, so a categorical split becomes a
+// chain of BRANCH_EQ nodes testing one category code each. Subset splits are
+// chains as well, with the equality tests of every category of a side leading
+// to the one copy of its subtree. Unseen categories fall off the end of the
+// chain, into the missing value child under the missing policy and into a
+// leaf holding the splitting node's distribution under the parent policy.
+// Missing values (NaN) follow the same child as the predictor through
+// nodes_missing_value_tracks_true. Thresholds are stored as float32.
+func convert(model *models.ModelData, encoding *Encoding, unseen string) *ensemble {
+	t := &ensemble{
+		classification: model.TargetType != "numeric",
+		encoding:       encoding,
+		unseen:         unseen,
+		featureIndex:   make(map[string]int),
+		classIndex:     make(map[string]int),
+	}
+	for i, feature := range encoding.Features {
+		t.featureIndex[feature] = i
+	}
+	if t.classification {
+		t.classes = model.TargetClasses()
+		for i, class := range t.classes {
+			t.classIndex[class] = i
+		}
+	}
+
+	tree := model.Tree
+	if tree == nil {
+		tree = &models.TreeNode{IsLeaf: true}
+	}
+	t.emit(tree)
+	return t
+}
+
+// newNode appends a node and returns its id
+func (t *ensemble) newNode(mode string, feature string, value float32) int64 {
+	t.modes = append(t.modes, mode)
+	t.features = append(t.features, int64(t.featureIndex[feature]))
+	t.values = append(t.values, value)
+	t.trueIDs = append(t.trueIDs, 0)
+	t.falseIDs = append(t.falseIDs, 0)
+	t.missingTrue = append(t.missingTrue, 0)
+	return int64(len(t.modes) - 1)
+}
+
+// emit writes the subtree rooted at node and returns the id of its root
+func (t *ensemble) emit(node *models.TreeNode) int64 {
+	if node.IsLeaf {
+		return t.leaf(node)
+	}
+	missing := algorithm.MissingValueChild(node)
+
+	switch node.SplitType {
+	case "categorical":
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		branches := make([]branch, len(keys))
+		for i, key := range keys {
+			branches[i] = branch{key, node.Children[key]}
+		}
+		return t.chain(node, branches, missing)
+	case "subset":
+		var branches []branch
+		for _, side := range []struct {
+			categories []string
+			child      *models.TreeNode
+		}{
+			{node.LeftCategories, node.Left},
+			{node.RightCategories, node.Right},
+		} {
+			if side.child == nil {
+				continue
+			}
+			for _, category := range side.categories {
+				branches = append(branches, branch{category, side.child})
+			}
+		}
+		return t.chain(node, branches, missing)
+	default:
+		threshold, ok := models.ToFloat(node.SplitValue)
+		if !ok {
+			threshold = 0
+		}
+		id := t.newNode(modeLT, node.Feature, float32(threshold))
+		if missing == node.Left {
+			t.missingTrue[id] = 1
+		}
+		t.trueIDs[id] = t.child(node, node.Left)
+		t.falseIDs[id] = t.child(node, node.Right)
+		return id
+	}
+}
+
+// branch is one category of a split and the child it leads to
+type branch struct {
+	category string
+	child    *models.TreeNode
+}
+
+// chain writes one BRANCH_EQ node per category. Missing values follow the
+// first branch of the missing value child, and unseen categories fall off the
+// end of the chain as the unseen policy says.
+func (t *ensemble) chain(node *models.TreeNode, branches []branch, missing *models.TreeNode) int64 {
+	if len(branches) == 0 {
+		return t.leaf(node)
+	}
+
+	// Each child is written once, whatever the number of its categories
+	emitted := make(map[*models.TreeNode]int64)
+	emitOnce := func(child *models.TreeNode) int64 {
+		id, ok := emitted[child]
+		if !ok {
+			id = t.emit(child)
+			emitted[child] = id
+		}
+		return id
+	}
+
+	ids := make([]int64, len(branches))
+	missingMarked := false
+	for i, b := range branches {
+		ids[i] = t.newNode(modeEQ, node.Feature, t.encoding.Code(node.Feature, b.category))
+		if b.child == missing && !missingMarked {
+			t.missingTrue[ids[i]] = 1
+			missingMarked = true
+		}
+		t.trueIDs[ids[i]] = emitOnce(b.child)
+	}
+
+	for i := range ids {
+		if i+1 < len(ids) {
+			t.falseIDs[ids[i]] = ids[i+1]
+		}
+	}
+	last := ids[len(ids)-1]
+	switch {
+	case t.unseen == algorithm.UnseenParent && node.Prediction != nil:
+		t.falseIDs[last] = t.leaf(node)
+	case missing != nil:
+		// Models without node predictions send unseen values down the missing
+		// value child under either policy
+		t.falseIDs[last] = emitOnce(missing)
+	default:
+		t.falseIDs[last] = t.leaf(node)
+	}
+	return ids[0]
+}
+
+// child writes a branch of a numerical split, falling back to a leaf with the
+// node's own prediction when the branch does not exist
+func (t *ensemble) child(node, child *models.TreeNode) int64 {
+	if child == nil {
+		return t.leaf(node)
+	}
+	return t.emit(child)
+}
+
+// leaf writes a leaf with the prediction of node
+func (t *ensemble) leaf(node *models.TreeNode) int64 {
+	id := t.newNode(modeLeaf, "", 0)
+	if !t.classification {
+		t.leafIDs = append(t.leafIDs, id)
+		t.leafTarget = append(t.leafTarget, 0)
+		t.leafWeight = append(t.leafWeight, float32(number(node.Prediction)))
+		return id
+	}
+
+	// Every class gets a weight so runtimes never apply their binary shortcut
+	distribution := t.distribution(node)
+	for i := range t.classes {
+		t.leafIDs = append(t.leafIDs, id)
+		t.leafTarget = append(t.leafTarget, int64(i))
+		t.leafWeight = append(t.leafWeight, distribution[i])
+	}
+	return id
+}
+
+// distribution returns the class probabilities of a node. When the stored
+// prediction is not the single most frequent class, as after two leaves with
+// the same prediction were merged, it is given all the weight so the label
+// output matches the predictor.
+func (t *ensemble) distribution(node *models.TreeNode) []float32 {
+	distribution := make([]float32, len(t.classes))
+	predicted, hasPrediction := t.classIndex[models.GetValueKey(node.Prediction)]
+	if node.Prediction == nil {
+		hasPrediction = false
+	}
+
+	if node.Samples > 0 {
+		for class, count := range node.ClassCounts {
+			distribution[t.classIndex[class]] = float32(count) / float32(node.Samples)
+		}
+	}
+	if !hasPrediction {
+		return distribution
+	}
+
+	for i, p := range distribution {
+		if i != predicted && p >= distribution[predicted] {
+			distribution = make([]float32, len(t.classes))
+			distribution[predicted] = 1
+			break
+		}
+	}
+	if node.Samples == 0 {
+		distribution[predicted] = 1
+	}
+	return distribution
+}
+
+// Attribute types of AttributeProto
+const (
+	attrInt     = 2
+	attrString  = 3
+	attrFloats  = 6
+	attrInts    = 7
+	attrStrings = 8
+)
+
+// attributes encodes the operator attributes
+func (t *ensemble) attributes() []*message {
+	ids := make([]int64, len(t.modes))
+	treeIDs := make([]int64, len(t.modes))
+	for i := range ids {
+		ids[i] = int64(i)
+	}
+	leafTrees := make([]int64, len(t.leafIDs))
+
+	attrs := []*message{
+		intsAttr("nodes_falsenodeids", t.falseIDs),
+		intsAttr("nodes_featureids", t.features),
+		intsAttr("nodes_missing_value_tracks_true", t.missingTrue),
+		stringsAttr("nodes_modes", t.modes),
+		intsAttr("nodes_nodeids", ids),
+		intsAttr("nodes_treeids", treeIDs),
+		intsAttr("nodes_truenodeids", t.trueIDs),
+		floatsAttr("nodes_values", t.values),
+		stringAttr("post_transform", "NONE"),
+	}
+	if t.classification {
+		return append(attrs,
+			intsAttr("class_ids", t.leafTarget),
+			intsAttr("class_nodeids", t.leafIDs),
+			intsAttr("class_treeids", leafTrees),
+			floatsAttr("class_weights", t.leafWeight),
+			stringsAttr("classlabels_strings", t.classes),
+		)
+	}
+	return append(attrs,
+		stringAttr("aggregate_function", "SUM"),
+		intAttr("n_targets", 1),
+		intsAttr("target_ids", t.leafTarget),
+		intsAttr("target_nodeids", t.leafIDs),
+		intsAttr("target_treeids", leafTrees),
+		floatsAttr("target_weights", t.leafWeight),
+	)
+}
+
+func intAttr(name string, value int64) *message {
+	m := &message{}
+	m.string(1, name)
+	m.int(3, value)
+	m.int(20, attrInt)
+	return m
+}
+
+func stringAttr(name, value string) *message {
+	m := &message{}
+	m.string(1, name)
+	m.string(4, value)
+	m.int(20, attrString)
+	return m
+}
+
+func intsAttr(name string, values []int64) *message {
+	m := &message{}
+	m.string(1, name)
+	m.ints(8, values)
+	m.int(20, attrInts)
+	return m
+}
+
+func floatsAttr(name string, values []float32) *message {
+	m := &message{}
+	m.string(1, name)
+	m.floats(7, values)
+	m.int(20, attrFloats)
+	return m
+}
+
+func stringsAttr(name string, values []string) *message {
+	m := &message{}
+	m.string(1, name)
+	m.strings(9, values)
+	m.int(20, attrStrings)
+	return m
+}
@@ -0,0 +1,253 @@
+// Package onnx exports decision trees as ONNX-ML TreeEnsembleClassifier and
+// TreeEnsembleRegressor models.
+package onnx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// Versions written in the model header
+const (
+	IRVersion = 8
+	MLOpset   = 3
+	Opset     = 17
+)
+
+// UnseenCode is the input value for categories that have no code
+const UnseenCode = -1
+
+// Encoding describes how records become the float input tensor X. Each
+// feature is one column; numeric features keep their value and categorical
+// features use the index of the category in Categories, or UnseenCode.
+// Missing values are NaN.
+type Encoding struct {
+	Features   []string            `json:"features"`
+	Categories map[string][]string `json:"category_codes"`
+	Groups     map[string][]string `json:"category_groups,omitempty"`
+	codes      map[string]map[string]int
+}
+
+// NewEncoding derives the input encoding of a model: every column except the
+// target, with codes for the categories the tree splits on
+func NewEncoding(model *models.ModelData) *Encoding {
+	e := &Encoding{
+		Categories: make(map[string][]string),
+		Groups:     model.CategoryGroups,
+	}
+	for _, column := range model.Columns {
+		if column != model.TargetColumn {
+			e.Features = append(e.Features, column)
+		}
+	}
+
+	seen := make(map[string]map[string]bool)
+	add := func(feature string, categories ...string) {
+		if seen[feature] == nil {
+			seen[feature] = make(map[string]bool)
+		}
+		for _, category := range categories {
+			seen[feature][category] = true
+		}
+	}
+	var visit func(node *models.TreeNode)
+	visit = func(node *models.TreeNode) {
+		if node == nil || node.IsLeaf {
+			return
+		}
+		switch node.SplitType {
+		case "categorical":
+			for key, child := range node.Children {
+				add(node.Feature, key)
+				visit(child)
+			}
+		case "subset":
+			add(node.Feature, node.LeftCategories...)
+			add(node.Feature, node.RightCategories...)
+		}
+		visit(node.Left)
+		visit(node.Right)
+	}
+	visit(model.Tree)
+
+	for feature, categories := range seen {
+		for category := range categories {
+			e.Categories[feature] = append(e.Categories[feature], category)
+		}
+		sort.Strings(e.Categories[feature])
+	}
+	return e
+}
+
+// Code returns the input value of a category of a feature
+func (e *Encoding) Code(feature, category string) float32 {
+	if e.codes == nil {
+		e.codes = make(map[string]map[string]int)
+		for name, categories := range e.Categories {
+			e.codes[name] = make(map[string]int, len(categories))
+			for i, c := range categories {
+				e.codes[name][c] = i
+			}
+		}
+	}
+	if code, ok := e.codes[feature][category]; ok {
+		return float32(code)
+	}
+	return UnseenCode
+}
+
+// Encode turns a record into one row of the input tensor
+func (e *Encoding) Encode(record map[string]interface{}) []float32 {
+	row := make([]float32, len(e.Features))
+	for i, feature := range e.Features {
+		value := record[feature]
+		if value == nil {
+			row[i] = float32(math.NaN())
+			continue
+		}
+		if _, categorical := e.Categories[feature]; categorical {
+			category := models.GetValueKey(value)
+			if kept, grouped := e.Groups[feature]; grouped && !slices.Contains(kept, category) {
+				category = algorithm.OtherCategory
+			}
+			row[i] = e.Code(feature, category)
+			continue
+		}
+		row[i] = float32(number(value))
+	}
+	return row
+}
+
+// Write encodes the model as an ONNX protobuf
+func Write(w io.Writer, model *models.ModelData, unseen string) error {
+	data, err := Marshal(model, unseen)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Marshal builds the ONNX ModelProto of a trained model. The graph has one
+// input X of shape [N, features] described by the "encoding" metadata entry.
+// Classifiers output "label" and "probabilities", regressors "variable".
+// Unseen categories are routed by the missing or parent policy; the others
+// cannot be expressed as a tree ensemble.
+func Marshal(model *models.ModelData, unseen string) ([]byte, error) {
+	if unseen != algorithm.UnseenMissing && unseen != algorithm.UnseenParent {
+		return nil, fmt.Errorf("ONNX export does not support the %q unseen category policy", unseen)
+	}
+	encoding := NewEncoding(model)
+	ensemble := convert(model, encoding, unseen)
+
+	encodingJSON, err := json.Marshal(encoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode input encoding: %w", err)
+	}
+
+	node := &message{}
+	node.string(1, "X")
+	if ensemble.classification {
+		node.string(2, "label")
+		node.string(2, "probabilities")
+		node.string(3, "TreeEnsembleClassifier")
+		node.string(4, "TreeEnsembleClassifier")
+	} else {
+		node.string(2, "variable")
+		node.string(3, "TreeEnsembleRegressor")
+		node.string(4, "TreeEnsembleRegressor")
+	}
+	for _, attr := range ensemble.attributes() {
+		node.message(5, attr)
+	}
+	node.string(7, "ai.onnx.ml")
+
+	graph := &message{}
+	graph.message(1, node)
+	graph.string(2, model.TargetColumn)
+	graph.message(11, valueInfo("X", elemFloat, -1, int64(len(encoding.Features))))
+	if ensemble.classification {
+		graph.message(12, valueInfo("label", elemString, -1))
+		graph.message(12, valueInfo("probabilities", elemFloat, -1, int64(len(ensemble.classes))))
+	} else {
+		graph.message(12, valueInfo("variable", elemFloat, -1, 1))
+	}
+
+	result := &message{}
+	result.int(1, IRVersion)
+	result.string(2, "dt")
+	result.message(7, graph)
+	result.message(8, opsetID("", Opset))
+	result.message(8, opsetID("ai.onnx.ml", MLOpset))
+	result.message(14, keyValue("target", model.TargetColumn))
+	result.message(14, keyValue("encoding", string(encodingJSON)))
+	return result.buf, nil
+}
+
+// Tensor element types
+const (
+	elemFloat  = 1
+	elemString = 8
+)
+
+// valueInfo describes a graph input or output; a negative dimension is the
+// symbolic batch size N
+func valueInfo(name string, elemType int64, dims ...int64) *message {
+	shape := &message{}
+	for _, d := range dims {
+		dim := &message{}
+		if d < 0 {
+			dim.string(2, "N")
+		} else {
+			dim.int(1, d)
+		}
+		shape.message(1, dim)
+	}
+	tensor := &message{}
+	tensor.int(1, elemType)
+	tensor.message(2, shape)
+	typ := &message{}
+	typ.message(1, tensor)
+
+	info := &message{}
+	info.string(1, name)
+	info.message(2, typ)
+	return info
+}
+
+func opsetID(domain string, version int64) *message {
+	m := &message{}
+	m.string(1, domain)
+	m.int(2, version)
+	return m
+}
+
+func keyValue(key, value string) *message {
+	m := &message{}
+	m.string(1, key)
+	m.string(2, value)
+	return m
+}
+
+// number converts a numeric value to float64, NaN when it is not a number
+func number(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return math.NaN()
+}
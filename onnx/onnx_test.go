@@ -0,0 +1,313 @@
+package onnx
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"dt/algorithm"
+	"dt/internal/testmodel"
+	"dt/models"
+	"dt/utils"
+)
+
+// fields decodes one protobuf message into its fields by number. Varints and
+// fixed32 values are returned as uint64, length-delimited fields as []byte.
+func fields(t *testing.T, data []byte) map[int][]interface{} {
+	t.Helper()
+	result := make(map[int][]interface{})
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("invalid field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("invalid varint in field %d", field)
+			}
+			result[field] = append(result[field], v)
+			data = data[n:]
+		case wireFixed32:
+			result[field] = append(result[field], uint64(binary.LittleEndian.Uint32(data)))
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || int(size) > len(data[n:]) {
+				t.Fatalf("invalid length in field %d", field)
+			}
+			result[field] = append(result[field], data[n:n+int(size)])
+			data = data[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d in field %d", key&7, field)
+		}
+	}
+	return result
+}
+
+// decodedTree is a TreeEnsemble read back from its attributes
+type decodedTree struct {
+	ints    map[string][]int64
+	floats  map[string][]float32
+	strings map[string][]string
+}
+
+// decode parses the model and returns its operator type, attributes and metadata
+func decode(t *testing.T, data []byte) (string, decodedTree, map[string]string) {
+	t.Helper()
+	model := fields(t, data)
+	metadata := make(map[string]string)
+	for _, entry := range model[14] {
+		kv := fields(t, entry.([]byte))
+		metadata[string(kv[1][0].([]byte))] = string(kv[2][0].([]byte))
+	}
+
+	graph := fields(t, model[7][0].([]byte))
+	node := fields(t, graph[1][0].([]byte))
+	tree := decodedTree{
+		ints:    make(map[string][]int64),
+		floats:  make(map[string][]float32),
+		strings: make(map[string][]string),
+	}
+	for _, raw := range node[5] {
+		attr := fields(t, raw.([]byte))
+		name := string(attr[1][0].([]byte))
+		for _, v := range append(attr[3], attr[8]...) {
+			tree.ints[name] = append(tree.ints[name], int64(v.(uint64)))
+		}
+		for _, v := range attr[7] {
+			tree.floats[name] = append(tree.floats[name], math.Float32frombits(uint32(v.(uint64))))
+		}
+		for _, v := range append(attr[4], attr[9]...) {
+			tree.strings[name] = append(tree.strings[name], string(v.([]byte)))
+		}
+	}
+	return string(node[4][0].([]byte)), tree, metadata
+}
+
+// evaluate runs one input row through the tree and returns the leaf id
+func (d decodedTree) evaluate(row []float32) int64 {
+	id := int64(0)
+	for {
+		x := row[d.ints["nodes_featureids"][id]]
+		value := d.floats["nodes_values"][id]
+		var next bool
+		switch d.strings["nodes_modes"][id] {
+		case modeLeaf:
+			return id
+		case modeLT:
+			next = x < value
+		case modeEQ:
+			next = x == value
+		}
+		if math.IsNaN(float64(x)) {
+			next = d.ints["nodes_missing_value_tracks_true"][id] == 1
+		}
+		if next {
+			id = d.ints["nodes_truenodeids"][id]
+		} else {
+			id = d.ints["nodes_falsenodeids"][id]
+		}
+	}
+}
+
+// classify returns the label and class weights of a row
+func (d decodedTree) classify(row []float32) (string, []float32) {
+	leaf := d.evaluate(row)
+	labels := d.strings["classlabels_strings"]
+	scores := make([]float32, len(labels))
+	for i, id := range d.ints["class_nodeids"] {
+		if id == leaf {
+			scores[d.ints["class_ids"][i]] += d.floats["class_weights"][i]
+		}
+	}
+	best := 0
+	for i, score := range scores {
+		if score > scores[best] {
+			best = i
+		}
+	}
+	return labels[best], scores
+}
+
+func TestMarshalClassifier(t *testing.T) {
+	// The Rural node predicts No so that an unseen education gets a
+	// different label under each policy
+	model := testmodel.Loan()
+	rural := model.Tree.Right.Children["Rural"]
+	rural.Prediction, rural.ClassCounts = "No", map[string]int{"No": 2, "Yes": 1}
+	records := testmodel.LoanRecords()
+
+	tests := []struct {
+		policy     string
+		wantUnseen []float32 // Class weights of an unseen education
+	}{
+		{algorithm.UnseenMissing, []float32{0, 1}},
+		{algorithm.UnseenParent, []float32{2.0 / 3, 1.0 / 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			defer func() { *utils.UnseenPtr = algorithm.UnseenMissing }()
+			*utils.UnseenPtr = tt.policy
+
+			models.Records = make([]map[string]interface{}, len(records))
+			for i, record := range records {
+				models.Records[i] = make(map[string]interface{})
+				for column, value := range record {
+					models.Records[i][column] = value
+				}
+			}
+			algorithm.ApplyCategoryGroups(models.Records, model.CategoryGroups)
+			expected, err := algorithm.Predict(context.Background(), model.Tree)
+			if err != nil {
+				t.Fatalf("Predict returned an error: %v", err)
+			}
+
+			data, err := Marshal(model, tt.policy)
+			if err != nil {
+				t.Fatalf("Marshal returned an error: %v", err)
+			}
+			opType, tree, metadata := decode(t, data)
+			if opType != "TreeEnsembleClassifier" {
+				t.Fatalf("op_type = %q, want TreeEnsembleClassifier", opType)
+			}
+
+			// Rows are encoded from the metadata, as a consumer of the file would
+			var encoding Encoding
+			if err := json.Unmarshal([]byte(metadata["encoding"]), &encoding); err != nil {
+				t.Fatalf("invalid encoding metadata: %v", err)
+			}
+			if want := []string{"Credit_History", "Property_Area", "Education"}; fmt.Sprint(encoding.Features) != fmt.Sprint(want) {
+				t.Errorf("encoding features = %v, want %v", encoding.Features, want)
+			}
+
+			for i, record := range records {
+				got, _ := tree.classify(encoding.Encode(record))
+				if want := fmt.Sprintf("%v", expected[i]); got != want {
+					t.Errorf("record %d: label = %q, want %q", i+1, got, want)
+				}
+			}
+
+			_, scores := tree.classify(encoding.Encode(records[5]))
+			if fmt.Sprint(scores) != fmt.Sprint(tt.wantUnseen) {
+				t.Errorf("unseen category scores = %v, want %v", scores, tt.wantUnseen)
+			}
+		})
+	}
+}
+
+func TestSubsetChildrenWrittenOnce(t *testing.T) {
+	// Ten nested subset splits with four categories a side: repeating the
+	// subtree under every category would take over 4^10 nodes
+	categories := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	model := &models.ModelData{
+		TargetColumn: "label",
+		TargetType:   "categorical",
+		Columns:      []string{"code", "label"},
+		FeatureTypes: map[string]string{"code": "categorical", "label": "categorical"},
+		Tree:         &models.TreeNode{IsLeaf: true, Prediction: "No"},
+	}
+	for depth := 0; depth < 10; depth++ {
+		model.Tree = &models.TreeNode{
+			Feature: "code", SplitType: "subset", Prediction: "No",
+			LeftCategories: categories[:4], RightCategories: categories[4:],
+			Left:  model.Tree,
+			Right: &models.TreeNode{IsLeaf: true, Prediction: "Yes"},
+		}
+	}
+
+	data, err := Marshal(model, algorithm.UnseenParent)
+	if err != nil {
+		t.Fatalf("Marshal returned an error: %v", err)
+	}
+	_, tree, _ := decode(t, data)
+	// Per level: eight tests, the Yes leaf and the unseen leaf
+	if nodes, want := len(tree.strings["nodes_modes"]), 10*10+1; nodes != want {
+		t.Errorf("tree has %d nodes, want %d", nodes, want)
+	}
+	encoding := NewEncoding(model)
+	if label, _ := tree.classify(encoding.Encode(map[string]interface{}{"code": "e"})); label != "Yes" {
+		t.Errorf("code e: label = %q, want Yes", label)
+	}
+}
+
+func TestMarshalRegressor(t *testing.T) {
+	model := &models.ModelData{
+		TargetColumn: "LoanAmount",
+		TargetType:   "numeric",
+		Columns:      []string{"Income", "LoanAmount"},
+		FeatureTypes: map[string]string{"Income": "numeric", "LoanAmount": "numeric"},
+		Tree: &models.TreeNode{
+			Feature: "Income", SplitType: "numerical", SplitValue: 4000.0, Prediction: 120.0,
+			Left:  &models.TreeNode{IsLeaf: true, Prediction: 90.0},
+			Right: &models.TreeNode{IsLeaf: true, Prediction: 150.0},
+		},
+	}
+	if _, err := Marshal(model, algorithm.UnseenFail); err == nil {
+		t.Error("Marshal accepted the fail unseen policy")
+	}
+	data, err := Marshal(model, algorithm.UnseenMissing)
+	if err != nil {
+		t.Fatalf("Marshal returned an error: %v", err)
+	}
+	opType, tree, _ := decode(t, data)
+	if opType != "TreeEnsembleRegressor" {
+		t.Fatalf("op_type = %q, want TreeEnsembleRegressor", opType)
+	}
+
+	encoding := NewEncoding(model)
+	tests := []struct {
+		income interface{}
+		want   float32
+	}{
+		{3999.5, 90},
+		{4000, 150},
+		{nil, 90},
+	}
+	for _, tt := range tests {
+		leaf := tree.evaluate(encoding.Encode(map[string]interface{}{"Income": tt.income}))
+		for i, id := range tree.ints["target_nodeids"] {
+			if id == leaf && tree.floats["target_weights"][i] != tt.want {
+				t.Errorf("Income=%v: prediction = %v, want %v", tt.income, tree.floats["target_weights"][i], tt.want)
+			}
+		}
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	classes := &ensemble{classes: []string{"No", "Yes"}, classIndex: map[string]int{"No": 0, "Yes": 1}}
+	tests := []struct {
+		name string
+		node *models.TreeNode
+		want []float32
+	}{
+		{
+			name: "Class frequencies",
+			node: &models.TreeNode{Prediction: "Yes", Samples: 4, ClassCounts: map[string]int{"No": 1, "Yes": 3}},
+			want: []float32{0.25, 0.75},
+		},
+		{
+			name: "Tie keeps the prediction",
+			node: &models.TreeNode{Prediction: "No", Samples: 2, ClassCounts: map[string]int{"No": 1, "Yes": 1}},
+			want: []float32{1, 0},
+		},
+		{
+			name: "No statistics",
+			node: &models.TreeNode{Prediction: "Yes"},
+			want: []float32{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classes.distribution(tt.node); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("distribution() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package onnx
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protocol buffer wire types
+const (
+	wireVarint  = 0
+	wireFixed32 = 5
+	wireBytes   = 2
+)
+
+// message builds a protocol buffer message field by field. Only the encodings
+// ONNX needs are implemented; repeated scalars are written unpacked, which is
+// the proto2 default that onnx.proto uses.
+type message struct {
+	buf []byte
+}
+
+func (m *message) tag(field int, wire int) {
+	m.buf = binary.AppendUvarint(m.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (m *message) int(field int, v int64) {
+	m.tag(field, wireVarint)
+	m.buf = binary.AppendUvarint(m.buf, uint64(v))
+}
+
+func (m *message) float(field int, v float32) {
+	m.tag(field, wireFixed32)
+	m.buf = binary.LittleEndian.AppendUint32(m.buf, math.Float32bits(v))
+}
+
+func (m *message) bytes(field int, v []byte) {
+	m.tag(field, wireBytes)
+	m.buf = binary.AppendUvarint(m.buf, uint64(len(v)))
+	m.buf = append(m.buf, v...)
+}
+
+func (m *message) string(field int, v string) {
+	m.bytes(field, []byte(v))
+}
+
+func (m *message) message(field int, sub *message) {
+	m.bytes(field, sub.buf)
+}
+
+func (m *message) ints(field int, values []int64) {
+	for _, v := range values {
+		m.int(field, v)
+	}
+}
+
+func (m *message) floats(field int, values []float32) {
+	for _, v := range values {
+		m.float(field, v)
+	}
+}
+
+func (m *message) strings(field int, values []string) {
+	for _, v := range values {
+		m.string(field, v)
+	}
+}
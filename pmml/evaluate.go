@@ -0,0 +1,286 @@
+package pmml
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"dt/models"
+)
+
+// Prediction is the outcome of evaluating a TreeModel for one record
+type Prediction struct {
+	Score         string
+	Probabilities map[string]float64
+	NodeID        string
+}
+
+// Read parses a PMML document holding a TreeModel
+func Read(r io.Reader) (*PMML, error) {
+	var doc PMML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse PMML: %w", err)
+	}
+	if doc.TreeModel == nil {
+		return nil, errors.New("PMML document has no TreeModel")
+	}
+	return &doc, nil
+}
+
+// truth is a three-valued logic result: predicates on missing values are unknown
+type truth int
+
+const (
+	isFalse truth = iota
+	isTrue
+	isUnknown
+)
+
+// Evaluate scores one record following the PMML 4.4 TreeModel rules for the
+// missing value strategies defaultChild, none, lastPrediction and
+// nullPrediction, and the no-true-child strategies returnLastPrediction and
+// returnNullPrediction. Values are compared numerically when the field is
+// continuous or both sides are numbers, and as strings otherwise.
+func (p *PMML) Evaluate(record map[string]interface{}) (Prediction, error) {
+	if p.TreeModel == nil {
+		return Prediction{}, errors.New("PMML document has no TreeModel")
+	}
+	model := p.TreeModel
+	continuous := make(map[string]bool)
+	for _, field := range p.DataDictionary.DataFields {
+		continuous[field.Name] = field.OpType == "continuous"
+	}
+	e := evaluator{record: record, continuous: continuous}
+
+	node := &model.Node
+	if e.predicate(node.Predicate) != isTrue {
+		return Prediction{}, nil
+	}
+
+	last := node
+	for len(node.Nodes) > 0 {
+		var next *Node
+	children:
+		for i := range node.Nodes {
+			switch e.predicate(node.Nodes[i].Predicate) {
+			case isTrue:
+				next = &node.Nodes[i]
+				break children
+			case isUnknown:
+				switch model.MissingValueStrategy {
+				case "defaultChild":
+					if next = childByID(node, node.DefaultChild); next == nil {
+						return Prediction{}, fmt.Errorf("node %s has no default child for missing values", node.ID)
+					}
+					break children
+				case "lastPrediction":
+					return prediction(last), nil
+				case "nullPrediction":
+					return Prediction{}, nil
+				}
+				// "none": an unknown predicate counts as false
+			}
+		}
+
+		if next == nil {
+			if model.NoTrueChildStrategy == "returnLastPrediction" {
+				return prediction(last), nil
+			}
+			return Prediction{}, nil
+		}
+		node = next
+		if node.Score != "" {
+			last = node
+		}
+	}
+	return prediction(node), nil
+}
+
+// childByID finds the direct child with the given id
+func childByID(node *Node, id string) *Node {
+	for i := range node.Nodes {
+		if node.Nodes[i].ID == id {
+			return &node.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// prediction builds the result for the node a record ended in
+func prediction(node *Node) Prediction {
+	result := Prediction{Score: node.Score, NodeID: node.ID}
+	if len(node.ScoreDistributions) == 0 {
+		return result
+	}
+
+	total := 0.0
+	for _, distribution := range node.ScoreDistributions {
+		total += distribution.RecordCount
+	}
+	result.Probabilities = make(map[string]float64)
+	for _, distribution := range node.ScoreDistributions {
+		switch {
+		case distribution.Probability > 0:
+			result.Probabilities[distribution.Value] = distribution.Probability
+		case total > 0:
+			result.Probabilities[distribution.Value] = distribution.RecordCount / total
+		}
+	}
+	return result
+}
+
+// evaluator evaluates predicates against one record
+type evaluator struct {
+	record     map[string]interface{}
+	continuous map[string]bool
+}
+
+func (e evaluator) predicate(p Predicate) truth {
+	switch {
+	case p.True != nil:
+		return isTrue
+	case p.False != nil:
+		return isFalse
+	case p.SimplePredicate != nil:
+		return e.simple(p.SimplePredicate)
+	case p.SimpleSetPredicate != nil:
+		return e.set(p.SimpleSetPredicate)
+	case p.CompoundPredicate != nil:
+		return e.compound(p.CompoundPredicate)
+	}
+	return isFalse
+}
+
+func (e evaluator) simple(p *SimplePredicate) truth {
+	value := e.record[p.Field]
+	switch p.Operator {
+	case "isMissing":
+		return boolean(value == nil)
+	case "isNotMissing":
+		return boolean(value != nil)
+	}
+	if value == nil {
+		return isUnknown
+	}
+
+	c := e.compare(p.Field, value, p.Value)
+	switch p.Operator {
+	case "equal":
+		return boolean(c == 0)
+	case "notEqual":
+		return boolean(c != 0)
+	case "lessThan":
+		return boolean(c < 0)
+	case "lessOrEqual":
+		return boolean(c <= 0)
+	case "greaterThan":
+		return boolean(c > 0)
+	case "greaterOrEqual":
+		return boolean(c >= 0)
+	}
+	return isFalse
+}
+
+func (e evaluator) set(p *SimpleSetPredicate) truth {
+	value := e.record[p.Field]
+	if value == nil {
+		return isUnknown
+	}
+
+	found := false
+	for _, member := range parseArray(p.Array.Value) {
+		if e.compare(p.Field, value, member) == 0 {
+			found = true
+			break
+		}
+	}
+	if p.BooleanOperator == "isNotIn" {
+		return boolean(!found)
+	}
+	return boolean(found)
+}
+
+func (e evaluator) compound(p *CompoundPredicate) truth {
+	switch p.BooleanOperator {
+	case "and":
+		result := isTrue
+		for _, child := range p.Predicates {
+			switch e.predicate(child) {
+			case isFalse:
+				return isFalse
+			case isUnknown:
+				result = isUnknown
+			}
+		}
+		return result
+	case "or":
+		result := isFalse
+		for _, child := range p.Predicates {
+			switch e.predicate(child) {
+			case isTrue:
+				return isTrue
+			case isUnknown:
+				result = isUnknown
+			}
+		}
+		return result
+	case "xor":
+		result := false
+		for _, child := range p.Predicates {
+			switch e.predicate(child) {
+			case isUnknown:
+				return isUnknown
+			case isTrue:
+				result = !result
+			}
+		}
+		return boolean(result)
+	case "surrogate":
+		for _, child := range p.Predicates {
+			if result := e.predicate(child); result != isUnknown {
+				return result
+			}
+		}
+		return isUnknown
+	}
+	return isFalse
+}
+
+// compare orders a record value against a constant from the document
+func (e evaluator) compare(field string, value interface{}, constant string) int {
+	text := models.GetValueKey(value)
+	if c, err := strconv.ParseFloat(constant, 64); err == nil {
+		v, isNumber := asFloat(value)
+		if !isNumber && e.continuous[field] {
+			v, isNumber = parseFloat(text)
+		}
+		if isNumber {
+			return models.CompareValues(v, c)
+		}
+	}
+	return models.CompareValues(text, constant)
+}
+
+func asFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+func boolean(b bool) truth {
+	if b {
+		return isTrue
+	}
+	return isFalse
+}
@@ -0,0 +1,242 @@
+package pmml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// FromModel converts a trained model to a PMML TreeModel document.
+//
+// Numerical splits become lessThan/greaterOrEqual predicates, categorical
+// splits equal predicates and subset splits isIn set predicates. Records with
+// a missing value follow the defaultChild of each node. Under the missing
+// unseen policy the missing value child comes last, its predicate widened by
+// an or with True so an unseen category matches it too. Under the parent
+// policy an unseen category matches no child and the node's own score is
+// returned. Other policies are not supported. Rare category buckets become
+// isNotIn predicates over the categories kept in training.
+func FromModel(model *models.ModelData, unseen string) (*PMML, error) {
+	if unseen != algorithm.UnseenMissing && unseen != algorithm.UnseenParent {
+		return nil, fmt.Errorf("PMML export does not support the %q unseen category policy", unseen)
+	}
+	doc := &PMML{
+		Xmlns:   Namespace,
+		Version: Version,
+		Header: Header{
+			Description: "Decision tree for " + model.TargetColumn,
+			Application: &Application{Name: "dt"},
+		},
+	}
+
+	functionName := "classification"
+	if model.TargetType == "numeric" {
+		functionName = "regression"
+	}
+
+	schema := MiningSchema{}
+	for _, column := range model.Columns {
+		field := DataField{Name: column, OpType: "categorical", DataType: "string"}
+		if model.FeatureTypes[column] == "numeric" {
+			field.OpType = "continuous"
+			field.DataType = "double"
+		}
+
+		if column == model.TargetColumn {
+			if functionName == "classification" {
+				for _, class := range model.TargetClasses() {
+					field.Values = append(field.Values, Value{Value: class})
+				}
+			}
+			schema.MiningFields = append(schema.MiningFields, MiningField{Name: column, UsageType: "target"})
+		} else {
+			schema.MiningFields = append(schema.MiningFields, MiningField{Name: column})
+		}
+		doc.DataDictionary.DataFields = append(doc.DataDictionary.DataFields, field)
+	}
+	doc.DataDictionary.NumberOfFields = len(doc.DataDictionary.DataFields)
+
+	converter := &converter{
+		groups:         model.CategoryGroups,
+		classification: functionName == "classification",
+		unseen:         unseen,
+	}
+	tree := model.Tree
+	if tree == nil {
+		tree = &models.TreeNode{IsLeaf: true}
+	}
+
+	doc.TreeModel = &TreeModel{
+		ModelName:            model.TargetColumn,
+		FunctionName:         functionName,
+		SplitCharacteristic:  "multiSplit",
+		MissingValueStrategy: "defaultChild",
+		NoTrueChildStrategy:  "returnLastPrediction",
+		MiningSchema:         schema,
+		Node:                 converter.node(tree, Predicate{True: &struct{}{}}),
+	}
+	return doc, nil
+}
+
+// Write encodes the model as an indented PMML document
+func Write(w io.Writer, model *models.ModelData, unseen string) error {
+	doc, err := FromModel(model, unseen)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("failed to encode PMML: %w", err)
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// converter turns tree nodes into PMML nodes with sequential ids
+type converter struct {
+	groups         map[string][]string
+	classification bool
+	unseen         string
+	nextID         int
+}
+
+func (c *converter) node(node *models.TreeNode, predicate Predicate) Node {
+	c.nextID++
+	result := Node{
+		ID:          strconv.Itoa(c.nextID),
+		RecordCount: float64(node.Samples),
+		Predicate:   predicate,
+	}
+	if node.Prediction != nil {
+		result.Score = fmt.Sprintf("%v", node.Prediction)
+	}
+	if c.classification && node.Samples > 0 {
+		classes := make([]string, 0, len(node.ClassCounts))
+		for class := range node.ClassCounts {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			count := node.ClassCounts[class]
+			result.ScoreDistributions = append(result.ScoreDistributions, ScoreDistribution{
+				Value:       class,
+				RecordCount: float64(count),
+				Probability: float64(count) / float64(node.Samples),
+			})
+		}
+	}
+	if node.IsLeaf {
+		return result
+	}
+
+	missing := algorithm.MissingValueChild(node)
+	// Under the missing policy, or when the node has no score to return, the
+	// predicates of the missing value child are held back and written last
+	// with True, so categories no other child takes end there too
+	catchAll := (node.SplitType == "categorical" || node.SplitType == "subset") && missing != nil &&
+		(c.unseen == algorithm.UnseenMissing || node.Prediction == nil)
+	var held []Predicate
+	add := func(child *models.TreeNode, predicate Predicate) {
+		if child == nil {
+			return
+		}
+		if catchAll && child == missing {
+			held = append(held, predicate)
+			return
+		}
+		converted := c.node(child, predicate)
+		if child == missing {
+			result.DefaultChild = converted.ID
+		}
+		result.Nodes = append(result.Nodes, converted)
+	}
+
+	switch node.SplitType {
+	case "categorical":
+		keys := make([]string, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			add(node.Children[key], c.categoryPredicate(node.Feature, []string{key}))
+		}
+	case "subset":
+		right := node.RightCategories
+		if catchAll && missing == node.Left {
+			// A category listed on both sides goes left, which now comes last
+			right = slices.DeleteFunc(slices.Clone(right), func(category string) bool {
+				return slices.Contains(node.LeftCategories, category)
+			})
+		}
+		add(node.Left, c.categoryPredicate(node.Feature, node.LeftCategories))
+		add(node.Right, c.categoryPredicate(node.Feature, right))
+	default:
+		threshold := fmt.Sprintf("%v", node.SplitValue)
+		add(node.Left, Predicate{SimplePredicate: &SimplePredicate{
+			Field: node.Feature, Operator: "lessThan", Value: threshold,
+		}})
+		add(node.Right, Predicate{SimplePredicate: &SimplePredicate{
+			Field: node.Feature, Operator: "greaterOrEqual", Value: threshold,
+		}})
+	}
+
+	if len(held) > 0 {
+		predicate := Predicate{CompoundPredicate: &CompoundPredicate{
+			BooleanOperator: "or",
+			Predicates:      append(held, Predicate{True: &struct{}{}}),
+		}}
+		converted := c.node(missing, predicate)
+		result.DefaultChild = converted.ID
+		result.Nodes = append(result.Nodes, converted)
+	}
+	return result
+}
+
+// categoryPredicate matches a set of categories. The rare category bucket of
+// a grouped feature matches every value that was not kept in training.
+func (c *converter) categoryPredicate(feature string, categories []string) Predicate {
+	kept, grouped := c.groups[feature]
+	if grouped && slices.Contains(categories, algorithm.OtherCategory) {
+		others := Predicate{SimpleSetPredicate: &SimpleSetPredicate{
+			Field:           feature,
+			BooleanOperator: "isNotIn",
+			Array:           Array{N: len(kept), Type: "string", Value: formatArray(kept)},
+		}}
+
+		rest := make([]string, 0, len(categories)-1)
+		for _, category := range categories {
+			if category != algorithm.OtherCategory {
+				rest = append(rest, category)
+			}
+		}
+		if len(rest) == 0 {
+			return others
+		}
+		return Predicate{CompoundPredicate: &CompoundPredicate{
+			BooleanOperator: "or",
+			Predicates:      []Predicate{c.categoryPredicate(feature, rest), others},
+		}}
+	}
+
+	if len(categories) == 1 {
+		return Predicate{SimplePredicate: &SimplePredicate{
+			Field: feature, Operator: "equal", Value: categories[0],
+		}}
+	}
+	return Predicate{SimpleSetPredicate: &SimpleSetPredicate{
+		Field:           feature,
+		BooleanOperator: "isIn",
+		Array:           Array{N: len(categories), Type: "string", Value: formatArray(categories)},
+	}}
+}
@@ -0,0 +1,343 @@
+package pmml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// ToModel converts a TreeModel document to a model the predictor can use.
+//
+// Each node's children must split on one field: either a numeric threshold
+// (lessThan/greaterOrEqual or lessOrEqual/greaterThan, the second child may
+// also be True) or categories given by equal and isIn predicates. An isNotIn
+// predicate becomes the rare category bucket of the field. A last child whose
+// predicate is True, or an or of its categories with True, becomes the branch
+// for unseen categories, which the predictor follows with the "other" unseen
+// value policy. The defaultChild of a node is followed for missing values.
+func (p *PMML) ToModel() (*models.ModelData, error) {
+	if p.TreeModel == nil {
+		return nil, errors.New("PMML document has no TreeModel")
+	}
+	tree := p.TreeModel
+
+	model := &models.ModelData{
+		TargetType:   "categorical",
+		FeatureTypes: make(map[string]string),
+	}
+	if tree.FunctionName == "regression" {
+		model.TargetType = "numeric"
+	}
+	for _, field := range p.DataDictionary.DataFields {
+		model.Columns = append(model.Columns, field.Name)
+		model.FeatureTypes[field.Name] = "categorical"
+		if field.OpType == "continuous" {
+			model.FeatureTypes[field.Name] = "numeric"
+		}
+	}
+	for _, field := range tree.MiningSchema.MiningFields {
+		if field.UsageType == "target" || field.UsageType == "predicted" {
+			model.TargetColumn = field.Name
+		}
+	}
+	if model.TargetColumn == "" {
+		return nil, errors.New("PMML mining schema has no target field")
+	}
+	model.FeatureTypes[model.TargetColumn] = model.TargetType
+
+	importer := &importer{regression: model.TargetType == "numeric", groups: make(map[string][]string)}
+	root, err := importer.node(&tree.Node)
+	if err != nil {
+		return nil, err
+	}
+	model.Tree = root
+	if len(importer.groups) > 0 {
+		model.CategoryGroups = importer.groups
+	}
+	return model, nil
+}
+
+// importer converts PMML nodes and collects rare category groups
+type importer struct {
+	regression bool
+	groups     map[string][]string
+}
+
+func (im *importer) node(n *Node) (*models.TreeNode, error) {
+	node := &models.TreeNode{Samples: int(n.RecordCount)}
+	if n.Score != "" {
+		node.Prediction = n.Score
+		if im.regression {
+			score, err := strconv.ParseFloat(n.Score, 64)
+			if err != nil {
+				return nil, fmt.Errorf("node %s: invalid score %q", n.ID, n.Score)
+			}
+			node.Prediction = score
+		}
+	}
+	if len(n.ScoreDistributions) > 0 {
+		node.ClassCounts = make(map[string]int)
+		for _, distribution := range n.ScoreDistributions {
+			count := distribution.RecordCount
+			if count == 0 && n.RecordCount > 0 {
+				count = distribution.Probability * n.RecordCount
+			}
+			if c := int(math.Round(count)); c > 0 {
+				node.ClassCounts[distribution.Value] = c
+			}
+		}
+		if node.Prediction == nil {
+			node.Prediction = majorityClass(n.ScoreDistributions)
+		}
+	}
+
+	if len(n.Nodes) == 0 {
+		node.IsLeaf = true
+		return node, nil
+	}
+
+	children := make([]*models.TreeNode, len(n.Nodes))
+	for i := range n.Nodes {
+		child, err := im.node(&n.Nodes[i])
+		if err != nil {
+			return nil, err
+		}
+		children[i] = child
+	}
+
+	if err := im.split(n, node, children); err != nil {
+		return nil, fmt.Errorf("node %s: %w", n.ID, err)
+	}
+
+	for i := range n.Nodes {
+		if n.DefaultChild != "" && n.Nodes[i].ID == n.DefaultChild {
+			node.MissingBranch = branchName(node, children[i])
+		}
+	}
+	return node, nil
+}
+
+// split sets the split of node from the predicates of its children
+func (im *importer) split(n *Node, node *models.TreeNode, children []*models.TreeNode) error {
+	if len(n.Nodes) == 2 {
+		if ok, err := im.numericSplit(n, node, children); ok || err != nil {
+			return err
+		}
+	}
+	return im.categorySplit(n, node, children)
+}
+
+// numericSplit recognises a threshold split over two children
+func (im *importer) numericSplit(n *Node, node *models.TreeNode, children []*models.TreeNode) (bool, error) {
+	first := n.Nodes[0].SimplePredicate
+	if first == nil {
+		return false, nil
+	}
+
+	var threshold float64
+	var left, right *models.TreeNode
+	switch first.Operator {
+	case "lessThan", "lessOrEqual":
+		left, right = children[0], children[1]
+	case "greaterOrEqual", "greaterThan":
+		left, right = children[1], children[0]
+	default:
+		return false, nil
+	}
+	value, err := strconv.ParseFloat(first.Value, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid threshold %q", first.Value)
+	}
+
+	// The predictor sends x < threshold left, so inclusive bounds move up
+	threshold = value
+	if first.Operator == "lessOrEqual" || first.Operator == "greaterThan" {
+		threshold = math.Nextafter(value, math.Inf(1))
+	}
+
+	second := n.Nodes[1].Predicate
+	if second.True == nil {
+		complement := map[string]string{
+			"lessThan": "greaterOrEqual", "greaterOrEqual": "lessThan",
+			"lessOrEqual": "greaterThan", "greaterThan": "lessOrEqual",
+		}
+		p := second.SimplePredicate
+		if p == nil || p.Field != first.Field || p.Operator != complement[first.Operator] || p.Value != first.Value {
+			return false, fmt.Errorf("children of a numeric split on %s are not complementary", first.Field)
+		}
+	}
+
+	node.Feature = first.Field
+	node.SplitType = "numerical"
+	node.SplitValue = threshold
+	node.Left, node.Right = left, right
+	return true, nil
+}
+
+// categorySplit builds a categorical split. Two children with category sets
+// become a subset split; otherwise every category maps to its child.
+func (im *importer) categorySplit(n *Node, node *models.TreeNode, children []*models.TreeNode) error {
+	feature := ""
+	sets := make([][]string, len(n.Nodes))
+	catchAll, widened := -1, -1
+
+	for i := range n.Nodes {
+		predicate := n.Nodes[i].Predicate
+		if i == len(n.Nodes)-1 {
+			if predicate.True != nil {
+				catchAll = i
+				continue
+			}
+			if rest, ok := withoutTrue(predicate); ok {
+				predicate = rest
+				widened = i
+			}
+		}
+		field, categories, err := im.categories(predicate)
+		if err != nil {
+			return err
+		}
+		if feature != "" && field != feature {
+			return fmt.Errorf("children split on both %s and %s", feature, field)
+		}
+		feature = field
+		sets[i] = categories
+	}
+	if feature == "" {
+		return errors.New("no supported predicate on the children")
+	}
+	if catchAll >= 0 {
+		// The catch-all child becomes the branch for unseen values
+		sets[catchAll] = []string{algorithm.OtherCategory}
+	}
+
+	node.Feature = feature
+	if len(n.Nodes) == 2 && (len(sets[0]) > 1 || len(sets[1]) > 1) {
+		node.SplitType = "subset"
+		node.Left, node.Right = children[0], children[1]
+		node.LeftCategories, node.RightCategories = sorted(sets[0]), sorted(sets[1])
+	} else {
+		node.SplitType = "categorical"
+		node.Children = make(map[string]*models.TreeNode)
+		for i, categories := range sets {
+			for _, category := range categories {
+				if _, taken := node.Children[category]; !taken {
+					node.Children[category] = children[i]
+				}
+			}
+		}
+	}
+
+	for i, categories := range sets {
+		if slices.Contains(categories, algorithm.OtherCategory) {
+			node.OtherBranch = branchName(node, children[i])
+		}
+	}
+	if widened >= 0 {
+		node.OtherBranch = branchName(node, children[widened])
+	}
+	return nil
+}
+
+// withoutTrue strips True from an or predicate that also holds other
+// predicates, as written for the child taking every category left over
+func withoutTrue(p Predicate) (Predicate, bool) {
+	compound := p.CompoundPredicate
+	if compound == nil || compound.BooleanOperator != "or" {
+		return p, false
+	}
+	var rest []Predicate
+	for _, child := range compound.Predicates {
+		if child.True == nil {
+			rest = append(rest, child)
+		}
+	}
+	switch {
+	case len(rest) == len(compound.Predicates) || len(rest) == 0:
+		return p, false
+	case len(rest) == 1:
+		return rest[0], true
+	}
+	return Predicate{CompoundPredicate: &CompoundPredicate{BooleanOperator: "or", Predicates: rest}}, true
+}
+
+// categories returns the field and categories a predicate selects. isNotIn
+// selects the rare category bucket and records the kept categories.
+func (im *importer) categories(p Predicate) (string, []string, error) {
+	switch {
+	case p.SimplePredicate != nil && p.SimplePredicate.Operator == "equal":
+		return p.SimplePredicate.Field, []string{p.SimplePredicate.Value}, nil
+	case p.SimpleSetPredicate != nil:
+		set := p.SimpleSetPredicate
+		values := parseArray(set.Array.Value)
+		if set.BooleanOperator == "isNotIn" {
+			kept := sorted(values)
+			if previous, ok := im.groups[set.Field]; ok && !slices.Equal(previous, kept) {
+				return "", nil, fmt.Errorf("isNotIn predicates on %s list different categories", set.Field)
+			}
+			im.groups[set.Field] = kept
+			return set.Field, []string{algorithm.OtherCategory}, nil
+		}
+		return set.Field, values, nil
+	case p.CompoundPredicate != nil && p.CompoundPredicate.BooleanOperator == "or":
+		field := ""
+		var values []string
+		for _, child := range p.CompoundPredicate.Predicates {
+			f, v, err := im.categories(child)
+			if err != nil {
+				return "", nil, err
+			}
+			if field != "" && f != field {
+				return "", nil, fmt.Errorf("compound predicate mixes %s and %s", field, f)
+			}
+			field = f
+			values = append(values, v...)
+		}
+		return field, values, nil
+	}
+	return "", nil, errors.New("unsupported predicate")
+}
+
+// branchName returns the name of child as used by OtherBranch and MissingBranch
+func branchName(node, child *models.TreeNode) string {
+	switch child {
+	case node.Left:
+		return "left"
+	case node.Right:
+		return "right"
+	}
+	keys := make([]string, 0, len(node.Children))
+	for key := range node.Children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if node.Children[key] == child {
+			return key
+		}
+	}
+	return ""
+}
+
+// majorityClass returns the class with the largest record count
+func majorityClass(distributions []ScoreDistribution) string {
+	best := distributions[0]
+	for _, distribution := range distributions[1:] {
+		if distribution.RecordCount > best.RecordCount {
+			best = distribution
+		}
+	}
+	return best.Value
+}
+
+func sorted(values []string) []string {
+	result := slices.Clone(values)
+	sort.Strings(result)
+	return result
+}
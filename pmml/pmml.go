@@ -0,0 +1,264 @@
+// Package pmml converts decision trees to and from PMML 4.4 TreeModel
+// documents and evaluates such documents.
+package pmml
+
+import (
+	"encoding/xml"
+	"strings"
+	"unicode"
+)
+
+// Namespace and version of the documents written by this package
+const (
+	Namespace = "http://www.dmg.org/PMML-4_4"
+	Version   = "4.4"
+)
+
+// PMML is the root element of a document
+type PMML struct {
+	XMLName        xml.Name       `xml:"PMML"`
+	Xmlns          string         `xml:"xmlns,attr,omitempty"`
+	Version        string         `xml:"version,attr"`
+	Header         Header         `xml:"Header"`
+	DataDictionary DataDictionary `xml:"DataDictionary"`
+	TreeModel      *TreeModel     `xml:"TreeModel"`
+}
+
+// Header describes who produced the document
+type Header struct {
+	Description string       `xml:"description,attr,omitempty"`
+	Application *Application `xml:"Application"`
+}
+
+// Application names the producing software
+type Application struct {
+	Name    string `xml:"name,attr"`
+	Version string `xml:"version,attr,omitempty"`
+}
+
+// DataDictionary declares every field the model uses
+type DataDictionary struct {
+	NumberOfFields int         `xml:"numberOfFields,attr"`
+	DataFields     []DataField `xml:"DataField"`
+}
+
+// DataField declares one field and, for categorical fields, its values
+type DataField struct {
+	Name     string  `xml:"name,attr"`
+	OpType   string  `xml:"optype,attr"`   // "continuous" or "categorical"
+	DataType string  `xml:"dataType,attr"` // "double", "integer" or "string"
+	Values   []Value `xml:"Value"`
+}
+
+// Value is one valid value of a categorical field
+type Value struct {
+	Value string `xml:"value,attr"`
+}
+
+// TreeModel holds the tree and how to evaluate it
+type TreeModel struct {
+	ModelName            string       `xml:"modelName,attr,omitempty"`
+	FunctionName         string       `xml:"functionName,attr"` // "classification" or "regression"
+	SplitCharacteristic  string       `xml:"splitCharacteristic,attr,omitempty"`
+	MissingValueStrategy string       `xml:"missingValueStrategy,attr,omitempty"`
+	NoTrueChildStrategy  string       `xml:"noTrueChildStrategy,attr,omitempty"`
+	MiningSchema         MiningSchema `xml:"MiningSchema"`
+	Node                 Node         `xml:"Node"`
+}
+
+// MiningSchema lists the fields the model reads and its target
+type MiningSchema struct {
+	MiningFields []MiningField `xml:"MiningField"`
+}
+
+// MiningField is one entry of the mining schema
+type MiningField struct {
+	Name      string `xml:"name,attr"`
+	UsageType string `xml:"usageType,attr,omitempty"` // "active" (default) or "target"
+}
+
+// Node is a tree node. Exactly one predicate field is set; it tells whether a
+// record entering the parent goes to this node.
+type Node struct {
+	ID           string  `xml:"id,attr,omitempty"`
+	Score        string  `xml:"score,attr,omitempty"`
+	RecordCount  float64 `xml:"recordCount,attr,omitempty"`
+	DefaultChild string  `xml:"defaultChild,attr,omitempty"`
+
+	Predicate
+	ScoreDistributions []ScoreDistribution `xml:"ScoreDistribution"`
+	Nodes              []Node              `xml:"Node"`
+}
+
+// Predicate holds one of the supported predicate elements
+type Predicate struct {
+	True               *struct{}           `xml:"True"`
+	False              *struct{}           `xml:"False"`
+	SimplePredicate    *SimplePredicate    `xml:"SimplePredicate"`
+	SimpleSetPredicate *SimpleSetPredicate `xml:"SimpleSetPredicate"`
+	CompoundPredicate  *CompoundPredicate  `xml:"CompoundPredicate"`
+}
+
+// SimplePredicate compares a field with a constant
+type SimplePredicate struct {
+	Field    string `xml:"field,attr"`
+	Operator string `xml:"operator,attr"` // equal, notEqual, lessThan, lessOrEqual, greaterThan, greaterOrEqual, isMissing, isNotMissing
+	Value    string `xml:"value,attr,omitempty"`
+}
+
+// SimpleSetPredicate checks a field against a set of values
+type SimpleSetPredicate struct {
+	Field           string `xml:"field,attr"`
+	BooleanOperator string `xml:"booleanOperator,attr"` // "isIn" or "isNotIn"
+	Array           Array  `xml:"Array"`
+}
+
+// Array is a PMML array of space separated, optionally quoted, values
+type Array struct {
+	N     int    `xml:"n,attr,omitempty"`
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// CompoundPredicate combines predicates with a boolean operator
+type CompoundPredicate struct {
+	BooleanOperator string // "and", "or", "xor" or "surrogate"
+	Predicates      []Predicate
+}
+
+// ScoreDistribution is the number of training records of one class at a node
+type ScoreDistribution struct {
+	Value       string  `xml:"value,attr"`
+	RecordCount float64 `xml:"recordCount,attr"`
+	Probability float64 `xml:"probability,attr,omitempty"`
+}
+
+// MarshalXML writes the combined predicates as sibling elements
+func (c CompoundPredicate) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Attr = []xml.Attr{{Name: xml.Name{Local: "booleanOperator"}, Value: c.BooleanOperator}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, predicate := range c.Predicates {
+		if err := predicate.encode(e); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML reads the combined predicates, skipping unsupported elements
+func (c *CompoundPredicate) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "booleanOperator" {
+			c.BooleanOperator = attr.Value
+		}
+	}
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			var predicate Predicate
+			if err := predicate.decode(d, t); err != nil {
+				return err
+			}
+			if !predicate.IsZero() {
+				c.Predicates = append(c.Predicates, predicate)
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// IsZero reports whether no predicate element is set
+func (p Predicate) IsZero() bool {
+	return p.True == nil && p.False == nil && p.SimplePredicate == nil &&
+		p.SimpleSetPredicate == nil && p.CompoundPredicate == nil
+}
+
+// encode writes the predicate element that is set
+func (p Predicate) encode(e *xml.Encoder) error {
+	element := func(name string) xml.StartElement {
+		return xml.StartElement{Name: xml.Name{Local: name}}
+	}
+	switch {
+	case p.True != nil:
+		return e.EncodeElement(struct{}{}, element("True"))
+	case p.False != nil:
+		return e.EncodeElement(struct{}{}, element("False"))
+	case p.SimplePredicate != nil:
+		return e.EncodeElement(p.SimplePredicate, element("SimplePredicate"))
+	case p.SimpleSetPredicate != nil:
+		return e.EncodeElement(p.SimpleSetPredicate, element("SimpleSetPredicate"))
+	case p.CompoundPredicate != nil:
+		return e.EncodeElement(p.CompoundPredicate, element("CompoundPredicate"))
+	}
+	return nil
+}
+
+// decode reads one predicate element into the matching field
+func (p *Predicate) decode(d *xml.Decoder, start xml.StartElement) error {
+	switch start.Name.Local {
+	case "True":
+		p.True = &struct{}{}
+	case "False":
+		p.False = &struct{}{}
+	case "SimplePredicate":
+		p.SimplePredicate = new(SimplePredicate)
+		return d.DecodeElement(p.SimplePredicate, &start)
+	case "SimpleSetPredicate":
+		p.SimpleSetPredicate = new(SimpleSetPredicate)
+		return d.DecodeElement(p.SimpleSetPredicate, &start)
+	case "CompoundPredicate":
+		p.CompoundPredicate = new(CompoundPredicate)
+		return d.DecodeElement(p.CompoundPredicate, &start)
+	}
+	return d.Skip()
+}
+
+// formatArray writes values as a PMML string array, quoting every value
+func formatArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		quoted[i] = `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseArray splits a PMML array into its values. Values are separated by
+// whitespace and may be quoted, with \" escaping a quote.
+func parseArray(s string) []string {
+	values := make([]string, 0)
+	var current strings.Builder
+	inQuotes, hasValue := false, false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inQuotes && c == '\\' && i+1 < len(s):
+			i++
+			current.WriteByte(s[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			hasValue = true
+		case !inQuotes && unicode.IsSpace(rune(c)):
+			if hasValue {
+				values = append(values, current.String())
+				current.Reset()
+				hasValue = false
+			}
+		default:
+			current.WriteByte(c)
+			hasValue = true
+		}
+	}
+	if hasValue {
+		values = append(values, current.String())
+	}
+	return values
+}
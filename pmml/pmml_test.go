@@ -0,0 +1,313 @@
+package pmml
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dt/algorithm"
+	"dt/internal/testmodel"
+	"dt/models"
+	"dt/utils"
+)
+
+func TestRoundTrip(t *testing.T) {
+	// The Rural node predicts No so that an unseen education gets a
+	// different label under each policy
+	model := testmodel.Loan()
+	rural := model.Tree.Right.Children["Rural"]
+	rural.Prediction, rural.ClassCounts = "No", map[string]int{"No": 2, "Yes": 1}
+	records := testmodel.LoanRecords()
+
+	tests := []struct {
+		policy     string
+		wantUnseen map[string]float64 // Probabilities of an unseen education
+	}{
+		{algorithm.UnseenMissing, map[string]float64{"Yes": 1}},
+		{algorithm.UnseenParent, map[string]float64{"No": 2.0 / 3, "Yes": 1.0 / 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			defer func() { *utils.UnseenPtr = algorithm.UnseenMissing }()
+			*utils.UnseenPtr = tt.policy
+
+			// Expected labels come from the interpreter on grouped copies,
+			// while the PMML document sees the raw values
+			models.Records = make([]map[string]interface{}, len(records))
+			for i, record := range records {
+				models.Records[i] = make(map[string]interface{})
+				for column, value := range record {
+					models.Records[i][column] = value
+				}
+			}
+			algorithm.ApplyCategoryGroups(models.Records, model.CategoryGroups)
+			expected, err := algorithm.Predict(context.Background(), model.Tree)
+			if err != nil {
+				t.Fatalf("Predict returned an error: %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := Write(&buf, model, tt.policy); err != nil {
+				t.Fatalf("Write returned an error: %v", err)
+			}
+			for _, want := range []string{
+				`<PMML xmlns="http://www.dmg.org/PMML-4_4" version="4.4">`,
+				`missingValueStrategy="defaultChild"`,
+				`<SimpleSetPredicate field="Property_Area" booleanOperator="isNotIn">`,
+				`<Array n="2" type="string">&#34;Graduate&#34; &#34;Post Graduate&#34;</Array>`,
+			} {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("document missing %q", want)
+				}
+			}
+
+			doc, err := Read(&buf)
+			if err != nil {
+				t.Fatalf("Read returned an error: %v", err)
+			}
+			for i, record := range records {
+				got, err := doc.Evaluate(record)
+				if err != nil {
+					t.Fatalf("record %d: Evaluate returned an error: %v", i+1, err)
+				}
+				if want := fmt.Sprintf("%v", expected[i]); got.Score != want {
+					t.Errorf("record %d: Evaluate() score = %q, want %q", i+1, got.Score, want)
+				}
+			}
+
+			got, err := doc.Evaluate(map[string]interface{}{"Credit_History": 1.0, "Property_Area": "Rural", "Education": "Doctorate"})
+			if err != nil {
+				t.Fatalf("Evaluate returned an error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Probabilities, tt.wantUnseen) {
+				t.Errorf("Evaluate() probabilities = %v, want %v", got.Probabilities, tt.wantUnseen)
+			}
+		})
+	}
+}
+
+func TestRegressionModel(t *testing.T) {
+	model := &models.ModelData{
+		TargetColumn: "LoanAmount",
+		TargetType:   "numeric",
+		Columns:      []string{"Income", "LoanAmount"},
+		FeatureTypes: map[string]string{"Income": "numeric", "LoanAmount": "numeric"},
+		Tree: &models.TreeNode{
+			Feature: "Income", SplitType: "numerical", SplitValue: 4000.0, Prediction: 120.0,
+			Left:  &models.TreeNode{IsLeaf: true, Prediction: 90.0},
+			Right: &models.TreeNode{IsLeaf: true, Prediction: 150.0},
+		},
+	}
+	if _, err := FromModel(model, algorithm.UnseenBlend); err == nil {
+		t.Error("FromModel accepted the blend unseen policy")
+	}
+	doc, err := FromModel(model, algorithm.UnseenMissing)
+	if err != nil {
+		t.Fatalf("FromModel returned an error: %v", err)
+	}
+	if doc.TreeModel.FunctionName != "regression" {
+		t.Errorf("FunctionName = %q, want regression", doc.TreeModel.FunctionName)
+	}
+
+	tests := []struct {
+		income interface{}
+		want   string
+	}{
+		{3999.5, "90"},
+		{"4000", "150"},
+		{nil, "90"},
+	}
+	for _, tt := range tests {
+		got, err := doc.Evaluate(map[string]interface{}{"Income": tt.income})
+		if err != nil {
+			t.Fatalf("Evaluate returned an error: %v", err)
+		}
+		if got.Score != tt.want {
+			t.Errorf("Evaluate(Income=%v) = %q, want %q", tt.income, got.Score, tt.want)
+		}
+	}
+}
+
+func TestEvaluateMissingValueStrategies(t *testing.T) {
+	doc, err := FromModel(testmodel.Loan(), algorithm.UnseenMissing)
+	if err != nil {
+		t.Fatalf("FromModel returned an error: %v", err)
+	}
+	record := map[string]interface{}{"Credit_History": 1.0, "Property_Area": nil}
+
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{"defaultChild", "Yes"},
+		{"lastPrediction", "Yes"},
+		{"nullPrediction", ""},
+		{"none", "Yes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			doc.TreeModel.MissingValueStrategy = tt.strategy
+			got, err := doc.Evaluate(record)
+			if err != nil {
+				t.Fatalf("Evaluate returned an error: %v", err)
+			}
+			if got.Score != tt.want {
+				t.Errorf("Evaluate() = %q, want %q", got.Score, tt.want)
+			}
+		})
+	}
+}
+
+func TestArray(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+	}{
+		{"Plain values", []string{"a", "b"}},
+		{"Spaces and quotes", []string{"Not \"Graduate\"", "Post Graduate", `back\slash`}},
+		{"Empty value", []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseArray(formatArray(tt.values)); !reflect.DeepEqual(got, tt.values) {
+				t.Errorf("parseArray(formatArray(%q)) = %q", tt.values, got)
+			}
+		})
+	}
+
+	if got := parseArray(`1 2  "three four"`); !reflect.DeepEqual(got, []string{"1", "2", "three four"}) {
+		t.Errorf("parseArray() = %q", got)
+	}
+}
+
+func TestToModel(t *testing.T) {
+	model := testmodel.Loan()
+	records := testmodel.LoanRecords()
+
+	predict := func(model *models.ModelData) []interface{} {
+		t.Helper()
+		models.Records = make([]map[string]interface{}, len(records))
+		for i, record := range records {
+			models.Records[i] = make(map[string]interface{})
+			for column, value := range record {
+				models.Records[i][column] = value
+			}
+		}
+		algorithm.ApplyCategoryGroups(models.Records, model.CategoryGroups)
+		predictions, err := algorithm.Predict(context.Background(), model.Tree)
+		if err != nil {
+			t.Fatalf("Predict returned an error: %v", err)
+		}
+		return predictions
+	}
+	expected := predict(model)
+
+	var buf bytes.Buffer
+	if err := Write(&buf, model, *utils.UnseenPtr); err != nil {
+		t.Fatalf("Write returned an error: %v", err)
+	}
+	doc, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read returned an error: %v", err)
+	}
+	imported, err := doc.ToModel()
+	if err != nil {
+		t.Fatalf("ToModel returned an error: %v", err)
+	}
+
+	if imported.TargetColumn != "Approved" || imported.TargetType != "categorical" {
+		t.Errorf("target = %s (%s), want Approved (categorical)", imported.TargetColumn, imported.TargetType)
+	}
+	if !reflect.DeepEqual(imported.CategoryGroups, model.CategoryGroups) {
+		t.Errorf("CategoryGroups = %v, want %v", imported.CategoryGroups, model.CategoryGroups)
+	}
+	for i, got := range predict(imported) {
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", expected[i]) {
+			t.Errorf("record %d: imported model predicts %v, want %v", i+1, got, expected[i])
+		}
+	}
+}
+
+func TestToModelSplits(t *testing.T) {
+	const document = `<PMML xmlns="http://www.dmg.org/PMML-4_4" version="4.4">
+  <DataDictionary numberOfFields="3">
+    <DataField name="income" optype="continuous" dataType="double"/>
+    <DataField name="area" optype="categorical" dataType="string"/>
+    <DataField name="approved" optype="categorical" dataType="string"/>
+  </DataDictionary>
+  <TreeModel functionName="classification" missingValueStrategy="defaultChild">
+    <MiningSchema>
+      <MiningField name="income"/>
+      <MiningField name="area"/>
+      <MiningField name="approved" usageType="predicted"/>
+    </MiningSchema>
+    <Node id="0" score="Y" defaultChild="2">
+      <True/>
+      <Node id="1" score="N">
+        <SimplePredicate field="income" operator="lessOrEqual" value="1000"/>
+      </Node>
+      <Node id="2" score="Y">
+        <SimplePredicate field="income" operator="greaterThan" value="1000"/>
+        <Node id="3" score="Y">
+          <SimplePredicate field="area" operator="equal" value="Urban"/>
+        </Node>
+        <Node id="4" score="N">
+          <SimpleSetPredicate field="area" booleanOperator="isIn">
+            <Array type="string">Rural "Semi urban"</Array>
+          </SimpleSetPredicate>
+        </Node>
+        <Node id="5" score="Y">
+          <True/>
+        </Node>
+      </Node>
+    </Node>
+  </TreeModel>
+</PMML>`
+
+	doc, err := Read(strings.NewReader(document))
+	if err != nil {
+		t.Fatalf("Read returned an error: %v", err)
+	}
+	model, err := doc.ToModel()
+	if err != nil {
+		t.Fatalf("ToModel returned an error: %v", err)
+	}
+
+	root := model.Tree
+	if root.SplitType != "numerical" || root.Feature != "income" || root.MissingBranch != "right" {
+		t.Fatalf("root = %s split on %s missing %q, want numerical on income missing right",
+			root.SplitType, root.Feature, root.MissingBranch)
+	}
+	area := root.Right
+	if area.SplitType != "categorical" || area.OtherBranch != algorithm.OtherCategory {
+		t.Errorf("area = %s split with other branch %q, want categorical with %q",
+			area.SplitType, area.OtherBranch, algorithm.OtherCategory)
+	}
+	if area.Children["Rural"] != area.Children["Semi urban"] {
+		t.Errorf("categories of one isIn predicate should share a child")
+	}
+
+	// lessOrEqual keeps the threshold itself on the left
+	tests := []struct {
+		record map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"income": 1000, "area": "Urban"}, "N"},
+		{map[string]interface{}{"income": 1000.5, "area": "Urban"}, "Y"},
+		{map[string]interface{}{"income": 2000, "area": "Semi urban"}, "N"},
+		{map[string]interface{}{"income": nil, "area": "Rural"}, "N"},
+	}
+	for i, tt := range tests {
+		models.Records = []map[string]interface{}{tt.record}
+		predictions, err := algorithm.Predict(context.Background(), model.Tree)
+		if err != nil {
+			t.Fatalf("Predict returned an error: %v", err)
+		}
+		if fmt.Sprintf("%v", predictions[0]) != tt.want {
+			t.Errorf("record %d: Predict() = %v, want %s", i+1, predictions[0], tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"dt/registry"
+	"dt/server"
+	"dt/utils"
+)
+
+// registryActions maps each action of the registry command to its handler,
+// called with the arguments following the action
+var registryActions = map[string]func(reg *registry.Registry, args []string) error{
+	"push":     registryPush,
+	"list":     registryList,
+	"promote":  registryPromote,
+	"rollback": registryRollback,
+}
+
+// runRegistry manages the versions and stages of the models in -registry
+func runRegistry(context.Context) error {
+	args := utils.Args()
+	if len(args) == 0 {
+		return errors.New("please provide a registry action: push, list, promote or rollback")
+	}
+	action, ok := registryActions[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown registry action %q, expected push, list, promote or rollback", args[0])
+	}
+	return action(registry.Open(*utils.RegistryPtr), args[1:])
+}
+
+// registryPush stores the -m model as the next version of -name
+func registryPush(reg *registry.Registry, args []string) error {
+	if *utils.ModelFilePtr == "" || len(args) > 0 {
+		return errors.New("usage: -c registry push -m <filepath.dt> [-name <name>] [-metrics name=value,...]")
+	}
+	name := *utils.NamePtr
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(*utils.ModelFilePtr), ".dt")
+	}
+	metrics, err := parseNamedNumbers(*utils.MetricsPtr, "metric")
+	if err != nil {
+		return err
+	}
+	version, err := reg.Push(name, *utils.ModelFilePtr, metrics)
+	if err != nil {
+		return fmt.Errorf("failed to push model: %w", err)
+	}
+	slog.Info("model pushed", "model", name+"@"+strconv.Itoa(version.Version), "checksum", version.Checksum)
+	return nil
+}
+
+// registryList writes the versions of every model, or of the models named,
+// to stdout as a table or, with -format json, as JSON
+func registryList(reg *registry.Registry, args []string) error {
+	var list []*registry.Model
+	if len(args) == 0 {
+		var err error
+		if list, err = reg.List(); err != nil {
+			return err
+		}
+	}
+	for _, name := range args {
+		model, err := reg.Get(name)
+		if err != nil {
+			return err
+		}
+		list = append(list, model)
+	}
+
+	switch *utils.FormatPtr {
+	case "json":
+		if list == nil {
+			list = []*registry.Model{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	case "", "text":
+	default:
+		return fmt.Errorf("unknown list format %q, expected text or json", *utils.FormatPtr)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tVERSION\tSTAGE\tPUSHED\tTARGET\tCHECKSUM\tMETRICS")
+	for _, model := range list {
+		for _, v := range model.Versions {
+			stage := strings.Join(model.StagesOf(v.Version), ",")
+			if stage == "" {
+				stage = "-"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%.12s\t%s\n", model.Name, v.Version, stage,
+				v.PushedAt.Format("2006-01-02 15:04"), v.Target, v.Checksum, formatMetrics(v.Metrics))
+		}
+	}
+	return w.Flush()
+}
+
+// registryPromote moves a stage to the version of a reference, such as
+// loans@3 or loans@staging
+func registryPromote(reg *registry.Registry, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: -c registry promote <name>@<version> <stage>")
+	}
+	name, _, err := registry.ParseRef(args[0])
+	if err != nil {
+		return err
+	}
+	_, version, err := reg.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+	if err := reg.Promote(name, version.Version, args[1]); err != nil {
+		return fmt.Errorf("failed to promote model: %w", err)
+	}
+	slog.Info("model promoted", "model", name+"@"+strconv.Itoa(version.Version), "stage", args[1])
+	return nil
+}
+
+// registryRollback returns a stage, production by default, to the version
+// that held it before
+func registryRollback(reg *registry.Registry, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: -c registry rollback <name> [stage]")
+	}
+	stage := registry.Production
+	if len(args) == 2 {
+		stage = args[1]
+	}
+	version, err := reg.Rollback(args[0], stage)
+	if err != nil {
+		return fmt.Errorf("failed to roll back model: %w", err)
+	}
+	slog.Info("model rolled back", "model", args[0]+"@"+strconv.Itoa(version), "stage", stage)
+	return nil
+}
+
+// parseNamedNumbers reads a comma-separated list of name=value pairs, such
+// as metrics or costs
+func parseNamedNumbers(list, kind string) (map[string]float64, error) {
+	if list == "" {
+		return nil, nil
+	}
+	metrics := make(map[string]float64)
+	for _, item := range strings.Split(list, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		number, err := strconv.ParseFloat(value, 64)
+		if !ok || name == "" || err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expected name=value", kind, item)
+		}
+		metrics[name] = number
+	}
+	return metrics, nil
+}
+
+func formatMetrics(metrics map[string]float64) string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]string, len(names))
+	for i, name := range names {
+		items[i] = name + "=" + strconv.FormatFloat(metrics[name], 'g', -1, 64)
+	}
+	return strings.Join(items, " ")
+}
+
+// resolveModelRef replaces a -m registry reference, such as loans@production,
+// with the path of the model file it names
+func resolveModelRef() error {
+	ref := *utils.ModelFilePtr
+	path, version, err := registry.Open(*utils.RegistryPtr).Resolve(ref)
+	if err != nil {
+		return err
+	}
+	slog.Info("resolved registry model", "model", ref, "version", version.Version, "path", path)
+	*utils.ModelFilePtr = path
+	return nil
+}
+
+// followRegistry makes the served models given as registry references load
+// the version their reference names at every reload, so promotions and
+// rollbacks are picked up without restarting. A reference given without a
+// name is served under the registry name.
+func followRegistry(sources []server.ModelSource) error {
+	reg := registry.Open(*utils.RegistryPtr)
+	for i, source := range sources {
+		if !utils.IsModelRef(source.Path) {
+			continue
+		}
+		name, _, err := registry.ParseRef(source.Path)
+		if err != nil {
+			return err
+		}
+		if source.Name == strings.TrimSuffix(filepath.Base(source.Path), filepath.Ext(source.Path)) {
+			sources[i].Name = name
+		}
+		ref := source.Path
+		sources[i].Resolve = func() (string, error) {
+			path, _, err := reg.Resolve(ref)
+			return path, err
+		}
+	}
+	return nil
+}
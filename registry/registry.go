@@ -0,0 +1,382 @@
+// Package registry stores .dt models in a directory under a name, with
+// auto-incrementing versions, training metadata, metrics and stage labels.
+// Each model has its own directory holding one immutable file per version
+// and an index, model.json, describing them:
+//
+//	registry/
+//	  loans/
+//	    model.json
+//	    v1.dt
+//	    v2.dt
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dt/models"
+	"dt/utils"
+)
+
+// Stages a version can be promoted to
+const (
+	Staging    = "staging"
+	Production = "production"
+)
+
+// Latest selects the last version pushed in a reference such as loans@latest
+const Latest = "latest"
+
+const indexFile = "model.json"
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Registry is a model registry rooted at a directory. The directory is
+// created by the first push.
+type Registry struct {
+	dir string
+}
+
+// Open returns the registry stored in dir
+func Open(dir string) *Registry {
+	return &Registry{dir: dir}
+}
+
+// Model is the index of a registered model
+type Model struct {
+	Name     string    `json:"name"`
+	Versions []Version `json:"versions"`
+	// Stages lists the versions that held each stage in order, the current
+	// one last, so that a promotion can be rolled back
+	Stages map[string][]int `json:"stages,omitempty"`
+}
+
+// Version is one pushed model file with the metadata of its training run
+type Version struct {
+	Version         int                    `json:"version"`
+	File            string                 `json:"file"` // Relative to the model directory
+	Checksum        string                 `json:"checksum"`
+	Source          string                 `json:"source"` // Path the model was pushed from
+	PushedAt        time.Time              `json:"pushed_at"`
+	CreatedAt       *time.Time             `json:"created_at,omitempty"` // Nil when the file does not record it
+	Target          string                 `json:"target"`
+	DatasetHash     string                 `json:"dataset_hash,omitempty"`
+	Hyperparameters *models.TrainingParams `json:"hyperparameters,omitempty"`
+	Metrics         map[string]float64     `json:"metrics,omitempty"`
+}
+
+// Current returns the version holding stage, or 0 when none does
+func (m *Model) Current(stage string) int {
+	if history := m.Stages[stage]; len(history) > 0 {
+		return history[len(history)-1]
+	}
+	return 0
+}
+
+// StagesOf returns the stages version currently holds, sorted
+func (m *Model) StagesOf(version int) []string {
+	var stages []string
+	for stage := range m.Stages {
+		if m.Current(stage) == version {
+			stages = append(stages, stage)
+		}
+	}
+	sort.Strings(stages)
+	return stages
+}
+
+// version returns the metadata of a version number
+func (m *Model) version(number int) (*Version, error) {
+	for i := range m.Versions {
+		if m.Versions[i].Version == number {
+			return &m.Versions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no version %d", m.Name, number)
+}
+
+// Push copies a model file into the registry as the next version of name and
+// returns its metadata. Checkpoints of unfinished training and files already
+// registered under name are refused.
+func (r *Registry) Push(name, path string, metrics map[string]float64) (*Version, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model file: %w", err)
+	}
+	file, model, err := models.DecodeModelFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid model %s: %w", path, err)
+	}
+	if file.Training != nil {
+		return nil, fmt.Errorf("%s is a checkpoint of unfinished training", path)
+	}
+
+	var pushed *Version
+	err = r.update(name, true, func(index *Model) error {
+		for _, v := range index.Versions {
+			if v.Checksum == file.Checksum {
+				return fmt.Errorf("model is already registered as %s@%d", name, v.Version)
+			}
+		}
+		number := 1
+		if n := len(index.Versions); n > 0 {
+			number = index.Versions[n-1].Version + 1
+		}
+		version := Version{
+			Version:         number,
+			File:            "v" + strconv.Itoa(number) + ".dt",
+			Checksum:        file.Checksum,
+			Source:          path,
+			PushedAt:        time.Now().UTC(),
+			Target:          model.TargetColumn,
+			DatasetHash:     file.DatasetHash,
+			Hyperparameters: file.Hyperparameters,
+			Metrics:         metrics,
+		}
+		if !file.CreatedAt.IsZero() {
+			version.CreatedAt = &file.CreatedAt
+		}
+		// The file is kept byte for byte, in its original encoding
+		if err := utils.WriteFileAtomic(filepath.Join(r.dir, name, version.File), data); err != nil {
+			return fmt.Errorf("failed to store model file: %w", err)
+		}
+		index.Versions = append(index.Versions, version)
+		pushed = &index.Versions[len(index.Versions)-1]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pushed, nil
+}
+
+// Promote makes version the current holder of stage. The version that held
+// it before is remembered for Rollback.
+func (r *Registry) Promote(name string, version int, stage string) error {
+	if err := checkStage(stage); err != nil {
+		return err
+	}
+	return r.update(name, false, func(index *Model) error {
+		if _, err := index.version(version); err != nil {
+			return err
+		}
+		if index.Current(stage) == version {
+			return nil
+		}
+		if index.Stages == nil {
+			index.Stages = make(map[string][]int)
+		}
+		index.Stages[stage] = append(index.Stages[stage], version)
+		return nil
+	})
+}
+
+// Rollback returns stage to the version that held it before the last
+// promotion and returns that version
+func (r *Registry) Rollback(name, stage string) (int, error) {
+	if err := checkStage(stage); err != nil {
+		return 0, err
+	}
+	var current int
+	err := r.update(name, false, func(index *Model) error {
+		history := index.Stages[stage]
+		if len(history) < 2 {
+			return fmt.Errorf("%s has no earlier %s version to roll back to", name, stage)
+		}
+		index.Stages[stage] = history[:len(history)-1]
+		current = index.Current(stage)
+		return nil
+	})
+	return current, err
+}
+
+// Get returns the index of a registered model
+func (r *Registry) Get(name string) (*Model, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	index, err := r.read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no model named %s in registry %s", name, r.dir)
+	}
+	return index, err
+}
+
+// List returns every registered model, sorted by name
+func (r *Registry) List() ([]*Model, error) {
+	entries, err := os.ReadDir(r.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry: %w", err)
+	}
+	var list []*Model
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		index, err := r.read(entry.Name())
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // Not a model directory
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, index)
+	}
+	return list, nil
+}
+
+// Resolve returns the file of a reference such as loans@production,
+// loans@3 or loans@latest, with its version
+func (r *Registry) Resolve(ref string) (string, *Version, error) {
+	name, selector, err := ParseRef(ref)
+	if err != nil {
+		return "", nil, err
+	}
+	index, err := r.Get(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var number int
+	switch selector {
+	case Latest:
+		if len(index.Versions) == 0 {
+			return "", nil, fmt.Errorf("%s has no versions", name)
+		}
+		number = index.Versions[len(index.Versions)-1].Version
+	case Staging, Production:
+		if number = index.Current(selector); number == 0 {
+			return "", nil, fmt.Errorf("%s has no %s version", name, selector)
+		}
+	default:
+		number, err = strconv.Atoi(strings.TrimPrefix(selector, "v"))
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid reference %q, expected a version, latest, staging or production after @", ref)
+		}
+	}
+	version, err := index.version(number)
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(r.dir, name, version.File), version, nil
+}
+
+// ParseRef splits a reference such as loans@production into the model name
+// and what follows the @
+func ParseRef(ref string) (name, selector string, err error) {
+	name, selector, ok := strings.Cut(ref, "@")
+	if !ok || selector == "" {
+		return "", "", fmt.Errorf("invalid reference %q, expected name@stage or name@version", ref)
+	}
+	if err := checkName(name); err != nil {
+		return "", "", err
+	}
+	return name, selector, nil
+}
+
+// update applies change to the index of name and saves it, holding the lock
+// of the model so concurrent pushes and promotions are not lost. A missing
+// model is created when create is set.
+func (r *Registry) update(name string, create bool, change func(*Model) error) error {
+	dir := filepath.Join(r.dir, name)
+	if create {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create registry: %w", err)
+		}
+	}
+	unlock, err := lock(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no model named %s in registry %s", name, r.dir)
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := r.read(name)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		index, err = &Model{Name: name}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := change(index); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode registry index: %w", err)
+	}
+	if err := utils.WriteFileAtomic(filepath.Join(dir, indexFile), append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write registry index: %w", err)
+	}
+	return nil
+}
+
+// read loads the index of name. It returns an error wrapping
+// fs.ErrNotExist when the model is not registered.
+func (r *Registry) read(name string) (*Model, error) {
+	data, err := os.ReadFile(filepath.Join(r.dir, name, indexFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry index: %w", err)
+	}
+	var index Model
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid registry index of %s: %w", name, err)
+	}
+	return &index, nil
+}
+
+// lockTimeout is how long a change waits for another one to finish
+const lockTimeout = 10 * time.Second
+
+// lock takes the lock file of a model directory and returns the function
+// releasing it
+func lock(dir string) (func(), error) {
+	path := filepath.Join(dir, ".lock")
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("registry is locked by another change, remove %s if none is running", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func checkName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid model name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+func checkStage(stage string) error {
+	if stage != Staging && stage != Production {
+		return fmt.Errorf("unknown stage %q, expected %s or %s", stage, Staging, Production)
+	}
+	return nil
+}
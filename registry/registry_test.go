@@ -0,0 +1,240 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"dt/models"
+	"dt/utils"
+)
+
+// writeModel saves a one-leaf model predicting label
+func writeModel(t *testing.T, path, label string, state *models.TrainingState) {
+	t.Helper()
+	model := &models.ModelData{
+		TargetColumn: "label",
+		TargetType:   "categorical",
+		Columns:      []string{"income", "label"},
+		FeatureTypes: map[string]string{"income": "numeric", "label": "categorical"},
+		Tree:         &models.TreeNode{IsLeaf: true, Prediction: label, Samples: 1, ClassCounts: map[string]int{label: 1}},
+	}
+	file, err := models.NewModelFile(model)
+	if err != nil {
+		t.Fatalf("NewModelFile() error = %v", err)
+	}
+	file.DatasetHash = "abc"
+	file.Training = state
+	data, err := models.EncodeJSON(file, model)
+	if err != nil {
+		t.Fatalf("EncodeJSON() error = %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to write model: %v", err)
+	}
+}
+
+// newRegistry returns a registry holding versions 1 to 3 of loans, each
+// predicting its version number
+func newRegistry(t *testing.T) (*Registry, string) {
+	t.Helper()
+	dir := t.TempDir()
+	reg := Open(filepath.Join(dir, "registry"))
+	for i, label := range []string{"v1", "v2", "v3"} {
+		path := filepath.Join(dir, label+".dt")
+		writeModel(t, path, label, nil)
+		version, err := reg.Push("loans", path, map[string]float64{"accuracy": 0.9})
+		if err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+		if version.Version != i+1 || version.Target != "label" || version.DatasetHash != "abc" ||
+			version.CreatedAt == nil {
+			t.Fatalf("Push() = %+v, want version %d with training metadata", version, i+1)
+		}
+	}
+	return reg, dir
+}
+
+// predicts returns the label predicted by the model file a reference names
+func predicts(t *testing.T, reg *Registry, ref string) string {
+	t.Helper()
+	path, _, err := reg.Resolve(ref)
+	if err != nil {
+		t.Fatalf("Resolve(%q) error = %v", ref, err)
+	}
+	_, model, err := utils.ReadModelFile(path)
+	if err != nil {
+		t.Fatalf("ReadModelFile() error = %v", err)
+	}
+	return model.Tree.Prediction.(string)
+}
+
+func TestPush(t *testing.T) {
+	reg, dir := newRegistry(t)
+
+	checkpoint := filepath.Join(dir, "checkpoint.dt")
+	writeModel(t, checkpoint, "v4", &models.TrainingState{Rows: 1})
+	broken := filepath.Join(dir, "broken.dt")
+	if err := os.WriteFile(broken, []byte("{"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		model   string
+		path    string
+		wantErr string
+	}{
+		{name: "same file twice", model: "loans", path: filepath.Join(dir, "v2.dt"), wantErr: "already registered as loans@2"},
+		{name: "checkpoint", model: "loans", path: checkpoint, wantErr: "checkpoint"},
+		{name: "invalid model", model: "loans", path: broken, wantErr: "invalid model"},
+		{name: "missing file", model: "loans", path: filepath.Join(dir, "none.dt"), wantErr: "failed to read"},
+		{name: "invalid name", model: "../loans", path: filepath.Join(dir, "v1.dt"), wantErr: "invalid model name"},
+		{name: "reference as name", model: "loans@2", path: filepath.Join(dir, "v1.dt"), wantErr: "invalid model name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := reg.Push(tt.model, tt.path, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Push() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The same file may be pushed under another name
+	if version, err := reg.Push("churn", filepath.Join(dir, "v1.dt"), nil); err != nil || version.Version != 1 {
+		t.Errorf("Push() under a new name = %v, %v, want version 1", version, err)
+	}
+	list, err := reg.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "churn" || list[1].Name != "loans" || len(list[1].Versions) != 3 {
+		t.Errorf("List() = %+v, want churn and loans with 3 versions", list)
+	}
+}
+
+func TestConcurrentPush(t *testing.T) {
+	dir := t.TempDir()
+	reg := Open(filepath.Join(dir, "registry"))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		path := filepath.Join(dir, strings.Repeat("m", i+1)+".dt")
+		writeModel(t, path, path, nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := reg.Push("loans", path, nil); err != nil {
+				t.Errorf("Push() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	model, err := reg.Get("loans")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	for i, version := range model.Versions {
+		if version.Version != i+1 {
+			t.Errorf("versions = %+v, want 1 to 8 in order", model.Versions)
+			break
+		}
+	}
+	if len(model.Versions) != 8 {
+		t.Errorf("got %d versions, want 8", len(model.Versions))
+	}
+}
+
+func TestStages(t *testing.T) {
+	reg, _ := newRegistry(t)
+
+	if _, _, err := reg.Resolve("loans@production"); err == nil {
+		t.Error("Resolve() found a production version before any promotion")
+	}
+	for _, version := range []int{1, 2, 2, 3} {
+		if err := reg.Promote("loans", version, Production); err != nil {
+			t.Fatalf("Promote(%d) error = %v", version, err)
+		}
+	}
+	if err := reg.Promote("loans", 1, Staging); err != nil {
+		t.Fatalf("Promote() error = %v", err)
+	}
+	if got := predicts(t, reg, "loans@production"); got != "v3" {
+		t.Errorf("production predicts %s, want v3", got)
+	}
+
+	model, err := reg.Get("loans")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got := model.StagesOf(1); !reflect.DeepEqual(got, []string{Staging}) {
+		t.Errorf("StagesOf(1) = %v, want [staging]", got)
+	}
+
+	// Promoting the current version again does not add to the history
+	for _, want := range []int{2, 1} {
+		version, err := reg.Rollback("loans", Production)
+		if err != nil || version != want {
+			t.Fatalf("Rollback() = %d, %v, want %d", version, err, want)
+		}
+	}
+	if got := predicts(t, reg, "loans@production"); got != "v1" {
+		t.Errorf("production after rollbacks predicts %s, want v1", got)
+	}
+	if _, err := reg.Rollback("loans", Production); err == nil {
+		t.Error("Rollback() past the first promotion succeeded")
+	}
+
+	for _, err := range []error{
+		reg.Promote("loans", 9, Production),
+		reg.Promote("loans", 1, "archived"),
+		reg.Promote("churn", 1, Production),
+	} {
+		if err == nil {
+			t.Error("Promote() of an invalid version, stage or model succeeded")
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	reg, _ := newRegistry(t)
+	if err := reg.Promote("loans", 2, Staging); err != nil {
+		t.Fatalf("Promote() error = %v", err)
+	}
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{ref: "loans@staging", want: "v2"},
+		{ref: "loans@latest", want: "v3"},
+		{ref: "loans@1", want: "v1"},
+		{ref: "loans@v3", want: "v3"},
+		{ref: "loans@production", wantErr: true},
+		{ref: "loans@4", wantErr: true},
+		{ref: "loans@best", wantErr: true},
+		{ref: "loans@", wantErr: true},
+		{ref: "loans", wantErr: true},
+		{ref: "churn@latest", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			_, _, err := reg.Resolve(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if got := predicts(t, reg, tt.ref); got != tt.want {
+					t.Errorf("%s predicts %s, want %s", tt.ref, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"dt/algorithm"
+	"dt/server"
+	"dt/utils"
+)
+
+const (
+	reloadInterval  = time.Second      // How often serve checks the model files for changes
+	shutdownTimeout = 10 * time.Second // Time given to requests in flight when serve stops
+)
+
+// runServe answers prediction requests over REST on -addr and over gRPC on
+// -grpc-addr until ctx is done, reloading models whenever their file changes
+func runServe(ctx context.Context) error {
+	if err := algorithm.CheckUnseenPolicy(); err != nil {
+		return err
+	}
+	if *utils.AddrPtr == "" && *utils.GRPCAddrPtr == "" {
+		return errors.New("nothing to serve, give -addr, -grpc-addr or both")
+	}
+	sources, err := server.ParseModelSources(*utils.ModelFilePtr)
+	if err != nil {
+		return err
+	}
+	if err := followRegistry(sources); err != nil {
+		return err
+	}
+	srv, err := server.New(sources...)
+	if err != nil {
+		return fmt.Errorf("failed to load model: %w", err)
+	}
+	go srv.Watch(ctx, reloadInterval)
+
+	var servers []*http.Server
+	if *utils.AddrPtr != "" {
+		servers = append(servers, &http.Server{
+			Addr:              *utils.AddrPtr,
+			Handler:           srv.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+	}
+	var grpcServer *grpc.Server
+	var grpcListener net.Listener
+	if *utils.GRPCAddrPtr != "" {
+		grpcListener, err = net.Listen("tcp", *utils.GRPCAddrPtr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for gRPC: %w", err)
+		}
+		grpcServer = srv.GRPCServer()
+	}
+
+	served := make(chan error, len(servers)+1)
+	for _, httpServer := range servers {
+		go func() { served <- httpServer.ListenAndServe() }()
+	}
+	if grpcServer != nil {
+		go func() { served <- grpcServer.Serve(grpcListener) }()
+	}
+	for _, source := range sources {
+		slog.Info("serving model", "model", source.Name, "path", source.Path)
+	}
+	slog.Info("serving predictions", "addr", *utils.AddrPtr, "grpc_addr", *utils.GRPCAddrPtr)
+
+	var failed error
+	select {
+	case err := <-served:
+		failed = fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	// Let requests in flight finish before exiting
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, httpServer := range servers {
+		if err := httpServer.Shutdown(shutdownCtx); err != nil && failed == nil {
+			failed = fmt.Errorf("failed to stop server: %w", err)
+		}
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			// Streams still open when the time is up are cut off
+			grpcServer.Stop()
+			<-stopped
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	slog.Info("server stopped")
+	return nil
+}
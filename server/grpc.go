@@ -0,0 +1,104 @@
+package server
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative predictor.proto
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// predictor is the Predictor service described in predictor.proto
+type predictor struct {
+	UnimplementedPredictorServer
+	s *Server
+}
+
+// GRPCServer returns a gRPC server answering the Predictor service described
+// in predictor.proto with the models of s
+func (s *Server) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	grpcServer := grpc.NewServer(opts...)
+	RegisterPredictorServer(grpcServer, &predictor{s: s})
+	return grpcServer
+}
+
+// Predict answers the unary Predict RPC
+func (p *predictor) Predict(ctx context.Context, req *PredictRequest) (*PredictResponse, error) {
+	return p.s.answer(req)
+}
+
+// PredictStream answers every request of the PredictStream RPC as soon as it
+// arrives, until the client closes its side. The first failing request ends
+// the stream with its status.
+func (p *predictor) PredictStream(stream Predictor_PredictStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := p.s.answer(req)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// answer scores the record of a PredictRequest with the model it names
+func (s *Server) answer(req *PredictRequest) (*PredictResponse, error) {
+	source, err := s.model(req.GetModel())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	features := make(map[string]interface{}, len(req.GetFeatures()))
+	for name, value := range req.GetFeatures() {
+		features[name] = featureValue(value)
+	}
+	model := source.current.Load()
+	prediction, scores, err := model.score(features)
+	var invalid *requestError
+	switch {
+	case errors.As(err, &invalid) || errors.Is(err, algorithm.ErrUnseenCategory):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &PredictResponse{
+		Id:            req.GetId(),
+		Model:         source.name,
+		Scores:        scores,
+		ModelChecksum: model.file.Checksum,
+	}
+	if prediction != nil {
+		resp.Prediction = models.GetValueKey(prediction)
+	}
+	return resp, nil
+}
+
+// featureValue returns the string, float64 or bool a Value holds, or nil for
+// a Value with no kind set
+func featureValue(value *Value) interface{} {
+	switch kind := value.GetKind().(type) {
+	case *Value_StringValue:
+		return kind.StringValue
+	case *Value_NumberValue:
+		return kind.NumberValue
+	case *Value_BoolValue:
+		return kind.BoolValue
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dt/algorithm"
+	"dt/models"
+	"dt/utils"
+)
+
+// Model is a named model file kept loaded. It is swapped atomically when
+// the file is reloaded, so requests never see a half-loaded model.
+type Model struct {
+	name    string
+	path    string
+	resolve func() (string, error) // Finds the file to load in place of path when set
+	current atomic.Pointer[loadedModel]
+	mu      sync.Mutex  // Serializes reloads
+	failed  os.FileInfo // File whose last load failed; it is not read again until it changes
+	err     error       // Error of that load
+}
+
+// loadedModel is a model with the file it was read from. It is never
+// modified once loaded, so requests can keep using it during a reload.
+type loadedModel struct {
+	file     *models.ModelFile
+	data     *models.ModelData
+	compiled *algorithm.CompiledTree // Tree compiled for the unseen policy in effect when loaded
+	path     string
+	info     os.FileInfo
+	loadedAt time.Time
+}
+
+// reload loads the model file again if it changed since it was last loaded
+// and reports whether a new model was swapped in. When the new file cannot
+// be loaded, the current model stays in use.
+func (m *Model) reload() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := m.path
+	if m.resolve != nil {
+		resolved, err := m.resolve()
+		if err != nil {
+			return false, err
+		}
+		path = resolved
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read model file: %w", err)
+	}
+	if current := m.current.Load(); current != nil && sameFile(current.info, info) {
+		return false, nil
+	}
+	if sameFile(m.failed, info) {
+		return false, m.err
+	}
+
+	file, data, err := utils.ReadModelFile(path)
+	if err != nil {
+		m.failed, m.err = info, err
+		return false, err
+	}
+	file.Model = nil // The tree is kept decoded in data
+	m.current.Store(&loadedModel{
+		file:     file,
+		data:     data,
+		compiled: algorithm.Compile(data.Tree, *utils.UnseenPtr),
+		path:     path,
+		info:     info,
+		loadedAt: time.Now().UTC(),
+	})
+	m.failed, m.err = nil, nil
+	return true, nil
+}
+
+// sameFile reports whether two stats describe the same, unchanged file. A
+// file replaced by a rename is a different file even with the same size.
+func sameFile(a, b os.FileInfo) bool {
+	return a != nil && b != nil && os.SameFile(a, b) &&
+		a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// explain predicts every record with its decision path. Features left out
+// of a record are missing.
+func (m *loadedModel) explain(raws []map[string]interface{}) ([]*algorithm.Explanation, error) {
+	records := make([]map[string]interface{}, len(raws))
+	for i, raw := range raws {
+		record, err := m.record(raw)
+		if err != nil {
+			return nil, recordError(i, len(raws), err)
+		}
+		records[i] = record
+	}
+	algorithm.ApplyCategoryGroups(records, m.data.CategoryGroups)
+
+	explanations := make([]*algorithm.Explanation, len(records))
+	for i, record := range records {
+		explanation, err := algorithm.Explain(record, m.data.Tree)
+		if err != nil {
+			return nil, recordError(i, len(records), err)
+		}
+		explanations[i] = explanation
+	}
+	return explanations, nil
+}
+
+// score predicts a record with the compiled tree and returns the class
+// probabilities, what explain gives without the decision path
+func (m *loadedModel) score(raw map[string]interface{}) (interface{}, map[string]float64, error) {
+	record, err := m.record(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	algorithm.ApplyCategoryGroups([]map[string]interface{}{record}, m.data.CategoryGroups)
+	return m.compiled.Score(record)
+}
+
+// record converts the feature values of a request to a record of the model
+func (m *loadedModel) record(raw map[string]interface{}) (map[string]interface{}, error) {
+	record := make(map[string]interface{}, len(m.data.Columns))
+	for _, column := range m.data.Columns {
+		record[column] = nil
+	}
+	for feature, value := range raw {
+		parsed, err := requestValue(value)
+		if err != nil {
+			return nil, &requestError{fmt.Errorf("feature %s: %w", feature, err)}
+		}
+		record[feature] = parsed
+	}
+	return record, nil
+}
+
+// requestValue types a value sent by a client like the cell of a prediction
+// CSV, so "3", 3 and 3.0 all become the int the model was trained on
+func requestValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool:
+		return v, nil
+	case string:
+		return utils.ParseValue(v), nil
+	case json.Number:
+		return utils.ParseValue(v.String()), nil
+	case float64:
+		return utils.ParseValue(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	}
+	return nil, fmt.Errorf("unsupported value %v, use a string, number, boolean or null", value)
+}
+
+// requestError is an error in the content of a request
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+func (e *requestError) Unwrap() error { return e.err }
+
+// recordError names the failing record of a batch
+func recordError(i, n int, err error) error {
+	if n == 1 {
+		return err
+	}
+	return fmt.Errorf("record %d: %w", i+1, err)
+}
@@ -0,0 +1,362 @@
+// Predictor serves the predictions of decision tree models trained by dt.
+// Start it with: dt -c serve -m loans=loans.dt,churn=churn.dt -grpc-addr :9090
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: predictor.proto
+
+package server
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Value is a feature value; a Value with no kind set is a missing value
+type Value struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Kind:
+	//
+	//	*Value_StringValue
+	//	*Value_NumberValue
+	//	*Value_BoolValue
+	Kind          isValue_Kind `protobuf_oneof:"kind"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Value) Reset() {
+	*x = Value{}
+	mi := &file_predictor_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Value) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Value) ProtoMessage() {}
+
+func (x *Value) ProtoReflect() protoreflect.Message {
+	mi := &file_predictor_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Value.ProtoReflect.Descriptor instead.
+func (*Value) Descriptor() ([]byte, []int) {
+	return file_predictor_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Value) GetKind() isValue_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return nil
+}
+
+func (x *Value) GetStringValue() string {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_StringValue); ok {
+			return x.StringValue
+		}
+	}
+	return ""
+}
+
+func (x *Value) GetNumberValue() float64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_NumberValue); ok {
+			return x.NumberValue
+		}
+	}
+	return 0
+}
+
+func (x *Value) GetBoolValue() bool {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_BoolValue); ok {
+			return x.BoolValue
+		}
+	}
+	return false
+}
+
+type isValue_Kind interface {
+	isValue_Kind()
+}
+
+type Value_StringValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3,oneof"`
+}
+
+type Value_NumberValue struct {
+	NumberValue float64 `protobuf:"fixed64,2,opt,name=number_value,json=numberValue,proto3,oneof"`
+}
+
+type Value_BoolValue struct {
+	BoolValue bool `protobuf:"varint,3,opt,name=bool_value,json=boolValue,proto3,oneof"`
+}
+
+func (*Value_StringValue) isValue_Kind() {}
+
+func (*Value_NumberValue) isValue_Kind() {}
+
+func (*Value_BoolValue) isValue_Kind() {}
+
+type PredictRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// model names the model to use, empty for the first model given to serve
+	Model string `protobuf:"bytes,1,opt,name=model,proto3" json:"model,omitempty"`
+	// features maps column names to values; absent columns are missing
+	Features map[string]*Value `protobuf:"bytes,2,rep,name=features,proto3" json:"features,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// id is copied to the response to match answers to requests
+	Id            string `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PredictRequest) Reset() {
+	*x = PredictRequest{}
+	mi := &file_predictor_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PredictRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PredictRequest) ProtoMessage() {}
+
+func (x *PredictRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_predictor_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PredictRequest.ProtoReflect.Descriptor instead.
+func (*PredictRequest) Descriptor() ([]byte, []int) {
+	return file_predictor_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PredictRequest) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *PredictRequest) GetFeatures() map[string]*Value {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+func (x *PredictRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type PredictResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// model is the name of the model that answered
+	Model      string `protobuf:"bytes,2,opt,name=model,proto3" json:"model,omitempty"`
+	Prediction string `protobuf:"bytes,3,opt,name=prediction,proto3" json:"prediction,omitempty"`
+	// scores is the probability of each class at the leaf reached
+	Scores        map[string]float64 `protobuf:"bytes,4,rep,name=scores,proto3" json:"scores,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"fixed64,2,opt,name=value"`
+	ModelChecksum string             `protobuf:"bytes,5,opt,name=model_checksum,json=modelChecksum,proto3" json:"model_checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PredictResponse) Reset() {
+	*x = PredictResponse{}
+	mi := &file_predictor_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PredictResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PredictResponse) ProtoMessage() {}
+
+func (x *PredictResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_predictor_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PredictResponse.ProtoReflect.Descriptor instead.
+func (*PredictResponse) Descriptor() ([]byte, []int) {
+	return file_predictor_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PredictResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *PredictResponse) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *PredictResponse) GetPrediction() string {
+	if x != nil {
+		return x.Prediction
+	}
+	return ""
+}
+
+func (x *PredictResponse) GetScores() map[string]float64 {
+	if x != nil {
+		return x.Scores
+	}
+	return nil
+}
+
+func (x *PredictResponse) GetModelChecksum() string {
+	if x != nil {
+		return x.ModelChecksum
+	}
+	return ""
+}
+
+var File_predictor_proto protoreflect.FileDescriptor
+
+const file_predictor_proto_rawDesc = "" +
+	"\n" +
+	"\x0fpredictor.proto\x12\x02dt\"z\n" +
+	"\x05Value\x12#\n" +
+	"\fstring_value\x18\x01 \x01(\tH\x00R\vstringValue\x12#\n" +
+	"\fnumber_value\x18\x02 \x01(\x01H\x00R\vnumberValue\x12\x1f\n" +
+	"\n" +
+	"bool_value\x18\x03 \x01(\bH\x00R\tboolValueB\x06\n" +
+	"\x04kind\"\xbc\x01\n" +
+	"\x0ePredictRequest\x12\x14\n" +
+	"\x05model\x18\x01 \x01(\tR\x05model\x12<\n" +
+	"\bfeatures\x18\x02 \x03(\v2 .dt.PredictRequest.FeaturesEntryR\bfeatures\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\tR\x02id\x1aF\n" +
+	"\rFeaturesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x1f\n" +
+	"\x05value\x18\x02 \x01(\v2\t.dt.ValueR\x05value:\x028\x01\"\xf2\x01\n" +
+	"\x0fPredictResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05model\x18\x02 \x01(\tR\x05model\x12\x1e\n" +
+	"\n" +
+	"prediction\x18\x03 \x01(\tR\n" +
+	"prediction\x127\n" +
+	"\x06scores\x18\x04 \x03(\v2\x1f.dt.PredictResponse.ScoresEntryR\x06scores\x12%\n" +
+	"\x0emodel_checksum\x18\x05 \x01(\tR\rmodelChecksum\x1a9\n" +
+	"\vScoresEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value:\x028\x012}\n" +
+	"\tPredictor\x122\n" +
+	"\aPredict\x12\x12.dt.PredictRequest\x1a\x13.dt.PredictResponse\x12<\n" +
+	"\rPredictStream\x12\x12.dt.PredictRequest\x1a\x13.dt.PredictResponse(\x010\x01B\x12Z\x10dt/server;serverb\x06proto3"
+
+var (
+	file_predictor_proto_rawDescOnce sync.Once
+	file_predictor_proto_rawDescData []byte
+)
+
+func file_predictor_proto_rawDescGZIP() []byte {
+	file_predictor_proto_rawDescOnce.Do(func() {
+		file_predictor_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_predictor_proto_rawDesc), len(file_predictor_proto_rawDesc)))
+	})
+	return file_predictor_proto_rawDescData
+}
+
+var file_predictor_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_predictor_proto_goTypes = []any{
+	(*Value)(nil),           // 0: dt.Value
+	(*PredictRequest)(nil),  // 1: dt.PredictRequest
+	(*PredictResponse)(nil), // 2: dt.PredictResponse
+	nil,                     // 3: dt.PredictRequest.FeaturesEntry
+	nil,                     // 4: dt.PredictResponse.ScoresEntry
+}
+var file_predictor_proto_depIdxs = []int32{
+	3, // 0: dt.PredictRequest.features:type_name -> dt.PredictRequest.FeaturesEntry
+	4, // 1: dt.PredictResponse.scores:type_name -> dt.PredictResponse.ScoresEntry
+	0, // 2: dt.PredictRequest.FeaturesEntry.value:type_name -> dt.Value
+	1, // 3: dt.Predictor.Predict:input_type -> dt.PredictRequest
+	1, // 4: dt.Predictor.PredictStream:input_type -> dt.PredictRequest
+	2, // 5: dt.Predictor.Predict:output_type -> dt.PredictResponse
+	2, // 6: dt.Predictor.PredictStream:output_type -> dt.PredictResponse
+	5, // [5:7] is the sub-list for method output_type
+	3, // [3:5] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_predictor_proto_init() }
+func file_predictor_proto_init() {
+	if File_predictor_proto != nil {
+		return
+	}
+	file_predictor_proto_msgTypes[0].OneofWrappers = []any{
+		(*Value_StringValue)(nil),
+		(*Value_NumberValue)(nil),
+		(*Value_BoolValue)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_predictor_proto_rawDesc), len(file_predictor_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_predictor_proto_goTypes,
+		DependencyIndexes: file_predictor_proto_depIdxs,
+		MessageInfos:      file_predictor_proto_msgTypes,
+	}.Build()
+	File_predictor_proto = out.File
+	file_predictor_proto_goTypes = nil
+	file_predictor_proto_depIdxs = nil
+}
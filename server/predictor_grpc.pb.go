@@ -0,0 +1,163 @@
+// Predictor serves the predictions of decision tree models trained by dt.
+// Start it with: dt -c serve -m loans=loans.dt,churn=churn.dt -grpc-addr :9090
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: predictor.proto
+
+package server
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Predictor_Predict_FullMethodName       = "/dt.Predictor/Predict"
+	Predictor_PredictStream_FullMethodName = "/dt.Predictor/PredictStream"
+)
+
+// PredictorClient is the client API for Predictor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PredictorClient interface {
+	// Predict scores one record
+	Predict(ctx context.Context, in *PredictRequest, opts ...grpc.CallOption) (*PredictResponse, error)
+	// PredictStream answers each request as soon as it arrives, in order. The
+	// first failing request ends the stream with its status.
+	PredictStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[PredictRequest, PredictResponse], error)
+}
+
+type predictorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPredictorClient(cc grpc.ClientConnInterface) PredictorClient {
+	return &predictorClient{cc}
+}
+
+func (c *predictorClient) Predict(ctx context.Context, in *PredictRequest, opts ...grpc.CallOption) (*PredictResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PredictResponse)
+	err := c.cc.Invoke(ctx, Predictor_Predict_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *predictorClient) PredictStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[PredictRequest, PredictResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Predictor_ServiceDesc.Streams[0], Predictor_PredictStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[PredictRequest, PredictResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Predictor_PredictStreamClient = grpc.BidiStreamingClient[PredictRequest, PredictResponse]
+
+// PredictorServer is the server API for Predictor service.
+// All implementations must embed UnimplementedPredictorServer
+// for forward compatibility.
+type PredictorServer interface {
+	// Predict scores one record
+	Predict(context.Context, *PredictRequest) (*PredictResponse, error)
+	// PredictStream answers each request as soon as it arrives, in order. The
+	// first failing request ends the stream with its status.
+	PredictStream(grpc.BidiStreamingServer[PredictRequest, PredictResponse]) error
+	mustEmbedUnimplementedPredictorServer()
+}
+
+// UnimplementedPredictorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPredictorServer struct{}
+
+func (UnimplementedPredictorServer) Predict(context.Context, *PredictRequest) (*PredictResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Predict not implemented")
+}
+func (UnimplementedPredictorServer) PredictStream(grpc.BidiStreamingServer[PredictRequest, PredictResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method PredictStream not implemented")
+}
+func (UnimplementedPredictorServer) mustEmbedUnimplementedPredictorServer() {}
+func (UnimplementedPredictorServer) testEmbeddedByValue()                   {}
+
+// UnsafePredictorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PredictorServer will
+// result in compilation errors.
+type UnsafePredictorServer interface {
+	mustEmbedUnimplementedPredictorServer()
+}
+
+func RegisterPredictorServer(s grpc.ServiceRegistrar, srv PredictorServer) {
+	// If the following call pancis, it indicates UnimplementedPredictorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Predictor_ServiceDesc, srv)
+}
+
+func _Predictor_Predict_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PredictRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PredictorServer).Predict(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Predictor_Predict_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PredictorServer).Predict(ctx, req.(*PredictRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Predictor_PredictStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PredictorServer).PredictStream(&grpc.GenericServerStream[PredictRequest, PredictResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Predictor_PredictStreamServer = grpc.BidiStreamingServer[PredictRequest, PredictResponse]
+
+// Predictor_ServiceDesc is the grpc.ServiceDesc for Predictor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Predictor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dt.Predictor",
+	HandlerType: (*PredictorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Predict",
+			Handler:    _Predictor_Predict_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PredictStream",
+			Handler:       _Predictor_PredictStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "predictor.proto",
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// maxRequestBytes limits the size of a request body
+const maxRequestBytes = 32 << 20
+
+// Handler returns the REST endpoints of the server. Each takes an optional
+// ?model=name query naming the model to use:
+//
+//	POST /predict        one JSON record, answered with its explanation
+//	POST /predict/batch  {"records": [...]}, answered with {"predictions": [...]}
+//	GET  /healthz        liveness and the checksum of every model in use
+//	GET  /model          metadata of the model in use
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /predict", s.predict)
+	mux.HandleFunc("POST /predict/batch", s.predictBatch)
+	mux.HandleFunc("GET /healthz", s.healthz)
+	mux.HandleFunc("GET /model", s.modelInfo)
+	return mux
+}
+
+func (s *Server) predict(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.requestModel(w, r)
+	if !ok {
+		return
+	}
+	model := source.current.Load()
+	var raw map[string]interface{}
+	if err := decodeBody(w, r, &raw); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if raw == nil {
+		writeError(w, http.StatusBadRequest, errors.New("request body must be a JSON object"))
+		return
+	}
+
+	explanations, err := model.explain([]map[string]interface{}{raw})
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, model, explanations[0])
+}
+
+func (s *Server) predictBatch(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.requestModel(w, r)
+	if !ok {
+		return
+	}
+	model := source.current.Load()
+	var request struct {
+		Records []map[string]interface{} `json:"records"`
+	}
+	if err := decodeBody(w, r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	explanations, err := model.explain(request.Records)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, model, map[string]interface{}{"predictions": explanations})
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	checksums := make(map[string]string, len(s.models))
+	for _, model := range s.models {
+		checksums[model.name] = model.current.Load().file.Checksum
+	}
+	def := s.models[0].current.Load()
+	writeJSON(w, def, map[string]interface{}{
+		"status":         "ok",
+		"model_checksum": def.file.Checksum,
+		"models":         checksums,
+	})
+}
+
+func (s *Server) modelInfo(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.requestModel(w, r)
+	if !ok {
+		return
+	}
+	model := source.current.Load()
+	writeJSON(w, model, struct {
+		*models.ModelFile
+		Name     string    `json:"name"`
+		Path     string    `json:"path"`
+		LoadedAt time.Time `json:"loaded_at"`
+	}{model.file, source.name, model.path, model.loadedAt})
+}
+
+// requestModel returns the model named by the ?model query, answering 404
+// when there is none of that name
+func (s *Server) requestModel(w http.ResponseWriter, r *http.Request) (*Model, bool) {
+	model, err := s.model(r.URL.Query().Get("model"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return nil, false
+	}
+	return model, true
+}
+
+// errorStatus maps a prediction error to an HTTP status
+func errorStatus(err error) int {
+	var invalid *requestError
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case errors.Is(err, algorithm.ErrUnseenCategory):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// decodeBody reads a JSON request body into v, keeping numbers as written
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	if decoder.More() {
+		return errors.New("invalid request body: more than one JSON value")
+	}
+	return nil
+}
+
+// writeJSON sends v with the checksum of the model that produced it
+func writeJSON(w http.ResponseWriter, model *loadedModel, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Model-Checksum", model.file.Checksum)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false) // Keep conditions such as "< 5000" readable
+	if err := encoder.Encode(v); err != nil {
+		slog.Warn("failed to write response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
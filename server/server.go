@@ -0,0 +1,140 @@
+// Package server serves the predictions of .dt models over HTTP, as a REST
+// API and as a gRPC Predictor service. Model files are watched and reloaded
+// when they change, without interrupting the requests in flight.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ModelSource names a model file to serve
+type ModelSource struct {
+	Name string
+	Path string
+	// Resolve, when set, finds the file to load in place of Path before
+	// every reload, so a model can follow a registry stage as it is promoted
+	Resolve func() (string, error)
+}
+
+// ParseModelSources reads a comma-separated list of model files, each given
+// as name=path or as a path named after its file: "model.dt" is "model".
+func ParseModelSources(list string) ([]ModelSource, error) {
+	var sources []ModelSource
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		name, path, named := strings.Cut(item, "=")
+		if !named {
+			path = item
+			name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		if name == "" || path == "" {
+			return nil, fmt.Errorf("invalid model %q, use name=path or path", item)
+		}
+		sources = append(sources, ModelSource{Name: name, Path: path})
+	}
+	return sources, nil
+}
+
+// Server answers prediction requests with a set of named models. The first
+// model is the default one, used when a request names none.
+type Server struct {
+	models []*Model
+	byName map[string]*Model
+}
+
+// New loads every model and returns a server for them
+func New(sources ...ModelSource) (*Server, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no model to serve")
+	}
+	s := &Server{byName: make(map[string]*Model, len(sources))}
+	for _, source := range sources {
+		if _, ok := s.byName[source.Name]; ok {
+			return nil, fmt.Errorf("model name %s is used twice", source.Name)
+		}
+		model := &Model{name: source.Name, path: source.Path, resolve: source.Resolve}
+		if _, err := model.reload(); err != nil {
+			return nil, fmt.Errorf("model %s: %w", source.Name, err)
+		}
+		s.models = append(s.models, model)
+		s.byName[source.Name] = model
+	}
+	return s, nil
+}
+
+// model returns the model with the given name, or the default one for an
+// empty name
+func (s *Server) model(name string) (*Model, error) {
+	if name == "" {
+		return s.models[0], nil
+	}
+	if model, ok := s.byName[name]; ok {
+		return model, nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownModel, name)
+}
+
+var errUnknownModel = errors.New("unknown model")
+
+// Reload loads every model file that changed since it was last loaded and
+// reports whether any new model was swapped in. Requests that started before
+// a swap finish with the old model. Models whose file cannot be loaded stay
+// in use, and the first error is returned.
+func (s *Server) Reload() (bool, error) {
+	reloaded, _, err := s.reload()
+	return reloaded, err
+}
+
+func (s *Server) reload() (bool, []error, error) {
+	var swapped bool
+	var first error
+	errs := make([]error, len(s.models))
+	for i, model := range s.models {
+		ok, err := model.reload()
+		if ok {
+			swapped = true
+			current := model.current.Load()
+			slog.Info("model reloaded", "model", model.name, "path", current.path, "checksum", current.file.Checksum)
+		}
+		if err != nil {
+			errs[i] = fmt.Errorf("model %s: %w", model.name, err)
+			if first == nil {
+				first = errs[i]
+			}
+		}
+	}
+	return swapped, errs, first
+}
+
+// Watch checks the model files every interval and reloads those that
+// change, until ctx is done. A failure is logged once per error.
+func (s *Server) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastErrs := make([]string, len(s.models))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, errs, _ := s.reload()
+		for i, err := range errs {
+			message := ""
+			if err != nil {
+				message = err.Error()
+			}
+			if message != "" && message != lastErrs[i] {
+				slog.Warn("model reload failed, keeping the current model", "path", s.models[i].path, "err", err)
+			}
+			lastErrs[i] = message
+		}
+	}
+}
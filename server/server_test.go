@@ -0,0 +1,558 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"dt/algorithm"
+	"dt/models"
+	"dt/utils"
+)
+
+// writeModel saves a model predicting highIncome for incomes from 5000 and
+// "No" below. Areas other than Urban are grouped as rare into __other__
+// unless ungrouped is set.
+func writeModel(t *testing.T, path string, highIncome string, ungrouped bool) {
+	t.Helper()
+	model := &models.ModelData{
+		TargetColumn:   "label",
+		TargetType:     "categorical",
+		Columns:        []string{"income", "area", "label"},
+		FeatureTypes:   map[string]string{"income": "numeric", "area": "categorical", "label": "categorical"},
+		CategoryGroups: map[string][]string{"area": {"Urban"}},
+		Tree: &models.TreeNode{
+			SplitType:   "numerical",
+			Feature:     "income",
+			SplitValue:  5000.0,
+			Prediction:  "No",
+			Samples:     10,
+			ClassCounts: map[string]int{highIncome: 4, "No": 6},
+			Left:        &models.TreeNode{IsLeaf: true, Prediction: "No", Samples: 6, ClassCounts: map[string]int{"No": 6}},
+			Right: &models.TreeNode{
+				SplitType:   "categorical",
+				Feature:     "area",
+				Prediction:  highIncome,
+				Samples:     4,
+				ClassCounts: map[string]int{highIncome: 4},
+				Children: map[string]*models.TreeNode{
+					"Urban":                 {IsLeaf: true, Prediction: highIncome, Samples: 3, ClassCounts: map[string]int{highIncome: 3}},
+					algorithm.OtherCategory: {IsLeaf: true, Prediction: highIncome, Samples: 1, ClassCounts: map[string]int{highIncome: 1}},
+				},
+			},
+		},
+	}
+	if ungrouped {
+		model.CategoryGroups = nil
+	}
+	file, err := models.NewModelFile(model)
+	if err != nil {
+		t.Fatalf("NewModelFile() error = %v", err)
+	}
+	data, err := models.EncodeJSON(file, model)
+	if err != nil {
+		t.Fatalf("EncodeJSON() error = %v", err)
+	}
+	if err := utils.WriteFileAtomic(path, data); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+}
+
+func newTestServer(t *testing.T, ungrouped bool) (*Server, *httptest.Server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "model.dt")
+	writeModel(t, path, "Yes", ungrouped)
+	srv, err := New(ModelSource{Name: "loans", Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	httpServer := httptest.NewServer(srv.Handler())
+	t.Cleanup(httpServer.Close)
+	return srv, httpServer, path
+}
+
+func post(t *testing.T, url, body string) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, decodeResponse(t, resp.Body)
+}
+
+func decodeResponse(t *testing.T, body io.Reader) map[string]interface{} {
+	t.Helper()
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&decoded); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return decoded
+}
+
+func TestPredict(t *testing.T) {
+	_, httpServer, _ := newTestServer(t, false)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantLabel  interface{}
+		wantPath   []string
+	}{
+		{name: "low income", body: `{"income": 1200, "area": "Urban"}`, wantStatus: 200, wantLabel: "No",
+			wantPath: []string{"< 5000"}},
+		{name: "string numbers are parsed", body: `{"income": "7000", "area": "Urban"}`, wantStatus: 200, wantLabel: "Yes",
+			wantPath: []string{">= 5000", "= Urban"}},
+		{name: "rare category is grouped", body: `{"income": 7000, "area": "Rural"}`, wantStatus: 200, wantLabel: "Yes",
+			wantPath: []string{">= 5000", "= " + algorithm.OtherCategory}},
+		{name: "missing feature", body: `{"area": "Urban"}`, wantStatus: 200, wantLabel: "Yes",
+			wantPath: []string{">= 5000", "= Urban"}},
+		{name: "not an object", body: `[1, 2]`, wantStatus: 400},
+		{name: "nested value", body: `{"income": {"value": 1}}`, wantStatus: 400},
+		{name: "invalid json", body: `{"income":`, wantStatus: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, got := post(t, httpServer.URL+"/predict", tt.body)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %v", status, tt.wantStatus, got)
+			}
+			if status != http.StatusOK {
+				if got["error"] == "" {
+					t.Error("error response has no message")
+				}
+				return
+			}
+			if got["prediction"] != tt.wantLabel {
+				t.Errorf("prediction = %v, want %v", got["prediction"], tt.wantLabel)
+			}
+			var path []string
+			for _, step := range got["path"].([]interface{}) {
+				path = append(path, step.(map[string]interface{})["condition"].(string))
+			}
+			if !reflect.DeepEqual(path, tt.wantPath) {
+				t.Errorf("path = %q, want %q", path, tt.wantPath)
+			}
+			if probs := got["probabilities"].(map[string]interface{}); probs[tt.wantLabel.(string)] != 1.0 {
+				t.Errorf("probabilities = %v, want %v certain", probs, tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestPredictBatch(t *testing.T) {
+	_, httpServer, _ := newTestServer(t, false)
+
+	status, got := post(t, httpServer.URL+"/predict/batch",
+		`{"records": [{"income": 100}, {"income": 9000, "area": "Urban"}, {"income": null}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d: %v", status, got)
+	}
+	var labels []interface{}
+	for _, prediction := range got["predictions"].([]interface{}) {
+		labels = append(labels, prediction.(map[string]interface{})["prediction"])
+	}
+	if want := []interface{}{"No", "Yes", "Yes"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("predictions = %v, want %v", labels, want)
+	}
+
+	status, got = post(t, httpServer.URL+"/predict/batch", `{"records": [{"income": 1}, {"income": [1]}]}`)
+	if status != http.StatusBadRequest || !strings.HasPrefix(got["error"].(string), "record 2:") {
+		t.Errorf("status = %d, error = %v, want 400 naming record 2", status, got["error"])
+	}
+}
+
+func TestUnseenFailStatus(t *testing.T) {
+	_, httpServer, _ := newTestServer(t, true)
+	policy := algorithm.UnseenFail
+	utils.UnseenPtr = &policy
+	defer func() {
+		defaultPolicy := algorithm.UnseenMissing
+		utils.UnseenPtr = &defaultPolicy
+	}()
+
+	status, got := post(t, httpServer.URL+"/predict", `{"income": 9000, "area": "Rural"}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422: %v", status, got)
+	}
+	if status, _ := post(t, httpServer.URL+"/predict", `{"income": 9000, "area": "Urban"}`); status != http.StatusOK {
+		t.Errorf("status of a seen value = %d, want 200", status)
+	}
+}
+
+func TestMetadataEndpoints(t *testing.T) {
+	_, httpServer, path := newTestServer(t, false)
+
+	resp, err := http.Get(httpServer.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz: %v", err)
+	}
+	health := decodeResponse(t, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || health["status"] != "ok" || health["model_checksum"] == "" {
+		t.Errorf("GET /healthz = %d %v", resp.StatusCode, health)
+	}
+	if got := resp.Header.Get("X-Model-Checksum"); got != health["model_checksum"] {
+		t.Errorf("X-Model-Checksum = %q, want %q", got, health["model_checksum"])
+	}
+
+	resp, err = http.Get(httpServer.URL + "/model")
+	if err != nil {
+		t.Fatalf("GET /model: %v", err)
+	}
+	info := decodeResponse(t, resp.Body)
+	resp.Body.Close()
+	if info["path"] != path || info["target"].(map[string]interface{})["name"] != "label" || info["model"] != nil {
+		t.Errorf("GET /model = %v", info)
+	}
+
+	if resp, err := http.Get(httpServer.URL + "/predict"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /predict = %v, %v, want 405", resp.StatusCode, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	srv, httpServer, path := newTestServer(t, false)
+	high := `{"income": 9000, "area": "Urban"}`
+
+	// Requests keep being answered while the model is replaced
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Watch(ctx, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	failures := make(chan string, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := http.Post(httpServer.URL+"/predict", "application/json", strings.NewReader(high))
+			if err != nil || resp.StatusCode != http.StatusOK {
+				select {
+				case failures <- "request failed during reload":
+				default:
+				}
+				return
+			}
+			resp.Body.Close()
+		}
+	}()
+
+	writeModel(t, path, "Approved", false)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, got := post(t, httpServer.URL+"/predict", high)
+		if got["prediction"] == "Approved" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the new model was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case failure := <-failures:
+		t.Error(failure)
+	default:
+	}
+
+	// A broken file is not loaded; the current model stays in use
+	if err := os.WriteFile(path, []byte(`{"format_version": 2`), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if reloaded, err := srv.Reload(); reloaded || err == nil {
+		t.Errorf("Reload() = %v, %v, want an error", reloaded, err)
+	}
+	if _, got := post(t, httpServer.URL+"/predict", high); got["prediction"] != "Approved" {
+		t.Errorf("prediction after a failed reload = %v, want Approved", got["prediction"])
+	}
+	if _, err := New(ModelSource{Name: "loans", Path: path}); err == nil {
+		t.Error("New() loaded a broken model file")
+	}
+}
+
+func TestParseModelSources(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []ModelSource
+		wantErr bool
+	}{
+		{list: "models/loans.dt", want: []ModelSource{{Name: "loans", Path: "models/loans.dt"}}},
+		{list: "a=loans.dt, b=/tmp/churn.dt", want: []ModelSource{{Name: "a", Path: "loans.dt"}, {Name: "b", Path: "/tmp/churn.dt"}}},
+		{list: "=loans.dt", wantErr: true},
+		{list: "loans=", wantErr: true},
+		{list: "loans.dt,", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			got, err := ParseModelSources(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseModelSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseModelSources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newNamedServer serves two models: "loans" predicting Yes for high incomes
+// and "approvals" predicting Approved
+func newNamedServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	loans, approvals := filepath.Join(dir, "loans.dt"), filepath.Join(dir, "approvals.dt")
+	writeModel(t, loans, "Yes", false)
+	writeModel(t, approvals, "Approved", false)
+	srv, err := New(ModelSource{Name: "loans", Path: loans}, ModelSource{Name: "approvals", Path: approvals})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := New(ModelSource{Name: "loans", Path: loans}, ModelSource{Name: "loans", Path: approvals}); err == nil {
+		t.Error("New() accepted a model name used twice")
+	}
+	return srv
+}
+
+func TestNamedModels(t *testing.T) {
+	httpServer := httptest.NewServer(newNamedServer(t).Handler())
+	defer httpServer.Close()
+	high := `{"income": 9000, "area": "Urban"}`
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantLabel  interface{}
+	}{
+		{query: "", wantStatus: 200, wantLabel: "Yes"},
+		{query: "?model=loans", wantStatus: 200, wantLabel: "Yes"},
+		{query: "?model=approvals", wantStatus: 200, wantLabel: "Approved"},
+		{query: "?model=churn", wantStatus: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			status, got := post(t, httpServer.URL+"/predict"+tt.query, high)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %v", status, tt.wantStatus, got)
+			}
+			if status == http.StatusOK && got["prediction"] != tt.wantLabel {
+				t.Errorf("prediction = %v, want %v", got["prediction"], tt.wantLabel)
+			}
+		})
+	}
+
+	resp, err := http.Get(httpServer.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz: %v", err)
+	}
+	health := decodeResponse(t, resp.Body)
+	resp.Body.Close()
+	if checksums := health["models"].(map[string]interface{}); len(checksums) != 2 || checksums["loans"] != health["model_checksum"] {
+		t.Errorf("GET /healthz = %v, want both models with loans as the default", health)
+	}
+}
+
+// newGRPCClient serves the Predictor service of srv on a local port and
+// returns a client connected to it
+func newGRPCClient(t *testing.T, srv *Server) PredictorClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	grpcServer := srv.GRPCServer()
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewPredictorClient(conn)
+}
+
+// predictRequest builds a PredictRequest; a nil feature is sent as a Value
+// with no kind set
+func predictRequest(model, id string, features map[string]interface{}) *PredictRequest {
+	req := &PredictRequest{Model: model, Id: id, Features: make(map[string]*Value)}
+	for name, value := range features {
+		v := &Value{}
+		switch value := value.(type) {
+		case string:
+			v.Kind = &Value_StringValue{StringValue: value}
+		case float64:
+			v.Kind = &Value_NumberValue{NumberValue: value}
+		case bool:
+			v.Kind = &Value_BoolValue{BoolValue: value}
+		}
+		req.Features[name] = v
+	}
+	return req
+}
+
+func TestGRPCPredict(t *testing.T) {
+	client := newGRPCClient(t, newNamedServer(t))
+
+	tests := []struct {
+		name      string
+		req       *PredictRequest
+		wantCode  codes.Code
+		wantModel string
+		wantLabel string
+	}{
+		{name: "default model", wantCode: codes.OK, wantModel: "loans", wantLabel: "No",
+			req: predictRequest("", "1", map[string]interface{}{"income": 1200.0, "area": "Urban"})},
+		{name: "named model", wantCode: codes.OK, wantModel: "approvals", wantLabel: "Approved",
+			req: predictRequest("approvals", "1", map[string]interface{}{"income": 9000.0, "area": "Urban"})},
+		{name: "string number and missing value", wantCode: codes.OK, wantModel: "loans", wantLabel: "Yes",
+			req: predictRequest("loans", "1", map[string]interface{}{"income": "7000", "area": nil})},
+		{name: "bool value", wantCode: codes.OK, wantModel: "loans", wantLabel: "Yes",
+			req: predictRequest("loans", "1", map[string]interface{}{"income": 7000.0, "urban": true})},
+		{name: "unknown model", wantCode: codes.NotFound,
+			req: predictRequest("churn", "1", map[string]interface{}{"income": 1.0})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := client.Predict(context.Background(), tt.req)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %v, want %v: %v", code, tt.wantCode, err)
+			}
+			if tt.wantCode != codes.OK {
+				return
+			}
+			if got.Id != "1" || got.Model != tt.wantModel || got.Prediction != tt.wantLabel || got.ModelChecksum == "" {
+				t.Errorf("response = %v, want model %s predicting %s", got, tt.wantModel, tt.wantLabel)
+			}
+			if got.Scores[tt.wantLabel] != 1.0 {
+				t.Errorf("scores = %v, want %s certain", got.Scores, tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestGRPCPredictStream(t *testing.T) {
+	client := newGRPCClient(t, newNamedServer(t))
+
+	// Each answer arrives before the next request is sent
+	stream, err := client.PredictStream(context.Background())
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	incomes := []float64{100, 9000, 4999.5, 5000}
+	want := []string{"No", "Approved", "No", "Approved"}
+	for i, income := range incomes {
+		id := strconv.Itoa(i)
+		if err := stream.Send(predictRequest("approvals", id, map[string]interface{}{"income": income})); err != nil {
+			t.Fatalf("failed to send request %d: %v", i, err)
+		}
+		got, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("failed to receive response %d: %v", i, err)
+		}
+		if got.Id != id || got.Prediction != want[i] {
+			t.Errorf("response %d = %v, want id %s predicting %s", i, got, id, want[i])
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("stream did not end after the requests: %v", err)
+	}
+
+	// A failing request ends the stream with its status after the answers
+	// already sent
+	stream, err = client.PredictStream(context.Background())
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	stream.Send(predictRequest("", "0", nil))
+	stream.Send(predictRequest("churn", "1", nil))
+	stream.CloseSend()
+	var answers int
+	for {
+		_, err = stream.Recv()
+		if err != nil {
+			break
+		}
+		answers++
+	}
+	if answers != 1 || status.Code(err) != codes.NotFound {
+		t.Errorf("got %d responses and %v, want 1 and NotFound", answers, err)
+	}
+}
+
+func TestResolvedSource(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "v1.dt"), filepath.Join(dir, "v2.dt")
+	writeModel(t, first, "Yes", false)
+	writeModel(t, second, "Approved", false)
+
+	// Promoting another version changes the file the source resolves to
+	var mu sync.Mutex
+	current := first
+	srv, err := New(ModelSource{Name: "loans", Path: "loans@production", Resolve: func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return current, nil
+	}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	httpServer := httptest.NewServer(srv.Handler())
+	defer httpServer.Close()
+	high := `{"income": 9000, "area": "Urban"}`
+
+	if _, got := post(t, httpServer.URL+"/predict", high); got["prediction"] != "Yes" {
+		t.Errorf("prediction = %v, want Yes", got["prediction"])
+	}
+	mu.Lock()
+	current = second
+	mu.Unlock()
+	if reloaded, err := srv.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload() = %v, %v, want the promoted file loaded", reloaded, err)
+	}
+	if _, got := post(t, httpServer.URL+"/predict", high); got["prediction"] != "Approved" {
+		t.Errorf("prediction after promotion = %v, want Approved", got["prediction"])
+	}
+
+	resp, err := http.Get(httpServer.URL + "/model")
+	if err != nil {
+		t.Fatalf("GET /model: %v", err)
+	}
+	info := decodeResponse(t, resp.Body)
+	resp.Body.Close()
+	if info["path"] != second {
+		t.Errorf("model path = %v, want %s", info["path"], second)
+	}
+}
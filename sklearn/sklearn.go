@@ -0,0 +1,210 @@
+// Package sklearn imports decision trees trained with scikit-learn from a
+// JSON dump of the estimator's tree_ attribute.
+package sklearn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"dt/models"
+)
+
+// leafChild marks a missing child in children_left and children_right
+const leafChild = -1
+
+// Tree is the JSON layout of a fitted DecisionTreeClassifier or
+// DecisionTreeRegressor. The arrays are copied from estimator.tree_, and
+// the names from feature_names_in_ and classes_:
+//
+//	{
+//	  "feature_names": ["petal_length", "petal_width"],
+//	  "classes": ["setosa", "versicolor"],
+//	  "children_left": [1, -1, -1],
+//	  "children_right": [2, -1, -1],
+//	  "feature": [0, -2, -2],
+//	  "threshold": [2.45, -2, -2],
+//	  "value": [[[50, 50]], [[50, 0]], [[0, 50]]],
+//	  "n_node_samples": [100, 50, 50]
+//	}
+//
+// A tree without classes is a regressor. Only single-output trees are
+// supported.
+type Tree struct {
+	TargetName   string        `json:"target_name,omitempty"`
+	FeatureNames []string      `json:"feature_names,omitempty"`
+	Classes      []interface{} `json:"classes,omitempty"`
+
+	ChildrenLeft    []int         `json:"children_left"`
+	ChildrenRight   []int         `json:"children_right"`
+	Feature         []int         `json:"feature"`
+	Threshold       []float64     `json:"threshold"`
+	Value           [][][]float64 `json:"value"`
+	NodeSamples     []int         `json:"n_node_samples,omitempty"`
+	MissingGoToLeft []int         `json:"missing_go_to_left,omitempty"`
+}
+
+// Read parses a tree dump and converts it to a model. The target column is
+// named after target_name, or "target" when the dump has none.
+func Read(r io.Reader) (*models.ModelData, error) {
+	var tree Tree
+	if err := json.NewDecoder(r).Decode(&tree); err != nil {
+		return nil, fmt.Errorf("failed to parse scikit-learn tree: %w", err)
+	}
+	return tree.ToModel()
+}
+
+// ToModel converts the dump to a model. scikit-learn sends x <= threshold to
+// the left child while this predictor uses x < threshold, so each threshold
+// is replaced by the next larger float64, which selects exactly the same
+// records.
+func (t *Tree) ToModel() (*models.ModelData, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+
+	target := t.TargetName
+	if target == "" {
+		target = "target"
+	}
+	model := &models.ModelData{
+		TargetColumn: target,
+		TargetType:   "categorical",
+		FeatureTypes: make(map[string]string),
+	}
+	if len(t.Classes) == 0 {
+		model.TargetType = "numeric"
+	}
+
+	names := t.FeatureNames
+	if len(names) == 0 {
+		maxFeature := -1
+		for _, feature := range t.Feature {
+			maxFeature = max(maxFeature, feature)
+		}
+		for i := 0; i <= maxFeature; i++ {
+			names = append(names, fmt.Sprintf("feature_%d", i))
+		}
+	}
+	for _, name := range names {
+		model.Columns = append(model.Columns, name)
+		model.FeatureTypes[name] = "numeric"
+	}
+	model.Columns = append(model.Columns, target)
+	model.FeatureTypes[target] = model.TargetType
+
+	tree, err := t.node(0, names, 0)
+	if err != nil {
+		return nil, err
+	}
+	model.Tree = tree
+	return model, nil
+}
+
+// validate checks that the arrays describe one tree of consistent size
+func (t *Tree) validate() error {
+	n := len(t.ChildrenLeft)
+	if n == 0 {
+		return errors.New("scikit-learn tree has no nodes")
+	}
+	if len(t.ChildrenRight) != n || len(t.Feature) != n || len(t.Threshold) != n || len(t.Value) != n {
+		return errors.New("scikit-learn tree arrays have different lengths")
+	}
+	if len(t.NodeSamples) != 0 && len(t.NodeSamples) != n {
+		return errors.New("n_node_samples does not match the number of nodes")
+	}
+	if len(t.MissingGoToLeft) != 0 && len(t.MissingGoToLeft) != n {
+		return errors.New("missing_go_to_left does not match the number of nodes")
+	}
+	for i, value := range t.Value {
+		if len(value) != 1 {
+			return fmt.Errorf("node %d: only single-output trees are supported", i)
+		}
+		if len(t.Classes) > 0 && len(value[0]) != len(t.Classes) {
+			return fmt.Errorf("node %d: expected %d class values, got %d", i, len(t.Classes), len(value[0]))
+		}
+	}
+	return nil
+}
+
+// node converts the subtree rooted at node id
+func (t *Tree) node(id int, names []string, depth int) (*models.TreeNode, error) {
+	if depth > len(t.ChildrenLeft) {
+		return nil, errors.New("scikit-learn tree contains a cycle")
+	}
+
+	node := &models.TreeNode{}
+	if len(t.NodeSamples) > 0 {
+		node.Samples = t.NodeSamples[id]
+	}
+	t.setPrediction(node, id)
+
+	left, right := t.ChildrenLeft[id], t.ChildrenRight[id]
+	if left == leafChild || right == leafChild {
+		node.IsLeaf = true
+		return node, nil
+	}
+	if left < 0 || left >= len(t.ChildrenLeft) || right < 0 || right >= len(t.ChildrenLeft) {
+		return nil, fmt.Errorf("node %d: child out of range", id)
+	}
+	if t.Feature[id] < 0 || t.Feature[id] >= len(names) {
+		return nil, fmt.Errorf("node %d: feature %d out of range", id, t.Feature[id])
+	}
+
+	node.Feature = names[t.Feature[id]]
+	node.SplitType = "numerical"
+	node.SplitValue = math.Nextafter(t.Threshold[id], math.Inf(1))
+	if len(t.MissingGoToLeft) > 0 {
+		node.MissingBranch = "right"
+		if t.MissingGoToLeft[id] == 1 {
+			node.MissingBranch = "left"
+		}
+	}
+
+	var err error
+	if node.Left, err = t.node(left, names, depth+1); err != nil {
+		return nil, err
+	}
+	if node.Right, err = t.node(right, names, depth+1); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// setPrediction fills the prediction and class counts of a node. Recent
+// scikit-learn versions store class fractions rather than counts in value,
+// so counts are rebuilt from n_node_samples when it is present.
+func (t *Tree) setPrediction(node *models.TreeNode, id int) {
+	value := t.Value[id][0]
+	if len(t.Classes) == 0 {
+		node.Prediction = value[0]
+		return
+	}
+
+	total, best := 0.0, 0
+	for i, v := range value {
+		total += v
+		if v > value[best] {
+			best = i
+		}
+	}
+	node.Prediction = t.Classes[best]
+
+	node.ClassCounts = make(map[string]int)
+	for i, v := range value {
+		count := v
+		if node.Samples > 0 && total > 0 {
+			count = v / total * float64(node.Samples)
+		}
+		if c := int(math.Round(count)); c > 0 {
+			node.ClassCounts[models.GetValueKey(t.Classes[i])] = c
+		}
+	}
+	if node.Samples == 0 {
+		for _, c := range node.ClassCounts {
+			node.Samples += c
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sklearn
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"dt/algorithm"
+	"dt/models"
+)
+
+// Dump of a DecisionTreeClassifier fitted on two iris features, with class
+// fractions in value as written by scikit-learn 1.4 and later
+const irisTree = `{
+  "target_name": "species",
+  "feature_names": ["petal_length", "petal_width"],
+  "classes": ["setosa", "versicolor", "virginica"],
+  "children_left": [1, -1, 3, -1, -1],
+  "children_right": [2, -1, 4, -1, -1],
+  "feature": [0, -2, 1, -2, -2],
+  "threshold": [2.45, -2, 1.75, -2, -2],
+  "value": [
+    [[0.3333, 0.3333, 0.3333]],
+    [[1, 0, 0]],
+    [[0, 0.5, 0.5]],
+    [[0, 0.9074, 0.0926]],
+    [[0, 0.0217, 0.9783]]
+  ],
+  "n_node_samples": [150, 50, 100, 54, 46],
+  "missing_go_to_left": [1, 0, 0, 0, 0]
+}`
+
+func TestRead(t *testing.T) {
+	model, err := Read(strings.NewReader(irisTree))
+	if err != nil {
+		t.Fatalf("Read returned an error: %v", err)
+	}
+
+	if model.TargetColumn != "species" || model.TargetType != "categorical" {
+		t.Errorf("target = %s (%s), want species (categorical)", model.TargetColumn, model.TargetType)
+	}
+	if got := fmt.Sprint(model.Columns); got != "[petal_length petal_width species]" {
+		t.Errorf("Columns = %s", got)
+	}
+	if got := model.Tree.Right.Left.ClassCounts; got["versicolor"] != 49 || got["virginica"] != 5 {
+		t.Errorf("ClassCounts = %v, want versicolor 49 and virginica 5", got)
+	}
+
+	// Records on a threshold go left as in scikit-learn, and missing values
+	// follow missing_go_to_left rather than the larger subtree
+	tests := []struct {
+		record map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"petal_length": 1.4, "petal_width": 0.2}, "setosa"},
+		{map[string]interface{}{"petal_length": 2.45, "petal_width": 2.0}, "setosa"},
+		{map[string]interface{}{"petal_length": 4.5, "petal_width": 1.75}, "versicolor"},
+		{map[string]interface{}{"petal_length": 5, "petal_width": 2}, "virginica"},
+		{map[string]interface{}{"petal_length": 5, "petal_width": nil}, "virginica"},
+		{map[string]interface{}{"petal_length": nil, "petal_width": 2}, "setosa"},
+	}
+	models.Records = make([]map[string]interface{}, len(tests))
+	for i, tt := range tests {
+		models.Records[i] = tt.record
+	}
+	predictions, err := algorithm.Predict(context.Background(), model.Tree)
+	if err != nil {
+		t.Fatalf("Predict returned an error: %v", err)
+	}
+	for i, tt := range tests {
+		if fmt.Sprintf("%v", predictions[i]) != tt.want {
+			t.Errorf("record %d: Predict() = %v, want %s", i+1, predictions[i], tt.want)
+		}
+	}
+}
+
+func TestToModelRegressor(t *testing.T) {
+	tree := &Tree{
+		ChildrenLeft:  []int{1, -1, -1},
+		ChildrenRight: []int{2, -1, -1},
+		Feature:       []int{0, -2, -2},
+		Threshold:     []float64{10, -2, -2},
+		Value:         [][][]float64{{{5}}, {{2}}, {{8}}},
+	}
+	model, err := tree.ToModel()
+	if err != nil {
+		t.Fatalf("ToModel returned an error: %v", err)
+	}
+	if model.TargetType != "numeric" || model.TargetColumn != "target" {
+		t.Errorf("target = %s (%s), want target (numeric)", model.TargetColumn, model.TargetType)
+	}
+	if model.Tree.Feature != "feature_0" {
+		t.Errorf("Feature = %q, want feature_0", model.Tree.Feature)
+	}
+	if got := model.Tree.SplitValue.(float64); got <= 10 || got != math.Nextafter(10, 11) {
+		t.Errorf("SplitValue = %v, want the float64 after 10", got)
+	}
+	if model.Tree.Left.Prediction != 2.0 || model.Tree.Right.Prediction != 8.0 {
+		t.Errorf("leaf predictions = %v, %v, want 2, 8", model.Tree.Left.Prediction, model.Tree.Right.Prediction)
+	}
+}
+
+func TestToModelErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		tree Tree
+		want string
+	}{
+		{
+			name: "Empty tree",
+			tree: Tree{},
+			want: "no nodes",
+		},
+		{
+			name: "Mismatched arrays",
+			tree: Tree{ChildrenLeft: []int{-1}, ChildrenRight: []int{-1, -1}, Feature: []int{-2}, Threshold: []float64{-2}, Value: [][][]float64{{{1}}}},
+			want: "different lengths",
+		},
+		{
+			name: "Multi-output tree",
+			tree: Tree{ChildrenLeft: []int{-1}, ChildrenRight: []int{-1}, Feature: []int{-2}, Threshold: []float64{-2}, Value: [][][]float64{{{1}, {2}}}},
+			want: "single-output",
+		},
+		{
+			name: "Cycle",
+			tree: Tree{ChildrenLeft: []int{0}, ChildrenRight: []int{0}, Feature: []int{0}, Threshold: []float64{1}, Value: [][][]float64{{{1}}}},
+			want: "cycle",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.tree.ToModel()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ToModel() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package utils
+
+import "context"
+
+// CanceledError reports that an operation stopped because its context was
+// cancelled or its deadline passed. It unwraps to context.Canceled or
+// context.DeadlineExceeded.
+type CanceledError struct {
+	Op  string // The operation that stopped, such as "training"
+	Err error  // The error of the context
+}
+
+func (e *CanceledError) Error() string {
+	return e.Op + " stopped: " + e.Err.Error()
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// Canceled returns a *CanceledError for op when ctx is done, and nil otherwise
+func Canceled(ctx context.Context, op string) error {
+	if err := ctx.Err(); err != nil {
+		return &CanceledError{Op: op, Err: err}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 	"path/filepath"
+	"strings"
 )
 
 func FileExtValidation() error {
@@ -13,14 +14,70 @@ func FileExtValidation() error {
 	if *CommandPtr == "predict" && inputExt != ".csv" {
 		return errors.New("input file must be a CSV for prediction")
 	}
+	if *CommandPtr == "counterfactual" && inputExt != ".csv" {
+		return errors.New("input file must be a CSV for counterfactuals")
+	}
 	if *CommandPtr == "train" && filepath.Ext(*OutputPtr) != ".dt" {
 		return errors.New("output file must have .dt extension for model")
 	}
+	if *CommandPtr == "train" && *CheckpointPtr != "" && filepath.Ext(*CheckpointPtr) != ".dt" {
+		return errors.New("checkpoint file must have .dt extension for model")
+	}
+	if *CommandPtr == "train" && *ResumePtr && *CheckpointPtr == "" {
+		return errors.New("-resume needs the -checkpoint file to continue from")
+	}
+	if *CommandPtr == "train" && *CheckpointPtr != "" && *CheckpointEveryPtr <= 0 {
+		return errors.New("checkpoint interval must be positive")
+	}
+	if (*CommandPtr == "import" || *CommandPtr == "migrate") && filepath.Ext(*OutputPtr) != ".dt" {
+		return errors.New("output file must have .dt extension for model")
+	}
 	if *CommandPtr == "predict" && filepath.Ext(*OutputPtr) != ".csv" {
 		return errors.New("output file must have .csv extension for predictions")
 	}
-	if *CommandPtr == "predict" && filepath.Ext(*ModelFilePtr) != ".dt" {
+	if *CommandPtr == "serve" {
+		for _, item := range strings.Split(*ModelFilePtr, ",") {
+			_, path, _ := strings.Cut(strings.TrimSpace(item), "=")
+			if path == "" {
+				path = strings.TrimSpace(item)
+			}
+			if !IsModelRef(path) && filepath.Ext(path) != ".dt" {
+				return errors.New("model files must have .dt extension")
+			}
+		}
+	}
+	if (*CommandPtr == "predict" || *CommandPtr == "export" || *CommandPtr == "rules" || *CommandPtr == "codegen" ||
+		*CommandPtr == "migrate" || *CommandPtr == "importance" || *CommandPtr == "counterfactual") &&
+		!IsModelRef(*ModelFilePtr) && filepath.Ext(*ModelFilePtr) != ".dt" {
+		return errors.New("model file must have .dt extension")
+	}
+	if *CommandPtr == "registry" && *ModelFilePtr != "" && filepath.Ext(*ModelFilePtr) != ".dt" {
 		return errors.New("model file must have .dt extension")
 	}
+	if *CommandPtr == "codegen" && *LangPtr == "go" && filepath.Ext(*OutputPtr) != ".go" {
+		return errors.New("output file must have .go extension for go code")
+	}
+	if *CommandPtr == "predict" && *ExplainFilePtr != "" && filepath.Ext(*ExplainFilePtr) != ".jsonl" {
+		return errors.New("explanation file must have .jsonl extension")
+	}
+	if *CommandPtr == "importance" && *InputPtr != "" && inputExt != ".csv" {
+		return errors.New("input file must be a labeled CSV for permutation importance")
+	}
+	if *CommandPtr == "codegen" && *InputPtr != "" && inputExt != ".csv" {
+		return errors.New("input file must be a CSV for codegen samples")
+	}
+	if (*CommandPtr == "train" || *CommandPtr == "migrate") &&
+		*FormatPtr != "" && *FormatPtr != "json" && *FormatPtr != "binary" {
+		return errors.New("model format must be json or binary")
+	}
+	if *CommandPtr == "train" && *CatSplitPtr != "multiway" && *CatSplitPtr != "binary" {
+		return errors.New("categorical split style must be multiway or binary")
+	}
 	return nil
 }
+
+// IsModelRef reports whether a -m value names a registry model, such as
+// loans@production, rather than a .dt file
+func IsModelRef(value string) bool {
+	return strings.Contains(value, "@") && filepath.Ext(value) != ".dt"
+}
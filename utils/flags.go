@@ -1,15 +1,80 @@
 package utils
 
-import "flag"
+import (
+	"flag"
+	"time"
+)
 
 var (
 	CommandPtr   = flag.String("c", "", "Specify the command")
 	InputPtr     = flag.String("i", "", "input csv file")
 	ColumnPtr    = flag.String("t", "", "name of the target column")
 	OutputPtr    = flag.String("o", "", "path to save trained dataset tree model")
-	ModelFilePtr = flag.String("m", "", "path to trained dataset for predictions")
+	ModelFilePtr = flag.String("m", "", "path to trained dataset for predictions; serve takes a comma-separated list of name=path")
+	FormatPtr    = flag.String("format", "", "output format of the selected command")
+	WorkersPtr   = flag.Int("workers", 0, "number of worker goroutines for training and prediction, 0 for one per CPU")
+	TimeoutPtr   = flag.Duration("timeout", 0, "stop the command after this long, such as 30m; 0 for no limit")
+
+	// Logging options
+	LogLevelPtr  = flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error")
+	LogFormatPtr = flag.String("log-format", "text", "format of log messages written to stderr: text or json")
+	QuietPtr     = flag.Bool("quiet", false, "only log errors")
+
+	// Training options
+	SamplePtr          = flag.String("sample", "none", "rebalance the target before training: none, under, over or smote")
+	SeedPtr            = flag.Int64("seed", 1, "random seed used for sampling")
+	SmoteKPtr          = flag.Int("smote-k", 5, "number of nearest neighbours used by smote")
+	CatSplitPtr        = flag.String("cat-split", "multiway", "categorical split style: multiway or binary")
+	RareCountPtr       = flag.Int("rare-min-count", 0, "group categories seen fewer times than this into __other__")
+	RareFreqPtr        = flag.Float64("rare-min-freq", 0, "group categories rarer than this fraction of rows into __other__")
+	CheckpointPtr      = flag.String("checkpoint", "", "save training progress to this .dt file periodically and when training is stopped")
+	CheckpointEveryPtr = flag.Duration("checkpoint-every", time.Minute, "interval between training checkpoints")
+	ResumePtr          = flag.Bool("resume", false, "continue training from the -checkpoint file if it exists")
+
+	// Prediction options
+	UnseenPtr      = flag.String("unseen", "missing", "handling of unseen categorical values: missing, parent, blend, other or fail")
+	ChunkSizePtr   = flag.Int("chunk-size", 10000, "number of rows read and scored at a time by predict")
+	ExplainPtr     = flag.Bool("explain", false, "add the decision path of each prediction to predict's output as an explanation column")
+	ExplainFilePtr = flag.String("explain-file", "", "write predict's explanations to this JSONL file instead of a column")
+	SHAPPtr        = flag.Bool("shap", false, "add the SHAP value of each feature for the predicted class to predict's output")
+
+	// Serving options
+	AddrPtr     = flag.String("addr", ":8080", "address serve answers REST requests on, empty to disable")
+	GRPCAddrPtr = flag.String("grpc-addr", "", "address serve answers gRPC requests on, empty to disable")
+
+	// Registry options
+	RegistryPtr = flag.String("registry", "registry", "directory of the model registry used by -c registry and name@stage models")
+	NamePtr     = flag.String("name", "", "name to push a model under, the model file name by default")
+	MetricsPtr  = flag.String("metrics", "", "comma-separated name=value metrics recorded with a pushed model, such as accuracy=0.91")
+
+	// Importance options
+	RepeatsPtr = flag.Int("repeats", 5, "number of times importance shuffles each feature of the -i dataset")
+
+	// Counterfactual options
+	ClassPtr     = flag.String("class", "", "class counterfactuals must be predicted as")
+	ImmutablePtr = flag.String("immutable", "", "comma-separated features counterfactuals cannot change")
+	CostsPtr     = flag.String("costs", "", "comma-separated feature=cost of changing a feature, per unit for numeric ones; 1 when not set")
+	TopPtr       = flag.Int("top", 3, "most counterfactuals written per row, 0 for all")
+
+	// Code generation options
+	LangPtr    = flag.String("lang", "go", "language of generated code")
+	PackagePtr = flag.String("pkg", "model", "package name of generated code")
 )
 
+// args holds the positional arguments, such as the action of -c registry
+var args []string
+
+// ParseFlag parses the command line. Positional arguments may come before,
+// between or after the flags.
 func ParseFlag() {
 	flag.Parse()
+	for flag.NArg() > 0 {
+		args = append(args, flag.Arg(0))
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+}
+
+// Args returns the positional arguments of the command line
+func Args() []string {
+	return args
 }
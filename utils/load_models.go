@@ -1,28 +1,73 @@
 package utils
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
+	"log/slog"
+	"runtime/debug"
 
 	"dt/models"
 )
 
 func LoadModels() (*models.ModelData, error) {
-	jsonData, err := os.ReadFile(*ModelFilePtr)
+	_, modelData, err := LoadModelFile()
+	return modelData, err
+}
+
+// LoadModelFile reads, verifies and validates the model given with -m,
+// migrating files written in an older format. The JSON and binary encodings
+// are detected automatically; the file is memory-mapped while it is decoded.
+func LoadModelFile() (*models.ModelFile, *models.ModelData, error) {
+	modelFile, modelData, err := ReadModelFile(*ModelFilePtr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read model file: %w", err)
+		return nil, nil, err
 	}
-	var modelData models.ModelData
-	if err := json.Unmarshal(jsonData, &modelData); err != nil {
-		return nil, fmt.Errorf("failed to parse model data: %w", err)
+	if modelFile.Migrated() {
+		slog.Warn("migrated model from an older format, run -c migrate to update the file",
+			"from_version", modelFile.MigratedFrom, "to_version", modelFile.FormatVersion)
 	}
+
 	// Update global model data
 	models.FeatureTypes = modelData.FeatureTypes
 	models.TargetColumn = modelData.TargetColumn
 	models.TargetType = modelData.TargetType
 	models.Columns = modelData.Columns
+	models.CategoryGroups = modelData.CategoryGroups
+
+	slog.Info("loaded model", "target", modelData.TargetColumn)
+	return modelFile, modelData, nil
+}
+
+// ReadModelFile reads, verifies and validates the model file at path without
+// touching the global model data, so several models can be held at once
+func ReadModelFile(path string) (*models.ModelFile, *models.ModelData, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read model file: %w", err)
+	}
+	modelFile, modelData, err := decodeModel(data)
+	if unmapErr := unmap(); err == nil && unmapErr != nil {
+		err = fmt.Errorf("failed to unmap model file: %w", unmapErr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return modelFile, modelData, nil
+}
 
-	fmt.Printf("Loaded model trained for target column: %s\n", modelData.TargetColumn)
-	return &modelData, nil
+// decodeModel decodes a mapped model file. Reading a page of a file that was
+// truncated while mapped faults; the fault is returned as an error instead of
+// crashing the process.
+func decodeModel(data []byte) (file *models.ModelFile, model *models.ModelData, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			// Faults carry the address they happened at, other panics do not
+			if fault, ok := r.(interface{ Addr() uintptr }); ok {
+				err = fmt.Errorf("model file changed while it was read: %v", fault)
+				return
+			}
+			panic(r)
+		}
+	}()
+	return models.DecodeModelFile(data)
 }
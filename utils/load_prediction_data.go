@@ -1,62 +1,143 @@
 package utils
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 
 	"dt/models"
 )
 
-func LoadPredictionData() error {
+// LoadPredictionData reads the whole prediction CSV into models.Records. It
+// stops with a *CanceledError when ctx is done.
+func LoadPredictionData(ctx context.Context) error {
+	reader, err := OpenPredictionData()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	models.Columns = reader.Columns()
+	models.Records = []map[string]interface{}{}
+
+	for {
+		if err := Canceled(ctx, "loading prediction data"); err != nil {
+			return err
+		}
+		records, err := reader.ReadChunk(cancelCheckRows)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		models.Records = append(models.Records, records...)
+	}
+
+	slog.Info("loaded prediction data", "records", len(models.Records), "columns", len(models.Columns))
+	return nil
+}
+
+// PredictionReader reads the prediction input a chunk of rows at a time, so
+// files of any size can be scored in constant memory
+type PredictionReader struct {
+	file    *os.File
+	csv     *csv.Reader
+	columns []string
+}
+
+// OpenPredictionData opens the input file and reads its header row
+func OpenPredictionData() (*PredictionReader, error) {
 	csvFile, err := os.Open(*InputPtr)
 	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
+		return nil, fmt.Errorf("failed to open input file: %w", err)
 	}
-	defer csvFile.Close()
 
 	csvReader := csv.NewReader(csvFile)
-
 	csvReader.FieldsPerRecord = -1
+	csvReader.ReuseRecord = true
 
 	columns, err := csvReader.Read()
 	if err == io.EOF {
-		return fmt.Errorf("input file is empty")
+		csvFile.Close()
+		return nil, fmt.Errorf("input file is empty")
 	}
 	if err != nil {
-		return fmt.Errorf("failed to read header row: %w", err)
+		csvFile.Close()
+		return nil, fmt.Errorf("failed to read header row: %w", err)
 	}
 
-	models.Columns = columns
-	models.Records = []map[string]interface{}{}
+	return &PredictionReader{file: csvFile, csv: csvReader, columns: append([]string(nil), columns...)}, nil
+}
 
-	for {
-		row, err := csvReader.Read()
+// Columns returns the header row of the input
+func (r *PredictionReader) Columns() []string {
+	return r.columns
+}
+
+// ReadChunk returns up to size records. It returns io.EOF once every row
+// has been read.
+func (r *PredictionReader) ReadChunk(size int) ([]map[string]interface{}, error) {
+	rows, err := r.ReadRows(size)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		records[i] = RowRecord(r.columns, row)
+	}
+	return records, nil
+}
+
+// ReadRows returns up to size rows as read from the file, for callers that
+// convert the cells themselves. It returns io.EOF once every row has been
+// read.
+func (r *PredictionReader) ReadRows(size int) ([][]string, error) {
+	rows := make([][]string, 0, size)
+	// The cells of the chunk share one array, as the reader reuses its row
+	cells := make([]string, 0, size*len(r.columns))
+	for len(rows) < size {
+		row, err := r.csv.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error reading row: %w", err)
+			return nil, fmt.Errorf("error reading row: %w", err)
 		}
+		start := len(cells)
+		cells = append(cells, row...)
+		rows = append(rows, cells[start:len(cells):len(cells)])
+	}
 
-		record := make(map[string]interface{})
-		for i, val := range row {
-			if i < len(columns) {
-				record[columns[i]] = parseValue(val)
-			}
-		}
+	if len(rows) == 0 {
+		return nil, io.EOF
+	}
+	return rows, nil
+}
 
-		// Fill in missing values with nil
-		for _, col := range columns {
-			if _, exists := record[col]; !exists {
-				record[col] = nil
-			}
+// RowRecord converts a row of the prediction input to a record. Cells past
+// the header are ignored and columns the row is too short for are missing.
+func RowRecord(columns, row []string) map[string]interface{} {
+	record := make(map[string]interface{}, len(columns))
+	for i, val := range row {
+		if i < len(columns) {
+			record[columns[i]] = ParseValue(val)
 		}
+	}
 
-		models.Records = append(models.Records, record)
+	// Fill in missing values with nil
+	for _, col := range columns {
+		if _, exists := record[col]; !exists {
+			record[col] = nil
+		}
 	}
+	return record
+}
 
-	fmt.Printf("Loaded %d records with %d columns for prediction\n", len(models.Records), len(columns))
-	return nil
+// Close closes the input file
+func (r *PredictionReader) Close() error {
+	return r.file.Close()
 }
@@ -1,9 +1,13 @@
 package utils
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
 	"os"
 	"slices"
@@ -13,13 +17,22 @@ import (
 	"dt/models"
 )
 
-func LoadTrainingData() error {
+// cancelCheckRows is how many rows the loaders read between checks for
+// cancellation
+const cancelCheckRows = 1000
+
+// LoadTrainingData reads the training CSV. It stops with a *CanceledError
+// when ctx is done.
+func LoadTrainingData(ctx context.Context) error {
 	csvFile, err := os.Open(*InputPtr)
 	if err != nil {
 		return fmt.Errorf("failed to open input file: %w", err)
 	}
 	defer csvFile.Close()
-	csvReader := csv.NewReader(csvFile)
+
+	// Hash the file while it is parsed so the model can name its dataset
+	hash := sha256.New()
+	csvReader := csv.NewReader(io.TeeReader(csvFile, hash))
 
 	// Read Header Row
 	columns, err := csvReader.Read()
@@ -64,6 +77,11 @@ func LoadTrainingData() error {
 		if err != nil {
 			return fmt.Errorf("error reading row: %w", err)
 		}
+		if len(allRows)%cancelCheckRows == 0 {
+			if err := Canceled(ctx, "loading training data"); err != nil {
+				return err
+			}
+		}
 
 		allRows = append(allRows, row)
 
@@ -90,6 +108,8 @@ func LoadTrainingData() error {
 		}
 	}
 
+	models.DatasetHash = hex.EncodeToString(hash.Sum(nil))
+
 	// Calculate final means and modes
 	for i := range columnMeans {
 		if columnCounts[i] > 0 {
@@ -110,7 +130,12 @@ func LoadTrainingData() error {
 	batchSize := 1000
 	batch := make([]map[string]interface{}, 0, batchSize)
 
-	for _, row := range allRows {
+	for n, row := range allRows {
+		if n%cancelCheckRows == 0 {
+			if err := Canceled(ctx, "loading training data"); err != nil {
+				return err
+			}
+		}
 		record := make(map[string]interface{})
 
 		for i, val := range row {
@@ -123,7 +148,7 @@ func LoadTrainingData() error {
 				}
 			}
 
-			parsedVal := parseValue(val)
+			parsedVal := ParseValue(val)
 			record[columns[i]] = parsedVal
 
 			// Detect feature type if not yet determined
@@ -166,11 +191,13 @@ func LoadTrainingData() error {
 		models.TargetType = "categorical"
 	}
 
-	fmt.Printf("Loaded %d records with %d columns\n", len(models.Records), len(columns))
+	slog.Info("loaded training data", "records", len(models.Records), "columns", len(columns))
 	return nil
 }
 
-func parseValue(value string) interface{} {
+// ParseValue converts a CSV cell to the type training and prediction use:
+// nil when empty, then int, float64, bool, a date or else the string itself
+func ParseValue(value string) interface{} {
 	// Handle empty values
 	if value == "" {
 		return nil
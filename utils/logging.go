@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// NewLogger creates a logger writing to w. level is debug, info, warn or
+// error and format is text or json; quiet drops everything below errors.
+func NewLogger(w io.Writer, level, format string, quiet bool) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+	}
+	if quiet {
+		minLevel = max(minLevel, slog.LevelError)
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, use text or json", format)
+}
+
+// SetupLogging makes the logger chosen with -log-level, -log-format and
+// -quiet the default. Logs go to stderr so they never mix with data written
+// to stdout.
+func SetupLogging() error {
+	logger, err := NewLogger(os.Stderr, *LogLevelPtr, *LogFormatPtr, *QuietPtr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
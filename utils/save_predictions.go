@@ -3,48 +3,95 @@ package utils
 import (
 	"encoding/csv"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 )
 
 func SavePredictions(predictions []interface{}) error {
+	writer, err := CreatePredictions()
+	if err != nil {
+		return err
+	}
+	if err := writer.Write(predictions); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	slog.Info("predictions saved", "output", *OutputPtr)
+	return nil
+}
+
+// PredictionWriter writes predictions to the output file as they are made
+type PredictionWriter struct {
+	file *os.File
+	csv  *csv.Writer
+}
+
+// CreatePredictions creates the output file and writes its header: a
+// prediction column followed by the extra columns named
+func CreatePredictions(extra ...string) (*PredictionWriter, error) {
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(*OutputPtr)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		if err := os.MkdirAll(dir, 0o755); err != nil {
-			return fmt.Errorf("failed to create directory: %w", err)
+			return nil, fmt.Errorf("failed to create directory: %w", err)
 		}
 	}
 
 	// Create CSV file
 	file, err := os.Create(*OutputPtr)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		return nil, fmt.Errorf("failed to create output file: %w", err)
 	}
-	defer file.Close()
-
-	// Create CSV writer
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
 
 	// Write header
-	if err := writer.Write([]string{"prediction"}); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+	writer := &PredictionWriter{file: file, csv: csv.NewWriter(file)}
+	if err := writer.csv.Write(append([]string{"prediction"}, extra...)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write header: %w", err)
 	}
+	return writer, nil
+}
 
-	// Write predictions
-	for _, pred := range predictions {
+// Write appends predictions to the output
+func (w *PredictionWriter) Write(predictions []interface{}) error {
+	return w.WriteWith(predictions, nil)
+}
+
+// WriteWith appends predictions to the output, each followed by its cells in
+// the extra columns named in CreatePredictions: extra[i] for predictions[i]
+func (w *PredictionWriter) WriteWith(predictions []interface{}, extra [][]string) error {
+	for i, pred := range predictions {
 		var strPred string
 		if pred == nil {
 			strPred = "unknown"
 		} else {
 			strPred = fmt.Sprintf("%v", pred)
 		}
-		if err := writer.Write([]string{strPred}); err != nil {
+		row := []string{strPred}
+		if extra != nil {
+			row = append(row, extra[i]...)
+		}
+		if err := w.csv.Write(row); err != nil {
 			return fmt.Errorf("failed to write prediction: %w", err)
 		}
 	}
+	return nil
+}
 
-	fmt.Printf("Predictions saved to %s\n", *OutputPtr)
+// Close flushes buffered predictions and closes the output file
+func (w *PredictionWriter) Close() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to write predictions: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
 	return nil
 }
@@ -2,30 +2,96 @@ package utils
 
 import (
 	"dt/models"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 )
 
+// SaveModel writes the trained tree with its training metadata
 func SaveModel(tree *models.TreeNode) error {
+	return saveModel(*OutputPtr, tree, nil)
+}
+
+// SaveCheckpoint writes a partially built tree and the state needed to
+// continue growing it to the -checkpoint file
+func SaveCheckpoint(tree *models.TreeNode, state *models.TrainingState) error {
+	return saveModel(*CheckpointPtr, tree, state)
+}
+
+// LoadCheckpoint reads the -checkpoint file. It returns an error wrapping
+// fs.ErrNotExist when there is no checkpoint yet.
+func LoadCheckpoint() (*models.ModelFile, *models.ModelData, error) {
+	modelFile, modelData, err := ReadModelFile(*CheckpointPtr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	if modelFile.Training == nil {
+		return nil, nil, fmt.Errorf("%s is not a training checkpoint", *CheckpointPtr)
+	}
+	return modelFile, modelData, nil
+}
+
+// RemoveCheckpoint deletes the -checkpoint file once training has finished
+func RemoveCheckpoint() error {
+	if err := os.Remove(*CheckpointPtr); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+	return nil
+}
+
+func saveModel(path string, tree *models.TreeNode, state *models.TrainingState) error {
 	modelData := models.ModelData{
 		Tree:         tree,
 		FeatureTypes: models.FeatureTypes,
 		TargetColumn: *ColumnPtr,
 		TargetType:   models.TargetType,
 		Columns:      models.Columns,
+
+		CategoryGroups: models.CategoryGroups,
 	}
 
-	file, err := os.Create(*OutputPtr)
+	file, err := models.NewModelFile(&modelData)
 	if err != nil {
-		return fmt.Errorf("failed to create model file: %w", err)
+		return err
 	}
-	defer file.Close()
+	file.DatasetHash = models.DatasetHash
+	file.Hyperparameters = models.Hyperparameters
+	file.Training = state
+	return writeModelFile(path, file, &modelData)
+}
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(modelData); err != nil {
-		return fmt.Errorf("failed to encode model data: %w", err)
+// SaveModelData validates and writes a model that has no training metadata
+func SaveModelData(modelData *models.ModelData) error {
+	if err := modelData.Validate(); err != nil {
+		return err
 	}
+	file, err := models.NewModelFile(modelData)
+	if err != nil {
+		return err
+	}
+	return SaveModelFile(file, modelData)
+}
 
+// SaveModelFile writes a model envelope to the output file, in the binary
+// encoding when -format binary is given
+func SaveModelFile(modelFile *models.ModelFile, modelData *models.ModelData) error {
+	return writeModelFile(*OutputPtr, modelFile, modelData)
+}
+
+// writeModelFile encodes a model and replaces path with it atomically, so an
+// interrupted write never leaves a truncated file behind
+func writeModelFile(path string, modelFile *models.ModelFile, modelData *models.ModelData) error {
+	encode := models.EncodeJSON
+	if *FormatPtr == "binary" {
+		encode = models.EncodeBinary
+	}
+	data, err := encode(modelFile, modelData)
+	if err != nil {
+		return fmt.Errorf("failed to encode model data: %w", err)
+	}
+	if err := WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write model file: %w", err)
+	}
 	return nil
 }
@@ -1,11 +1,17 @@
 package utils
 
 import (
+	"context"
 	"dt/models"
 	"encoding/csv"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -74,6 +80,36 @@ func TestSavePredictions(t *testing.T) {
 	}
 }
 
+func TestPredictionWriterExtraColumns(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "predictions.csv")
+	OutputPtr = &outputFile
+
+	writer, err := CreatePredictions("explanation")
+	if err != nil {
+		t.Fatalf("CreatePredictions() error = %v", err)
+	}
+	if err := writer.WriteWith([]interface{}{"Y", nil}, [][]string{{"a < 1 -> leaf(Y)"}, {"a >= 1, b"}}); err != nil {
+		t.Fatalf("WriteWith() error = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	file, err := os.Open(outputFile)
+	if err != nil {
+		t.Fatalf("failed to open output file: %v", err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read CSV file: %v", err)
+	}
+	want := [][]string{{"prediction", "explanation"}, {"Y", "a < 1 -> leaf(Y)"}, {"unknown", "a >= 1, b"}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("output = %q, want %q", records, want)
+	}
+}
+
 func TestLoadTrainingData(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -141,7 +177,7 @@ func TestLoadTrainingData(t *testing.T) {
 			InputPtr = &inputFileName
 			ColumnPtr = &columnName
 
-			err = LoadTrainingData()
+			err = LoadTrainingData(context.Background())
 
 			if (err != nil) != tt.expectedErr {
 				t.Errorf("expected error: %v, got: %v", tt.expectedErr, err)
@@ -171,6 +207,29 @@ func createTempCSV(content string) (string, error) {
 	return tmpfile.Name(), nil
 }
 
+func TestLoadCanceled(t *testing.T) {
+	fileName, err := createTempCSV("a,b\n1,x\n2,y\n")
+	if err != nil {
+		t.Fatalf("failed to create temp CSV file: %v", err)
+	}
+	defer os.Remove(fileName)
+	InputPtr = &fileName
+	target := "b"
+	ColumnPtr = &target
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, load := range map[string]func(context.Context) error{
+		"training":   LoadTrainingData,
+		"prediction": LoadPredictionData,
+	} {
+		var canceled *CanceledError
+		if err := load(ctx); !errors.As(err, &canceled) || !errors.Is(err, context.Canceled) {
+			t.Errorf("loading %s data: error = %v, want a *CanceledError", name, err)
+		}
+	}
+}
+
 func TestLoadPredictionData(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -208,7 +267,7 @@ func TestLoadPredictionData(t *testing.T) {
 
 			InputPtr = &fileName
 
-			err = LoadPredictionData()
+			err = LoadPredictionData(context.Background())
 			if (err != nil) != tt.expectError {
 				t.Errorf("LoadPredictionData() error = %v, expectError %v", err, tt.expectError)
 			}
@@ -224,3 +283,238 @@ func TestLoadPredictionData(t *testing.T) {
 		})
 	}
 }
+
+func TestPredictionReaderChunks(t *testing.T) {
+	fileName, err := createTempCSV("a,b\n1,x\n2\n3,z\n4,w\n5,v\n")
+	if err != nil {
+		t.Fatalf("failed to create temp CSV file: %v", err)
+	}
+	defer os.Remove(fileName)
+	InputPtr = &fileName
+
+	reader, err := OpenPredictionData()
+	if err != nil {
+		t.Fatalf("OpenPredictionData() error = %v", err)
+	}
+	defer reader.Close()
+
+	var sizes []int
+	var all []map[string]interface{}
+	for {
+		records, err := reader.ReadChunk(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadChunk() error = %v", err)
+		}
+		sizes = append(sizes, len(records))
+		all = append(all, records...)
+	}
+
+	if !reflect.DeepEqual(sizes, []int{2, 2, 1}) {
+		t.Errorf("chunk sizes = %v, want [2 2 1]", sizes)
+	}
+	if all[1]["a"] != 2 || all[1]["b"] != nil || all[4]["b"] != "v" {
+		t.Errorf("unexpected records %v", all)
+	}
+}
+
+func TestSaveAndLoadModelFile(t *testing.T) {
+	model := &models.ModelData{
+		TargetColumn: "Target",
+		TargetType:   "categorical",
+		Columns:      []string{"Feature1", "Target"},
+		FeatureTypes: map[string]string{"Feature1": "numeric", "Target": "categorical"},
+		Tree: &models.TreeNode{
+			Feature: "Feature1", SplitType: "numerical", SplitValue: 2.5, Prediction: "Yes",
+			Left:  &models.TreeNode{IsLeaf: true, Prediction: "No"},
+			Right: &models.TreeNode{IsLeaf: true, Prediction: "Yes"},
+		},
+	}
+
+	for _, format := range []string{"json", "binary"} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "model.dt")
+			FormatPtr = &format
+			OutputPtr = &path
+			ModelFilePtr = &path
+			defer func() {
+				empty := ""
+				FormatPtr = &empty
+			}()
+
+			if err := SaveModelData(model); err != nil {
+				t.Fatalf("SaveModelData returned an error: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read model file: %v", err)
+			}
+			if models.IsBinaryModel(data) != (format == "binary") {
+				t.Errorf("file written with -format %s has binary magic = %v", format, models.IsBinaryModel(data))
+			}
+
+			loaded, err := LoadModels()
+			if err != nil {
+				t.Fatalf("LoadModels returned an error: %v", err)
+			}
+			if loaded.Tree.SplitValue != 2.5 || loaded.Tree.Right.Prediction != "Yes" {
+				t.Errorf("loaded tree differs from the saved tree")
+			}
+		})
+	}
+}
+
+func TestDecodeTruncatedMapping(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("model files are read, not mapped")
+	}
+	path := filepath.Join(t.TempDir(), "model.dt")
+	format := "binary"
+	FormatPtr, OutputPtr = &format, &path
+	defer func() {
+		empty := ""
+		FormatPtr = &empty
+	}()
+	model := &models.ModelData{TargetColumn: "Target", Tree: &models.TreeNode{IsLeaf: true, Prediction: "Yes"}}
+	if err := SaveModelData(model); err != nil {
+		t.Fatalf("SaveModelData returned an error: %v", err)
+	}
+
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		t.Fatalf("mapFile returned an error: %v", err)
+	}
+	defer unmap()
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("failed to truncate model file: %v", err)
+	}
+	if _, _, err := decodeModel(data); err == nil {
+		t.Error("decodeModel read a truncated mapping without an error")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "model.dt")
+
+	for _, content := range []string{"first version", "second"} {
+		if err := WriteFileAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("WriteFileAtomic() error = %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if string(got) != content {
+			t.Errorf("file holds %q, want %q", got, content)
+		}
+	}
+
+	// A failed write leaves the old file and no temporary files behind
+	if err := os.Mkdir(filepath.Join(dir, "model.dir"), 0o755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "model.dir"), []byte("x")); err == nil {
+		t.Error("WriteFileAtomic() over a directory succeeded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory holds %d entries after writes, want 2", len(entries))
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   string
+		format  string
+		quiet   bool
+		want    []string
+		wantErr bool
+	}{
+		{name: "text info", level: "info", format: "text", want: []string{"level=INFO msg=loaded", "level=WARN"}},
+		{name: "json", level: "info", format: "json", want: []string{`"msg":"loaded","records":3`}},
+		{name: "debug", level: "debug", format: "text", want: []string{"level=DEBUG", "level=INFO"}},
+		{name: "warn", level: "warn", format: "text", want: []string{"level=WARN"}},
+		{name: "quiet", level: "debug", format: "text", quiet: true, want: []string{"level=ERROR"}},
+		{name: "bad level", level: "loud", format: "text", wantErr: true},
+		{name: "bad format", level: "info", format: "xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			logger, err := NewLogger(&out, tt.level, tt.format, tt.quiet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLogger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			logger.Debug("details")
+			logger.Info("loaded", "records", 3)
+			logger.Warn("unseen")
+			logger.Error("failed")
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("log output %q does not contain %q", out.String(), want)
+				}
+			}
+			if wantLines := map[string]int{"info": 3, "warn": 2, "debug": 4}[tt.level]; !tt.quiet && len(lines) != wantLines {
+				t.Errorf("logged %d lines, want %d", len(lines), wantLines)
+			}
+			if tt.quiet && len(lines) != 1 {
+				t.Errorf("quiet logger wrote %d lines, want 1", len(lines))
+			}
+		})
+	}
+}
+
+func TestIsModelRef(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{value: "loans@production", want: true},
+		{value: "loans.v2@3", want: true},
+		{value: "model.dt", want: false},
+		{value: "models/loans@2024.dt", want: false},
+		{value: "loans", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := IsModelRef(tt.value); got != tt.want {
+				t.Errorf("IsModelRef(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileExtValidationCatSplit(t *testing.T) {
+	command, input, output, split := *CommandPtr, *InputPtr, *OutputPtr, *CatSplitPtr
+	defer func() { *CommandPtr, *InputPtr, *OutputPtr, *CatSplitPtr = command, input, output, split }()
+	*CommandPtr, *InputPtr, *OutputPtr = "train", "data.csv", "model.dt"
+
+	for _, tt := range []struct {
+		split   string
+		wantErr bool
+	}{
+		{split: "multiway"},
+		{split: "binary"},
+		{split: "subset", wantErr: true},
+		{split: "", wantErr: true},
+	} {
+		*CatSplitPtr = tt.split
+		if err := FileExtValidation(); (err != nil) != tt.wantErr {
+			t.Errorf("FileExtValidation() with -cat-split %q error = %v, wantErr %v", tt.split, err, tt.wantErr)
+		}
+	}
+}